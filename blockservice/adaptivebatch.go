@@ -0,0 +1,143 @@
+package blockservice
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAdaptiveBatchTarget is the PutMany latency targeted by
+	// [WithAdaptiveBatching].
+	DefaultAdaptiveBatchTarget = 100 * time.Millisecond
+
+	// defaultAdaptiveBatchBlocks is the batch size used before the first
+	// measurement and while they are noisy, within the bounds.
+	defaultAdaptiveBatchBlocks = 256
+	// adaptiveBatchSamples is the number of latencies the noise is estimated
+	// from.
+	adaptiveBatchSamples = 8
+	// adaptiveBatchMaxVariation is the coefficient of variation of the
+	// latencies per block over which they are too noisy to adapt to.
+	adaptiveBatchMaxVariation = 1.0
+)
+
+// WithAdaptiveBatching sizes the PutMany calls done by AddBlocks between
+// minBlocks and maxBlocks blocks from the time the previous ones took: the
+// size grows by a step while the batches are committed within the target of
+// [WithAdaptiveBatchTarget] and is halved when one is slower.
+// When the latencies are too noisy to be trusted, the size falls back to a
+// fixed 256 blocks, within the bounds, until they settle. [WithMaxBatchSize]
+// still applies.
+func WithAdaptiveBatching(minBlocks, maxBlocks int) Option {
+	return func(bs *blockService) {
+		if minBlocks <= 0 || maxBlocks < minBlocks {
+			bs.invalidOption("WithAdaptiveBatching: invalid bounds (%d to %d blocks)", minBlocks, maxBlocks)
+			return
+		}
+		bs.adaptiveMinBlocks = minBlocks
+		bs.adaptiveMaxBlocks = maxBlocks
+	}
+}
+
+// WithAdaptiveBatchTarget sets the PutMany latency targeted by
+// [WithAdaptiveBatching], it defaults to [DefaultAdaptiveBatchTarget].
+func WithAdaptiveBatchTarget(target time.Duration) Option {
+	return func(bs *blockService) {
+		if target <= 0 {
+			bs.invalidOption("WithAdaptiveBatchTarget: the target must be positive, got %s", target)
+			return
+		}
+		bs.adaptiveTarget = target
+	}
+}
+
+// batchSizer is the additive increase, multiplicative decrease controller of
+// [WithAdaptiveBatching].
+type batchSizer struct {
+	min, max, fallback int
+	step               int
+	target             time.Duration
+
+	lk      sync.Mutex
+	size    int
+	samples [adaptiveBatchSamples]float64 // seconds per block
+	count   int
+	noisy   bool
+}
+
+func newBatchSizer(minBlocks, maxBlocks int, target time.Duration) *batchSizer {
+	if target == 0 {
+		target = DefaultAdaptiveBatchTarget
+	}
+	fallback := min(max(defaultAdaptiveBatchBlocks, minBlocks), maxBlocks)
+	return &batchSizer{
+		min:      minBlocks,
+		max:      maxBlocks,
+		fallback: fallback,
+		step:     max((maxBlocks-minBlocks)/16, 1),
+		target:   target,
+		size:     fallback,
+	}
+}
+
+// next returns the size of the next batch, 0 without adaptive batching.
+func (b *batchSizer) next() int {
+	if b == nil {
+		return 0
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.noisy {
+		return b.fallback
+	}
+	return b.size
+}
+
+// observe records that a batch of n blocks was committed in d.
+func (b *batchSizer) observe(n int, d time.Duration) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	b.samples[b.count%len(b.samples)] = d.Seconds() / float64(n)
+	b.count++
+	wasNoisy := b.noisy
+	b.noisy = b.variation() > adaptiveBatchMaxVariation
+	switch {
+	case b.noisy:
+		return
+	case wasNoisy:
+		// start again from the fallback size
+		b.size = b.fallback
+	case d > b.target:
+		b.size = max(b.size/2, b.min)
+	case n >= b.size:
+		// only full batches tell that a bigger one would fit
+		b.size = min(b.size+b.step, b.max)
+	}
+}
+
+// variation returns the coefficient of variation of the latencies, 0 until
+// there are enough of them.
+func (b *batchSizer) variation() float64 {
+	if b.count < len(b.samples)/2 {
+		return 0
+	}
+	samples := b.samples[:min(b.count, len(b.samples))]
+	var sum float64
+	for _, s := range samples {
+		sum += s
+	}
+	mean := sum / float64(len(samples))
+	if mean == 0 {
+		return 0
+	}
+	var sq float64
+	for _, s := range samples {
+		sq += (s - mean) * (s - mean)
+	}
+	return math.Sqrt(sq/float64(len(samples))) / mean
+}
@@ -0,0 +1,99 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchSizer(t *testing.T) {
+	t.Parallel()
+
+	b := newBatchSizer(10, 1000, 100*time.Millisecond)
+	require.Equal(t, 256, b.next())
+
+	// full batches within the target grow by a step, up to the maximum
+	b.observe(256, 50*time.Millisecond)
+	require.Equal(t, 256+61, b.next())
+	// partial batches don't tell a bigger one would fit
+	b.observe(100, 20*time.Millisecond)
+	require.Equal(t, 256+61, b.next())
+	// slow batches halve the size, down to the minimum
+	b.observe(317, 200*time.Millisecond)
+	require.Equal(t, 158, b.next())
+
+	b = newBatchSizer(10, 1000, 100*time.Millisecond)
+	for _, size := range []int{256, 128, 64, 32, 16} {
+		require.Equal(t, size, b.next())
+		b.observe(size, 200*time.Millisecond)
+	}
+	require.Equal(t, 10, b.next())
+
+	var nilSizer *batchSizer
+	require.Zero(t, nilSizer.next())
+	nilSizer.observe(1, time.Second)
+}
+
+func TestBatchSizerNoisy(t *testing.T) {
+	t.Parallel()
+
+	b := newBatchSizer(10, 1000, time.Second)
+	for range adaptiveBatchSamples {
+		b.observe(b.next(), time.Millisecond)
+	}
+	require.Greater(t, b.next(), 256)
+
+	// a few wild latencies make the measurements untrustworthy
+	b.observe(b.next(), 10*time.Second)
+	b.observe(b.next(), time.Microsecond)
+	require.Equal(t, 256, b.next())
+
+	// once they settle the size adapts again from the fixed size
+	for range adaptiveBatchSamples {
+		b.observe(b.next(), time.Millisecond)
+	}
+	require.Greater(t, b.next(), 256)
+}
+
+// slowBatchBlockstore takes a millisecond of clk to write each batch.
+type slowBatchBlockstore struct {
+	*batchRecordingBlockstore
+	clk *clock.Mock
+}
+
+func (bs *slowBatchBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	bs.clk.Add(time.Millisecond)
+	return bs.batchRecordingBlockstore.PutMany(ctx, blks)
+}
+
+func TestWithAdaptiveBatching(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clk := clock.NewMock()
+	bstore := &slowBatchBlockstore{
+		batchRecordingBlockstore: &batchRecordingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))},
+		clk:                      clk,
+	}
+	// every batch misses the target
+	bserv := New(bstore, nil, WithAdaptiveBatching(2, 8), WithAdaptiveBatchTarget(time.Microsecond), WithClock(clk)).(*blockService)
+	require.Equal(t, 8, bserv.Stats(false).AdaptiveBatchSize)
+	require.NoError(t, bserv.AddBlocks(ctx, random.BlocksOfSize(16, blockSize)))
+	require.Equal(t, []int{8, 4, 2, 2}, bstore.batches)
+	require.Equal(t, 2, bserv.Stats(false).AdaptiveBatchSize)
+
+	require.Zero(t, New(bstore, nil).(*blockService).Stats(false).AdaptiveBatchSize)
+
+	_, err := NewWithOptions(bstore, nil, WithAdaptiveBatching(4, 2))
+	require.Error(t, err)
+	_, err = NewWithOptions(bstore, nil, WithAdaptiveBatchTarget(0))
+	require.Error(t, err)
+}
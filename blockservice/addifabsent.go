@@ -0,0 +1,160 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// absentLockStripes is the number of mutexes serializing the AddBlockIfAbsent
+// calls on blockstores without [ConditionalPutter], picked by the last byte of
+// the multihash.
+const absentLockStripes = 256
+
+// ErrAlreadyExists is returned by AddBlockIfAbsent when the block was already
+// stored.
+type ErrAlreadyExists struct {
+	Cid cid.Cid
+}
+
+func (e ErrAlreadyExists) Error() string {
+	return fmt.Sprintf("block %s already exists", e.Cid)
+}
+
+// ConditionalPutter is implemented by blockstores able to write a block only
+// if it is not stored yet, atomically.
+type ConditionalPutter interface {
+	// PutIfAbsent stores b unless it is already stored, and reports whether
+	// it stored it.
+	PutIfAbsent(ctx context.Context, b blocks.Block) (bool, error)
+}
+
+// ConditionalAdder is implemented by the blockservices telling the adds which
+// stored a block from the ones which found it already stored, to attribute
+// the storage to the first writer for instance.
+type ConditionalAdder interface {
+	// AddBlockIfAbsent adds b and returns [ErrAlreadyExists] if it was already
+	// stored, in which case the exchange is not notified and b is not
+	// provided. The lookup and the write are atomic when the blockstore
+	// implements [ConditionalPutter], otherwise they are only atomic against
+	// the other AddBlockIfAbsent calls of the blockservice.
+	AddBlockIfAbsent(ctx context.Context, b blocks.Block) error
+
+	// AddBlocksIfAbsent is AddBlockIfAbsent for each block of bs, the
+	// outcome of bs[i] is errs[i]: nil if it was stored, [ErrAlreadyExists]
+	// or the reason why it could not be added. err is only set when the call
+	// failed as a whole, errs is nil then.
+	AddBlocksIfAbsent(ctx context.Context, bs []blocks.Block) (errs []error, err error)
+}
+
+var _ ConditionalAdder = (*blockService)(nil)
+
+func (s *blockService) AddBlockIfAbsent(ctx context.Context, b blocks.Block) error {
+	ctx, span := internal.StartSpan(ctx, "blockService.AddBlockIfAbsent", trace.WithAttributes(attribute.Stringer("CID", b.Cid())))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Add)
+	defer cancel()
+
+	p := s.startRootPin(ctx)
+	defer p.release()
+	stored, announce, err := s.addBlock(ctx, writePathAdd, opAdd, p, b, false, s.putIfAbsent)
+	s.announceAdded(ctx, writePathAdd, announce...)
+	if err == nil && !stored {
+		return ErrAlreadyExists{Cid: b.Cid()}
+	}
+	return err
+}
+
+func (s *blockService) AddBlocksIfAbsent(ctx context.Context, bs []blocks.Block) ([]error, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.AddBlocksIfAbsent", trace.WithAttributes(attribute.Int("count", len(bs))))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return nil, ErrReadOnly
+	}
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Add)
+	defer cancel()
+
+	p := s.startRootPin(ctx)
+	defer p.release()
+	errs := make([]error, len(bs))
+	var announce []blocks.Block
+	stored := 0
+	for i, b := range bs {
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			continue
+		}
+		ok, toAnnounce, err := s.addBlock(ctx, writePathAddBatch, opAddMany, p, b, false, s.putIfAbsent)
+		// the new blocks are announced together once all are written
+		announce = append(announce, toAnnounce...)
+		switch {
+		case err != nil:
+			errs[i] = err
+		case !ok:
+			errs[i] = ErrAlreadyExists{Cid: b.Cid()}
+		default:
+			stored++
+		}
+	}
+	s.announceAdded(ctx, writePathAddBatch, announce...)
+	span.SetAttributes(attribute.Int("stored", stored))
+	return errs, nil
+}
+
+// putIfAbsent stores b unless the blockstore has it, and reports whether it
+// stored it. It is the put of [addBlock] for AddBlockIfAbsent.
+func (s *blockService) putIfAbsent(ctx context.Context, b blocks.Block) (bool, error) {
+	cp, ok := s.blockstore.(ConditionalPutter)
+	if !ok {
+		return s.lockedPutIfAbsent(ctx, b)
+	}
+	stored := false
+	err := s.retryPut(ctx, func() error {
+		var err error
+		stored, err = cp.PutIfAbsent(ctx, b)
+		return err
+	})
+	return stored, err
+}
+
+// lockedPutIfAbsent is putIfAbsent with Has and Put, holding the lock of the
+// CID of b.
+func (s *blockService) lockedPutIfAbsent(ctx context.Context, b blocks.Block) (bool, error) {
+	h := b.Cid().Hash()
+	lk := &s.absentLocks[h[len(h)-1]]
+	lk.Lock()
+	defer lk.Unlock()
+
+	has, err := s.blockstore.Has(ctx, b.Cid())
+	if err != nil || has {
+		return false, err
+	}
+	if err := s.retryPut(ctx, func() error { return s.blockstore.Put(ctx, b) }); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,170 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+// conditionalBlockstore implements ConditionalPutter and fails the Has calls,
+// so the fallback is never used.
+type conditionalBlockstore struct {
+	blockstore.Blockstore
+
+	lk    sync.Mutex
+	calls int
+}
+
+func (bs *conditionalBlockstore) Has(context.Context, cid.Cid) (bool, error) {
+	return false, errors.New("Has called")
+}
+
+func (bs *conditionalBlockstore) PutIfAbsent(ctx context.Context, b blocks.Block) (bool, error) {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	bs.calls++
+	has, err := bs.Blockstore.Has(ctx, b.Cid())
+	if err != nil || has {
+		return false, err
+	}
+	return true, bs.Blockstore.Put(ctx, b)
+}
+
+func TestAddBlockIfAbsent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name        string
+		conditional bool
+	}{
+		{"has and put", false},
+		{"conditional put", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var bstore blockstore.Blockstore = blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+			conditional := &conditionalBlockstore{Blockstore: bstore}
+			if tc.conditional {
+				bstore = conditional
+			}
+			ex := &notifyRecordingExchange{Interface: offline.Exchange(bstore), notified: make(map[cid.Cid]int)}
+			prov := &recordingProvider{}
+			bserv := New(bstore, ex, WithProvider(prov)).(*blockService)
+
+			blk := random.BlocksOfSize(1, blockSize)[0]
+			const adders = 8
+			errs := make([]error, adders)
+			var wg sync.WaitGroup
+			for i := range errs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs[i] = bserv.AddBlockIfAbsent(ctx, blk)
+				}()
+			}
+			wg.Wait()
+
+			// only the first writer stored the block
+			stored := 0
+			for _, err := range errs {
+				if err == nil {
+					stored++
+					continue
+				}
+				var exists ErrAlreadyExists
+				require.ErrorAs(t, err, &exists)
+				require.Equal(t, blk.Cid(), exists.Cid)
+			}
+			require.Equal(t, 1, stored)
+			require.Equal(t, 1, ex.notified[blk.Cid()])
+			require.Equal(t, []cid.Cid{blk.Cid()}, prov.Provided())
+			if tc.conditional {
+				require.Equal(t, adders, conditional.calls)
+			}
+			has, err := conditional.Blockstore.Has(ctx, blk.Cid())
+			require.NoError(t, err)
+			require.True(t, has)
+		})
+	}
+}
+
+func TestAddBlocksIfAbsent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	ex := &notifyRecordingExchange{Interface: offline.Exchange(bstore), notified: make(map[cid.Cid]int)}
+	prov := &recordingProvider{}
+	bserv := New(bstore, ex, WithProvider(prov),
+		WithAllowlist(verifcid.NewAllowlist(map[uint64]bool{multihash.SHA2_256: true})),
+	)
+
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, bstore.Put(ctx, blks[0]))
+	rejected := blockWithHash(t, []byte("sha1"), multihash.SHA1)
+
+	errs, err := bserv.(ConditionalAdder).AddBlocksIfAbsent(ctx, []blocks.Block{blks[0], blks[1], rejected, blks[1], blks[2]})
+	require.NoError(t, err)
+	require.Len(t, errs, 5)
+	require.ErrorIs(t, errs[0], ErrAlreadyExists{Cid: blks[0].Cid()})
+	require.NoError(t, errs[1])
+	require.Error(t, errs[2])
+	require.NotErrorIs(t, errs[2], ErrAlreadyExists{Cid: rejected.Cid()})
+	// the duplicates of a batch are found stored by the first one
+	require.ErrorIs(t, errs[3], ErrAlreadyExists{Cid: blks[1].Cid()})
+	require.NoError(t, errs[4])
+
+	// only the stored blocks were announced, together
+	require.Equal(t, map[cid.Cid]int{blks[1].Cid(): 1, blks[2].Cid(): 1}, ex.notified)
+	require.Equal(t, 1, ex.calls)
+	require.Equal(t, []cid.Cid{blks[1].Cid(), blks[2].Cid()}, prov.Provided())
+}
+
+func TestAddBlockIfAbsentReadOnly(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithReadOnly()).(*blockService)
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	require.ErrorIs(t, bserv.AddBlockIfAbsent(context.Background(), blk), ErrReadOnly)
+	_, err := bserv.AddBlocksIfAbsent(context.Background(), []blocks.Block{blk})
+	require.ErrorIs(t, err, ErrReadOnly)
+}
+
+func TestAddBlockIfAbsentAfterFailedWrite(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	exch := &notifyRecordingExchange{Interface: offline.Exchange(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))), notified: make(map[cid.Cid]int)}
+	prov := &recordingProvider{}
+	bstore := &controlledPutBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), puts: make(chan chan error)}
+	bserv := New(bstore, exch, WithProvider(prov)).(*blockService)
+
+	// the concurrent AddBlock claims the write first and fails
+	addErr, absentErr := make(chan error), make(chan error)
+	go func() { addErr <- bserv.AddBlock(ctx, blk) }()
+	add := <-bstore.puts
+	go func() { absentErr <- bserv.AddBlockIfAbsent(ctx, blk) }()
+	absent := <-bstore.puts
+	absent <- nil
+	require.NoError(t, <-absentErr)
+	add <- errors.New("disk full")
+	require.Error(t, <-addErr)
+
+	require.Equal(t, 1, exch.notified[blk.Cid()])
+	require.Equal(t, []cid.Cid{blk.Cid()}, prov.Provided())
+}
@@ -0,0 +1,126 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// ErrAtomicUnsupported is returned by AddBlocksAtomic when the blockstore does
+// not implement [Transactor].
+var ErrAtomicUnsupported = errors.New("blockstore does not support transactions")
+
+// Transactor is implemented by blockstores able to write blocks in a
+// transaction.
+type Transactor interface {
+	NewTransaction(ctx context.Context) (BlockstoreTxn, error)
+}
+
+// BlockstoreTxn is a blockstore transaction, none of its writes are visible
+// until Commit succeeds.
+type BlockstoreTxn interface {
+	Has(ctx context.Context, c cid.Cid) (bool, error)
+	PutMany(ctx context.Context, bs []blocks.Block) error
+	// Commit writes the blocks put in the transaction, all or none of them.
+	Commit(ctx context.Context) error
+	// Discard drops the transaction, it is a no-op after Commit.
+	Discard(ctx context.Context)
+}
+
+// AddBlocksAtomic adds bs in a single transaction of the blockstore, so either
+// all of them are stored or none is. The exchange is notified and the blocks
+// are provided only once the transaction is committed.
+// Unlike AddBlocks, one block rejected by the allowlist, the content blocker or
+// [WithVerifyOnAdd] fails the whole call.
+// It returns [ErrAtomicUnsupported] if the blockstore does not implement
+// [Transactor].
+func (s *blockService) AddBlocksAtomic(ctx context.Context, bs []blocks.Block) error {
+	ctx, span := internal.StartSpan(ctx, "blockService.AddBlocksAtomic")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return ErrReadOnly
+	}
+	transactor, ok := s.blockstore.(Transactor)
+	if !ok {
+		return ErrAtomicUnsupported
+	}
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Add)
+	defer cancel()
+
+	mismatches, err := s.verifyBlocks(ctx, bs)
+	if err != nil {
+		return err
+	}
+	for i, b := range bs {
+		if err := s.validateCidFor(opAddMany, b.Cid()); err != nil {
+			return err
+		}
+		if mismatches != nil && mismatches[i] != nil {
+			return mismatches[i]
+		}
+		if err := s.checkServableSize(b); err != nil {
+			return err
+		}
+	}
+
+	s.countOffered(writePathAddBatch, bs...)
+	p := s.startRootPin(ctx)
+	defer p.release()
+	txn, err := transactor.NewTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard(ctx)
+
+	toput := bs
+	if s.checkFirst {
+		toput = make([]blocks.Block, 0, len(bs))
+		for _, b := range bs {
+			has, err := txn.Has(ctx, b.Cid())
+			if err != nil {
+				return err
+			}
+			if !has {
+				toput = append(toput, b)
+			}
+		}
+	}
+	if len(toput) == 0 {
+		return p.pin(ctx, bs...)
+	}
+
+	toput, claims, release, err := s.claimWrites(ctx, toput, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	refund, err := reserveQuota(ctx, toput...)
+	if err != nil {
+		return err
+	}
+	if err := txn.PutMany(ctx, toput); err != nil {
+		refund()
+		return err
+	}
+	if err := txn.Commit(ctx); err != nil {
+		refund()
+		return err
+	}
+	pinErr := p.pin(ctx, bs...)
+	s.countWritten(writePathAddBatch, toput...)
+	s.audit(ctx, AuditAdd, toput...)
+	s.added(ctx, toput, s.storedWrites(ctx, writePathAddBatch, toput, claims))
+	return pinErr
+}
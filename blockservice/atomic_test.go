@@ -0,0 +1,109 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Transactor = (*txnBlockstore)(nil)
+
+// txnBlockstore buffers the writes of its transactions until they commit.
+type txnBlockstore struct {
+	blockstore.Blockstore
+	failCommit error
+}
+
+func (bs *txnBlockstore) NewTransaction(context.Context) (BlockstoreTxn, error) {
+	return &bufferedTxn{bs: bs}, nil
+}
+
+type bufferedTxn struct {
+	bs      *txnBlockstore
+	pending []blocks.Block
+}
+
+func (t *bufferedTxn) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return t.bs.Has(ctx, c)
+}
+
+func (t *bufferedTxn) PutMany(_ context.Context, bs []blocks.Block) error {
+	t.pending = append(t.pending, bs...)
+	return nil
+}
+
+func (t *bufferedTxn) Commit(ctx context.Context) error {
+	if t.bs.failCommit != nil {
+		return t.bs.failCommit
+	}
+	defer t.Discard(ctx)
+	return t.bs.Blockstore.PutMany(ctx, t.pending)
+}
+
+func (t *bufferedTxn) Discard(context.Context) {
+	t.pending = nil
+}
+
+func TestAddBlocksAtomic(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	bstore := &txnBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	exch := &notifyRecordingExchange{Interface: offline.Exchange(bstore), notified: make(map[cid.Cid]int)}
+	bserv := New(bstore, exch, WithContentBlocker(func(c cid.Cid) error {
+		if c == blks[3].Cid() {
+			return errors.New("blocked")
+		}
+		return nil
+	})).(*blockService)
+
+	hasAny := func() bool {
+		for _, b := range blks {
+			has, err := bstore.Has(ctx, b.Cid())
+			require.NoError(t, err)
+			if has {
+				return true
+			}
+		}
+		return false
+	}
+
+	// a rejected block fails the whole call
+	require.ErrorIs(t, bserv.AddBlocksAtomic(ctx, blks), ErrBlocked)
+	require.False(t, hasAny())
+
+	// so does a failed commit, without notifying the exchange
+	errCommit := errors.New("commit failed")
+	bstore.failCommit = errCommit
+	require.ErrorIs(t, bserv.AddBlocksAtomic(ctx, blks[:3]), errCommit)
+	require.False(t, hasAny())
+	require.Empty(t, exch.notified)
+
+	bstore.failCommit = nil
+	require.NoError(t, bserv.AddBlocksAtomic(ctx, blks[:3]))
+	for _, b := range blks[:3] {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+		require.Equal(t, 1, exch.notified[b.Cid()])
+	}
+}
+
+func TestAddBlocksAtomicUnsupported(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil).(*blockService)
+	err := bserv.AddBlocksAtomic(context.Background(), random.BlocksOfSize(1, blockSize))
+	require.ErrorIs(t, err, ErrAtomicUnsupported)
+}
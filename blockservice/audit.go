@@ -0,0 +1,159 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// auditBufferSize is the number of entries waiting for the sink of
+// [WithAuditSink] over which new entries are dropped.
+const auditBufferSize = 1024
+
+// AuditOperation is the kind of mutation recorded by an [AuditEntry].
+type AuditOperation string
+
+const (
+	// AuditAdd is a block stored by AddBlock, AddBlocks or AddBlocksAtomic.
+	AuditAdd AuditOperation = "add"
+	// AuditFetchCache is a block fetched from the exchange and stored for
+	// caching.
+	AuditFetchCache AuditOperation = "fetch-cache"
+	// AuditDelete is a block deleted by DeleteBlock, DeleteBlockFrom or
+	// DeleteBlocks.
+	AuditDelete AuditOperation = "delete"
+)
+
+// AuditEntry records a block stored or deleted by the blockservice.
+type AuditEntry struct {
+	Operation AuditOperation
+	Cid       cid.Cid
+	// Size is the size of the block in bytes.
+	Size int
+	// Time is when the mutation completed.
+	Time time.Time
+	// Tag is the tag of [ContextWithAuditTag] set on the context of the
+	// operation, empty if there is none.
+	Tag string
+}
+
+// WithAuditSink records every block the blockservice stores or deletes with
+// sink, once the blockstore write or delete has succeeded; failed writes and
+// blocks which were already stored or missing are not recorded.
+// The entries are handed to sink in order from a single goroutine. sink must
+// not block: the entries are buffered and the ones which don't fit are
+// dropped and counted in [Stats.AuditDropped]. The buffered entries are
+// handed to sink before Close returns.
+func WithAuditSink(sink func(AuditEntry)) Option {
+	return func(bs *blockService) {
+		if sink == nil {
+			bs.invalidOption("WithAuditSink: nil sink")
+			return
+		}
+		bs.auditSink = sink
+	}
+}
+
+type auditTagKey struct{}
+
+// ContextWithAuditTag sets the tag of the [AuditEntry] recorded by the
+// operations made with the returned context, to identify their requester.
+func ContextWithAuditTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, auditTagKey{}, tag)
+}
+
+func auditTag(ctx context.Context) string {
+	tag, _ := ctx.Value(auditTagKey{}).(string)
+	return tag
+}
+
+// auditLog hands the entries to the sink from a goroutine, its methods
+// handle a nil receiver.
+type auditLog struct {
+	sink    func(AuditEntry)
+	entries chan AuditEntry
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	lk     sync.RWMutex
+	closed bool
+}
+
+func newAuditLog(sink func(AuditEntry)) *auditLog {
+	l := &auditLog{
+		sink:    sink,
+		entries: make(chan AuditEntry, auditBufferSize),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *auditLog) run() {
+	defer close(l.done)
+	for e := range l.entries {
+		l.sink(e)
+	}
+}
+
+func (l *auditLog) record(e AuditEntry) {
+	l.lk.RLock()
+	defer l.lk.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// close hands the buffered entries to the sink, the entries recorded
+// afterwards are dropped.
+func (l *auditLog) close() {
+	if l == nil {
+		return
+	}
+	l.lk.Lock()
+	if l.closed {
+		l.lk.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.entries)
+	l.lk.Unlock()
+	<-l.done
+}
+
+func (l *auditLog) droppedCount() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.dropped.Load()
+}
+
+// audit records the blocks of bs as mutated by op.
+func (s *blockService) audit(ctx context.Context, op AuditOperation, bs ...blocks.Block) {
+	if s == nil || s.auditLog == nil {
+		return
+	}
+	now := s.clock.Now()
+	tag := auditTag(ctx)
+	for _, b := range bs {
+		s.auditLog.record(AuditEntry{Operation: op, Cid: b.Cid(), Size: len(b.RawData()), Time: now, Tag: tag})
+	}
+}
+
+// auditDelete records the deletion of c, of size bytes.
+func (s *blockService) auditDelete(ctx context.Context, c cid.Cid, size int) {
+	if s == nil || s.auditLog == nil {
+		return
+	}
+	s.auditLog.record(AuditEntry{Operation: AuditDelete, Cid: c, Size: size, Time: s.clock.Now(), Tag: auditTag(ctx)})
+}
@@ -0,0 +1,97 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+type auditRecorder struct {
+	lk      sync.Mutex
+	entries []AuditEntry
+}
+
+func (r *auditRecorder) record(e AuditEntry) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.entries = append(r.entries, e)
+}
+
+// ops returns the operations, CIDs and tags of the recorded entries.
+func (r *auditRecorder) ops() []string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	var ops []string
+	for _, e := range r.entries {
+		ops = append(ops, string(e.Operation)+" "+e.Cid.String()+" "+e.Tag)
+	}
+	return ops
+}
+
+func TestWithAuditSink(t *testing.T) {
+	t.Parallel()
+	ctx := ContextWithAuditTag(context.Background(), "alice")
+
+	blks := random.BlocksOfSize(4, blockSize)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.Put(ctx, blks[3]))
+	bstore := &flakyBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), err: errors.New("disk full")}
+	rec := &auditRecorder{}
+	bserv := New(bstore, offline.Exchange(exchbstore), WithAuditSink(rec.record))
+
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlocks(context.Background(), blks[1:2]))
+	bstore.failures = 1
+	require.Error(t, bserv.AddBlock(ctx, blks[2]))
+	_, err := bserv.GetBlock(ctx, blks[3].Cid())
+	require.NoError(t, err)
+	require.NoError(t, bserv.DeleteBlock(ctx, blks[0].Cid()))
+	// nothing to delete
+	require.NoError(t, bserv.DeleteBlock(ctx, blks[0].Cid()))
+	require.NoError(t, bserv.Close())
+
+	// the entries are all handed to the sink by Close
+	require.Equal(t, []string{
+		"add " + blks[0].Cid().String() + " alice",
+		"add " + blks[1].Cid().String() + " ",
+		"fetch-cache " + blks[3].Cid().String() + " alice",
+		"delete " + blks[0].Cid().String() + " alice",
+	}, rec.ops())
+	for _, e := range rec.entries {
+		require.Equal(t, blockSize, e.Size)
+		require.False(t, e.Time.IsZero())
+	}
+}
+
+func TestAuditSinkDrops(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	var seen []cid.Cid
+	sink := func(e AuditEntry) {
+		<-release
+		seen = append(seen, e.Cid)
+	}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithAuditSink(sink)).(*blockService)
+
+	// the sink is stuck, the entries over the buffer are dropped
+	blks := random.BlocksOfSize(auditBufferSize+10, blockSize)
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+	dropped := bserv.Stats(false).AuditDropped
+	require.GreaterOrEqual(t, dropped, uint64(9))
+
+	close(release)
+	require.NoError(t, bserv.Close())
+	require.Len(t, seen, len(blks)-int(dropped))
+}
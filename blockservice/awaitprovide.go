@@ -0,0 +1,216 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+var (
+	// ErrProvideTimeout is wrapped by the errors returned when the context
+	// expires while waiting for a provide, the block has been stored.
+	ErrProvideTimeout = errors.New("timed out waiting for the provide")
+	// ErrProvideDropped is returned when a provide was dropped by the rate
+	// limit policy, a suspended provider or the closing of the blockservice.
+	ErrProvideDropped = errors.New("provide dropped")
+
+	errProvideQueued = errors.New("provide queued")
+)
+
+// ProvideAwaitingBlockService is a [BlockService] able to wait for the blocks
+// it adds to be announced, for callers who need to know a block is
+// discoverable.
+type ProvideAwaitingBlockService interface {
+	BlockService
+
+	// AddBlockAndAwaitProvide adds o like AddBlock, then provides it even if it
+	// was already stored and waits for the provider calls to return, through
+	// the provide queue when there is one. The errors of the providers are
+	// returned, [ErrProvideDropped] if the provide was dropped, or an error
+	// wrapping [ErrProvideTimeout] if ctx expires first; the block is stored
+	// in every case.
+	// It returns once the block is stored if the blockservice does not provide
+	// it: no provider, [WithProvideOn], [WithProvideFilter] or
+	// [ContextWithNoProvide].
+	AddBlockAndAwaitProvide(ctx context.Context, o blocks.Block) error
+
+	// AddBlocksAndAwaitProvide is AddBlockAndAwaitProvide for AddBlocks, the
+	// provides are waited for once they have all been started and their
+	// errors are joined.
+	AddBlocksAndAwaitProvide(ctx context.Context, bs []blocks.Block) error
+}
+
+var _ ProvideAwaitingBlockService = (*blockService)(nil)
+
+type awaitedProvideKey struct{}
+
+// isAwaitedProvide reports whether the caller provides the blocks itself, to
+// wait for the provides.
+func isAwaitedProvide(ctx context.Context) bool {
+	awaited, _ := ctx.Value(awaitedProvideKey{}).(bool)
+	return awaited
+}
+
+func (s *blockService) AddBlockAndAwaitProvide(ctx context.Context, o blocks.Block) error {
+	if err := s.AddBlock(context.WithValue(ctx, awaitedProvideKey{}, true), o); err != nil {
+		return err
+	}
+	return s.startAwaitedProvide(ctx, o.Cid())()
+}
+
+func (s *blockService) AddBlocksAndAwaitProvide(ctx context.Context, bs []blocks.Block) error {
+	if err := s.AddBlocks(context.WithValue(ctx, awaitedProvideKey{}, true), bs); err != nil {
+		return err
+	}
+	waits := make([]func() error, 0, len(bs))
+	seen := make(map[cid.Cid]struct{}, len(bs))
+	for _, b := range bs {
+		if _, ok := seen[b.Cid()]; ok {
+			continue
+		}
+		seen[b.Cid()] = struct{}{}
+		waits = append(waits, s.startAwaitedProvide(ctx, b.Cid()))
+	}
+	var errs []error
+	for _, wait := range waits {
+		if err := wait(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// startAwaitedProvide provides c like the add operations, it returns a
+// function waiting for the end of the provides which were queued.
+func (s *blockService) startAwaitedProvide(ctx context.Context, c cid.Cid) func() error {
+	noWait := func(err error) func() error {
+		return func() error { return err }
+	}
+	if s.provider == nil || s.provideOn&ProvideOnAdd == 0 || isNoProvide(ctx) {
+		return noWait(nil)
+	}
+	if s.provideFilter != nil && !s.provideFilter(c) {
+		return noWait(nil)
+	}
+	if s.blocked(c) {
+		return noWait(nil)
+	}
+
+	q := s.provideQueue
+	if s.provideWorkers > 0 {
+		task := provideTask{cid: c}
+		w := q.waitFor(task.journalID())
+		q.enqueue(ctx, task)
+		return func() error { return q.wait(ctx, task.journalID(), w) }
+	}
+
+	var errs []error
+	var waits []func() error
+	for _, t := range s.provideTargets {
+		id := journalID{cid: c, target: t.index}
+		w := q.waitFor(id)
+		err := s.provideTo(ctx, t, c)
+		if err == errProvideQueued {
+			waits = append(waits, func() error { return q.wait(ctx, id, w) })
+			continue
+		}
+		q.forget(id, w)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = provideTimeout(c, ctx.Err())
+			}
+			errs = append(errs, err)
+		}
+	}
+	return func() error {
+		for _, wait := range waits {
+			if err := wait(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+func provideTimeout(c cid.Cid, err error) error {
+	return fmt.Errorf("%w of %s: %w", ErrProvideTimeout, c, err)
+}
+
+// provideWaiter is notified of the end of the next provide of a CID to a
+// target, or to all of them, by the provide queue.
+type provideWaiter struct {
+	done chan error
+}
+
+// waitFor registers a waiter for the end of the next provide identified by
+// id, a nil queue returns a nil waiter.
+func (q *provideQueue) waitFor(id journalID) *provideWaiter {
+	if q == nil {
+		return nil
+	}
+	w := &provideWaiter{done: make(chan error, 1)}
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if q.waiters == nil {
+		q.waiters = make(map[journalID][]*provideWaiter)
+	}
+	q.waiters[id] = append(q.waiters[id], w)
+	return w
+}
+
+// forget unregisters w.
+func (q *provideQueue) forget(id journalID, w *provideWaiter) {
+	if q == nil || w == nil {
+		return
+	}
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	ws := q.waiters[id]
+	for i, x := range ws {
+		if x == w {
+			ws = append(ws[:i], ws[i+1:]...)
+			break
+		}
+	}
+	if len(ws) == 0 {
+		delete(q.waiters, id)
+	} else {
+		q.waiters[id] = ws
+	}
+}
+
+// finished notifies the waiters of id that the provide ended with err.
+func (q *provideQueue) finished(id journalID, err error) {
+	q.lk.Lock()
+	ws := q.waiters[id]
+	delete(q.waiters, id)
+	q.lk.Unlock()
+	for _, w := range ws {
+		w.done <- err
+	}
+}
+
+// finishedAll notifies the waiters of task, and of each of its targets which
+// were not notified yet, that it ended with err.
+func (q *provideQueue) finishedAll(task provideTask, err error) {
+	if task.target == nil {
+		for _, t := range q.s.provideTargets {
+			q.finished(journalID{cid: task.cid, target: t.index}, err)
+		}
+	}
+	q.finished(task.journalID(), err)
+}
+
+// wait waits for the provide w was registered for.
+func (q *provideQueue) wait(ctx context.Context, id journalID, w *provideWaiter) error {
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		q.forget(id, w)
+		return provideTimeout(id.cid, ctx.Err())
+	}
+}
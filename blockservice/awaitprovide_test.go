@@ -0,0 +1,89 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddBlockAndAwaitProvide(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("async", func(t *testing.T) {
+		t.Parallel()
+		prov := &recordingProvider{}
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, nil, WithProvider(prov), WithAsyncProvide(2, 4)).(*blockService)
+		defer bserv.Close()
+
+		blks := random.BlocksOfSize(3, blockSize)
+		require.NoError(t, bserv.AddBlockAndAwaitProvide(ctx, blks[0]))
+		require.Equal(t, []cid.Cid{blks[0].Cid()}, prov.Provided())
+
+		// blocks already stored are provided again
+		require.NoError(t, bserv.AddBlocksAndAwaitProvide(ctx, blks))
+		require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}, prov.Provided())
+	})
+
+	t.Run("sync errors", func(t *testing.T) {
+		t.Parallel()
+		prov := &failingProvider{}
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, nil, WithProvider(prov))
+
+		blk := random.BlocksOfSize(1, blockSize)[0]
+		require.ErrorIs(t, bserv.(ProvideAwaitingBlockService).AddBlockAndAwaitProvide(ctx, blk), errProvide)
+		require.Equal(t, []cid.Cid{blk.Cid()}, prov.Provided())
+	})
+
+	t.Run("queued per target", func(t *testing.T) {
+		t.Parallel()
+		ok, failing := &recordingProvider{}, &failingProvider{}
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, nil, WithProviders(ok, failing), WithProvideRateLimit(2, 1), WithProvidePolicy(ProvideQueue)).(*blockService)
+		defer bserv.Close()
+
+		// the first block takes the tokens, the provides of the second one
+		// are queued for each target and the failing one is waited for
+		blks := random.BlocksOfSize(2, blockSize)
+		require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+		require.ErrorIs(t, bserv.AddBlockAndAwaitProvide(ctx, blks[1]), errProvide)
+		require.Equal(t, cidsOf(blks...), ok.Provided())
+		require.Equal(t, cidsOf(blks...), failing.Provided())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		prov := &blockingProvider{started: make(chan cid.Cid, 1)}
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, nil, WithProvider(prov), WithAsyncProvide(1, 4), WithCloseTimeout(10*time.Millisecond)).(*blockService)
+		defer bserv.Close()
+
+		blk := random.BlocksOfSize(1, blockSize)[0]
+		tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, bserv.AddBlockAndAwaitProvide(tctx, blk), ErrProvideTimeout)
+		has, err := bstore.Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	})
+
+	t.Run("not provided", func(t *testing.T) {
+		t.Parallel()
+		prov := &recordingProvider{}
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, nil, WithProvider(prov), WithProvideOn(ProvideOnFetch), WithAsyncProvide(1, 4)).(*blockService)
+		defer bserv.Close()
+
+		require.NoError(t, bserv.AddBlockAndAwaitProvide(ctx, random.BlocksOfSize(1, blockSize)[0]))
+		require.Empty(t, prov.Provided())
+	})
+}
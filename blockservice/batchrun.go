@@ -0,0 +1,67 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+// batchRunner runs a function on the batches of a list of CIDs, up to
+// concurrency batches at once, and accumulates the stats of type S and the
+// failures of the batches. It is shared by CopyBlocks and WarmCache.
+type batchRunner[S any] struct {
+	batchSize   int
+	concurrency int
+	// merge adds the stats of a batch to the total.
+	merge func(total *S, batch S)
+	// progress, if set, receives the total after each batch, it is never
+	// called concurrently.
+	progress func(S)
+
+	lk     sync.Mutex
+	stats  S
+	failed map[cid.Cid]error
+}
+
+// run calls do on the batches of ks until they are all done or ctx is done,
+// and returns the accumulated stats and failures.
+func (r *batchRunner[S]) run(ctx context.Context, ks []cid.Cid, do func(ctx context.Context, batch []cid.Cid) (S, map[cid.Cid]error)) (S, map[cid.Cid]error) {
+	if r.failed == nil {
+		r.failed = make(map[cid.Cid]error)
+	}
+	limiter := make(chan struct{}, r.concurrency)
+	var wg sync.WaitGroup
+	for start := 0; start < len(ks); start += r.batchSize {
+		select {
+		case limiter <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		batch := ks[start:min(start+r.batchSize, len(ks))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-limiter }()
+			stats, failed := do(ctx, batch)
+			r.add(stats, failed)
+		}()
+	}
+	wg.Wait()
+	return r.stats, r.failed
+}
+
+func (r *batchRunner[S]) add(stats S, failed map[cid.Cid]error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.merge(&r.stats, stats)
+	for k, err := range failed {
+		r.failed[k] = err
+	}
+	if r.progress != nil {
+		r.progress(r.stats)
+	}
+}
@@ -0,0 +1,77 @@
+package blockservice
+
+import (
+	"context"
+
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// WithPurgeBlocked deletes the blocks rejected by the content blocker of
+// [WithContentBlocker] from the blockstores the first time they are accessed,
+// in the background. Read-only blockservices don't delete them.
+func WithPurgeBlocked() Option {
+	return func(bs *blockService) {
+		bs.purgeBlocked = true
+	}
+}
+
+// blocked reports whether the content blocker currently rejects c, the blocks
+// already stored are neither announced nor provided.
+func (s *blockService) blocked(c cid.Cid) bool {
+	return s != nil && s.blocker != nil && s.blocker(c) != nil
+}
+
+// notifyNewBlocks tells ex about the blocks of bs which are not blocked, p
+// is the write path which stored them. With [WithNotifyCoalescing] the
+// blocks are queued and nil is returned.
+func (s *blockService) notifyNewBlocks(ctx context.Context, p writePath, ex exchange.Interface, bs ...blocks.Block) error {
+	if s != nil && s.blocker != nil {
+		allowed := make([]blocks.Block, 0, len(bs))
+		for _, b := range bs {
+			if !s.blocked(b.Cid()) {
+				allowed = append(allowed, b)
+			}
+		}
+		bs = allowed
+	}
+	if len(bs) == 0 {
+		return nil
+	}
+	if s != nil && ex == s.exchange && s.notifier.add(ctx, p, bs) {
+		return nil
+	}
+	err := ex.NotifyNewBlocks(ctx, bs...)
+	if err != nil {
+		s.notifyFailed(ctx, p, bs, err)
+	}
+	return err
+}
+
+// purge deletes the blocked block c in the background if [WithPurgeBlocked]
+// is set, once at a time.
+func (s *blockService) purge(c cid.Cid) {
+	if !s.purgeBlocked || s.ReadOnly() {
+		return
+	}
+	if _, running := s.purging.LoadOrStore(c, struct{}{}); running {
+		return
+	}
+	ctx, done, err := s.track(s.serviceCtx)
+	if err != nil {
+		s.purging.Delete(c)
+		return
+	}
+	go func() {
+		defer done()
+		defer s.purging.Delete(c)
+		removed, err := s.deleteBlock(ctx, c, AllStores, deleteOptions{ignoreNotFound: true})
+		switch {
+		case err != nil:
+			logger.Errorf("failed to purge the blocked block %s: %s", c, err)
+		case removed:
+			logger.Infof("purged the blocked block %s", c)
+		}
+	}()
+}
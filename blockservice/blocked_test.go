@@ -0,0 +1,148 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// denylist is a content blocker which can be changed at any time.
+type denylist struct {
+	lk      sync.Mutex
+	blocked map[cid.Cid]struct{}
+}
+
+func (d *denylist) block(cs ...cid.Cid) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if d.blocked == nil {
+		d.blocked = make(map[cid.Cid]struct{})
+	}
+	for _, c := range cs {
+		d.blocked[c] = struct{}{}
+	}
+}
+
+func (d *denylist) unblock(c cid.Cid) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	delete(d.blocked, c)
+}
+
+func (d *denylist) check(c cid.Cid) error {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	if _, ok := d.blocked[c]; ok {
+		return errDenied
+	}
+	return nil
+}
+
+var errDenied = errors.New("denied")
+
+// hookPutBlockstore calls onPut before writing blocks.
+type hookPutBlockstore struct {
+	blockstore.Blockstore
+	onPut func(bs ...blocks.Block)
+}
+
+func (bs *hookPutBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	bs.onPut(b)
+	return bs.Blockstore.Put(ctx, b)
+}
+
+func (bs *hookPutBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	bs.onPut(blks...)
+	return bs.Blockstore.PutMany(ctx, blks)
+}
+
+func TestBlockedNotAnnounced(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	deny := &denylist{}
+	blks := random.BlocksOfSize(4, blockSize)
+	// the blocks get blocked while they are being written
+	bstore := &hookPutBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		onPut: func(bs ...blocks.Block) {
+			for _, b := range bs {
+				if b.Cid() != blks[2].Cid() {
+					deny.block(b.Cid())
+				}
+			}
+		},
+	}
+	exch := &notifyRecordingExchange{Interface: offline.Exchange(bstore), notified: make(map[cid.Cid]int)}
+	prov := &recordingProvider{}
+	bserv := New(bstore, exch, WithContentBlocker(deny.check), WithProvider(prov))
+
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlocks(ctx, blks[1:3]))
+	require.Equal(t, map[cid.Cid]int{blks[2].Cid(): 1}, exch.notified)
+	require.Equal(t, []cid.Cid{blks[2].Cid()}, prov.Provided())
+
+	// the stored blocks are refused once blocked
+	_, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.ErrorIs(t, err, ErrBlocked)
+	require.ErrorIs(t, err, errDenied)
+
+	// and served again once unblocked, without a restart
+	deny.unblock(blks[0].Cid())
+	blk, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), blk.RawData())
+}
+
+func TestBlockedWhileQueuedNotProvided(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	deny := &denylist{}
+	prov := &gatedProvider{gate: make(chan struct{})}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithContentBlocker(deny.check), WithProvider(prov), WithAsyncProvide(1, 10)).(*blockService)
+	defer bserv.Close()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+	deny.block(blks[1].Cid(), blks[2].Cid())
+	close(prov.gate)
+	require.NoError(t, bserv.WaitIdle(ctx))
+	require.Equal(t, []cid.Cid{blks[0].Cid()}, prov.Provided())
+}
+
+func TestWithPurgeBlocked(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	deny := &denylist{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithContentBlocker(deny.check), WithPurgeBlocked())
+	defer bserv.Close()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+	deny.block(blks[0].Cid())
+
+	_, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.ErrorIs(t, err, ErrBlocked)
+	require.Eventually(t, func() bool {
+		has, err := bstore.Has(ctx, blks[0].Cid())
+		return err == nil && !has
+	}, time.Second, time.Millisecond)
+	has, err := bstore.Has(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+}
@@ -0,0 +1,267 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+)
+
+// hasParallelism bounds the Has calls of HasMany and MissingBlocks running at
+// once on blockstores without a batched lookup.
+const hasParallelism = 8
+
+// BlockReader reads what is stored locally without ever going to the
+// exchange, for exchange servers answering want-haves: the blockservice can be
+// used in place of its blockstore and the allowlist and content blocker still
+// apply.
+// When the blockstore implements BlockReader itself, its methods are used for
+// the blockstore lookups.
+type BlockReader interface {
+	// GetSizes returns the sizes of the blocks of ks, -1 for the ones which are
+	// not stored or rejected. The rejected CIDs are listed in a
+	// [*RejectedCidsError], the sizes of the others are still returned.
+	GetSizes(ctx context.Context, ks []cid.Cid) ([]int, error)
+
+	// HasMany reports which blocks of ks are stored, the rejected CIDs are
+	// reported missing and listed in a [*RejectedCidsError].
+	HasMany(ctx context.Context, ks []cid.Cid) ([]bool, error)
+}
+
+var _ BlockReader = (*blockService)(nil)
+
+// MissingFinder is implemented by the blockservices able to tell which blocks
+// of a set still need to be fetched.
+type MissingFinder interface {
+	// MissingBlocks returns the CIDs of ks which are not stored locally, in
+	// the order of ks, without ever going to the exchange. The CIDs rejected
+	// by the allowlist or the content blocker are returned as missing too and
+	// listed in a [*RejectedCidsError] returned with them.
+	MissingBlocks(ctx context.Context, ks []cid.Cid) ([]cid.Cid, error)
+}
+
+var _ MissingFinder = (*blockService)(nil)
+
+// RejectedCidsError is returned by the [BlockReader] methods when some CIDs
+// were rejected by the allowlist or the content blocker.
+type RejectedCidsError struct {
+	// Rejected maps the rejected CIDs to the reason why.
+	Rejected map[cid.Cid]error
+}
+
+func (e *RejectedCidsError) Error() string {
+	return fmt.Sprintf("%d CIDs rejected", len(e.Rejected))
+}
+
+// Unwrap returns the errors of the rejected CIDs, so errors.Is matches
+// [ErrBlocked] when one of them was blocked.
+func (e *RejectedCidsError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Rejected))
+	for _, err := range e.Rejected {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (s *blockService) GetSizes(ctx context.Context, ks []cid.Cid) ([]int, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.GetSizes", trace.WithAttributes(attribute.Int("count", len(ks))))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Get)
+	defer cancel()
+
+	valid, rejected := s.splitRejected(ks)
+	sizes := make([]int, len(ks))
+	for i := range sizes {
+		sizes[i] = -1
+	}
+	found, err := s.blockstoreSizes(ctx, valid)
+	if err != nil {
+		return nil, err
+	}
+	j := 0
+	for i, c := range ks {
+		if _, ok := rejected[c]; ok {
+			continue
+		}
+		size := found[j]
+		j++
+		if size < 0 {
+			if sz, ok := s.getSizeOffBlockstore(ctx, c); ok {
+				size = sz
+			}
+		}
+		sizes[i] = size
+	}
+	return sizes, rejectedError(rejected)
+}
+
+func (s *blockService) HasMany(ctx context.Context, ks []cid.Cid) ([]bool, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.HasMany", trace.WithAttributes(attribute.Int("count", len(ks))))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Get)
+	defer cancel()
+
+	valid, rejected := s.splitRejected(ks)
+	found, err := s.blockstoreHasMany(ctx, valid)
+	if err != nil {
+		return nil, err
+	}
+	has := make([]bool, len(ks))
+	j := 0
+	for i, c := range ks {
+		if _, ok := rejected[c]; ok {
+			continue
+		}
+		has[i] = found[j]
+		j++
+		if !has[i] {
+			_, has[i] = s.getSizeOffBlockstore(ctx, c)
+		}
+	}
+	return has, rejectedError(rejected)
+}
+
+func (s *blockService) MissingBlocks(ctx context.Context, ks []cid.Cid) ([]cid.Cid, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.MissingBlocks", trace.WithAttributes(attribute.Int("count", len(ks))))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Get)
+	defer cancel()
+
+	valid, rejected := s.splitRejected(ks)
+	found, err := s.blockstoreHasMany(ctx, valid)
+	if err != nil {
+		return nil, err
+	}
+	var missing []cid.Cid
+	j := 0
+	for _, c := range ks {
+		if _, ok := rejected[c]; ok {
+			missing = append(missing, c)
+			continue
+		}
+		has := found[j]
+		j++
+		if !has {
+			_, has = s.getSizeOffBlockstore(ctx, c)
+		}
+		if !has {
+			missing = append(missing, c)
+		}
+	}
+	span.SetAttributes(attribute.Int("missing", len(missing)))
+	return missing, rejectedError(rejected)
+}
+
+// splitRejected returns the CIDs of ks passing ValidateCid, and the errors of
+// the others.
+func (s *blockService) splitRejected(ks []cid.Cid) (valid []cid.Cid, rejected map[cid.Cid]error) {
+	valid = make([]cid.Cid, 0, len(ks))
+	for _, c := range ks {
+		if err := s.validateCidFor(opGetMany, c); err != nil {
+			if rejected == nil {
+				rejected = make(map[cid.Cid]error)
+			}
+			rejected[c] = err
+			continue
+		}
+		valid = append(valid, c)
+	}
+	return valid, rejected
+}
+
+func rejectedError(rejected map[cid.Cid]error) error {
+	if rejected == nil {
+		return nil
+	}
+	return &RejectedCidsError{Rejected: rejected}
+}
+
+// getSizeOffBlockstore looks up the size of c where the reads find the blocks
+// missing from the blockstore: the fetch cache, the other CIDs of its multihash
+// and the fallback blockstore.
+func (s *blockService) getSizeOffBlockstore(ctx context.Context, c cid.Cid) (int, bool) {
+	if size, ok := s.getSizeFromFetchCache(ctx, c); ok {
+		return size, true
+	}
+	if size, ok := s.getSizeByMultihash(ctx, c); ok {
+		return size, true
+	}
+	return s.getSizeFromFallback(ctx, c)
+}
+
+// blockstoreSizes returns the sizes of ks in the blockstore, -1 for the
+// missing ones.
+func (s *blockService) blockstoreSizes(ctx context.Context, ks []cid.Cid) ([]int, error) {
+	if br, ok := s.blockstore.(BlockReader); ok {
+		sizes, err := br.GetSizes(ctx, ks)
+		if err == nil && len(sizes) != len(ks) {
+			err = fmt.Errorf("GetSizes: the blockstore returned %d sizes for %d CIDs", len(sizes), len(ks))
+		}
+		return sizes, err
+	}
+	sizes := make([]int, len(ks))
+	for i, c := range ks {
+		size, err := s.blockstore.GetSize(ctx, c)
+		switch {
+		case err == nil:
+			sizes[i] = size
+		case ipld.IsNotFound(err):
+			sizes[i] = -1
+		default:
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
+
+// blockstoreHasMany reports which blocks of ks are in the blockstore, with up
+// to hasParallelism Has calls at once when it does not implement BlockReader.
+func (s *blockService) blockstoreHasMany(ctx context.Context, ks []cid.Cid) ([]bool, error) {
+	if br, ok := s.blockstore.(BlockReader); ok {
+		has, err := br.HasMany(ctx, ks)
+		if err == nil && len(has) != len(ks) {
+			err = fmt.Errorf("HasMany: the blockstore returned %d results for %d CIDs", len(has), len(ks))
+		}
+		return has, err
+	}
+	has := make([]bool, len(ks))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(hasParallelism)
+	for i, c := range ks {
+		g.Go(func() error {
+			var err error
+			has[i], err = s.blockstore.Has(ctx, c)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return has, nil
+}
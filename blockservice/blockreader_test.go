@@ -0,0 +1,165 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// batchReadingBlockstore implements BlockReader and counts its calls.
+type batchReadingBlockstore struct {
+	blockstore.Blockstore
+	calls atomic.Int32
+}
+
+func (bs *batchReadingBlockstore) GetSizes(ctx context.Context, ks []cid.Cid) ([]int, error) {
+	bs.calls.Add(1)
+	sizes := make([]int, len(ks))
+	for i, c := range ks {
+		size, err := bs.Blockstore.GetSize(ctx, c)
+		if err != nil {
+			size = -1
+		}
+		sizes[i] = size
+	}
+	return sizes, nil
+}
+
+func (bs *batchReadingBlockstore) HasMany(ctx context.Context, ks []cid.Cid) ([]bool, error) {
+	bs.calls.Add(1)
+	has := make([]bool, len(ks))
+	for i, c := range ks {
+		has[i], _ = bs.Blockstore.Has(ctx, c)
+	}
+	return has, nil
+}
+
+func TestBlockReader(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	bstore := &batchReadingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	blocked := blks[1].Cid()
+	bserv := New(bstore, offline.Exchange(exchbstore), WithContentBlocker(func(c cid.Cid) error {
+		if c == blocked {
+			return errors.New("nope")
+		}
+		return nil
+	}))
+	require.NoError(t, bstore.Blockstore.PutMany(ctx, blks[:2]))
+
+	ks := []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}
+	br := bserv.(BlockReader)
+	sizes, err := br.GetSizes(ctx, ks)
+	require.ErrorIs(t, err, ErrBlocked)
+	var rerr *RejectedCidsError
+	require.ErrorAs(t, err, &rerr)
+	require.Len(t, rerr.Rejected, 1)
+	require.Contains(t, rerr.Rejected, blocked)
+	// the missing block is not fetched from the exchange
+	require.Equal(t, []int{blockSize, -1, -1}, sizes)
+
+	has, err := br.HasMany(ctx, ks)
+	require.ErrorIs(t, err, ErrBlocked)
+	require.Equal(t, []bool{true, false, false}, has)
+	require.EqualValues(t, 2, bstore.calls.Load())
+
+	has, err = br.HasMany(ctx, ks[:1])
+	require.NoError(t, err)
+	require.Equal(t, []bool{true}, has)
+}
+
+func TestMissingBlocks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(40, blockSize)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	blocked := blks[1].Cid()
+	blocker := WithContentBlocker(func(c cid.Cid) error {
+		if c == blocked {
+			return errors.New("nope")
+		}
+		return nil
+	})
+	ks := make([]cid.Cid, len(blks))
+	var want []cid.Cid
+	for i, b := range blks {
+		ks[i] = b.Cid()
+		if i%3 != 0 || i == 1 {
+			want = append(want, b.Cid())
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		batched   bool
+		wantCalls int32
+	}{
+		{"batched", true, 1},
+		{"parallel", false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			bstore := &batchReadingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+			for i, b := range blks {
+				if i%3 == 0 || i == 1 {
+					require.NoError(t, bstore.Put(ctx, b))
+				}
+			}
+			var bs blockstore.Blockstore = bstore
+			if !tc.batched {
+				bs = bstore.Blockstore
+			}
+			exch := &callRecordingExchange{Interface: offline.Exchange(exchbstore)}
+			bserv := New(bs, exch, blocker).(MissingFinder)
+
+			missing, err := bserv.MissingBlocks(ctx, ks)
+			var rejected *RejectedCidsError
+			require.ErrorAs(t, err, &rejected)
+			require.ErrorIs(t, err, ErrBlocked)
+			require.Len(t, rejected.Rejected, 1)
+			require.Contains(t, rejected.Rejected, blocked)
+			// the blocked CID is missing although stored
+			require.Equal(t, want, missing)
+			require.Equal(t, tc.wantCalls, bstore.calls.Load())
+			require.Empty(t, exch.calls)
+		})
+	}
+}
+
+func TestBlockReaderFallback(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	fallback := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, fallback.Put(ctx, blks[0]))
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithReadFallbackBlockstore(fallback))
+
+	// the block only the fallback has is found by every lookup
+	ks := cidsOf(blks...)
+	sizes, err := bserv.(BlockReader).GetSizes(ctx, ks)
+	require.NoError(t, err)
+	require.Equal(t, []int{blockSize, -1}, sizes)
+	has, err := bserv.(BlockReader).HasMany(ctx, ks)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false}, has)
+	missing, err := bserv.(MissingFinder).MissingBlocks(ctx, ks)
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{blks[1].Cid()}, missing)
+}
@@ -5,25 +5,60 @@ package blockservice
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 
+	"github.com/benbjohnson/clock"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/ipfs/boxo/blockstore"
 	"github.com/ipfs/boxo/exchange"
+	"github.com/ipfs/boxo/provider"
 	"github.com/ipfs/boxo/verifcid"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/ipfs/boxo/blockservice/httpfetch"
 	"github.com/ipfs/boxo/blockservice/internal"
 )
 
 var logger = logging.Logger("blockservice")
 
+// ErrBlocked is wrapped by the errors returned for CIDs rejected by the
+// content blocker.
+var ErrBlocked = errors.New("blocked by the content blocker")
+
+// PartialWriteError is returned by AddBlocks when a batch fails after
+// previous batches were written.
+type PartialWriteError struct {
+	// Written is the number of blocks durably written before the failure.
+	Written int
+	// Unwritten lists the CIDs of the blocks which were not written, the
+	// other blocks given to AddBlocks are stored.
+	Unwritten []cid.Cid
+	Err       error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("wrote %d blocks before failing: %s", e.Written, e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
 // BlockGetter is the common interface shared between blockservice sessions and
 // the blockservice.
 type BlockGetter interface {
@@ -37,6 +72,9 @@ type BlockGetter interface {
 	// be canceled). In that case, it will close the channel early. It is up
 	// to the consumer to detect this situation and keep track which blocks
 	// it has received and which it hasn't.
+	// The blockservice and its sessions close the channel as soon as the
+	// context is canceled, even if the blockstore or the exchange are slow to
+	// return.
 	GetBlocks(ctx context.Context, ks []cid.Cid) <-chan blocks.Block
 }
 
@@ -60,7 +98,9 @@ type BlockService interface {
 	// capabilities of the underlying datastore whenever possible.
 	AddBlocks(ctx context.Context, bs []blocks.Block) error
 
-	// DeleteBlock deletes the given block from the blockservice.
+	// DeleteBlock deletes the given block from the blockservice. It returns
+	// [ErrNotFound] if the blockstore reports the block was not stored, see
+	// [ContextWithDeleteOptions] to ignore it.
 	DeleteBlock(ctx context.Context, o cid.Cid) error
 }
 
@@ -68,6 +108,9 @@ type BlockService interface {
 type BoundedBlockService interface {
 	BlockService
 
+	// Allowlist returns the allowlist checking the CIDs. With
+	// [WithSecurityPolicy] it is the allowlist of the policy, like the one of
+	// [AllowlistPolicy], or nil if the policy has none and decides alone.
 	Allowlist() verifcid.Allowlist
 }
 
@@ -75,11 +118,151 @@ var _ BoundedBlockService = (*blockService)(nil)
 
 type blockService struct {
 	allowlist  verifcid.Allowlist
+	policy     SecurityPolicy // nil unless WithSecurityPolicy is used
+	blocker    Blocker
 	blockstore blockstore.Blockstore
 	exchange   exchange.Interface
 	// If checkFirst is true then first check that a block doesn't
 	// already exist to avoid republishing the block on the exchange.
 	checkFirst bool
+
+	hashOnLocalRead  uint64 // hash one local read out of hashOnLocalRead
+	sizeGuardLimit   int
+	sizeGuardEnforce bool
+
+	purgeBlocked bool
+	purging      sync.Map // cid.Cid -> struct{}, the running purges
+
+	deleteGuard func(ctx context.Context, c cid.Cid) error // nil without WithDeleteGuard
+
+	shadow shadowReads
+	wants  wantSet
+
+	clock clock.Clock
+
+	gcLocker blockstore.GCLocker
+	pinner   func(context.Context, cid.Cid) error
+
+	multihashLookup bool
+
+	fallback            blockstore.Blockstore
+	copyUpOnFallbackHit bool
+	httpFallback        *httpfetch.Fetcher
+	httpFallbackDelay   time.Duration
+
+	fetchCache blockstore.Blockstore
+
+	skipInvalid bool
+	verifyOnAdd bool
+	readOnly    atomic.Bool
+
+	detailedTracing bool
+	traceSampling   int
+	retrievalDebug  bool
+
+	fetchCodecPolicy func(codec uint64) bool
+
+	fetchedBlockValidator func(blocks.Block) error
+
+	fetchSlots *semaphore.Weighted
+
+	progress   func(ProgressEvent)
+	progressLk sync.Mutex
+
+	maxBatchBlocks int
+	maxBatchBytes  int64
+	parallelPut    int
+
+	adaptiveMinBlocks int
+	adaptiveMaxBlocks int
+	adaptiveTarget    time.Duration
+	batchSizer        *batchSizer
+
+	maxBatchRequest int
+	maxMisses       int
+
+	fetchBuffer         int
+	fetchMemoryBudget   int64
+	fetchWindow         int
+	exchangeBaggage     []string
+	getAnyParallelism   int
+	eagerDelivery       bool
+	fetchLimiter        *rate.Limiter
+	auditSink           func(AuditEntry)
+	auditLog            *auditLog
+	maxFetchedBlockSize int
+
+	sessionRefsLimit int
+
+	notifyMaxDelay  time.Duration
+	notifyMaxBlocks int
+	notifier        *notifyCoalescer // nil without WithNotifyCoalescing
+	sessionFactory  SessionFactory
+
+	sessionIdleTimeout time.Duration
+	sessions           *sessionRegistry // nil without WithSessionTracking
+
+	blockErrorHandler func(cid.Cid, error)
+	strictPanics      bool
+
+	leakWarnAfter  time.Duration
+	leakAbortAfter time.Duration
+
+	localBudgetFraction float64
+
+	writes            writeRegistry
+	fetchedWriteCheck bool                          // set by WithFetchedWriteCheck
+	absentLocks       [absentLockStripes]sync.Mutex // serialize AddBlockIfAbsent without ConditionalPutter
+
+	recentCIDs *lru.Cache[cid.Cid, struct{}]
+
+	reprovideInterval time.Duration
+	lastProvided      *lru.Cache[cid.Cid, time.Time] // nil without WithReprovideOnRead
+
+	rejections rejectionTracker
+
+	timeouts OperationTimeouts
+
+	missRetryPasses int
+	unsolicitedWarn rate.Sometimes
+
+	notifyErrorHandler func(error, []cid.Cid)
+	notifyErrorLog     rate.Sometimes
+
+	putAttempts  int
+	putBackoff   time.Duration
+	putRetryable func(error) bool
+
+	promRegistry prometheus.Registerer
+	codecMetrics bool
+	metrics      *metrics
+
+	providers        []provider.Provider
+	provider         provider.Provider // set up by start from providers
+	provideTargets   []*provideTarget
+	provideOn        ProvideOn
+	provideFilter    func(cid.Cid) bool
+	provideLimiter   *rate.Limiter
+	providePolicy    ProvidePolicy
+	provideWorkers   int
+	provideQueueSize int
+	provideQueue     *provideQueue
+	provideDatastore ds.Datastore
+
+	provideBackoffFailures int
+	provideBackoffCooldown time.Duration
+
+	stats stats
+
+	// serviceCtx is canceled by Close to abort in-flight operations.
+	serviceCtx    context.Context
+	serviceCancel context.CancelFunc
+	closeTimeout  time.Duration
+	lifecycleLk   sync.Mutex
+	closed        bool
+	inflight      sync.WaitGroup
+
+	optionErrors []error
 }
 
 type Option func(*blockService)
@@ -93,14 +276,83 @@ func WriteThrough() Option {
 }
 
 // WithAllowlist sets a custom [verifcid.Allowlist] which will be used
+// unless [WithSecurityPolicy] is set.
 func WithAllowlist(allowlist verifcid.Allowlist) Option {
 	return func(bs *blockService) {
+		if allowlist == nil {
+			bs.invalidOption("WithAllowlist: nil allowlist")
+			return
+		}
 		bs.allowlist = allowlist
 	}
 }
 
+// Blocker returns err != nil if the CID is disallowed to be fetched or stored
+// in the blockservice. It returns an error so error messages can be passed.
+type Blocker func(cid.Cid) error
+
+// WithContentBlocker allows to filter what blocks can be fetched or added.
+// Each CID is passed to the blocker and if it returns an error, the block is
+// rejected with an error wrapping [ErrBlocked].
+// The blocker is called on every use, so it can change its answers at any
+// time: the blocks it rejects are also not given to NotifyNewBlocks nor
+// provided, even when they were stored or queued for providing before being
+// blocked. See [WithPurgeBlocked] to delete them.
+func WithContentBlocker(blocker Blocker) Option {
+	return func(bs *blockService) {
+		bs.blocker = blocker
+	}
+}
+
+// WithMaxBatchSize bounds the PutMany calls done by AddBlocks to at most
+// blocks blocks and bytes bytes, bigger inputs are split into multiple batches
+// which are written, notified and provided one after the other.
+// Zero means no limit, a batch always contains at least one block.
+func WithMaxBatchSize(blocks int, bytes int64) Option {
+	return func(bs *blockService) {
+		if blocks < 0 || bytes < 0 {
+			bs.invalidOption("WithMaxBatchSize: negative limit (%d blocks, %d bytes)", blocks, bytes)
+			return
+		}
+		bs.maxBatchBlocks = blocks
+		bs.maxBatchBytes = bytes
+	}
+}
+
 // New creates a BlockService with given datastore instance.
+// Invalid options are logged and replaced by their default, use
+// [NewWithOptions] to get an error instead.
 func New(bs blockstore.Blockstore, exchange exchange.Interface, opts ...Option) BlockService {
+	if bs == nil {
+		logger.Error("blockservice created with a nil blockstore")
+	}
+
+	service := newBlockService(bs, exchange, opts)
+	for _, err := range service.optionErrors {
+		logger.Errorf("invalid blockservice option: %s", err)
+	}
+	service.start()
+	return service
+}
+
+// NewWithOptions is like [New] but it returns an error if bs is nil or if
+// any of the options is invalid.
+func NewWithOptions(bs blockstore.Blockstore, exchange exchange.Interface, opts ...Option) (BlockService, error) {
+	if bs == nil {
+		return nil, errors.New("blockservice: nil blockstore")
+	}
+
+	service := newBlockService(bs, exchange, opts)
+	if len(service.optionErrors) != 0 {
+		return nil, fmt.Errorf("blockservice: invalid options: %w", errors.Join(service.optionErrors...))
+	}
+	service.start()
+	return service, nil
+}
+
+// newBlockService applies the options, it does not start anything so it can
+// be dropped if the options are invalid.
+func newBlockService(bs blockstore.Blockstore, exchange exchange.Interface, opts []Option) *blockService {
 	if exchange == nil {
 		logger.Debug("blockservice running in local (offline) mode.")
 	}
@@ -110,15 +362,65 @@ func New(bs blockstore.Blockstore, exchange exchange.Interface, opts ...Option)
 		blockstore: bs,
 		exchange:   exchange,
 		checkFirst: true,
+		provideOn:  ProvideOnAdd | ProvideOnFetch,
+		clock:      realClock,
+
+		unsolicitedWarn: rate.Sometimes{Interval: time.Minute},
+		notifyErrorLog:  rate.Sometimes{Interval: time.Minute},
+
+		maxFetchedBlockSize: DefaultMaxFetchedBlockSize,
+		closeTimeout:        defaultCloseTimeout,
+		sessionRefsLimit:    defaultSessionRefsLimit,
 	}
 
 	for _, opt := range opts {
 		opt(service)
 	}
-
 	return service
 }
 
+// start sets up the metrics and the background workers.
+func (s *blockService) start() {
+	s.serviceCtx, s.serviceCancel = context.WithCancel(context.Background())
+
+	if s.allowlist == InsecureAllowlist {
+		logger.Warn("blockservice running with InsecureAllowAllHashes: hash functions and digest lengths are NOT verified, never use this on a node fetching content from the network")
+	}
+
+	if s.promRegistry != nil {
+		s.metrics = newMetrics(s.promRegistry, s.codecMetrics)
+	}
+
+	if s.auditSink != nil {
+		s.auditLog = newAuditLog(s.auditSink)
+	}
+	if s.adaptiveMaxBlocks != 0 {
+		s.batchSizer = newBatchSizer(s.adaptiveMinBlocks, s.adaptiveMaxBlocks, s.adaptiveTarget)
+	}
+	s.startSessionTracking()
+	if s.notifyMaxBlocks != 0 && s.exchange != nil {
+		s.notifier = newNotifyCoalescer(s)
+	}
+	s.setupProviders()
+	if s.provideDatastore != nil && s.provideWorkers == 0 {
+		s.provideWorkers = 1
+		s.provideQueueSize = defaultProvideQueueSize
+	}
+	if s.needsProvideQueue() {
+		size := s.provideQueueSize
+		if s.provideWorkers == 0 {
+			size = defaultProvideQueueSize
+		}
+		s.provideQueue = newProvideQueue(s, s.provideWorkers, size)
+	}
+}
+
+// invalidOption records an error for an option which can't be applied, the
+// option must leave the default in place.
+func (s *blockService) invalidOption(format string, args ...any) {
+	s.optionErrors = append(s.optionErrors, fmt.Errorf(format, args...))
+}
+
 // Blockstore returns the blockstore behind this blockservice.
 func (s *blockService) Blockstore() blockstore.Blockstore {
 	return s.blockstore
@@ -130,7 +432,13 @@ func (s *blockService) Exchange() exchange.Interface {
 }
 
 func (s *blockService) Allowlist() verifcid.Allowlist {
-	return s.allowlist
+	if s.policy == nil {
+		return s.allowlist
+	}
+	if p, ok := s.policy.(interface{ Allowlist() verifcid.Allowlist }); ok {
+		return p.Allowlist()
+	}
+	return nil
 }
 
 // NewSession creates a new session that allows for
@@ -139,94 +447,305 @@ func (s *blockService) Allowlist() verifcid.Allowlist {
 // session will be created. Otherwise, the current exchange will be used
 // directly.
 // Sessions are lazily setup, this is cheap.
-func NewSession(ctx context.Context, bs BlockService) *Session {
-	ses := grabSessionFromContext(ctx, bs)
-	if ses != nil {
-		return ses
+// A session embedded in ctx is only reused when no options are given.
+func NewSession(ctx context.Context, bs BlockService, opts ...SessionOption) *Session {
+	if len(opts) == 0 {
+		if ses := grabSessionFromContext(ctx, bs); ses != nil {
+			return ses
+		}
 	}
 
-	return newSession(ctx, bs)
+	return newSession(ctx, bs, opts...)
 }
 
 // newSession is like [NewSession] but it does not attempt to reuse session from the existing context.
-func newSession(ctx context.Context, bs BlockService) *Session {
-	return &Session{bs: bs, sesctx: ctx}
+func newSession(ctx context.Context, bs BlockService, opts ...SessionOption) *Session {
+	ses := &Session{
+		bs:   bs,
+		refs: sessionRefs{limit: grabServiceFromBlockservice(bs).getSessionRefsLimit()},
+		id:   sessionIDs.Add(1),
+	}
+	ses.clock = grabServiceFromBlockservice(bs).getClock()
+	ses.lastUsed = ses.clock.Now()
+	for _, opt := range opts {
+		opt(ses)
+	}
+	if ses.keepAlive > 0 {
+		// the session outlives ctx, it is closed once idle instead
+		ctx = context.WithoutCancel(ctx)
+	}
+	ses.ctxDone = ctx.Done()
+	ses.sesctx, ses.cancel = context.WithCancel(ctx)
+	sessions := grabServiceFromBlockservice(bs).getSessions()
+	sessions.add(ses)
+	switch {
+	case sessions != nil || ses.keepAlive > 0:
+		context.AfterFunc(ses.sesctx, func() { ses.Close() })
+	case ses.memCache != nil:
+		// the cancellation releases the exchange session and the memory
+		// cache, the blocks stored locally are still served
+		context.AfterFunc(ses.sesctx, ses.memCache.close)
+	}
+	ses.startKeepAlive()
+	return ses
 }
 
 // AddBlock adds a particular block to the service, Putting it into the datastore.
 func (s *blockService) AddBlock(ctx context.Context, o blocks.Block) error {
 	ctx, span := internal.StartSpan(ctx, "blockService.AddBlock")
 	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return ErrReadOnly
+	}
 
-	c := o.Cid()
-	err := verifcid.ValidateCid(s.allowlist, c) // hash security
+	ctx, done, err := s.track(ctx)
 	if err != nil {
 		return err
 	}
-	if s.checkFirst {
-		if has, err := s.blockstore.Has(ctx, c); has || err != nil {
-			return err
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Add)
+	defer cancel()
+
+	p := s.startRootPin(ctx)
+	defer p.release()
+	_, announce, err := s.addBlock(ctx, writePathAdd, opAdd, p, o, s.checkFirst, s.putBlock)
+	s.announceAdded(ctx, writePathAdd, announce...)
+	return err
+}
+
+// addBlock adds b through the write path wp, op is the operation reported for
+// the rejections. put writes b and reports whether it stored it, if check is
+// true b is looked up in the blockstore first as with checkFirst. It reports
+// whether b was stored and returns the blocks to announce, see
+// [storedWrites], even when pinning b failed.
+func (s *blockService) addBlock(ctx context.Context, wp writePath, op string, p *rootPin, b blocks.Block, check bool, put func(context.Context, blocks.Block) (bool, error)) (stored bool, announce []blocks.Block, err error) {
+	c := b.Cid()
+	if err := s.validateBlockFor(op, b); err != nil {
+		return false, nil, err
+	}
+	if err := s.checkServableSize(b); err != nil {
+		return false, nil, err
+	}
+	s.countOffered(wp, b)
+	w, err := s.claimWrite(ctx, c, check)
+	if err != nil {
+		return false, nil, err
+	}
+	defer w.release()
+	if check {
+		has := s.recentlyStored(c)
+		if !has {
+			has, err = s.blockstore.Has(ctx, c)
+			if err != nil {
+				return false, nil, err
+			}
+		}
+		w.lookedUp()
+		if has {
+			w.stored()
+			return false, nil, p.pin(ctx, b)
 		}
 	}
 
-	if err := s.blockstore.Put(ctx, o); err != nil {
-		return err
+	refund, err := reserveQuota(ctx, b)
+	if err != nil {
+		return false, nil, err
 	}
-
-	logger.Debugf("BlockService.BlockAdded %s", c)
-
-	if s.exchange != nil {
-		if err := s.exchange.NotifyNewBlocks(ctx, o); err != nil {
-			logger.Errorf("NotifyNewBlocks: %s", err.Error())
-		}
+	stored, err = put(ctx, b)
+	if err != nil || !stored {
+		refund()
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	if !stored {
+		w.stored()
+		return false, nil, p.pin(ctx, b)
 	}
+	s.countWritten(wp, b)
+	s.audit(ctx, AuditAdd, b)
+	s.markStored(c)
+	pinErr := p.pin(ctx, b)
+
+	logBlock("BlockService.BlockAdded", b)
+	s.observeBlockSize(directionAdded, b)
+	return true, s.storedWrites(ctx, wp, []blocks.Block{b}, []*writeClaim{w}), pinErr
+}
 
-	return nil
+// putBlock writes b to the blockstore, it is the put of [addBlock] for
+// AddBlock.
+func (s *blockService) putBlock(ctx context.Context, b blocks.Block) (bool, error) {
+	if err := s.retryPut(ctx, func() error { return s.blockstore.Put(ctx, b) }); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (s *blockService) AddBlocks(ctx context.Context, bs []blocks.Block) error {
 	ctx, span := internal.StartSpan(ctx, "blockService.AddBlocks")
 	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Add)
+	defer cancel()
+
+	mismatches, err := s.verifyBlocks(ctx, bs)
+	if err != nil {
+		return err
+	}
 
 	// hash security
-	for _, b := range bs {
-		err := verifcid.ValidateCid(s.allowlist, b.Cid())
-		if err != nil {
+	var skipped map[cid.Cid]error
+	for i, b := range bs {
+		// this is ValidateBlock with the hashes verified in parallel
+		err := s.validateCidFor(opAddMany, b.Cid())
+		if err == nil {
+			err = s.checkPolicyBlock(b)
+		}
+		if err == nil && mismatches != nil {
+			err = mismatches[i]
+		}
+		if err == nil {
+			err = s.checkServableSize(b)
+		}
+		if err == nil {
+			continue
+		}
+		if !s.skipInvalid {
 			return err
 		}
+		if skipped == nil {
+			skipped = make(map[cid.Cid]error)
+		}
+		skipped[b.Cid()] = err
+	}
+	if skipped != nil {
+		// don't clobber the caller's slice
+		valid := make([]blocks.Block, 0, len(bs)-len(skipped))
+		for _, b := range bs {
+			if _, ok := skipped[b.Cid()]; !ok {
+				valid = append(valid, b)
+			}
+		}
+		bs = valid
 	}
-	var toput []blocks.Block
+	s.countOffered(writePathAddBatch, bs...)
+	p := s.startRootPin(ctx)
+	defer p.release()
+	toput := bs
 	if s.checkFirst {
 		toput = make([]blocks.Block, 0, len(bs))
 		for _, b := range bs {
-			has, err := s.blockstore.Has(ctx, b.Cid())
-			if err != nil {
-				return err
-			}
-			if !has {
+			if !s.recentlyStored(b.Cid()) {
 				toput = append(toput, b)
 			}
 		}
-	} else {
-		toput = bs
 	}
+	// the blocks are looked up once their writes are claimed, so a concurrent
+	// write of the same block is either seen stored or announces it
+	toput, claims, release, err := s.claimWrites(ctx, toput, s.checkFirst)
+	if err != nil {
+		return err
+	}
+	defer release()
+	progress := s.newProgressReporter()
+	progress.duplicates(len(bs) - len(toput))
+
+	var written int
+	if s.parallelPut > 1 && len(toput) > 1 {
+		var unwritten []cid.Cid
+		written, unwritten, err = s.putShards(ctx, toput, claims, progress)
+		if err != nil {
+			if written != 0 {
+				return &PartialWriteError{Written: written, Unwritten: unwritten, Err: err}
+			}
+			return err
+		}
+		toput = nil
+	}
+	for len(toput) != 0 {
+		if written != 0 {
+			if err := ctx.Err(); err != nil {
+				return &PartialWriteError{Written: written, Unwritten: blockCids(toput), Err: err}
+			}
+		}
 
-	if len(toput) == 0 {
-		return nil
+		n := s.nextBatchLen(toput)
+		if err := s.putBatch(ctx, toput[:n], claims[:n]); err != nil {
+			if written != 0 {
+				return &PartialWriteError{Written: written, Unwritten: blockCids(toput), Err: err}
+			}
+			return err
+		}
+		written += n
+		progress.written(toput[:n])
+		toput, claims = toput[n:], claims[n:]
+	}
+	progress.done()
+	if err := p.pin(ctx, bs...); err != nil {
+		return err
 	}
+	if skipped != nil {
+		return &SkippedBlocksError{Skipped: skipped, Written: written}
+	}
+	return nil
+}
 
-	err := s.blockstore.PutMany(ctx, toput)
+// putBatch writes bs, claimed by [claimWrites], to the blockstore with a
+// single PutMany, then notifies and provides the ones [storedWrites] returns.
+func (s *blockService) putBatch(ctx context.Context, bs []blocks.Block, claims []*writeClaim) error {
+	refund, err := reserveQuota(ctx, bs...)
 	if err != nil {
 		return err
 	}
+	start := s.clock.Now()
+	err = s.retryPut(ctx, func() error { return s.blockstore.PutMany(ctx, bs) })
+	if err != nil {
+		refund()
+		return err
+	}
+	s.batchSizer.observe(len(bs), s.clock.Since(start))
+	s.countWritten(writePathAddBatch, bs...)
+	s.audit(ctx, AuditAdd, bs...)
+	s.added(ctx, bs, s.storedWrites(ctx, writePathAddBatch, bs, claims))
+	return nil
+}
+
+// added records the blocks of bs as stored, then notifies the exchange of the
+// blocks of announce and provides them.
+func (s *blockService) added(ctx context.Context, bs, announce []blocks.Block) {
+	for _, b := range bs {
+		s.markStored(b.Cid())
+		s.observeBlockSize(directionAdded, b)
+		logBlock("BlockService.BlockAdded", b)
+	}
+	s.announceAdded(ctx, writePathAddBatch, announce...)
+}
 
+// announceAdded notifies the exchange of the blocks of bs added through the
+// write path wp and provides them.
+func (s *blockService) announceAdded(ctx context.Context, wp writePath, bs ...blocks.Block) {
+	if len(bs) == 0 {
+		return
+	}
 	if s.exchange != nil {
-		logger.Debugf("BlockService.BlockAdded %d blocks", len(toput))
-		if err := s.exchange.NotifyNewBlocks(ctx, toput...); err != nil {
-			logger.Errorf("NotifyNewBlocks: %s", err.Error())
-		}
+		// failures are counted and logged by notifyNewBlocks
+		_ = s.notifyNewBlocks(ctx, wp, s.exchange, bs...)
+	}
+	for _, b := range bs {
+		s.provide(ctx, ProvideOnAdd, b.Cid())
 	}
-	return nil
 }
 
 // GetBlock retrieves a particular block from the service,
@@ -236,10 +755,13 @@ func (s *blockService) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, e
 		return ses.GetBlock(ctx, c)
 	}
 
-	ctx, span := internal.StartSpan(ctx, "blockService.GetBlock", trace.WithAttributes(attribute.Stringer("CID", c)))
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlock", trace.WithAttributes(attribute.Stringer("CID", c), codecAttribute(c)))
 	defer span.End()
+	s.tagSpan(ctx, span)
 
-	return getBlock(ctx, c, s, s.getExchangeFetcher)
+	blk, err := getBlock(ctx, c, s, nil, s.getExchangeFetcher)
+	recordBlockSize(span, blk)
+	return blk, err
 }
 
 // Look at what I have to do, no interface covariance :'(
@@ -247,53 +769,152 @@ func (s *blockService) getExchangeFetcher() exchange.Fetcher {
 	return s.exchange
 }
 
-func getBlock(ctx context.Context, c cid.Cid, bs BlockService, fetchFactory func() exchange.Fetcher) (blocks.Block, error) {
-	err := verifcid.ValidateCid(grabAllowlistFromBlockservice(bs), c) // hash security
+func getBlock(ctx context.Context, c cid.Cid, bs BlockService, ses *Session, fetchFactory func() exchange.Fetcher) (blocks.Block, error) {
+	releaseSession, err := ses.use()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSession()
+	if err := validateSessionCid(bs, ses, opGet, c); err != nil {
+		return nil, err
+	}
+	service := grabServiceFromBlockservice(bs)
+	mem := sessionMemoryCache(ses)
+
+	ctx, done, err := service.track(ctx)
 	if err != nil {
 		return nil, err
 	}
+	defer done()
+	ctx, cancel := service.withTimeout(ctx, service.getTimeout())
+	defer cancel()
+
+	if blk, ok := mem.get(c); ok {
+		return blk, nil
+	}
 
 	blockstore := bs.Blockstore()
 
 	block, err := blockstore.Get(ctx, c)
+	if err == nil {
+		// a corrupt copy is deleted and handled like a missing block
+		err = service.checkLocalRead(ctx, blockstore, block)
+		if err == nil {
+			service.markStored(c)
+			service.shadowRead(block)
+			service.reprovideOnRead(ctx, c)
+			return block, nil
+		}
+	}
 	switch {
-	case err == nil:
-		return block, nil
-	case ipld.IsNotFound(err):
-		break
+	case ipld.IsNotFound(err), errors.Is(err, ErrCorruptBlock{}):
 	default:
 		return nil, err
 	}
 
-	fetch := fetchFactory() // lazily create session if needed
+	if blk, ok := service.getFromFetchCache(ctx, c); ok {
+		return blk, nil
+	}
+	if blk, ok := service.getByMultihash(ctx, c); ok {
+		return blk, nil
+	}
+	if blk, ok := service.getFromFallback(ctx, c); ok {
+		return blk, nil
+	}
+
+	if isOffline(ctx) {
+		logger.Debug("BlockService GetBlock: Not found (offline)")
+		return nil, err
+	}
+	if err := service.checkFetchAllowed(c); err != nil {
+		return nil, err
+	}
+	fetch := service.withHTTPFallback(fetchFactory()) // lazily create session if needed
 	if fetch == nil {
 		logger.Debug("BlockService GetBlock: Not found")
 		return nil, err
 	}
 
 	logger.Debug("BlockService: Searching")
-	blk, err := fetch.GetBlock(ctx, c)
+	releaseFetch, err := service.acquireFetch(ctx)
 	if err != nil {
 		return nil, err
 	}
+	fetchCtx, fetchSpan := service.startDetailedSpan(service.exchangeContext(ctx), "getBlock.fetch", attribute.Bool("session", usedSession(ctx)))
+	wanted := service.want(ses, c)
+	blk, err := fetch.GetBlock(fetchCtx, c)
+	wanted.done()
+	endFetchSpan(fetchSpan, blk, err)
+	releaseFetch()
+	if err != nil {
+		return nil, err
+	}
+	if !blk.Cid().Equals(c) {
+		service.dropUnsolicited(blk.Cid())
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	if err := service.checkFetched(blk); err != nil {
+		return nil, err
+	}
+	if err := service.throttleFetch(ctx, blk); err != nil {
+		return nil, err
+	}
+	service.countOffered(writePathFetchCache, blk)
+	if mem != nil {
+		// kept in memory only, the blockstore is left untouched
+		mem.add(blk)
+		return blk, nil
+	}
+	if service.isReadOnly() {
+		return blk, nil
+	}
 	// also write in the blockstore for caching, inform the exchange that the block is available
-	err = blockstore.Put(ctx, blk)
+	store := service.fetchStore(bs)
+	w, announce, err := service.claimFetchedWrite(ctx, store, c)
 	if err != nil {
 		return nil, err
 	}
-	if ex := bs.Exchange(); ex != nil {
-		err = ex.NotifyNewBlocks(ctx, blk)
-		if err != nil {
-			return nil, err
+	defer w.release()
+	writeCtx, writeSpan := service.startDetailedSpan(ctx, "getBlock.cacheWrite", attribute.Int("bytes", len(blk.RawData())))
+	err = service.retryPut(writeCtx, func() error { return store.Put(writeCtx, blk) })
+	endSpan(writeSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	service.countWritten(writePathFetchCache, blk)
+	service.audit(ctx, AuditFetchCache, blk)
+	service.markFetchStored(c)
+	service.observeBlockSize(directionFetched, blk)
+	announceFetched := func(ctx context.Context) error {
+		if ex := bs.Exchange(); ex != nil {
+			if err := service.notifyNewBlocks(ctx, writePathFetchCache, ex, blk); err != nil {
+				return err
+			}
+		}
+		if ses.providesFetched() {
+			service.provide(ctx, ProvideOnFetch, blk.Cid())
 		}
+		return nil
 	}
-	logger.Debugf("BlockService.BlockFetched %s", c)
+	w.stored()
+	if !w.first {
+		announce = w.handOff(ctx, func(ctx context.Context) { _ = announceFetched(ctx) })
+	}
+	if !announce {
+		return blk, nil
+	}
+	if err := announceFetched(ctx); err != nil {
+		return nil, err
+	}
+	logBlock("BlockService.BlockFetched", blk)
 	return blk, nil
 }
 
 // GetBlocks gets a list of blocks asynchronously and returns through
 // the returned channel.
 // NB: No guarantees are made about order.
+// The channel is closed promptly once ctx is canceled, the blocks being
+// written to the blockstore at that time are written in the background.
 func (s *blockService) GetBlocks(ctx context.Context, ks []cid.Cid) <-chan blocks.Block {
 	if ses := grabSessionFromContext(ctx, s); ses != nil {
 		return ses.GetBlocks(ctx, ks)
@@ -301,36 +922,94 @@ func (s *blockService) GetBlocks(ctx context.Context, ks []cid.Cid) <-chan block
 
 	ctx, span := internal.StartSpan(ctx, "blockService.GetBlocks")
 	defer span.End()
+	s.tagSpan(ctx, span)
 
-	return getBlocks(ctx, ks, s, s.getExchangeFetcher)
+	return getBlocks(ctx, ks, s, nil, s.getExchangeFetcher)
 }
 
-func getBlocks(ctx context.Context, ks []cid.Cid, blockservice BlockService, fetchFactory func() exchange.Fetcher) <-chan blocks.Block {
-	out := make(chan blocks.Block)
+func getBlocks(ctx context.Context, ks []cid.Cid, blockservice BlockService, ses *Session, fetchFactory func() exchange.Fetcher) <-chan blocks.Block {
+	service := grabServiceFromBlockservice(blockservice)
+	if err := service.checkBatchRequest(len(ks)); err != nil {
+		logger.Debugf("BlockService GetBlocks: %s", err)
+		service.rejectBatch(ks, err)
+		ses.failedAll(ks, err)
+		out := make(chan blocks.Block)
+		close(out)
+		return out
+	}
+	releaseSession, err := ses.use()
+	if err != nil {
+		service.rejectBatch(ks, err)
+		ses.failedAll(ks, err)
+		out := make(chan blocks.Block)
+		close(out)
+		return out
+	}
+	mem := sessionMemoryCache(ses)
+	dbg := service.getRetrievalRecorder(ctx)
+	tracker := service.newBlockErrorTracker(ks, ses.failureRecorder())
+	ctx, done, err := service.track(ctx)
+	if err != nil {
+		logger.Debugf("BlockService GetBlocks: %s", err)
+		releaseSession()
+		tracker.finish(ctx, err)
+		out := make(chan blocks.Block)
+		close(out)
+		return out
+	}
+	ctx, cancel := service.withTimeout(ctx, service.getManyTimeout())
+	budget := service.newPhaseBudget(ctx, trace.SpanFromContext(ctx))
+	ctx, leaks := service.newLeakWatch(ctx)
+	out := newBlockOutput(ctx, tracker)
+	out.leaks = leaks
+	out.codecs = newCodecSummary(ctx)
+	// the span of the caller ends once this returns
+	sampler := service.newBlockSampler(ctx, ks)
 
 	go func() {
-		defer close(out)
+		defer releaseSession()
+		defer done()
+		defer cancel()
+		defer out.close()
+		var abortErr error
+		defer func() { tracker.finish(ctx, abortErr) }()
+		defer func() {
+			if r := recover(); r != nil {
+				// report the panic for the blocks not returned
+				abortErr = service.recovered("GetBlocks", r)
+				service.repanic(r)
+			}
+		}()
+		defer sampler.end()
+
+		validate := func(c cid.Cid) error {
+			return validateSessionCid(blockservice, ses, opGetMany, c)
+		}
 
-		allowlist := grabAllowlistFromBlockservice(blockservice)
+		reject := func(c cid.Cid, err error) {
+			logger.Errorf("rejected CID (%s) passed to blockService.GetBlocks: %s", c, err)
+			tracker.fail(c, err)
+		}
 
 		var lastAllValidIndex int
 		var c cid.Cid
+		var firstErr error
 		for lastAllValidIndex, c = range ks {
-			if err := verifcid.ValidateCid(allowlist, c); err != nil {
+			if firstErr = validate(c); firstErr != nil {
 				break
 			}
 		}
 
-		if lastAllValidIndex != len(ks) {
+		if firstErr != nil {
 			// can't shift in place because we don't want to clobber callers.
 			ks2 := make([]cid.Cid, lastAllValidIndex, len(ks))
-			copy(ks2, ks[:lastAllValidIndex])          // fast path for already filtered elements
-			for _, c := range ks[lastAllValidIndex:] { // don't rescan already scanned elements
-				// hash security
-				if err := verifcid.ValidateCid(allowlist, c); err == nil {
+			copy(ks2, ks[:lastAllValidIndex]) // fast path for already filtered elements
+			reject(ks[lastAllValidIndex], firstErr)
+			for _, c := range ks[lastAllValidIndex+1:] { // don't rescan already scanned elements
+				if err := validate(c); err == nil {
 					ks2 = append(ks2, c)
 				} else {
-					logger.Errorf("unsafe CID (%s) passed to blockService.GetBlocks: %s", c, err)
+					reject(c, err)
 				}
 			}
 			ks = ks2
@@ -339,86 +1018,341 @@ func getBlocks(ctx context.Context, ks []cid.Cid, blockservice BlockService, fet
 		bs := blockservice.Blockstore()
 
 		var misses []cid.Cid
-		for _, c := range ks {
-			hit, err := bs.Get(ctx, c)
-			if err != nil {
+		var corrupt []error
+		localCtx, stopLocal := budget.localContext(ctx, service)
+		defer stopLocal()
+		for i, c := range ks {
+			start := dbg.now()
+			sampleStart := sampler.lookup(c)
+			hit, source, err := service.getLocal(localCtx, bs, mem, c)
+			dbg.local(c, source, start)
+			sampler.local(c, source, sampleStart)
+			if hit == nil {
+				if budget.lookupCut(ctx, localCtx) {
+					// leave the lookups left to the exchange
+					misses = append(misses, ks[i:]...)
+					break
+				}
+				if err != nil {
+					corrupt = append(corrupt, err)
+				}
 				misses = append(misses, c)
 				continue
 			}
-			select {
-			case out <- hit:
-			case <-ctx.Done():
+			if !out.send(hit) {
 				return
 			}
 		}
+		// the corrupt blocks which won't be fetched again
+		failCorrupt := func() {
+			for _, err := range corrupt {
+				tracker.fail(err.(ErrCorruptBlock).Cid, err)
+			}
+		}
 
-		fetch := fetchFactory() // don't load exchange unless we have to
-		if len(misses) == 0 || fetch == nil {
+		if len(misses) == 0 || isOffline(ctx) {
+			failCorrupt()
+			return
+		}
+		// misses is owned by this goroutine, it can be filtered in place
+		misses = service.filterFetchAllowed(misses, tracker)
+		misses = service.limitMisses(misses, tracker)
+		if len(misses) == 0 {
+			return
+		}
+		fetch := service.withHTTPFallback(fetchFactory()) // don't load exchange unless we have to
+		if fetch == nil {
+			failCorrupt()
 			return
 		}
 
-		rblocks, err := fetch.GetBlocks(ctx, misses)
+		releaseFetch, err := service.acquireFetch(ctx)
+		if err != nil {
+			abortErr = err
+			return
+		}
+		defer releaseFetch()
+
+		fetchCtx, fetchSpan := service.startDetailedSpan(service.exchangeContext(ctx), "getBlocks.fetch",
+			attribute.Bool("session", usedSession(ctx)),
+			attribute.Int("requested", len(misses)),
+		)
+		batch := fetchBatch{span: fetchSpan, requested: len(misses)}
+		defer func() {
+			budget.record(ctx, fetchSpan)
+			batch.end(ctx, abortErr)
+		}()
+
+		dbg.fetchStarted()
+		sampler.fetchStarted()
+		// the misses are recorded as wanted as they are handed to the exchange
+		wanted := service.want(ses)
+		defer wanted.done()
+		requested := newRequestedBlocks(misses)
+		retry := service.newMissRetry(requested)
+		// startFetch requests ks from the exchange, again for the passes of
+		// WithMissRetry
+		startFetch := func(ks []cid.Cid) (<-chan blocks.Block, *fetchWindow, error) {
+			rblocks, window, err := service.windowedGetBlocks(fetchCtx, fetch, ks, wanted)
+			if err != nil {
+				return nil, nil, err
+			}
+			rblocks = service.validateFetchedBlocks(ctx, rblocks, func(c cid.Cid, err error) {
+				if !requested.receive(c) {
+					service.dropUnsolicited(c)
+					return
+				}
+				wanted.received(c)
+				window.consumed(c)
+				tracker.fail(c, err)
+			})
+			return rblocks, window, nil
+		}
+		rblocks, window, err := startFetch(misses)
 		if err != nil {
 			logger.Debugf("Error with GetBlocks: %s", err)
+			abortErr = err
 			return
 		}
 
+		buf := service.newDeliveryBuffer(ctx, dbg, out.send)
+		defer buf.close()
+
 		ex := blockservice.Exchange()
+		store := service.fetchStore(blockservice)
 		var cache [1]blocks.Block // preallocate once for all iterations
+		// cacheFetched writes b in the blockstore for caching, then announces
+		// and provides it, fail is called for the blocks which can't be
+		// written.
+		cacheFetched := func(ctx context.Context, b blocks.Block, fail func(cid.Cid, error)) error {
+			w, announce, err := service.claimFetchedWrite(ctx, store, b.Cid())
+			if err != nil {
+				fail(b.Cid(), err)
+				return err
+			}
+			defer w.release()
+			writeStart := batch.startWrite()
+			err = service.retryPut(ctx, func() error { return store.Put(ctx, b) })
+			batch.wrote(writeStart)
+			dbg.fetched(b, err)
+			sampler.fetched(b, err)
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Errorf("could not write blocks from the network to the blockstore: %s", err)
+				}
+				fail(b.Cid(), err)
+				return err
+			}
+			service.countWritten(writePathFetchCache, b)
+			service.audit(ctx, AuditFetchCache, b)
+			service.markFetchStored(b.Cid())
+			service.observeBlockSize(directionFetched, b)
+			logBlock("BlockService.BlockFetched", b)
+
+			w.stored()
+			if !w.first {
+				announce = w.handOff(ctx, func(ctx context.Context) {
+					if ex != nil {
+						_ = service.notifyNewBlocks(ctx, writePathFetchCache, ex, b)
+					}
+					if ses.providesFetched() {
+						service.provide(ctx, ProvideOnFetch, b.Cid())
+					}
+				})
+			}
+			if ex != nil && announce {
+				// inform the exchange that the blocks are available
+				cache[0] = b
+				err = service.notifyNewBlocks(ctx, writePathFetchCache, ex, cache[:]...)
+				cache[0] = nil // early gc
+				if err != nil {
+					return err
+				}
+			}
+			if announce && ses.providesFetched() {
+				service.provide(ctx, ProvideOnFetch, b.Cid())
+			}
+			return nil
+		}
+		bookkeepingCtx, stopBookkeeping := service.bookkeepingContext(ctx)
+		defer stopBookkeeping()
 		for {
 			var b blocks.Block
+			waitStart := service.getClock().Now()
 			select {
 			case v, ok := <-rblocks:
 				if !ok {
-					return
+					remaining := service.nextMissRetry(ctx, retry)
+					if len(remaining) == 0 {
+						return
+					}
+					rblocks, window, err = startFetch(remaining)
+					if err != nil {
+						logger.Debugf("Error with GetBlocks: %s", err)
+						abortErr = err
+						return
+					}
+					continue
 				}
 				b = v
 			case <-ctx.Done():
 				return
 			}
-
-			// write in the blockstore for caching
-			err = bs.Put(ctx, b)
-			if err != nil {
-				logger.Errorf("could not write blocks from the network to the blockstore: %s", err)
+			if !requested.receive(b.Cid()) {
+				service.dropUnsolicited(b.Cid())
+				continue
+			}
+			exchangeWait := service.getClock().Since(waitStart)
+			service.exchangeWaited(exchangeWait)
+			dbg.exchangeWaited(b.Cid(), exchangeWait)
+			batch.received(b)
+			sampler.received(b)
+			wanted.received(b.Cid())
+			if err := service.throttleFetch(ctx, b); err != nil {
 				return
 			}
+			if err := service.checkFetchedSize(b); err != nil {
+				logger.Error(err)
+				tracker.fail(b.Cid(), err)
+				window.consumed(b.Cid())
+				continue
+			}
+			service.countOffered(writePathFetchCache, b)
+			if mem != nil || service.isReadOnly() {
+				mem.add(b)
+				dbg.fetched(b, nil)
+				sampler.fetched(b, nil)
+				if !buf.push(b, window) {
+					return
+				}
+				continue
+			}
 
-			if ex != nil {
-				// inform the exchange that the blocks are available
-				cache[0] = b
-				err = ex.NotifyNewBlocks(ctx, cache[:]...)
-				if err != nil {
-					logger.Errorf("could not tell the exchange about new blocks: %s", err)
+			if service.eagerDeliveryEnabled() {
+				if !buf.push(b, window) {
 					return
 				}
-				cache[0] = nil // early gc
+				// the block is out, the caching must not be lost to the
+				// cancellation of the caller
+				if err := cacheFetched(bookkeepingCtx, b, func(cid.Cid, error) {}); err != nil {
+					service.stats.deferredCacheFailures.Add(1)
+					if bookkeepingCtx.Err() != nil {
+						return
+					}
+				}
+				continue
 			}
 
-			select {
-			case out <- b:
-			case <-ctx.Done():
+			if err := cacheFetched(ctx, b, tracker.fail); err != nil {
+				abortErr = err
+				return
+			}
+			if !buf.push(b, window) {
 				return
 			}
 		}
 	}()
-	return out
+	return out.ch
 }
 
-// DeleteBlock deletes a block in the blockservice from the datastore
-func (s *blockService) DeleteBlock(ctx context.Context, c cid.Cid) error {
-	ctx, span := internal.StartSpan(ctx, "blockService.DeleteBlock", trace.WithAttributes(attribute.Stringer("CID", c)))
+// getLocal looks c up in the memory cache of the session, the blockstore, the
+// fetch cache and the fallback blockstore. It returns a nil block if none of
+// them has it, and an [ErrCorruptBlock] if the blockstore had a corrupt copy.
+func (s *blockService) getLocal(ctx context.Context, bs blockstore.Blockstore, mem *memoryCache, c cid.Cid) (blocks.Block, RetrievalSource, error) {
+	if blk, ok := mem.get(c); ok {
+		return blk, SourceMemory, nil
+	}
+	var corrupt error
+	if blk, err := bs.Get(ctx, c); err == nil {
+		if corrupt = s.checkLocalRead(ctx, bs, blk); corrupt == nil {
+			s.markStored(c)
+			s.shadowRead(blk)
+			s.reprovideOnRead(ctx, c)
+			return blk, SourceBlockstore, nil
+		}
+	}
+	if blk, ok := s.getFromFetchCache(ctx, c); ok {
+		return blk, SourceFetchCache, nil
+	}
+	if blk, ok := s.getByMultihash(ctx, c); ok {
+		return blk, SourceMultihash, nil
+	}
+	if blk, ok := s.getFromFallback(ctx, c); ok {
+		return blk, SourceFallback, nil
+	}
+	return nil, "", corrupt
+}
+
+// GetSize returns the size of the block for the given CID, fetching it
+// through the exchange if it is not stored locally.
+func (s *blockService) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.GetSize", trace.WithAttributes(attribute.Stringer("CID", c)))
 	defer span.End()
+	s.tagSpan(ctx, span)
 
-	err := s.blockstore.DeleteBlock(ctx, c)
-	if err == nil {
-		logger.Debugf("BlockService.BlockDeleted %s", c)
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return 0, err
 	}
-	return err
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Get)
+	defer cancel()
+
+	if err := s.validateCidFor(opGet, c); err != nil {
+		return 0, err
+	}
+
+	size, err := s.blockstore.GetSize(ctx, c)
+	if err == nil || !ipld.IsNotFound(err) {
+		return size, err
+	}
+	if size, ok := s.getSizeOffBlockstore(ctx, c); ok {
+		return size, nil
+	}
+
+	blk, err := s.GetBlock(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return len(blk.RawData()), nil
 }
 
+// DeleteBlock deletes a block in the blockservice from the datastore, and from
+// the fetch cache of [WithFetchCacheBlockstore].
+func (s *blockService) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	return s.DeleteBlockFrom(ctx, c, AllStores)
+}
+
+// Close cancels the in-flight operations and waits for them to return, then
+// flushes the pending work and closes the exchange. Operations started after
+// Close fail with [ErrServiceClosed].
 func (s *blockService) Close() error {
+	s.lifecycleLk.Lock()
+	if s.closed {
+		s.lifecycleLk.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lifecycleLk.Unlock()
+
 	logger.Debug("blockservice is shutting down...")
+	ctx, cancel := s.clock.WithTimeout(context.Background(), s.closeTimeout)
+	defer cancel()
+
+	s.serviceCancel()
+	if err := s.waitInflight(ctx); err != nil {
+		logger.Warnf("in-flight operations did not finish before closing: %s", err)
+	}
+
+	err := s.Sync(ctx)
+	if err != nil && !errors.Is(err, ErrSyncUnsupported) {
+		logger.Errorf("failed to flush the blockservice on close: %s", err)
+	}
+	s.notifier.close(ctx)
+	if s.provideQueue != nil {
+		s.provideQueue.close(ctx)
+	}
+	s.auditLog.close()
 	if s.exchange == nil {
 		return nil
 	}
@@ -431,11 +1365,36 @@ type Session struct {
 	bs            BlockService
 	ses           exchange.Fetcher
 	sesctx        context.Context
+	cancel        context.CancelFunc
+	wants         sessionWants
+	refs          sessionRefs
+	errors        sessionErrors
+	allowlist     verifcid.Allowlist // nil unless SessionAllowlist is used
+	memCache      *memoryCache       // nil unless SessionMemoryCache is used
+	noProvide     bool               // set by SessionNoProvide
+	strictContext bool               // set by SessionStrictContext
+	ctxDone       <-chan struct{}    // of the context of NewSession
+
+	// id and span identify the session in traces, see linkSpan.
+	id       uint64
+	spanOnce sync.Once
+	span     trace.Span
+
+	// use tracking for Close and WithSessionTracking
+	useLk    sync.Mutex
+	closed   bool
+	active   int
+	lastUsed time.Time
+
+	keepAlive      time.Duration // 0 unless SessionWithKeepAlive is used
+	keepAliveTimer *clock.Timer
+	clock          clock.Clock
 }
 
 // grabSession is used to lazily create sessions.
 func (s *Session) grabSession() exchange.Fetcher {
 	s.createSession.Do(func() {
+		s.startSessionSpan()
 		defer func() {
 			s.sesctx = nil // early gc
 		}()
@@ -446,6 +1405,18 @@ func (s *Session) grabSession() exchange.Fetcher {
 		}
 		s.ses = ex // always fallback to non session fetches
 
+		if err := s.sesctx.Err(); err != nil {
+			// some exchanges fail every call or panic on a done context
+			logger.Debugf("session %d: context done before first use (%s), fetching without exchange session", s.id, err)
+			return
+		}
+		if factory := grabServiceFromBlockservice(s.bs).getSessionFactory(); factory != nil {
+			if ses := factory(s.sesctx, ex); ses != nil {
+				s.ses = ses
+			}
+			return
+		}
+
 		sesEx, ok := ex.(exchange.SessionExchange)
 		if !ok {
 			return
@@ -458,18 +1429,35 @@ func (s *Session) grabSession() exchange.Fetcher {
 
 // GetBlock gets a block in the context of a request session
 func (s *Session) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
-	ctx, span := internal.StartSpan(ctx, "Session.GetBlock", trace.WithAttributes(attribute.Stringer("CID", c)))
+	ctx, span := internal.StartSpan(ctx, "Session.GetBlock", trace.WithAttributes(attribute.Stringer("CID", c), codecAttribute(c)))
 	defer span.End()
+	grabServiceFromBlockservice(s.bs).tagSpan(ctx, span)
+	s.linkSpan(span)
+	ctx = s.markSessionFetch(ctx)
 
-	return getBlock(ctx, c, s.bs, s.grabSession)
+	s.refs.addRequested(c)
+	blk, err := getBlock(ctx, c, s.bs, s, s.grabSession)
+	if err != nil {
+		s.errors.failed(c, err)
+		return nil, err
+	}
+	s.errors.retrieved(c)
+	recordBlockSize(span, blk)
+	s.refs.addReceived(blk.Cid())
+	return blk, nil
 }
 
 // GetBlocks gets blocks in the context of a request session
 func (s *Session) GetBlocks(ctx context.Context, ks []cid.Cid) <-chan blocks.Block {
 	ctx, span := internal.StartSpan(ctx, "Session.GetBlocks")
 	defer span.End()
+	grabServiceFromBlockservice(s.bs).tagSpan(ctx, span)
+	s.linkSpan(span)
+	ctx = s.markSessionFetch(ctx)
 
-	return getBlocks(ctx, ks, s.bs, s.grabSession)
+	s.refs.addRequested(ks...)
+	s.wants.add(ks)
+	return s.filterCanceled(ctx, ks, getBlocks(ctx, ks, s.bs, s, s.grabSession))
 }
 
 var _ BlockGetter = (*Session)(nil)
@@ -511,10 +1499,83 @@ func grabSessionFromContext(ctx context.Context, bs BlockService) *Session {
 	return ss
 }
 
-// grabAllowlistFromBlockservice never returns nil
+// checkBlocker returns an error wrapping [ErrBlocked] if the content blocker
+// rejects c.
+func (s *blockService) checkBlocker(c cid.Cid) error {
+	err := s.blockerErr(c)
+	if err != nil {
+		s.purge(c)
+	}
+	return err
+}
+
+// blockerErr is checkBlocker without purging c.
+func (s *blockService) blockerErr(c cid.Cid) error {
+	if s == nil || s.blocker == nil {
+		return nil
+	}
+	if err := s.blocker(c); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrBlocked, c, err)
+	}
+	return nil
+}
+
+// ContextWithOffline returns a context which makes the blockservice and its
+// sessions only serve blocks from the local blockstore, without using the
+// exchange.
+func ContextWithOffline(ctx context.Context) context.Context {
+	return context.WithValue(ctx, offlineKey{}, true)
+}
+
+type offlineKey struct{}
+
+func isOffline(ctx context.Context) bool {
+	offline, _ := ctx.Value(offlineKey{}).(bool)
+	return offline
+}
+
+// grabServiceFromBlockservice returns nil if bs is not implemented by this
+// package, the returned value's helper methods handle a nil receiver.
+// The wrappers of this package, like [NewScoped], are unwrapped.
+func grabServiceFromBlockservice(bs BlockService) *blockService {
+	for {
+		w, ok := bs.(*scopedBlockService)
+		if !ok {
+			break
+		}
+		bs = w.inner
+	}
+	s, _ := bs.(*blockService)
+	return s
+}
+
+// grabAllowlistFromBlockservice returns nil when the [SecurityPolicy] of bs
+// has no allowlist.
 func grabAllowlistFromBlockservice(bs BlockService) verifcid.Allowlist {
 	if bbs, ok := bs.(BoundedBlockService); ok {
 		return bbs.Allowlist()
 	}
 	return verifcid.DefaultAllowlist
 }
+
+// nextBatchLen returns how many blocks from the start of bs fit in a batch.
+func (s *blockService) nextBatchLen(bs []blocks.Block) int {
+	n := len(bs)
+	if s.maxBatchBlocks > 0 {
+		n = min(n, s.maxBatchBlocks)
+	}
+	if size := s.batchSizer.next(); size > 0 {
+		n = min(n, size)
+	}
+	if s.maxBatchBytes <= 0 {
+		return n
+	}
+	var size int64
+	for i, b := range bs[:n] {
+		size += int64(len(b.RawData()))
+		if size > s.maxBatchBytes {
+			return max(i, 1)
+		}
+	}
+	return n
+}
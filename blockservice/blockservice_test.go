@@ -2,6 +2,7 @@ package blockservice
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	blockstore "github.com/ipfs/boxo/blockstore"
@@ -16,6 +17,7 @@ import (
 	"github.com/ipfs/go-test/random"
 	"github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const blockSize = 4
@@ -352,3 +354,68 @@ func TestContextSession(t *testing.T) {
 		"session must be deduped in all invocations on the same context",
 	)
 }
+
+type batchRecordingBlockstore struct {
+	blockstore.Blockstore
+	batches []int
+	failAt  int // 1-based index of the PutMany call to fail, 0 never fails
+}
+
+func (bs *batchRecordingBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	bs.batches = append(bs.batches, len(blks))
+	if len(bs.batches) == bs.failAt {
+		return errors.New("put failed")
+	}
+	return bs.Blockstore.PutMany(ctx, blks)
+}
+
+func TestAddBlocksMaxBatchSize(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := &batchRecordingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	exch := &notifyCountingExchange{offline.Exchange(bstore), 0}
+	bserv := New(bstore, exch, WithMaxBatchSize(3, 0))
+	require.NoError(t, bserv.AddBlocks(ctx, random.BlocksOfSize(7, blockSize)))
+	require.Equal(t, []int{3, 3, 1}, bstore.batches)
+	require.Equal(t, 7, exch.notifyCount)
+
+	bstore = &batchRecordingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	bserv = New(bstore, nil, WithMaxBatchSize(0, 2*blockSize))
+	require.NoError(t, bserv.AddBlocks(ctx, random.BlocksOfSize(5, blockSize)))
+	require.Equal(t, []int{2, 2, 1}, bstore.batches)
+
+	bstore = &batchRecordingBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		failAt:     2,
+	}
+	bserv = New(bstore, nil, WithMaxBatchSize(2, 0))
+	blks := random.BlocksOfSize(5, blockSize)
+	err := bserv.AddBlocks(ctx, blks)
+	var partial *PartialWriteError
+	require.ErrorAs(t, err, &partial)
+	require.Equal(t, 2, partial.Written)
+	require.Equal(t, cidsOf(blks[2:]...), partial.Unwritten)
+	require.Equal(t, []int{2, 2}, bstore.batches)
+}
+
+func TestNewWithOptions(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+
+	_, err := NewWithOptions(nil, nil)
+	require.Error(t, err)
+
+	_, err = NewWithOptions(bstore, nil, WithAllowlist(nil), WithFetchBuffer(-1))
+	require.ErrorContains(t, err, "WithAllowlist")
+	require.ErrorContains(t, err, "WithFetchBuffer")
+
+	bserv, err := NewWithOptions(bstore, nil, WriteThrough(), WithFetchBuffer(4))
+	require.NoError(t, err)
+	require.NoError(t, bserv.Close())
+
+	// New keeps the defaults in place of invalid options
+	bserv = New(bstore, nil, WithAllowlist(nil))
+	require.Equal(t, verifcid.DefaultAllowlist, bserv.(BoundedBlockService).Allowlist())
+}
@@ -0,0 +1,141 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// StreamingBlockGetter is implemented by the blockservices and sessions able
+// to get blocks whose CIDs are discovered progressively, a DAG traversal for
+// example.
+type StreamingBlockGetter interface {
+	// GetBlocksFromChannel is GetBlocks for the CIDs received from ks. The
+	// blocks stored locally are returned as soon as their CID arrives, the
+	// others are fetched in batches of up to 64 CIDs, sent to the exchange
+	// once full or 10ms after their first CID.
+	// The returned channel is closed once ks is closed and every batch is
+	// done, or as soon as ctx is done. The CIDs which can't be returned are
+	// reported to the handler of [WithBlockErrorHandler], which may be called
+	// concurrently for different batches.
+	GetBlocksFromChannel(ctx context.Context, ks <-chan cid.Cid) <-chan blocks.Block
+}
+
+var (
+	_ StreamingBlockGetter = (*blockService)(nil)
+	_ StreamingBlockGetter = (*Session)(nil)
+)
+
+const (
+	// streamBatchSize and streamBatchDelay bound the batches of
+	// GetBlocksFromChannel.
+	streamBatchSize  = 64
+	streamBatchDelay = 10 * time.Millisecond
+)
+
+func (s *blockService) GetBlocksFromChannel(ctx context.Context, ks <-chan cid.Cid) <-chan blocks.Block {
+	if ses := grabSessionFromContext(ctx, s); ses != nil {
+		return ses.GetBlocksFromChannel(ctx, ks)
+	}
+
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlocksFromChannel")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	return getBlocksFromChannel(ctx, ks, s, nil, s.GetBlocks)
+}
+
+func (s *Session) GetBlocksFromChannel(ctx context.Context, ks <-chan cid.Cid) <-chan blocks.Block {
+	ctx, span := internal.StartSpan(ctx, "Session.GetBlocksFromChannel")
+	defer span.End()
+	grabServiceFromBlockservice(s.bs).tagSpan(ctx, span)
+	s.linkSpan(span)
+
+	return getBlocksFromChannel(ctx, ks, s.bs, s, s.GetBlocks)
+}
+
+// getBlocksFromChannel serves the local hits of ks and hands the misses to
+// getMany in batches.
+func getBlocksFromChannel(ctx context.Context, ks <-chan cid.Cid, bs BlockService, ses *Session, getMany func(context.Context, []cid.Cid) <-chan blocks.Block) <-chan blocks.Block {
+	service := grabServiceFromBlockservice(bs)
+	mem := sessionMemoryCache(ses)
+	ctx, leaks := service.newLeakWatch(ctx)
+	out := newBlockOutput(ctx, nil)
+	out.leaks = leaks
+
+	go func() {
+		var wg sync.WaitGroup
+		defer out.close()
+		defer wg.Wait()
+
+		var batch []cid.Cid
+		var timer *clock.Timer
+		var timeout <-chan time.Time
+		flush := func() {
+			if timer != nil {
+				timer.Stop()
+				timer, timeout = nil, nil
+			}
+			if len(batch) == 0 {
+				return
+			}
+			in := getMany(ctx, batch)
+			batch = nil
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for b := range in {
+					if !out.send(b) {
+						// in is closed once ctx is done
+						for range in {
+						}
+						return
+					}
+				}
+			}()
+		}
+
+		blockstore := bs.Blockstore()
+		for {
+			select {
+			case c, ok := <-ks:
+				if !ok {
+					flush()
+					return
+				}
+				if err := validateSessionCid(bs, ses, opGetMany, c); err != nil {
+					service.rejectBatch([]cid.Cid{c}, err)
+					ses.failedAll([]cid.Cid{c}, err)
+					continue
+				}
+				if blk, _, _ := service.getLocal(ctx, blockstore, mem, c); blk != nil {
+					if !out.send(blk) {
+						service.rejectBatch(batch, ctx.Err())
+						return
+					}
+					continue
+				}
+				batch = append(batch, c)
+				switch {
+				case len(batch) >= streamBatchSize:
+					flush()
+				case timer == nil:
+					timer = service.getClock().Timer(streamBatchDelay)
+					timeout = timer.C
+				}
+			case <-timeout:
+				flush()
+			case <-ctx.Done():
+				service.rejectBatch(batch, ctx.Err())
+				return
+			}
+		}
+	}()
+	return out.ch
+}
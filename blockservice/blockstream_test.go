@@ -0,0 +1,130 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBlocksFromChannel(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(1+3+streamBatchSize, blockSize)
+	local, misses, full := blks[0], blks[1:4], blks[4:]
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, local))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[1:]))
+	exch := &callRecordingExchange{Interface: offline.Exchange(exchbstore)}
+	clk := clock.NewMock()
+	var lk sync.Mutex
+	failed := make(map[cid.Cid]error)
+	bserv := New(bstore, exch, WithClock(clk), WithBlockErrorHandler(func(c cid.Cid, err error) {
+		lk.Lock()
+		defer lk.Unlock()
+		failed[c] = err
+	}))
+	calls := func() [][]cid.Cid {
+		exch.lk.Lock()
+		defer exch.lk.Unlock()
+		return exch.calls
+	}
+
+	for _, getter := range []StreamingBlockGetter{bserv.(*blockService), NewSession(ctx, bserv)} {
+		exch.lk.Lock()
+		exch.calls = nil
+		exch.lk.Unlock()
+		ks := make(chan cid.Cid)
+		out := getter.GetBlocksFromChannel(ctx, ks)
+
+		// the local blocks come out right away
+		ks <- local.Cid()
+		require.Equal(t, local, <-out)
+
+		// the misses wait for the batch delay
+		for _, b := range misses {
+			ks <- b.Cid()
+		}
+		require.Empty(t, calls())
+		clk.Add(streamBatchDelay)
+		for range misses {
+			<-out
+		}
+		require.Len(t, calls(), 1)
+		require.Len(t, calls()[0], len(misses))
+
+		// or for the batch to be full
+		go func() {
+			for _, b := range full {
+				ks <- b.Cid()
+			}
+			// rejected
+			md5, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.MD5, MhLength: -1}.Sum([]byte("md5"))
+			require.NoError(t, err)
+			ks <- md5
+			close(ks)
+		}()
+		var got []blocks.Block
+		for b := range out {
+			got = append(got, b)
+		}
+		require.ElementsMatch(t, full, got)
+		require.Len(t, calls(), 2)
+		lk.Lock()
+		require.Len(t, failed, 1)
+		failed = make(map[cid.Cid]error)
+		lk.Unlock()
+		for _, b := range blks[1:] {
+			require.NoError(t, bstore.DeleteBlock(ctx, b.Cid()))
+		}
+	}
+}
+
+func TestGetBlocksFromChannelCancel(t *testing.T) {
+	t.Parallel()
+
+	exch := &hangingExchange{getsStarted: make(chan struct{}, 1)}
+	var lk sync.Mutex
+	var failed []cid.Cid
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch, WithBlockErrorHandler(func(c cid.Cid, err error) {
+		lk.Lock()
+		defer lk.Unlock()
+		require.ErrorIs(t, err, context.Canceled)
+		failed = append(failed, c)
+	})).(StreamingBlockGetter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ks := make(chan cid.Cid)
+	out := bserv.GetBlocksFromChannel(ctx, ks)
+	blks := random.BlocksOfSize(2, blockSize)
+	ks <- blks[0].Cid()
+	<-exch.getsStarted
+	ks <- blks[1].Cid()
+
+	// the output closes with the input still open
+	cancel()
+	select {
+	case _, ok := <-out:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("the output was not closed")
+	}
+	require.Eventually(t, func() bool {
+		lk.Lock()
+		defer lk.Unlock()
+		return len(failed) == 2
+	}, time.Second, time.Millisecond)
+}
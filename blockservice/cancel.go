@@ -0,0 +1,113 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// WantCanceler is implemented by exchange sessions able to retract wants which
+// are no longer needed.
+type WantCanceler interface {
+	CancelWants(ks []cid.Cid)
+}
+
+// sessionWants tracks the CIDs requested by the in-flight GetBlocks calls of a
+// [Session].
+type sessionWants struct {
+	lk       sync.Mutex
+	pending  map[cid.Cid]int
+	canceled map[cid.Cid]struct{}
+}
+
+func (w *sessionWants) add(ks []cid.Cid) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	if w.pending == nil {
+		w.pending = make(map[cid.Cid]int)
+	}
+	for _, k := range ks {
+		w.pending[k]++
+	}
+}
+
+func (w *sessionWants) remove(ks []cid.Cid) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	for _, k := range ks {
+		w.pending[k]--
+		if w.pending[k] <= 0 {
+			delete(w.pending, k)
+			delete(w.canceled, k)
+		}
+	}
+}
+
+// cancel marks the pending CIDs of ks as canceled and returns them.
+func (w *sessionWants) cancel(ks []cid.Cid) []cid.Cid {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	var canceled []cid.Cid
+	for _, k := range ks {
+		if w.pending[k] == 0 {
+			continue
+		}
+		if _, ok := w.canceled[k]; ok {
+			continue
+		}
+		if w.canceled == nil {
+			w.canceled = make(map[cid.Cid]struct{})
+		}
+		w.canceled[k] = struct{}{}
+		canceled = append(canceled, k)
+	}
+	return canceled
+}
+
+func (w *sessionWants) isCanceled(c cid.Cid) bool {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	_, ok := w.canceled[c]
+	return ok
+}
+
+// CancelWants tells the session the blocks for ks are no longer needed by the
+// in-flight GetBlocks calls. If the exchange session implements
+// [WantCanceler] the wants are retracted, either way blocks still arriving for
+// ks are written to the blockstore but no longer delivered.
+// CIDs which are not currently requested are ignored. It is safe to call
+// concurrently with GetBlocks.
+func (s *Session) CancelWants(ks []cid.Cid) {
+	canceled := s.wants.cancel(ks)
+	if len(canceled) == 0 {
+		return
+	}
+	if wc, ok := s.grabSession().(WantCanceler); ok {
+		wc.CancelWants(canceled)
+	}
+}
+
+// filterCanceled forwards the blocks of in to the returned channel, dropping
+// the ones canceled by [Session.CancelWants].
+func (s *Session) filterCanceled(ctx context.Context, ks []cid.Cid, in <-chan blocks.Block) <-chan blocks.Block {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		defer s.wants.remove(ks)
+		for b := range in {
+			s.refs.addReceived(b.Cid())
+			s.errors.retrieved(b.Cid())
+			if s.wants.isCanceled(b.Cid()) {
+				continue
+			}
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,71 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ exchange.SessionExchange = (*cancelingExchange)(nil)
+	_ WantCanceler             = (*cancelingExchange)(nil)
+)
+
+// cancelingExchange is its own session and records the canceled wants.
+type cancelingExchange struct {
+	*streamingExchange
+
+	lk       sync.Mutex
+	canceled []cid.Cid
+}
+
+func (e *cancelingExchange) NewSession(context.Context) exchange.Fetcher {
+	return e
+}
+
+func (e *cancelingExchange) CancelWants(ks []cid.Cid) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	e.canceled = append(e.canceled, ks...)
+}
+
+func TestSessionCancelWants(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	ks := []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}
+	exch := &cancelingExchange{streamingExchange: &streamingExchange{blks: blks[:3]}}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	ses := NewSession(ctx, New(bstore, exch))
+
+	out := ses.GetBlocks(ctx, ks)
+	first := <-out
+	require.Equal(t, blks[0].Cid(), first.Cid())
+
+	// blks[3] was never requested, it is ignored
+	ses.CancelWants([]cid.Cid{blks[2].Cid(), blks[3].Cid()})
+
+	var got []cid.Cid
+	for b := range out {
+		got = append(got, b.Cid())
+	}
+	require.Equal(t, []cid.Cid{blks[1].Cid()}, got)
+	require.Equal(t, []cid.Cid{blks[2].Cid()}, exch.canceled)
+
+	has, err := bstore.Has(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.True(t, has, "canceled blocks which arrive are still cached")
+
+	// once the call is over, the CIDs are not pending anymore
+	ses.CancelWants(ks)
+	require.Len(t, exch.canceled, 1)
+}
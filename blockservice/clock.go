@@ -0,0 +1,61 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/benbjohnson/clock"
+	"golang.org/x/time/rate"
+)
+
+// WithClock sets the clock of the time-dependent features of the blockservice
+// and of its sessions: timeouts, put retries, rate limits, provide backoffs,
+// session expiry, and the ages, durations and timestamps it reports. It is
+// meant for tests, with a [clock.Mock], and defaults to the real clock.
+// The spans of the traces are timed with the real clock regardless.
+func WithClock(clk clock.Clock) Option {
+	return func(bs *blockService) {
+		if clk == nil {
+			bs.invalidOption("WithClock: nil clock")
+			return
+		}
+		bs.clock = clk
+	}
+}
+
+var realClock = clock.New()
+
+// getClock handles a nil receiver by returning the real clock.
+func (s *blockService) getClock() clock.Clock {
+	if s == nil {
+		return realClock
+	}
+	return s.clock
+}
+
+// allow is [rate.Limiter.Allow] following clk.
+func allow(clk clock.Clock, lim *rate.Limiter) bool {
+	return lim.AllowN(clk.Now(), 1)
+}
+
+// waitLimiter is [rate.Limiter.Wait] following clk.
+func waitLimiter(ctx context.Context, clk clock.Clock, lim *rate.Limiter) error {
+	now := clk.Now()
+	r := lim.ReserveN(now, 1)
+	if !r.OK() {
+		return fmt.Errorf("rate: Wait(n=1) exceeds limiter's burst %d", lim.Burst())
+	}
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+	timer := clk.Timer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.CancelAt(clk.Now())
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,43 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithClock(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clk := clock.NewMock()
+	exch := &hangingExchange{getsStarted: make(chan struct{}, 1)}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch, WithClock(clk), WithOperationTimeouts(OperationTimeouts{Get: time.Minute}))
+
+	// the service timeouts follow the clock
+	errs := make(chan error, 1)
+	go func() {
+		_, err := bserv.GetBlock(ctx, random.BlocksOfSize(1, blockSize)[0].Cid())
+		errs <- err
+	}()
+	<-exch.getsStarted
+	clk.Add(time.Minute - time.Second)
+	select {
+	case err := <-errs:
+		t.Fatalf("GetBlock returned before its timeout: %v", err)
+	default:
+	}
+	clk.Add(time.Second)
+	require.ErrorIs(t, <-errs, context.DeadlineExceeded)
+
+	_, err := NewWithOptions(bstore, nil, WithClock(nil))
+	require.ErrorContains(t, err, "WithClock")
+}
@@ -0,0 +1,122 @@
+package blockservice
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap/zapcore"
+)
+
+// codecName returns the multicodec name of the codec of c, or its code in
+// hexadecimal when it is not one of the usual codecs of blocks.
+func codecName(c cid.Cid) string {
+	switch code := c.Prefix().Codec; code {
+	case cid.Raw:
+		return "raw"
+	case cid.DagProtobuf:
+		return "dag-pb"
+	case cid.DagCBOR:
+		return "dag-cbor"
+	case cid.DagJSON:
+		return "dag-json"
+	case cid.DagJOSE:
+		return "dag-jose"
+	case cid.Libp2pKey:
+		return "libp2p-key"
+	case cid.GitRaw:
+		return "git-raw"
+	default:
+		return "0x" + strconv.FormatUint(code, 16)
+	}
+}
+
+// codecAttribute is the span attribute of the codec of c.
+func codecAttribute(c cid.Cid) attribute.KeyValue {
+	return attribute.String("codec", codecName(c))
+}
+
+// recordBlockSize sets the size of blk on span, blk is nil if it could not
+// be retrieved.
+func recordBlockSize(span trace.Span, blk blocks.Block) {
+	if blk != nil {
+		span.SetAttributes(attribute.Int("bytes", len(blk.RawData())))
+	}
+}
+
+// logBlock logs msg with the CID, codec and size of b at the debug level.
+func logBlock(msg string, b blocks.Block) {
+	if !logger.Level().Enabled(zapcore.DebugLevel) {
+		return
+	}
+	c := b.Cid()
+	logger.Debugw(msg, "cid", c, "codec", codecName(c), "size", len(b.RawData()))
+}
+
+// codecSummary accumulates the sizes of the blocks returned by GetBlocks by
+// codec, they are recorded on a getBlocks.codecs span once the channel is
+// closed, as the span of GetBlocks ends before the blocks are returned.
+// It is guarded by the lk of the blockOutput.
+type codecSummary struct {
+	ctx   context.Context
+	start time.Time
+	codec map[string]*codecSizes
+}
+
+// codecSizes is the histogram of the sizes of the blocks of a codec, over
+// the buckets of the block size metric.
+type codecSizes struct {
+	blocks  int
+	bytes   int
+	buckets []int64
+}
+
+// newCodecSummary returns nil when the span of ctx is not recording.
+func newCodecSummary(ctx context.Context) *codecSummary {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return nil
+	}
+	return &codecSummary{ctx: ctx, start: time.Now(), codec: make(map[string]*codecSizes)}
+}
+
+func (cs *codecSummary) add(b blocks.Block) {
+	if cs == nil {
+		return
+	}
+	name := codecName(b.Cid())
+	sizes, ok := cs.codec[name]
+	if !ok {
+		sizes = &codecSizes{buckets: make([]int64, len(blockSizeBuckets)+1)}
+		cs.codec[name] = sizes
+	}
+	size := len(b.RawData())
+	sizes.blocks++
+	sizes.bytes += size
+	i, _ := slices.BinarySearch(blockSizeBuckets, float64(size))
+	sizes.buckets[i]++
+}
+
+// end records the summary, the last bucket counts the blocks larger than
+// all the bounds.
+func (cs *codecSummary) end() {
+	if cs == nil {
+		return
+	}
+	attrs := []attribute.KeyValue{attribute.Float64Slice("size_buckets_le", blockSizeBuckets)}
+	for name, sizes := range cs.codec {
+		attrs = append(attrs,
+			attribute.Int("codec."+name+".blocks", sizes.blocks),
+			attribute.Int("codec."+name+".bytes", sizes.bytes),
+			attribute.Int64Slice("codec."+name+".size_buckets", sizes.buckets),
+		)
+	}
+	_, span := internal.StartSpan(cs.ctx, "getBlocks.codecs", trace.WithTimestamp(cs.start), trace.WithAttributes(attrs...))
+	span.End()
+	cs.codec = nil
+}
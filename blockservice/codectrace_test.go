@@ -0,0 +1,90 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func TestCodecName(t *testing.T) {
+	t.Parallel()
+	mh, err := multihash.Sum([]byte("codec"), multihash.SHA2_256, -1)
+	require.NoError(t, err)
+	require.Equal(t, "raw", codecName(cid.NewCidV1(cid.Raw, mh)))
+	require.Equal(t, "dag-pb", codecName(cid.NewCidV0(mh)))
+	require.Equal(t, "dag-cbor", codecName(cid.NewCidV1(cid.DagCBOR, mh)))
+	require.Equal(t, "0x300001", codecName(cid.NewCidV1(0x300001, mh)))
+}
+
+func TestCodecSpans(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+	ctx := context.Background()
+
+	raw := []blocks.Block{
+		blockWithHash(t, random.Bytes(100), multihash.SHA2_256),
+		blockWithHash(t, random.Bytes(100), multihash.SHA2_256),
+	}
+	pb := blocks.NewBlock(random.Bytes(2000))
+	missing := blockWithHash(t, random.Bytes(blockSize), multihash.SHA2_256).Cid()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, raw[0]))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, []blocks.Block{raw[1], pb}))
+	bserv := New(bstore, offline.Exchange(exchbstore))
+
+	ctx, root := otel.Tracer("test").Start(ctx, "root")
+	_, err := bserv.GetBlock(ctx, pb.Cid())
+	require.NoError(t, err)
+	_, err = NewSession(ctx, bserv).GetBlock(ctx, raw[0].Cid())
+	require.NoError(t, err)
+	_, err = bserv.GetBlock(ctx, missing)
+	require.Error(t, err)
+	for range bserv.GetBlocks(ctx, []cid.Cid{raw[0].Cid(), raw[1].Cid(), pb.Cid(), missing}) {
+	}
+	root.End()
+
+	// the size is known once the block is in hand
+	sizes := make(map[string]int64)
+	for _, s := range append(spansInTrace(root, "Blockservice.blockService.GetBlock"), spansInTrace(root, "Blockservice.Session.GetBlock")...) {
+		c, _ := spanAttribute(s, "CID")
+		codec, ok := spanAttribute(s, "codec")
+		require.True(t, ok)
+		if c.AsString() == pb.Cid().String() {
+			require.Equal(t, "dag-pb", codec.AsString())
+		} else {
+			require.Equal(t, "raw", codec.AsString())
+		}
+		if bytes, ok := spanAttribute(s, "bytes"); ok {
+			sizes[c.AsString()] = bytes.AsInt64()
+		}
+	}
+	require.Equal(t, map[string]int64{pb.Cid().String(): 2000, raw[0].Cid().String(): 100}, sizes)
+
+	parents := spansInTrace(root, "Blockservice.blockService.GetBlocks")
+	require.Len(t, parents, 1)
+	summaries := spansInTrace(root, "Blockservice.getBlocks.codecs")
+	require.Len(t, summaries, 1)
+	summary := summaries[0]
+	require.Equal(t, parents[0].SpanContext().SpanID(), summary.Parent().SpanID())
+	v, _ := spanAttribute(summary, "codec.raw.blocks")
+	require.EqualValues(t, 2, v.AsInt64())
+	v, _ = spanAttribute(summary, "codec.raw.bytes")
+	require.EqualValues(t, 200, v.AsInt64())
+	v, _ = spanAttribute(summary, "codec.raw.size_buckets")
+	require.Equal(t, []int64{0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0}, v.AsInt64Slice())
+	v, _ = spanAttribute(summary, "codec.dag-pb.size_buckets")
+	require.Equal(t, []int64{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, v.AsInt64Slice())
+	v, _ = spanAttribute(summary, "size_buckets_le")
+	require.Equal(t, blockSizeBuckets, v.AsFloat64Slice())
+}
@@ -0,0 +1,168 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// FetchControl controls a GetBlocksControlled call. Its methods are safe to
+// call from any goroutine.
+type FetchControl struct {
+	lk        sync.Mutex
+	remaining map[cid.Cid]struct{}
+	order     []cid.Cid
+	stopped   bool
+	cancel    context.CancelFunc
+	fetcher   exchange.Fetcher
+}
+
+func newFetchControl(ks []cid.Cid) *FetchControl {
+	fc := &FetchControl{
+		remaining: make(map[cid.Cid]struct{}, len(ks)),
+		order:     make([]cid.Cid, 0, len(ks)),
+	}
+	for _, k := range ks {
+		if _, ok := fc.remaining[k]; ok {
+			continue
+		}
+		fc.remaining[k] = struct{}{}
+		fc.order = append(fc.order, k)
+	}
+	return fc
+}
+
+// StopRequestingNew stops asking the exchange for the blocks which have not
+// arrived yet, retracting the wants when the exchange implements
+// [WantCanceler]. The blocks already received are still delivered, then the
+// channel is closed.
+func (fc *FetchControl) StopRequestingNew() {
+	fc.lk.Lock()
+	if fc.stopped {
+		fc.lk.Unlock()
+		return
+	}
+	fc.stopped = true
+	cancel, fetcher := fc.cancel, fc.fetcher
+	fc.lk.Unlock()
+
+	if wc, ok := fetcher.(WantCanceler); ok {
+		wc.CancelWants(fc.Remaining())
+	}
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Remaining returns the requested CIDs which have not been delivered yet.
+func (fc *FetchControl) Remaining() []cid.Cid {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	remaining := make([]cid.Cid, 0, len(fc.remaining))
+	for _, k := range fc.order {
+		if _, ok := fc.remaining[k]; ok {
+			remaining = append(remaining, k)
+		}
+	}
+	return remaining
+}
+
+func (fc *FetchControl) delivered(c cid.Cid) {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	delete(fc.remaining, c)
+}
+
+// startFetch registers the cancel func of the exchange request, it returns
+// false if the fetch was already stopped.
+func (fc *FetchControl) startFetch(cancel context.CancelFunc, fetcher exchange.Fetcher) bool {
+	fc.lk.Lock()
+	defer fc.lk.Unlock()
+	if fc.stopped {
+		return false
+	}
+	fc.cancel, fc.fetcher = cancel, fetcher
+	return true
+}
+
+// controlledFetcher gives the exchange request of getBlocks its own context,
+// so it can be stopped without canceling the delivery of the blocks received.
+type controlledFetcher struct {
+	exchange.Fetcher
+	fc *FetchControl
+}
+
+func (f controlledFetcher) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	if !f.fc.startFetch(cancel, f.Fetcher) {
+		cancel()
+		out := make(chan blocks.Block)
+		close(out)
+		return out, nil
+	}
+	return f.Fetcher.GetBlocks(ctx, ks)
+}
+
+// getBlocksControlled is getBlocks with a [FetchControl], received is called
+// with the CID of each block delivered if not nil.
+func getBlocksControlled(ctx context.Context, ks []cid.Cid, bs BlockService, ses *Session, fetchFactory func() exchange.Fetcher, received func(cid.Cid)) (<-chan blocks.Block, *FetchControl) {
+	fc := newFetchControl(ks)
+	controlledFactory := func() exchange.Fetcher {
+		fetch := fetchFactory()
+		if fetch == nil {
+			return nil
+		}
+		return controlledFetcher{Fetcher: fetch, fc: fc}
+	}
+
+	in := getBlocks(ctx, ks, bs, ses, controlledFactory)
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for b := range in {
+			if received != nil {
+				received(b.Cid())
+			}
+			select {
+			case out <- b:
+				fc.delivered(b.Cid())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, fc
+}
+
+// GetBlocksControlled is like GetBlocks but returns a [*FetchControl] which
+// can stop requesting the blocks which have not arrived yet.
+func (s *blockService) GetBlocksControlled(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, *FetchControl) {
+	if ses := grabSessionFromContext(ctx, s); ses != nil {
+		return ses.GetBlocksControlled(ctx, ks)
+	}
+
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlocksControlled")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	return getBlocksControlled(ctx, ks, s, nil, s.getExchangeFetcher, nil)
+}
+
+// GetBlocksControlled is like [Session.GetBlocks] but returns a
+// [*FetchControl] which can stop requesting the blocks which have not arrived
+// yet.
+func (s *Session) GetBlocksControlled(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, *FetchControl) {
+	ctx, span := internal.StartSpan(ctx, "Session.GetBlocksControlled")
+	defer span.End()
+	grabServiceFromBlockservice(s.bs).tagSpan(ctx, span)
+	s.linkSpan(span)
+	ctx = s.markSessionFetch(ctx)
+
+	s.refs.addRequested(ks...)
+	return getBlocksControlled(ctx, ks, s.bs, s, s.grabSession, s.refs.addReceived)
+}
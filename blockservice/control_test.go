@@ -0,0 +1,80 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBlocksControlledStop(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(10, blockSize)
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	exch := &cancelingExchange{streamingExchange: &streamingExchange{blks: blks}}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch).(*blockService)
+
+	out, fc := bserv.GetBlocksControlled(ctx, ks)
+	var got []cid.Cid
+	for range 2 {
+		got = append(got, (<-out).Cid())
+	}
+	require.Eventually(t, func() bool { return len(fc.Remaining()) == len(ks)-2 }, time.Second, time.Millisecond)
+	require.Equal(t, ks[2:], fc.Remaining())
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		fc.StopRequestingNew()
+	}()
+	<-stopped
+	require.Equal(t, ks[2:], exch.canceled, "the outstanding wants are retracted")
+
+	// the blocks already in flight are still delivered
+	for b := range out {
+		got = append(got, b.Cid())
+	}
+	require.Less(t, len(got), len(ks))
+	require.Equal(t, ks[:len(got)], got)
+	require.Equal(t, ks[len(got):], fc.Remaining())
+}
+
+func TestGetBlocksControlledComplete(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, blks[0]))
+	exch := &cancelingExchange{streamingExchange: &streamingExchange{blks: blks[1:]}}
+	ses := NewSession(ctx, New(bstore, exch))
+
+	out, fc := ses.GetBlocksControlled(ctx, ks)
+	var got []cid.Cid
+	for b := range out {
+		got = append(got, b.Cid())
+	}
+	require.Equal(t, ks, got)
+	require.Empty(t, fc.Remaining())
+
+	fc.StopRequestingNew()
+	require.Empty(t, exch.canceled)
+	_, received := ses.Refs()
+	require.Equal(t, ks, received)
+}
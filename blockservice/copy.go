@@ -0,0 +1,228 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+const (
+	defaultCopyBatchSize   = 256
+	defaultCopyConcurrency = 4
+)
+
+// CopyStats reports what [CopyBlocks] did.
+type CopyStats struct {
+	// Copied is the number of blocks written to the destination.
+	Copied int
+	// CopiedBytes is the size of the blocks written to the destination.
+	CopiedBytes int64
+	// Skipped is the number of blocks the destination already had, or
+	// rejected with [WithSkipInvalid], the latter are reported in the
+	// [*CopyError].
+	Skipped int
+	// Missing is the number of blocks the source could not provide.
+	Missing int
+}
+
+// CopyError is returned by [CopyBlocks] when some blocks could not be copied,
+// the other blocks have been copied normally.
+type CopyError struct {
+	// Failed maps the CIDs which were not copied to the reason why.
+	Failed map[cid.Cid]error
+}
+
+func (e *CopyError) Error() string {
+	return fmt.Sprintf("failed to copy %d blocks", len(e.Failed))
+}
+
+// CopyOption configures [CopyBlocks].
+type CopyOption func(*copyOptions)
+
+type copyOptions struct {
+	batchSize    int
+	concurrency  int
+	skipExisting bool
+	progress     func(CopyStats)
+}
+
+// WithCopyBatchSize sets how many blocks are read and written at once, the
+// default is 256.
+func WithCopyBatchSize(n int) CopyOption {
+	return func(o *copyOptions) {
+		o.batchSize = n
+	}
+}
+
+// WithCopyConcurrency sets how many batches are copied in parallel, the
+// default is 4.
+func WithCopyConcurrency(n int) CopyOption {
+	return func(o *copyOptions) {
+		o.concurrency = n
+	}
+}
+
+// WithCopySkipExisting sets whether blocks already present in the destination
+// blockstore are skipped without reading them from the source, the default is
+// true.
+func WithCopySkipExisting(skip bool) CopyOption {
+	return func(o *copyOptions) {
+		o.skipExisting = skip
+	}
+}
+
+// WithCopyProgress sets a callback receiving the cumulative stats after each
+// batch. It is never called concurrently.
+func WithCopyProgress(progress func(CopyStats)) CopyOption {
+	return func(o *copyOptions) {
+		o.progress = progress
+	}
+}
+
+// CopyBlocks copies the blocks for ks from src to dst, reading them through a
+// [Session] when src is a [BlockService] and writing them with dst.AddBlocks
+// in batches.
+// Blocks which can't be copied don't abort the copy, they are reported in a
+// [*CopyError] once everything else has been copied.
+func CopyBlocks(ctx context.Context, src BlockGetter, dst BlockService, ks []cid.Cid, opts ...CopyOption) (CopyStats, error) {
+	ctx, span := internal.StartSpan(ctx, "CopyBlocks")
+	defer span.End()
+
+	o := copyOptions{
+		batchSize:    defaultCopyBatchSize,
+		concurrency:  defaultCopyConcurrency,
+		skipExisting: true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.batchSize <= 0 {
+		o.batchSize = defaultCopyBatchSize
+	}
+	if o.concurrency <= 0 {
+		o.concurrency = 1
+	}
+
+	if bs, ok := src.(BlockService); ok {
+		ses := NewSession(ctx, bs)
+		defer ses.Close()
+		src = ses
+	}
+
+	c := &copier{src: src, dst: dst, opts: &o}
+	r := batchRunner[CopyStats]{
+		batchSize:   o.batchSize,
+		concurrency: o.concurrency,
+		merge:       (*CopyStats).add,
+		progress:    o.progress,
+	}
+	stats, failed := r.run(ctx, ks, c.copyBatch)
+
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+	if len(failed) != 0 {
+		return stats, &CopyError{Failed: failed}
+	}
+	return stats, nil
+}
+
+// add adds the stats of a batch to s.
+func (s *CopyStats) add(batch CopyStats) {
+	s.Copied += batch.Copied
+	s.CopiedBytes += batch.CopiedBytes
+	s.Skipped += batch.Skipped
+	s.Missing += batch.Missing
+}
+
+type copier struct {
+	src  BlockGetter
+	dst  BlockService
+	opts *copyOptions
+}
+
+func (c *copier) copyBatch(ctx context.Context, batch []cid.Cid) (CopyStats, map[cid.Cid]error) {
+	var stats CopyStats
+	failed := make(map[cid.Cid]error)
+
+	want := batch
+	if c.opts.skipExisting {
+		want = make([]cid.Cid, 0, len(batch))
+		bstore := c.dst.Blockstore()
+		for _, k := range batch {
+			has, err := bstore.Has(ctx, k)
+			switch {
+			case err != nil:
+				failed[k] = err
+			case has:
+				stats.Skipped++
+			default:
+				want = append(want, k)
+			}
+		}
+	}
+
+	var blks []blocks.Block
+	if len(want) != 0 {
+		received := make(map[cid.Cid]struct{}, len(want))
+		for b := range c.src.GetBlocks(ctx, want) {
+			received[b.Cid()] = struct{}{}
+			blks = append(blks, b)
+		}
+		for _, k := range want {
+			if _, ok := received[k]; ok {
+				continue
+			}
+			if ctx.Err() != nil {
+				failed[k] = ctx.Err()
+				continue
+			}
+			stats.Missing++
+			failed[k] = ipld.ErrNotFound{Cid: k}
+		}
+	}
+
+	if len(blks) != 0 {
+		err := c.dst.AddBlocks(ctx, blks)
+		var partial *PartialWriteError
+		var unwritten map[cid.Cid]struct{}
+		if errors.As(err, &partial) {
+			// the blocks written before the failure are copied
+			unwritten = make(map[cid.Cid]struct{}, len(partial.Unwritten))
+			for _, k := range partial.Unwritten {
+				unwritten[k] = struct{}{}
+			}
+		}
+		var skipped *SkippedBlocksError
+		if errors.As(err, &skipped) {
+			// the blocks the destination rejected are not copied, the others
+			// are
+			err = nil
+		}
+		for _, b := range blks {
+			if skipped != nil {
+				if reason, ok := skipped.Skipped[b.Cid()]; ok {
+					stats.Skipped++
+					failed[b.Cid()] = reason
+					continue
+				}
+			}
+			if err != nil {
+				if _, ok := unwritten[b.Cid()]; ok || partial == nil {
+					failed[b.Cid()] = err
+					continue
+				}
+			}
+			stats.Copied++
+			stats.CopiedBytes += int64(len(b.RawData()))
+		}
+	}
+
+	return stats, failed
+}
@@ -0,0 +1,113 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyBlocks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	src := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil)
+	dst := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil)
+
+	blks := random.BlocksOfSize(10, blockSize)
+	require.NoError(t, src.AddBlocks(ctx, blks[:9]))
+	require.NoError(t, dst.AddBlocks(ctx, blks[:2]))
+
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+
+	var progressCalls int
+	stats, err := CopyBlocks(ctx, src, dst, ks, WithCopyBatchSize(3), WithCopyProgress(func(CopyStats) {
+		progressCalls++
+	}))
+	var copyErr *CopyError
+	require.ErrorAs(t, err, &copyErr)
+	require.Len(t, copyErr.Failed, 1)
+	require.True(t, ipld.IsNotFound(copyErr.Failed[blks[9].Cid()]))
+
+	require.Equal(t, 7, stats.Copied)
+	require.EqualValues(t, 7*blockSize, stats.CopiedBytes)
+	require.Equal(t, 2, stats.Skipped)
+	require.Equal(t, 1, stats.Missing)
+	require.Equal(t, 4, progressCalls)
+
+	for _, b := range blks[:9] {
+		has, err := dst.Blockstore().Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+}
+
+func TestCopyBlocksPartialWrite(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	src := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil, WithSessionTracking(time.Hour)).(*blockService)
+	defer src.Close()
+	dstore := &batchRecordingBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		failAt:     2,
+	}
+	dst := New(dstore, nil, WithMaxBatchSize(2, 0))
+
+	blks := random.BlocksOfSize(5, blockSize)
+	require.NoError(t, src.AddBlocks(ctx, blks))
+
+	// the first PutMany of the batch succeeds, the second one fails
+	stats, err := CopyBlocks(ctx, src, dst, cidsOf(blks...), WithCopyBatchSize(5))
+	var copyErr *CopyError
+	require.ErrorAs(t, err, &copyErr)
+	require.Len(t, copyErr.Failed, 3)
+	for _, b := range blks[:2] {
+		require.NotContains(t, copyErr.Failed, b.Cid())
+	}
+	require.Equal(t, 2, stats.Copied)
+	require.EqualValues(t, 2*blockSize, stats.CopiedBytes)
+
+	// the session reading the source is closed
+	require.Zero(t, src.Stats(false).LiveSessions)
+}
+
+func TestCopyBlocksSkipInvalid(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	src := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil)
+	require.NoError(t, src.AddBlocks(ctx, blks))
+	dstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	dst := New(dstore, nil, WithSkipInvalid(), WithContentBlocker(func(c cid.Cid) error {
+		if c == blks[1].Cid() {
+			return errors.New("denied")
+		}
+		return nil
+	}))
+
+	// the block the destination skipped is reported, the others are copied
+	stats, err := CopyBlocks(ctx, src, dst, cidsOf(blks...))
+	var copyErr *CopyError
+	require.ErrorAs(t, err, &copyErr)
+	require.Len(t, copyErr.Failed, 1)
+	require.ErrorIs(t, copyErr.Failed[blks[1].Cid()], ErrBlocked)
+	require.Equal(t, 2, stats.Copied)
+	require.EqualValues(t, 2*blockSize, stats.CopiedBytes)
+	require.Equal(t, 1, stats.Skipped)
+	has, err := dstore.Has(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+}
@@ -0,0 +1,56 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ErrBlockDecode is matched by the [*BlockDecodeError] returned by
+// [GetAndDecode] when the decoder fails.
+var ErrBlockDecode = errors.New("failed to decode block")
+
+// ErrCidMismatch is returned by [GetAndDecode] when the getter returned a
+// block with another CID than the requested one.
+var ErrCidMismatch = errors.New("block CID does not match the request")
+
+// BlockDecodeError identifies a block [GetAndDecode] could not decode, it
+// wraps the error of the decoder.
+type BlockDecodeError struct {
+	Cid   cid.Cid
+	Codec uint64
+	Err   error
+}
+
+func (e *BlockDecodeError) Error() string {
+	return fmt.Sprintf("%s %s (codec 0x%x): %s", ErrBlockDecode, e.Cid, e.Codec, e.Err)
+}
+
+func (e *BlockDecodeError) Is(target error) bool {
+	return target == ErrBlockDecode
+}
+
+func (e *BlockDecodeError) Unwrap() error {
+	return e.Err
+}
+
+// GetAndDecode gets the block of c from bg, a [BlockService] or a [Session],
+// checks it has the requested CID and decodes its data with decode.
+// Decoder failures are wrapped in a [*BlockDecodeError].
+func GetAndDecode[T any](ctx context.Context, bg BlockGetter, c cid.Cid, decode func([]byte) (T, error)) (T, error) {
+	var zero T
+	blk, err := bg.GetBlock(ctx, c)
+	if err != nil {
+		return zero, err
+	}
+	if !blk.Cid().Equals(c) {
+		return zero, fmt.Errorf("%w: requested %s, got %s", ErrCidMismatch, c, blk.Cid())
+	}
+	v, err := decode(blk.RawData())
+	if err != nil {
+		return zero, &BlockDecodeError{Cid: c, Codec: c.Prefix().Codec, Err: err}
+	}
+	return v, nil
+}
@@ -0,0 +1,55 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// wrongBlockGetter returns the same block whatever is requested.
+type wrongBlockGetter struct {
+	BlockGetter
+	blk blocks.Block
+}
+
+func (g wrongBlockGetter) GetBlock(context.Context, cid.Cid) (blocks.Block, error) {
+	return g.blk, nil
+}
+
+func TestGetAndDecode(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil)
+	blks := random.BlocksOfSize(2, blockSize)
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+
+	size := func(data []byte) (int, error) { return len(data), nil }
+	n, err := GetAndDecode(ctx, bserv, blks[0].Cid(), size)
+	require.NoError(t, err)
+	require.Equal(t, blockSize, n)
+	n, err = GetAndDecode(ctx, NewSession(ctx, bserv), blks[0].Cid(), size)
+	require.NoError(t, err)
+	require.Equal(t, blockSize, n)
+
+	errDecode := errors.New("bad data")
+	_, err = GetAndDecode(ctx, bserv, blks[0].Cid(), func([]byte) (int, error) { return 0, errDecode })
+	require.ErrorIs(t, err, ErrBlockDecode)
+	require.ErrorIs(t, err, errDecode)
+	var derr *BlockDecodeError
+	require.True(t, errors.As(err, &derr))
+	require.Equal(t, blks[0].Cid(), derr.Cid)
+	require.Equal(t, blks[0].Cid().Prefix().Codec, derr.Codec)
+
+	_, err = GetAndDecode(ctx, wrongBlockGetter{blk: blks[1]}, blks[0].Cid(), size)
+	require.ErrorIs(t, err, ErrCidMismatch)
+}
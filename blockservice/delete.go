@@ -0,0 +1,415 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrNotFound is returned by the deletes of blocks which were not stored,
+// whatever error the blockstore returned for them. It matches
+// [ipld.IsNotFound].
+// Blockstores which don't report the deletion of missing blocks, like the ones
+// of the boxo blockstore package over most datastores, succeed instead.
+type ErrNotFound struct {
+	Cid cid.Cid
+}
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("block %s not found", e.Cid)
+}
+
+// Is matches any ErrNotFound and [ipld.ErrNotFound], so ipld.IsNotFound
+// reports e.
+func (e ErrNotFound) Is(err error) bool {
+	switch err.(type) {
+	case ErrNotFound, ipld.ErrNotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+// NotFound implements the interface of the datastore errors.
+func (e ErrNotFound) NotFound() bool {
+	return true
+}
+
+// ErrDeleteRefused is returned by the deletes of the blocks refused by the
+// guard of [WithDeleteGuard], it wraps the error of the guard.
+type ErrDeleteRefused struct {
+	Cid cid.Cid
+	Err error
+}
+
+func (e ErrDeleteRefused) Error() string {
+	return fmt.Sprintf("delete of block %s refused: %s", e.Cid, e.Err)
+}
+
+func (e ErrDeleteRefused) Unwrap() error {
+	return e.Err
+}
+
+// WithDeleteGuard sets a function consulted before every delete of a block,
+// the blocks it returns an error for are kept and their delete fails with
+// [ErrDeleteRefused]. It can protect the pinned blocks from a garbage
+// collection sweep for instance.
+func WithDeleteGuard(guard func(ctx context.Context, c cid.Cid) error) Option {
+	return func(bs *blockService) {
+		if guard == nil {
+			bs.invalidOption("WithDeleteGuard: nil guard")
+			return
+		}
+		bs.deleteGuard = guard
+	}
+}
+
+// guardDelete returns an [ErrDeleteRefused] if the guard refuses the delete
+// of c.
+func (s *blockService) guardDelete(ctx context.Context, c cid.Cid) error {
+	if s.deleteGuard == nil {
+		return nil
+	}
+	if err := s.deleteGuard(ctx, c); err != nil {
+		return ErrDeleteRefused{Cid: c, Err: err}
+	}
+	return nil
+}
+
+// BatchDeleter is implemented by blockstores able to delete many blocks at
+// once, with a datastore batch for instance. DeleteBlocksFromChannel deletes
+// the blocks it receives by batches with it.
+type BatchDeleter interface {
+	// DeleteMany deletes the blocks of ks, the ones which are not stored
+	// are ignored.
+	DeleteMany(ctx context.Context, ks []cid.Cid) error
+}
+
+// deleteBatchSize bounds the batches of DeleteBlocksFromChannel.
+const deleteBatchSize = 256
+
+// DeleteOption configures a delete.
+type DeleteOption func(*deleteOptions)
+
+type deleteOptions struct {
+	ignoreNotFound bool
+}
+
+// DeleteIgnoreNotFound makes the deletes of blocks which were not stored
+// succeed instead of returning [ErrNotFound].
+func DeleteIgnoreNotFound() DeleteOption {
+	return func(o *deleteOptions) {
+		o.ignoreNotFound = true
+	}
+}
+
+type deleteOptionsKey struct{}
+
+// ContextWithDeleteOptions applies opts to the DeleteBlock and DeleteBlockFrom
+// calls made with the returned context.
+func ContextWithDeleteOptions(ctx context.Context, opts ...DeleteOption) context.Context {
+	o := deleteOptionsFromContext(ctx)
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return context.WithValue(ctx, deleteOptionsKey{}, o)
+}
+
+func deleteOptionsFromContext(ctx context.Context) deleteOptions {
+	o, _ := ctx.Value(deleteOptionsKey{}).(deleteOptions)
+	return o
+}
+
+// BlocksDeleter is implemented by the blockservices deleting blocks in
+// batches.
+type BlocksDeleter interface {
+	// DeleteBlocks deletes ks from all the blockstores. Every CID is deleted
+	// even when some fail, the errors are joined and the ones of the blocks
+	// which were not stored are [ErrNotFound], see [DeleteIgnoreNotFound].
+	DeleteBlocks(ctx context.Context, ks []cid.Cid, opts ...DeleteOption) error
+
+	// DeleteBlocksFromChannel is DeleteBlocks for the CIDs received from ks,
+	// each deleted as it arrives, until ks is closed or ctx is done. The
+	// returned stats cover what was done before a failure or cancellation.
+	DeleteBlocksFromChannel(ctx context.Context, ks <-chan cid.Cid, opts ...DeleteOption) (DeleteStats, error)
+}
+
+// DeleteStats counts the blocks of [BlocksDeleter.DeleteBlocksFromChannel].
+type DeleteStats struct {
+	// Deleted is the number of blocks deleted from at least one blockstore.
+	Deleted int
+	// Missing is the number of blocks which were not stored.
+	Missing int
+	// Refused is the number of blocks kept by the guard of
+	// [WithDeleteGuard].
+	Refused int
+	// Failed is the number of blocks which could not be deleted.
+	Failed int
+}
+
+var _ BlocksDeleter = (*blockService)(nil)
+
+func (s *blockService) DeleteBlocks(ctx context.Context, ks []cid.Cid, opts ...DeleteOption) error {
+	ctx, span := internal.StartSpan(ctx, "blockService.DeleteBlocks", trace.WithAttributes(attribute.Int("count", len(ks))))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Delete)
+	defer cancel()
+
+	o := deleteOptionsFromContext(ctx)
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var errs []error
+	for _, c := range ks {
+		if _, err := s.deleteBlock(ctx, c, AllStores, o); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *blockService) DeleteBlocksFromChannel(ctx context.Context, ks <-chan cid.Cid, opts ...DeleteOption) (DeleteStats, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.DeleteBlocksFromChannel")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return DeleteStats{}, ErrReadOnly
+	}
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return DeleteStats{}, err
+	}
+	defer done()
+
+	o := deleteOptionsFromContext(ctx)
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var st DeleteStats
+	var errs []error
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("deleted", st.Deleted),
+			attribute.Int("missing", st.Missing),
+			attribute.Int("refused", st.Refused),
+			attribute.Int("failed", st.Failed),
+		)
+	}()
+	batch := make([]cid.Cid, 0, deleteBatchSize)
+	for {
+		var ok bool
+		batch, ok = nextDeleteBatch(ctx, ks, batch[:0])
+		if err := ctx.Err(); err != nil {
+			// a ready channel can win the select
+			return st, errors.Join(append(errs, err)...)
+		}
+
+		// the timeout applies to each batch, the stream has no end known
+		// in advance
+		dctx, cancel := s.withTimeout(ctx, s.timeouts.Delete)
+		errs = s.deleteMany(dctx, batch, o, &st, errs)
+		cancel()
+		if !ok {
+			return st, errors.Join(errs...)
+		}
+	}
+}
+
+// nextDeleteBatch appends to batch the CIDs received from ks, waiting for the
+// first one then taking the ones ready, up to deleteBatchSize. It returns
+// false once ks is closed.
+func nextDeleteBatch(ctx context.Context, ks <-chan cid.Cid, batch []cid.Cid) ([]cid.Cid, bool) {
+	select {
+	case c, ok := <-ks:
+		if !ok {
+			return batch, false
+		}
+		batch = append(batch, c)
+	case <-ctx.Done():
+		return batch, true
+	}
+	for len(batch) < deleteBatchSize {
+		select {
+		case c, ok := <-ks:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, c)
+		default:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+// deleteMany deletes ks from all the blockstores, with a single DeleteMany of
+// the blockstore when it is a [BatchDeleter]. The outcomes are counted in st
+// and the errors appended to errs.
+func (s *blockService) deleteMany(ctx context.Context, ks []cid.Cid, o deleteOptions, st *DeleteStats, errs []error) []error {
+	count := func(removed bool, err error) {
+		var refused ErrDeleteRefused
+		switch {
+		case removed && err == nil:
+			st.Deleted++
+		case err == nil, isNotFound(err):
+			st.Missing++
+		case errors.As(err, &refused):
+			st.Refused++
+		default:
+			st.Failed++
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	bd, ok := s.blockstore.(BatchDeleter)
+	if !ok || len(ks) < 2 {
+		for _, c := range ks {
+			count(s.deleteBlock(ctx, c, AllStores, o))
+		}
+		return errs
+	}
+
+	allowed := make([]cid.Cid, 0, len(ks))
+	for _, c := range ks {
+		if err := s.guardDelete(ctx, c); err != nil {
+			count(false, err)
+			continue
+		}
+		allowed = append(allowed, c)
+	}
+	// the sizes tell the stored blocks from the missing ones, and are logged
+	// by the audit log
+	sizes, err := s.blockstoreSizes(ctx, allowed)
+	if err == nil {
+		err = bd.DeleteMany(ctx, allowed)
+	}
+	for i, c := range allowed {
+		d := blockDeletion{size: -1}
+		switch {
+		case err != nil:
+			d.record(err, -1)
+		case sizes[i] < 0:
+			d.record(ErrNotFound{Cid: c}, -1)
+		default:
+			d.record(nil, sizes[i])
+		}
+		if err == nil {
+			invalidateCache(ctx, s.blockstore, c)
+		}
+		s.forgetStored(c)
+		if s.fetchCache != nil {
+			d.deleteFrom(ctx, s, s.fetchCache, c)
+		}
+		count(s.endDelete(ctx, c, &d, o))
+	}
+	return errs
+}
+
+// deleteBlock deletes c from the selected blockstores and reports whether one
+// of them had it. The block was not stored if all of them report it missing.
+func (s *blockService) deleteBlock(ctx context.Context, c cid.Cid, from Stores, o deleteOptions) (bool, error) {
+	if err := s.guardDelete(ctx, c); err != nil {
+		return false, err
+	}
+	d := blockDeletion{size: -1}
+	if from&PrimaryStore != 0 {
+		d.deleteFrom(ctx, s, s.blockstore, c)
+		s.forgetStored(c)
+	}
+	if from&FetchCacheStore != 0 && s.fetchCache != nil {
+		d.deleteFrom(ctx, s, s.fetchCache, c)
+	}
+	return s.endDelete(ctx, c, &d, o)
+}
+
+// blockDeletion accumulates the outcomes of the deletes of a block from the
+// blockstores.
+type blockDeletion struct {
+	tried, missing int
+	removed        bool
+	size           int // size of the deleted block for the audit log
+	errs           []error
+}
+
+// deleteFrom deletes c from bs.
+func (d *blockDeletion) deleteFrom(ctx context.Context, s *blockService, bs blockstore.Blockstore, c cid.Cid) {
+	size := -1
+	if s.auditLog != nil {
+		// the size is only known before the delete
+		if sz, err := bs.GetSize(ctx, c); err == nil {
+			size = sz
+		}
+	}
+	err := bs.DeleteBlock(ctx, c)
+	d.record(err, size)
+	if err == nil || isNotFound(err) {
+		// also when c was missing, a cache claiming otherwise is stale
+		invalidateCache(ctx, bs, c)
+	}
+}
+
+// record records the outcome of a delete, size is the size of the block
+// before it, -1 if unknown.
+func (d *blockDeletion) record(err error, size int) {
+	d.tried++
+	switch {
+	case err == nil:
+		d.removed = true
+		d.size = max(d.size, size)
+	case isNotFound(err):
+		d.missing++
+	default:
+		d.errs = append(d.errs, err)
+	}
+}
+
+// endDelete audits the delete of c and returns its outcome: whether one of
+// the blockstores had it, and ErrNotFound if none of them did unless
+// ignored.
+func (s *blockService) endDelete(ctx context.Context, c cid.Cid, d *blockDeletion, o deleteOptions) (bool, error) {
+	if d.size >= 0 {
+		s.auditDelete(ctx, c, d.size)
+	}
+	if err := errors.Join(d.errs...); err != nil {
+		return d.removed, err
+	}
+	if d.tried != 0 && d.missing == d.tried && !o.ignoreNotFound {
+		return false, ErrNotFound{Cid: c}
+	}
+	logger.Debugf("BlockService.BlockDeleted %s", c)
+	return d.removed, nil
+}
+
+// isNotFound reports whether err is the way a blockstore reports a missing
+// block.
+func isNotFound(err error) bool {
+	var nf interface{ NotFound() bool }
+	return ipld.IsNotFound(err) ||
+		errors.Is(err, datastore.ErrNotFound) ||
+		errors.Is(err, fs.ErrNotExist) ||
+		(errors.As(err, &nf) && nf.NotFound())
+}
@@ -0,0 +1,263 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// reportingDeleteBlockstore reports the deletion of missing blocks with
+// notFound.
+type reportingDeleteBlockstore struct {
+	blockstore.Blockstore
+	notFound func(c cid.Cid) error
+}
+
+func (bs reportingDeleteBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	has, err := bs.Has(ctx, c)
+	if err != nil {
+		return err
+	}
+	if !has {
+		return bs.notFound(c)
+	}
+	return bs.Blockstore.DeleteBlock(ctx, c)
+}
+
+func TestDeleteNotFound(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name     string
+		notFound func(c cid.Cid) error
+	}{
+		{"ipld", func(c cid.Cid) error { return ipld.ErrNotFound{Cid: c} }},
+		{"datastore", func(c cid.Cid) error { return fmt.Errorf("deleting %s: %w", c, ds.ErrNotFound) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			bstore := reportingDeleteBlockstore{
+				Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+				notFound:   tc.notFound,
+			}
+			bserv := New(bstore, nil).(*blockService)
+
+			blks := random.BlocksOfSize(3, blockSize)
+			require.NoError(t, bserv.AddBlocks(ctx, blks[:2]))
+			require.NoError(t, bserv.DeleteBlock(ctx, blks[0].Cid()))
+
+			err := bserv.DeleteBlock(ctx, blks[0].Cid())
+			require.Equal(t, ErrNotFound{Cid: blks[0].Cid()}, err)
+			require.True(t, ipld.IsNotFound(err))
+			require.NoError(t, bserv.DeleteBlock(ContextWithDeleteOptions(ctx, DeleteIgnoreNotFound()), blks[0].Cid()))
+
+			err = bserv.DeleteBlocks(ctx, []cid.Cid{blks[1].Cid(), blks[2].Cid()})
+			require.ErrorIs(t, err, ErrNotFound{Cid: blks[2].Cid()})
+			var nf ErrNotFound
+			require.True(t, errors.As(err, &nf))
+			require.Equal(t, blks[2].Cid(), nf.Cid)
+			has, err := bstore.Has(ctx, blks[1].Cid())
+			require.NoError(t, err)
+			require.False(t, has)
+
+			require.NoError(t, bserv.DeleteBlocks(ctx, []cid.Cid{blks[1].Cid(), blks[2].Cid()}, DeleteIgnoreNotFound()))
+		})
+	}
+
+	t.Run("fetch cache", func(t *testing.T) {
+		t.Parallel()
+		notFound := func(c cid.Cid) error { return ipld.ErrNotFound{Cid: c} }
+		bstore := reportingDeleteBlockstore{blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), notFound}
+		cache := reportingDeleteBlockstore{blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), notFound}
+		bserv := New(bstore, nil, WithFetchCacheBlockstore(cache))
+
+		// missing from one of the blockstores only
+		blk := random.BlocksOfSize(1, blockSize)[0]
+		require.NoError(t, bserv.AddBlock(ctx, blk))
+		require.NoError(t, bserv.DeleteBlock(ctx, blk.Cid()))
+		require.ErrorIs(t, bserv.DeleteBlock(ctx, blk.Cid()), ErrNotFound{})
+	})
+
+	t.Run("unreported", func(t *testing.T) {
+		t.Parallel()
+		bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil)
+		require.NoError(t, bserv.DeleteBlock(ctx, random.BlocksOfSize(1, blockSize)[0].Cid()))
+	})
+}
+
+// failingDeleteBlockstore fails the deletes of the blocks of fail.
+type failingDeleteBlockstore struct {
+	blockstore.Blockstore
+	fail cid.Cid
+}
+
+func (bs failingDeleteBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	if c == bs.fail {
+		return errors.New("disk failure")
+	}
+	return bs.Blockstore.DeleteBlock(ctx, c)
+}
+
+func TestDeleteBlocksFromChannel(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(5, blockSize)
+	bstore := failingDeleteBlockstore{
+		Blockstore: reportingDeleteBlockstore{
+			Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+			notFound:   func(c cid.Cid) error { return ipld.ErrNotFound{Cid: c} },
+		},
+		fail: blks[3].Cid(),
+	}
+	bserv := New(bstore, nil).(*blockService)
+	require.NoError(t, bserv.AddBlocks(ctx, blks[:4]))
+
+	ks := make(chan cid.Cid)
+	go func() {
+		defer close(ks)
+		for _, b := range blks {
+			ks <- b.Cid()
+		}
+	}()
+	st, err := bserv.DeleteBlocksFromChannel(ctx, ks, DeleteIgnoreNotFound())
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrNotFound{})
+	require.Equal(t, DeleteStats{Deleted: 3, Missing: 1, Failed: 1}, st)
+	for _, b := range blks[:3] {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+
+	// without DeleteIgnoreNotFound the missing blocks are errors too
+	ks = make(chan cid.Cid, 1)
+	ks <- blks[0].Cid()
+	close(ks)
+	st, err = bserv.DeleteBlocksFromChannel(ctx, ks)
+	require.ErrorIs(t, err, ErrNotFound{})
+	require.Equal(t, DeleteStats{Missing: 1}, st)
+}
+
+func TestDeleteBlocksFromChannelCanceled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil).(*blockService)
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	require.NoError(t, bserv.AddBlock(ctx, blk))
+
+	ks := make(chan cid.Cid)
+	go func() {
+		ks <- blk.Cid()
+		// the channel is never closed
+		for {
+			if has, _ := bstore.Has(ctx, blk.Cid()); !has {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	st, err := bserv.DeleteBlocksFromChannel(ctx, ks)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, DeleteStats{Deleted: 1}, st)
+}
+
+// batchDeleteBlockstore records the batches of DeleteMany and fails the
+// deletes of a single block.
+type batchDeleteBlockstore struct {
+	blockstore.Blockstore
+
+	lk      sync.Mutex
+	batches [][]cid.Cid
+}
+
+func (bs *batchDeleteBlockstore) DeleteBlock(context.Context, cid.Cid) error {
+	return errors.New("DeleteBlock called")
+}
+
+func (bs *batchDeleteBlockstore) DeleteMany(ctx context.Context, ks []cid.Cid) error {
+	bs.lk.Lock()
+	bs.batches = append(bs.batches, slices.Clone(ks))
+	bs.lk.Unlock()
+	for _, c := range ks {
+		if err := bs.Blockstore.DeleteBlock(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestDeleteBlocksFromChannelBatched(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(6, blockSize)
+	bstore := &batchDeleteBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	errProtected := errors.New("protected")
+	bserv := New(bstore, nil, WithDeleteGuard(func(_ context.Context, c cid.Cid) error {
+		if c == blks[1].Cid() {
+			return errProtected
+		}
+		return nil
+	})).(*blockService)
+	require.NoError(t, bserv.AddBlocks(ctx, blks[:5]))
+
+	// the CIDs ready are deleted together
+	ks := make(chan cid.Cid, len(blks))
+	for _, b := range blks {
+		ks <- b.Cid()
+	}
+	close(ks)
+	st, err := bserv.DeleteBlocksFromChannel(ctx, ks, DeleteIgnoreNotFound())
+	require.ErrorIs(t, err, errProtected)
+	var refused ErrDeleteRefused
+	require.ErrorAs(t, err, &refused)
+	require.Equal(t, blks[1].Cid(), refused.Cid)
+	require.Equal(t, DeleteStats{Deleted: 4, Missing: 1, Refused: 1}, st)
+	require.Equal(t, [][]cid.Cid{cidsOf(append(blks[:1:1], blks[2:]...)...)}, bstore.batches)
+
+	has, err := bstore.Has(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+	for _, b := range append(blks[:1:1], blks[2:5]...) {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+}
+
+func TestDeleteGuard(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithDeleteGuard(func(context.Context, cid.Cid) error {
+		return errors.New("pinned")
+	}))
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	require.NoError(t, bserv.AddBlock(ctx, blk))
+	require.ErrorAs(t, bserv.DeleteBlock(ctx, blk.Cid()), &ErrDeleteRefused{})
+	has, err := bstore.Has(ctx, blk.Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	_, err = NewWithOptions(bstore, nil, WithDeleteGuard(nil))
+	require.Error(t, err)
+}
@@ -0,0 +1,137 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	ipld "github.com/ipfs/go-ipld-format"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// Values of the outcome attribute of the detailed spans.
+const (
+	outcomeFound    = "found"
+	outcomeNotFound = "not-found"
+	outcomeError    = "error"
+)
+
+// WithDetailedTracing adds child spans for the exchange fetches and the
+// blockstore writes of GetBlock, and one span for the exchange fetch of each
+// GetBlocks call. They are off by default as they add a few spans per call.
+func WithDetailedTracing() Option {
+	return func(bs *blockService) {
+		bs.detailedTracing = true
+	}
+}
+
+func (s *blockService) detailedTracingEnabled() bool {
+	return s != nil && s.detailedTracing
+}
+
+// startDetailedSpan starts a span if detailed tracing is enabled, otherwise it
+// returns ctx and a no-op span.
+func (s *blockService) startDetailedSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !s.detailedTracingEnabled() {
+		return ctx, noop.Span{}
+	}
+	return internal.StartSpan(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endFetchSpan records the result of the fetch of blk and ends span.
+func endFetchSpan(span trace.Span, blk blocks.Block, err error) {
+	switch {
+	case err == nil:
+		span.SetAttributes(attribute.String("outcome", outcomeFound), attribute.Int("bytes", len(blk.RawData())))
+	case ipld.IsNotFound(err):
+		span.SetAttributes(attribute.String("outcome", outcomeNotFound))
+	default:
+		span.SetAttributes(attribute.String("outcome", outcomeError))
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endSpan records err and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// fetchBatch accumulates what happened to the blocks of one exchange fetch of
+// getBlocks until the span is ended.
+type fetchBatch struct {
+	span      trace.Span
+	requested int
+	blocks    int
+	bytes     int
+	writeTime time.Duration
+}
+
+func (b *fetchBatch) received(blk blocks.Block) {
+	b.blocks++
+	b.bytes += len(blk.RawData())
+}
+
+// startWrite returns the start time of a cache write, or the zero time when
+// the span isn't recorded to avoid reading the clock for nothing.
+func (b *fetchBatch) startWrite() time.Time {
+	if !b.span.IsRecording() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (b *fetchBatch) wrote(start time.Time) {
+	if !start.IsZero() {
+		b.writeTime += time.Since(start)
+	}
+}
+
+func (b *fetchBatch) end(ctx context.Context, err error) {
+	if !b.span.IsRecording() {
+		b.span.End()
+		return
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	outcome := outcomeFound
+	switch {
+	case err != nil:
+		outcome = outcomeError
+		b.span.SetStatus(codes.Error, err.Error())
+	case b.blocks < b.requested:
+		outcome = outcomeNotFound
+	}
+	b.span.SetAttributes(
+		attribute.String("outcome", outcome),
+		attribute.Int("received", b.blocks),
+		attribute.Int("bytes", b.bytes),
+		attribute.Int64("cache_write_ns", b.writeTime.Nanoseconds()),
+	)
+	b.span.End()
+}
+
+type sessionFetchKey struct{}
+
+// markSessionFetch records in ctx that the fetches are done through s, for
+// the session attribute of the detailed spans.
+func (s *Session) markSessionFetch(ctx context.Context) context.Context {
+	if !grabServiceFromBlockservice(s.bs).detailedTracingEnabled() {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionFetchKey{}, true)
+}
+
+func usedSession(ctx context.Context) bool {
+	ses, _ := ctx.Value(sessionFetchKey{}).(bool)
+	return ses
+}
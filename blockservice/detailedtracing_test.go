@@ -0,0 +1,106 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spansInTrace returns the ended spans named name which are part of the trace
+// of root.
+func spansInTrace(root trace.Span, name string) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, s := range recordSpans().Ended() {
+		if s.Name() == name && s.SpanContext().TraceID() == root.SpanContext().TraceID() {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func TestDetailedTracing(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	missing := random.BlocksOfSize(1, blockSize)[0].Cid()
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(context.Background(), blks))
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), offline.Exchange(exchbstore), WithDetailedTracing())
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	_, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	_, err = bserv.GetBlock(ctx, missing)
+	require.Error(t, err)
+	var n int
+	for range NewSession(ctx, bserv).GetBlocks(ctx, []cid.Cid{blks[1].Cid(), blks[2].Cid(), missing}) {
+		n++
+	}
+	require.Equal(t, 2, n)
+	root.End()
+
+	fetches := spansInTrace(root, "Blockservice.getBlock.fetch")
+	require.Len(t, fetches, 2)
+	outcomes := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range fetches {
+		v, ok := spanAttribute(s, "outcome")
+		require.True(t, ok)
+		outcomes[v.AsString()] = s
+		v, _ = spanAttribute(s, "session")
+		require.False(t, v.AsBool())
+	}
+	require.Contains(t, outcomes, outcomeNotFound)
+	require.Contains(t, outcomes, outcomeFound)
+	v, _ := spanAttribute(outcomes[outcomeFound], "bytes")
+	require.EqualValues(t, blockSize, v.AsInt64())
+
+	writes := spansInTrace(root, "Blockservice.getBlock.cacheWrite")
+	require.Len(t, writes, 1)
+
+	batches := spansInTrace(root, "Blockservice.getBlocks.fetch")
+	require.Len(t, batches, 1)
+	for key, want := range map[attribute.Key]attribute.Value{
+		"session":   attribute.BoolValue(true),
+		"requested": attribute.IntValue(3),
+		"received":  attribute.IntValue(2),
+		"bytes":     attribute.IntValue(2 * blockSize),
+		"outcome":   attribute.StringValue(outcomeNotFound),
+	} {
+		v, ok := spanAttribute(batches[0], key)
+		require.True(t, ok, key)
+		require.Equal(t, want, v, key)
+	}
+	_, ok := spanAttribute(batches[0], "cache_write_ns")
+	require.True(t, ok)
+}
+
+func TestDetailedTracingDisabled(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.Put(context.Background(), blk))
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), offline.Exchange(exchbstore))
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	_, err := bserv.GetBlock(ctx, blk.Cid())
+	require.NoError(t, err)
+	root.End()
+
+	require.Empty(t, spansInTrace(root, "Blockservice.getBlock.fetch"))
+	require.Empty(t, spansInTrace(root, "Blockservice.getBlock.cacheWrite"))
+	require.NotEmpty(t, spansInTrace(root, "Blockservice.blockService.GetBlock"))
+}
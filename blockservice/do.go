@@ -0,0 +1,21 @@
+package blockservice
+
+import (
+	"context"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// Do runs fn with a new [Session] of bs, embedded in the context passed to fn
+// so the calls to bs made with it go through the session too. Everything fn
+// does is traced under a single span and the session is closed when fn
+// returns, or panics. The error of fn is returned unchanged.
+func Do(ctx context.Context, bs BlockService, fn func(ctx context.Context, ses *Session) error) error {
+	ctx, span := internal.StartSpan(ctx, "Do")
+	defer span.End()
+	grabServiceFromBlockservice(bs).tagSpan(ctx, span)
+
+	ses := newSession(ctx, bs)
+	defer ses.Close()
+	return fn(EmbedSessionInContext(ctx, ses), ses)
+}
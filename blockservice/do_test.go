@@ -0,0 +1,73 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestDo(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil)
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	require.NoError(t, bserv.AddBlock(ctx, blk))
+
+	errFn := errors.New("fn failed")
+	var session *Session
+	err := Do(ctx, bserv, func(ctx context.Context, ses *Session) error {
+		session = ses
+		require.Same(t, ses, NewSession(ctx, bserv))
+		_, err := bserv.GetBlock(ctx, blk.Cid())
+		require.NoError(t, err)
+		return errFn
+	})
+	require.Same(t, errFn, err)
+
+	// the session is closed once fn returned
+	_, err = session.GetBlock(ctx, blk.Cid())
+	require.ErrorIs(t, err, ErrSessionClosed)
+
+	// the nested calls are traced under the span of Do
+	doSpans := make(map[trace.SpanID]bool)
+	for _, s := range recordSpans().Ended() {
+		if s.Name() == "Blockservice.Do" {
+			doSpans[s.SpanContext().SpanID()] = true
+		}
+	}
+	var nested bool
+	for _, s := range recordSpans().Ended() {
+		if s.Name() == "Blockservice.Session.GetBlock" && doSpans[s.Parent().SpanID()] {
+			nested = true
+		}
+	}
+	require.True(t, nested)
+}
+
+func TestDoClosesSessionOnPanic(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil)
+
+	var session *Session
+	require.PanicsWithValue(t, "boom", func() {
+		Do(ctx, bserv, func(ctx context.Context, ses *Session) error {
+			session = ses
+			panic("boom")
+		})
+	})
+	_, err := session.GetBlock(ctx, random.BlocksOfSize(1, blockSize)[0].Cid())
+	require.ErrorIs(t, err, ErrSessionClosed)
+}
@@ -0,0 +1,135 @@
+package blockservice
+
+import (
+	"context"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DryRunListLimit is the number of CIDs listed by each list of a
+// [DryRunReport], the others are only counted.
+const DryRunListLimit = 1000
+
+// DryRunner is implemented by the blockservices of [New].
+type DryRunner interface {
+	// AddBlocksDryRun runs the checks and the deduplication of AddBlocks on
+	// bs and reports what AddBlocks would do, without writing, announcing,
+	// providing or purging anything. The hashes are verified in parallel
+	// as by AddBlocks with [WithVerifyOnAdd].
+	AddBlocksDryRun(ctx context.Context, bs []blocks.Block) (DryRunReport, error)
+}
+
+var _ DryRunner = (*blockService)(nil)
+
+// DryRunReport is what AddBlocks would do with a batch of blocks.
+type DryRunReport struct {
+	// New is the number of blocks which would be written and NewBytes their
+	// size.
+	New      int
+	NewBytes uint64
+	// Duplicates is the number of blocks which would not be written because
+	// they are already stored or come earlier in the batch.
+	Duplicates int
+	// Rejected is the number of blocks rejected by the checks of AddBlocks,
+	// without [WithSkipInvalid] AddBlocks would fail on the first one.
+	Rejected int
+
+	// DuplicateCids and RejectedErrs list the first [DryRunListLimit]
+	// duplicates and rejected blocks, the latter with the reason why, and
+	// DuplicatesOverflow and RejectedOverflow count the ones left out.
+	DuplicateCids      []cid.Cid
+	RejectedErrs       map[cid.Cid]error
+	DuplicatesOverflow int
+	RejectedOverflow   int
+}
+
+func (r *DryRunReport) duplicate(c cid.Cid) {
+	r.Duplicates++
+	if len(r.DuplicateCids) == DryRunListLimit {
+		r.DuplicatesOverflow++
+		return
+	}
+	r.DuplicateCids = append(r.DuplicateCids, c)
+}
+
+func (r *DryRunReport) reject(c cid.Cid, err error) {
+	r.Rejected++
+	if len(r.RejectedErrs) == DryRunListLimit {
+		r.RejectedOverflow++
+		return
+	}
+	if r.RejectedErrs == nil {
+		r.RejectedErrs = make(map[cid.Cid]error)
+	}
+	r.RejectedErrs[c] = err
+}
+
+func (s *blockService) AddBlocksDryRun(ctx context.Context, bs []blocks.Block) (DryRunReport, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.AddBlocksDryRun")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return DryRunReport{}, ErrReadOnly
+	}
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return DryRunReport{}, err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Add)
+	defer cancel()
+
+	mismatches, err := s.verifyBlocks(ctx, bs)
+	if err != nil {
+		return DryRunReport{}, err
+	}
+
+	var r DryRunReport
+	seen := make(map[cid.Cid]struct{}, len(bs))
+	for i, b := range bs {
+		c := b.Cid()
+		// the checks of AddBlocks, without their side effects
+		err := s.SecurityPolicy().ValidateCid(c)
+		if err == nil {
+			err = s.blockerErr(c)
+		}
+		if err == nil {
+			err = s.checkPolicyBlock(b)
+		}
+		if err == nil && mismatches != nil {
+			err = mismatches[i]
+		}
+		if err == nil && s.sizeGuardEnforce {
+			err = s.unservableErr(b)
+		}
+		if err != nil {
+			r.reject(c, err)
+			continue
+		}
+
+		if _, ok := seen[c]; ok {
+			r.duplicate(c)
+			continue
+		}
+		seen[c] = struct{}{}
+		if s.checkFirst {
+			has, err := s.blockstore.Has(ctx, c)
+			if err != nil {
+				return DryRunReport{}, err
+			}
+			if has {
+				r.duplicate(c)
+				continue
+			}
+		}
+		r.New++
+		r.NewBytes += uint64(len(b.RawData()))
+	}
+	span.SetAttributes(attribute.Int("new", r.New), attribute.Int("duplicates", r.Duplicates), attribute.Int("rejected", r.Rejected))
+	return r, nil
+}
@@ -0,0 +1,87 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddBlocksDryRun(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(5, blockSize)
+	corrupt, err := blocks.NewBlockWithCid([]byte("corrupt"), blks[4].Cid())
+	require.NoError(t, err)
+
+	inner := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, inner.PutMany(ctx, blks[:2]))
+	bstore := &hookPutBlockstore{Blockstore: inner, onPut: func(...blocks.Block) {
+		t.Error("unexpected put")
+	}}
+	exch := &notifyRecordingExchange{Interface: offline.Exchange(inner), notified: make(map[cid.Cid]int)}
+	prov := &recordingProvider{}
+	deny := &denylist{}
+	deny.block(blks[1].Cid(), blks[3].Cid())
+	bserv := New(bstore, exch, WithProvider(prov), WithContentBlocker(deny.check), WithPurgeBlocked(), WithVerifyOnAdd())
+	defer bserv.Close()
+
+	r, err := bserv.(DryRunner).AddBlocksDryRun(ctx, []blocks.Block{blks[0], blks[1], blks[2], blks[2], blks[3], corrupt})
+	require.NoError(t, err)
+	require.Equal(t, 1, r.New)
+	require.EqualValues(t, blockSize, r.NewBytes)
+	require.Equal(t, 2, r.Duplicates)
+	require.Equal(t, []cid.Cid{blks[0].Cid(), blks[2].Cid()}, r.DuplicateCids)
+	require.Equal(t, 3, r.Rejected)
+	require.Len(t, r.RejectedErrs, 3)
+	require.ErrorIs(t, r.RejectedErrs[blks[1].Cid()], ErrBlocked)
+	require.ErrorIs(t, r.RejectedErrs[blks[3].Cid()], ErrBlocked)
+	require.ErrorIs(t, r.RejectedErrs[corrupt.Cid()], ErrHashMismatch)
+	require.Zero(t, r.DuplicatesOverflow)
+	require.Zero(t, r.RejectedOverflow)
+
+	// nothing was written, announced, provided or purged
+	require.NoError(t, bserv.(IdleWaiter).WaitIdle(ctx))
+	require.Empty(t, prov.Provided())
+	exch.lk.Lock()
+	require.Empty(t, exch.notified)
+	exch.lk.Unlock()
+	for _, b := range blks[:2] {
+		has, err := inner.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	for _, b := range blks[2:] {
+		has, err := inner.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+
+	_, err = New(bstore, nil, WithReadOnly()).(DryRunner).AddBlocksDryRun(ctx, blks)
+	require.ErrorIs(t, err, ErrReadOnly)
+}
+
+func TestAddBlocksDryRunOverflow(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(DryRunListLimit+2, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.PutMany(ctx, blks))
+	bserv := New(bstore, nil)
+
+	r, err := bserv.(DryRunner).AddBlocksDryRun(ctx, blks)
+	require.NoError(t, err)
+	require.Zero(t, r.New)
+	require.Equal(t, DryRunListLimit+2, r.Duplicates)
+	require.Len(t, r.DuplicateCids, DryRunListLimit)
+	require.Equal(t, 2, r.DuplicatesOverflow)
+}
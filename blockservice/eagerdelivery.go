@@ -0,0 +1,39 @@
+package blockservice
+
+import (
+	"context"
+)
+
+// WithEagerDelivery makes GetBlocks send the blocks fetched from the exchange
+// to the consumer before writing them to the blockstore, announcing them to
+// the exchange and providing them, so the consumer doesn't wait for this
+// bookkeeping.
+// The blocks read from the output channel may not be stored yet, nor stored
+// at all if their write fails. The failures are logged and counted in
+// [Stats.DeferredCacheFailures], they don't stop the delivery of the other
+// blocks. The bookkeeping of the delivered blocks is completed even if the
+// context of GetBlocks is canceled, until the blockservice is closed.
+// By default the blocks are delivered once stored.
+func WithEagerDelivery() Option {
+	return func(bs *blockService) {
+		bs.eagerDelivery = true
+	}
+}
+
+func (s *blockService) eagerDeliveryEnabled() bool {
+	return s != nil && s.eagerDelivery
+}
+
+// bookkeepingContext returns a context keeping the values of ctx which is
+// only canceled when the blockservice is closed, or by the returned function.
+func (s *blockService) bookkeepingContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	if s == nil {
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(s.serviceCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
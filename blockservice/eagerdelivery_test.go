@@ -0,0 +1,104 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedPutBlockstore holds the writes until the gate is closed or their
+// context is canceled, or fails them with err.
+type gatedPutBlockstore struct {
+	blockstore.Blockstore
+	gate chan struct{}
+	err  error
+}
+
+func (bs *gatedPutBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	select {
+	case <-bs.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if bs.err != nil {
+		return bs.err
+	}
+	return bs.Blockstore.Put(ctx, b)
+}
+
+func TestWithEagerDelivery(t *testing.T) {
+	t.Parallel()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	ks := []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(context.Background(), blks))
+
+	t.Run("default", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		bstore := &gatedPutBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), gate: make(chan struct{})}
+		bserv := New(bstore, offline.Exchange(exchbstore))
+
+		// the blocks are stored before being delivered
+		out := bserv.GetBlocks(ctx, ks)
+		select {
+		case <-out:
+			t.Fatal("a block was delivered before being stored")
+		case <-time.After(20 * time.Millisecond):
+		}
+		close(bstore.gate)
+		b := <-out
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	})
+
+	t.Run("cancel after delivery", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		bstore := &gatedPutBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), gate: make(chan struct{})}
+		bserv := New(bstore, offline.Exchange(exchbstore), WithEagerDelivery())
+		defer bserv.Close()
+
+		// the block is delivered while its write is held
+		b := <-bserv.GetBlocks(ctx, ks)
+		cancel()
+		close(bstore.gate)
+		require.Eventually(t, func() bool {
+			has, err := bstore.Has(context.Background(), b.Cid())
+			require.NoError(t, err)
+			return has
+		}, time.Second, time.Millisecond)
+		require.Zero(t, bserv.(*blockService).Stats(false).DeferredCacheFailures)
+	})
+
+	t.Run("failing writes", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		gate := make(chan struct{})
+		close(gate)
+		bstore := &gatedPutBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), gate: gate, err: errors.New("disk full")}
+		bserv := New(bstore, offline.Exchange(exchbstore), WithEagerDelivery()).(*blockService)
+
+		// the failures don't stop the delivery, they are counted
+		var got []cid.Cid
+		for b := range bserv.GetBlocks(ctx, ks) {
+			got = append(got, b.Cid())
+		}
+		require.ElementsMatch(t, ks, got)
+		require.EqualValues(t, len(ks), bserv.Stats(false).DeferredCacheFailures)
+	})
+}
@@ -0,0 +1,120 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// WithBlockErrorHandler sets a function called by GetBlocks for every CID it
+// could not return, with the reason: rejected by the allowlist or the content
+// blocker, missing, rejected by [WithMaxFetchedBlockSize], canceled context,
+// blockstore write error...
+// It is called at most once per CID and always before the channel returned by
+// GetBlocks is closed. It runs inline in the goroutines producing the blocks,
+// never concurrently for the same call, so it must not block or call back into
+// the blockservice.
+func WithBlockErrorHandler(handler func(cid.Cid, error)) Option {
+	return func(bs *blockService) {
+		bs.blockErrorHandler = handler
+	}
+}
+
+// blockErrorTracker keeps track of the CIDs of a GetBlocks call which have not
+// been delivered yet. A nil tracker does nothing.
+type blockErrorTracker struct {
+	s       *blockService
+	handler func(cid.Cid, error) // nil without WithBlockErrorHandler
+	session func(cid.Cid, error) // records the failures in the session
+
+	lk      sync.Mutex
+	pending map[cid.Cid]struct{}
+}
+
+// newBlockErrorTracker returns nil if no handler is configured and the call
+// is not made through a session, session is the failureRecorder of the
+// session.
+func (s *blockService) newBlockErrorTracker(ks []cid.Cid, session func(cid.Cid, error)) *blockErrorTracker {
+	var handler func(cid.Cid, error)
+	if s != nil {
+		handler = s.blockErrorHandler
+	}
+	if handler == nil && session == nil {
+		return nil
+	}
+	t := &blockErrorTracker{
+		s:       s,
+		handler: handler,
+		session: session,
+		pending: make(map[cid.Cid]struct{}, len(ks)),
+	}
+	for _, k := range ks {
+		t.pending[k] = struct{}{}
+	}
+	return t
+}
+
+// delivered records c has been returned.
+func (t *blockErrorTracker) delivered(c cid.Cid) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	delete(t.pending, c)
+}
+
+// fail reports err for c unless it has already been delivered or reported.
+func (t *blockErrorTracker) fail(c cid.Cid, err error) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if _, ok := t.pending[c]; !ok {
+		return
+	}
+	delete(t.pending, c)
+	t.report(c, err)
+}
+
+// finish reports the CIDs still pending with err, or with ctx's error or not
+// found if err is nil.
+func (t *blockErrorTracker) finish(ctx context.Context, err error) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if err == nil {
+		err = ctx.Err()
+	}
+	for c := range t.pending {
+		if err != nil {
+			t.report(c, err)
+		} else {
+			t.report(c, ipld.ErrNotFound{Cid: c})
+		}
+	}
+	t.pending = nil
+}
+
+// report calls the handler, a panic is recovered so the other CIDs are still
+// reported.
+func (t *blockErrorTracker) report(c cid.Cid, err error) {
+	if t.session != nil {
+		t.session(c, err)
+	}
+	if t.handler == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			t.s.recovered("block error handler", r)
+			t.s.repanic(r)
+		}
+	}()
+	t.handler(c, err)
+}
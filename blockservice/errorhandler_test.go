@@ -0,0 +1,60 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockErrorHandler(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	big := random.BlocksOfSize(1, 2*blockSize)[0]
+	local, fetched, blocked, missing := blks[0], blks[1], blks[2], blks[3]
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, local))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, append(blks, big)))
+
+	errs := make(map[cid.Cid]error)
+	var calls int
+	bserv := New(bstore, offline.Exchange(exchbstore),
+		WithMaxFetchedBlockSize(blockSize),
+		WithContentBlocker(func(c cid.Cid) error {
+			if c == blocked.Cid() {
+				return errors.New("blocked")
+			}
+			return nil
+		}),
+		WithBlockErrorHandler(func(c cid.Cid, err error) {
+			calls++
+			errs[c] = err
+		}),
+	)
+	require.NoError(t, exchbstore.DeleteBlock(ctx, missing.Cid()))
+
+	ks := []cid.Cid{local.Cid(), fetched.Cid(), blocked.Cid(), missing.Cid(), big.Cid(), missing.Cid()}
+	var got []cid.Cid
+	for b := range bserv.GetBlocks(ctx, ks) {
+		got = append(got, b.Cid())
+	}
+	require.ElementsMatch(t, []cid.Cid{local.Cid(), fetched.Cid()}, got)
+
+	require.Equal(t, 3, calls, "one call per failed CID")
+	require.ErrorIs(t, errs[blocked.Cid()], ErrBlocked)
+	require.True(t, ipld.IsNotFound(errs[missing.Cid()]))
+	var tooLarge *BlockTooLargeError
+	require.ErrorAs(t, errs[big.Cid()], &tooLarge)
+}
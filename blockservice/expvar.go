@@ -0,0 +1,27 @@
+package blockservice
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+)
+
+// expvarLk makes checking and publishing an expvar name atomic, expvar.Publish
+// panics on duplicates.
+var expvarLk sync.Mutex
+
+func (s *blockService) PublishExpvar(prefix string) error {
+	if prefix == "" {
+		return errors.New("PublishExpvar: empty prefix")
+	}
+	expvarLk.Lock()
+	defer expvarLk.Unlock()
+	if expvar.Get(prefix) != nil {
+		return fmt.Errorf("PublishExpvar: %q is already published", prefix)
+	}
+	expvar.Publish(prefix, expvar.Func(func() any {
+		return s.totalStats()
+	}))
+	return nil
+}
@@ -0,0 +1,62 @@
+package blockservice
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsReset(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil).(StatsReporter)
+	blks := random.BlocksOfSize(3, blockSize)
+
+	require.NoError(t, bserv.(BlockService).AddBlock(ctx, blks[0]))
+	require.EqualValues(t, blockSize, bserv.Stats(true).AddBytes.Written)
+	require.Zero(t, bserv.Stats(false).AddBytes.Written)
+
+	require.NoError(t, bserv.(BlockService).AddBlocks(ctx, blks[1:]))
+	st := bserv.Stats(true)
+	require.Zero(t, st.AddBytes.Written)
+	require.EqualValues(t, 2*blockSize, st.AddBatchBytes.Written)
+	require.Zero(t, bserv.Stats(false).AddBatchBytes.Written)
+}
+
+func TestPublishExpvar(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil)
+	reporter := bserv.(StatsReporter)
+	// expvar is global, the tests may run more than once in a process
+	name := fmt.Sprintf("test_publish_expvar_%d", time.Now().UnixNano())
+	require.Error(t, reporter.PublishExpvar(""))
+	require.NoError(t, reporter.PublishExpvar(name))
+	require.Error(t, reporter.PublishExpvar(name))
+	require.Error(t, New(bstore, nil).(StatsReporter).PublishExpvar(name))
+
+	read := func() Stats {
+		var st Stats
+		require.NoError(t, json.Unmarshal([]byte(expvar.Get(name).String()), &st))
+		return st
+	}
+	require.Zero(t, read().AddBytes.Written)
+
+	// the variable is read lazily and ignores resets
+	require.NoError(t, bserv.AddBlock(ctx, random.BlocksOfSize(1, blockSize)[0]))
+	reporter.Stats(true)
+	require.EqualValues(t, blockSize, read().AddBytes.Written)
+}
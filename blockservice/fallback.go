@@ -0,0 +1,85 @@
+package blockservice
+
+import (
+	"context"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// WithReadFallbackBlockstore sets a read-only blockstore consulted when a
+// block is missing from the primary blockstore, before asking the exchange.
+// The fallback is never written to.
+func WithReadFallbackBlockstore(fallback blockstore.Blockstore) Option {
+	return func(bs *blockService) {
+		if fallback == nil {
+			bs.invalidOption("WithReadFallbackBlockstore: nil blockstore")
+			return
+		}
+		bs.fallback = fallback
+	}
+}
+
+// WithCopyUpOnFallbackHit makes the blocks found in the fallback blockstore be
+// written as if they had been fetched, to the primary blockstore or to the
+// fetch cache of [WithFetchCacheBlockstore]. Nothing is copied while the
+// blockservice is read-only.
+func WithCopyUpOnFallbackHit() Option {
+	return func(bs *blockService) {
+		bs.copyUpOnFallbackHit = true
+	}
+}
+
+// getFromFallback looks c up in the fallback blockstore, it returns false when
+// there is no fallback or it doesn't have the block.
+func (s *blockService) getFromFallback(ctx context.Context, c cid.Cid) (blocks.Block, bool) {
+	if s == nil || s.fallback == nil {
+		return nil, false
+	}
+	blk, err := s.fallback.Get(ctx, c)
+	if err != nil {
+		if !ipld.IsNotFound(err) {
+			logger.Debugf("fallback blockstore get %s: %s", c, err)
+		}
+		return nil, false
+	}
+	if s.copyUpOnFallbackHit && !s.isReadOnly() {
+		if err := s.copyUp(ctx, blk); err != nil {
+			logger.Errorf("failed to copy %s from the fallback blockstore: %s", c, err)
+		}
+	}
+	return blk, true
+}
+
+// copyUp writes blk found in the fallback blockstore to the fetchStore.
+func (s *blockService) copyUp(ctx context.Context, blk blocks.Block) error {
+	refund, err := reserveQuota(ctx, blk)
+	if err != nil {
+		return err
+	}
+	if err := s.retryPut(ctx, func() error { return s.fetchStore(s).Put(ctx, blk) }); err != nil {
+		refund()
+		return err
+	}
+	s.countWritten(writePathFetchCache, blk)
+	s.audit(ctx, AuditAdd, blk)
+	s.markFetchStored(blk.Cid())
+	return nil
+}
+
+// getSizeFromFallback is like getFromFallback for the size of c.
+func (s *blockService) getSizeFromFallback(ctx context.Context, c cid.Cid) (int, bool) {
+	if s == nil || s.fallback == nil {
+		return 0, false
+	}
+	size, err := s.fallback.GetSize(ctx, c)
+	if err != nil {
+		if !ipld.IsNotFound(err) {
+			logger.Debugf("fallback blockstore getsize %s: %s", c, err)
+		}
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,94 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFallbackBlockstore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	fallback := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, fallback.PutMany(ctx, blks[:2]))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.Put(ctx, blks[2]))
+	ex := &notifyCountingExchange{Interface: offline.Exchange(exchbstore)}
+	bserv := New(bstore, ex, WithReadFallbackBlockstore(fallback))
+
+	blk, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), blk.RawData())
+	require.Zero(t, ex.notifyCount, "fallback hits must not go to the exchange")
+
+	size, err := bserv.(*blockService).GetSize(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.Equal(t, len(blks[1].RawData()), size)
+
+	var got []cid.Cid
+	for b := range bserv.GetBlocks(ctx, []cid.Cid{blks[1].Cid(), blks[2].Cid()}) {
+		got = append(got, b.Cid())
+	}
+	require.ElementsMatch(t, []cid.Cid{blks[1].Cid(), blks[2].Cid()}, got)
+	require.Equal(t, 1, ex.notifyCount, "only the fallback miss is fetched")
+
+	has, err := bstore.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.False(t, has, "fallback hits are not copied by default")
+	has, err = fallback.Has(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.False(t, has, "the fallback is never written to")
+}
+
+func TestCopyUpOnFallbackHit(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	fallback := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, fallback.PutMany(ctx, blks))
+	rec := &auditRecorder{}
+	bserv := New(bstore, nil, WithReadFallbackBlockstore(fallback), WithCopyUpOnFallbackHit(), WithAuditSink(rec.record)).(*blockService)
+
+	_, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[1].Cid()}) {
+	}
+
+	for _, b := range blks {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	require.EqualValues(t, 2*blockSize, bserv.Stats(false).FetchCacheBytes.Written)
+	require.NoError(t, bserv.Close())
+	require.Equal(t, []string{"add " + blks[0].Cid().String() + " ", "add " + blks[1].Cid().String() + " "}, rec.ops())
+}
+
+func TestCopyUpOnFallbackHitReadOnly(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	fallback := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, fallback.Put(ctx, blk))
+	bserv := New(bstore, nil, WithReadFallbackBlockstore(fallback), WithCopyUpOnFallbackHit(), WithReadOnly())
+
+	_, err := bserv.GetBlock(ctx, blk.Cid())
+	require.NoError(t, err)
+	has, err := bstore.Has(ctx, blk.Cid())
+	require.NoError(t, err)
+	require.False(t, has, "a read-only blockservice doesn't copy up")
+}
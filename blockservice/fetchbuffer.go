@@ -0,0 +1,160 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"golang.org/x/sync/semaphore"
+)
+
+// WithFetchBuffer lets GetBlocks buffer up to n blocks received from the
+// exchange which the consumer has not read yet, so a slow consumer does not
+// stall the exchange. The default is 0, blocks are handed to the consumer one
+// at a time.
+func WithFetchBuffer(n int) Option {
+	return func(bs *blockService) {
+		if n < 0 {
+			bs.invalidOption("WithFetchBuffer: negative size %d", n)
+			return
+		}
+		bs.fetchBuffer = n
+	}
+}
+
+// WithFetchMemoryBudget bounds the size of the blocks received from the
+// exchange but not yet delivered to the consumer of a GetBlocks call.
+// When the budget is exhausted GetBlocks stops reading from the exchange until
+// the consumer catches up. It only has an effect with [WithFetchBuffer].
+func WithFetchMemoryBudget(bytes int64) Option {
+	return func(bs *blockService) {
+		if bytes < 0 {
+			bs.invalidOption("WithFetchMemoryBudget: negative budget %d", bytes)
+			return
+		}
+		bs.fetchMemoryBudget = bytes
+	}
+}
+
+// deliveryBuffer is the queue between the goroutine receiving blocks from the
+// exchange and the consumer reading the output channel of GetBlocks, it holds
+// up to the size of [WithFetchBuffer] blocks plus the one being delivered.
+// The time spent blocked on the consumer is counted in
+// [Stats.ConsumerWaitTime] and recorded for GetBlocksDebug.
+type deliveryBuffer struct {
+	ctx     context.Context
+	s       *blockService
+	dbg     *retrievalRecorder
+	send    func(blocks.Block) bool
+	pending chan delivery
+	budget  *semaphore.Weighted
+	max     int64
+	done    sync.WaitGroup
+}
+
+// newDeliveryBuffer starts delivering the pushed blocks with send, close must
+// be called before closing the output.
+func (s *blockService) newDeliveryBuffer(ctx context.Context, dbg *retrievalRecorder, send func(blocks.Block) bool) *deliveryBuffer {
+	var size int
+	var budget int64
+	if s != nil {
+		size, budget = s.fetchBuffer, s.fetchMemoryBudget
+	}
+	b := &deliveryBuffer{
+		ctx:     ctx,
+		s:       s,
+		dbg:     dbg,
+		send:    send,
+		pending: make(chan delivery, size),
+		max:     budget,
+	}
+	if budget > 0 {
+		b.budget = semaphore.NewWeighted(budget)
+	}
+	b.done.Add(1)
+	go b.deliver()
+	return b
+}
+
+// delivery is a block waiting for the consumer, its place in window is freed
+// once it is read.
+type delivery struct {
+	blk    blocks.Block
+	window *fetchWindow
+}
+
+// push queues blk for delivery, waiting for room in the buffer and the memory
+// budget. It returns false if ctx was canceled.
+func (b *deliveryBuffer) push(blk blocks.Block, window *fetchWindow) bool {
+	weight := b.weight(blk)
+	if b.budget != nil {
+		if err := b.budget.Acquire(b.ctx, weight); err != nil {
+			return false
+		}
+	}
+	select {
+	case b.pending <- delivery{blk, window}:
+		return true
+	case <-b.ctx.Done():
+		b.release(weight)
+		return false
+	}
+}
+
+func (b *deliveryBuffer) deliver() {
+	defer b.done.Done()
+	for d := range b.pending {
+		// once canceled the remaining blocks are dropped but the loop still
+		// runs to release their budget.
+		if b.ctx.Err() == nil {
+			b.deliverOne(d)
+		}
+		b.release(b.weight(d.blk))
+	}
+}
+
+// deliverOne hands d to the consumer, a panic is recovered and the block
+// dropped so the following ones are still delivered.
+func (b *deliveryBuffer) deliverOne(d delivery) {
+	defer b.s.recoverPanic("fetch buffer")
+	b.dbg.offered(d.blk.Cid())
+	start := b.s.getClock().Now()
+	if b.send(d.blk) {
+		d.window.consumed(d.blk.Cid())
+	}
+	b.s.consumerWaited(b.s.getClock().Since(start))
+}
+
+// close waits until every pushed block has been delivered, or dropped if ctx
+// is canceled.
+func (b *deliveryBuffer) close() {
+	close(b.pending)
+	b.done.Wait()
+}
+
+// weight is the share of the budget used by blk, it is capped so a block
+// bigger than the whole budget can still go through.
+func (b *deliveryBuffer) weight(blk blocks.Block) int64 {
+	return min(int64(len(blk.RawData())), b.max)
+}
+
+func (b *deliveryBuffer) release(weight int64) {
+	if b.budget != nil {
+		b.budget.Release(weight)
+	}
+}
+
+// exchangeWaited counts the time GetBlocks waited for the exchange.
+func (s *blockService) exchangeWaited(d time.Duration) {
+	if s != nil {
+		s.stats.exchangeWaitNanos.Add(int64(d))
+	}
+}
+
+// consumerWaited counts the time a fetched block waited for the consumer.
+func (s *blockService) consumerWaited(d time.Duration) {
+	if s != nil {
+		s.stats.consumerWaitNanos.Add(int64(d))
+	}
+}
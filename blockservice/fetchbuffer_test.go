@@ -0,0 +1,234 @@
+package blockservice
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+var _ exchange.Interface = (*streamingExchange)(nil)
+
+// streamingExchange sends its blocks one by one on an unbuffered channel and
+// counts how many were taken by the blockservice.
+type streamingExchange struct {
+	blks []blocks.Block
+	sent atomic.Int64
+}
+
+func (e *streamingExchange) GetBlock(context.Context, cid.Cid) (blocks.Block, error) {
+	panic("not implemented")
+}
+
+func (e *streamingExchange) GetBlocks(ctx context.Context, _ []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for _, b := range e.blks {
+			select {
+			case out <- b:
+				e.sent.Add(1)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (e *streamingExchange) NotifyNewBlocks(context.Context, ...blocks.Block) error { return nil }
+func (e *streamingExchange) Close() error                                           { return nil }
+
+func TestFetchMemoryBudget(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blks := random.BlocksOfSize(10, blockSize)
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	exch := &gatedExchange{blks: blks, gate: make(chan struct{})}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch, WithFetchBuffer(8), WithFetchMemoryBudget(2*blockSize))
+
+	out := bserv.GetBlocks(ctx, ks)
+	// the exchange takes the gate again once its last block was taken: the
+	// budget is used by one block waiting on out and one buffered, the producer
+	// holds a third one waiting for budget.
+	for range 4 {
+		exch.gate <- struct{}{}
+	}
+	select {
+	case exch.gate <- struct{}{}:
+		t.Fatal("the exchange must not be read past the budget")
+	default:
+	}
+	<-out
+	// reading a block makes room for the fourth one
+	exch.gate <- struct{}{}
+
+	got := 1
+	for range out {
+		got++
+		if got == 5 {
+			cancel()
+			break
+		}
+	}
+	require.Eventually(t, func() bool {
+		select {
+		case _, ok := <-out:
+			return !ok
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond, "the channel must close after cancellation")
+}
+
+// gatedExchange sends a block of blks each time gate is signaled.
+type gatedExchange struct {
+	blks []blocks.Block
+	gate chan struct{}
+}
+
+func (e *gatedExchange) GetBlock(context.Context, cid.Cid) (blocks.Block, error) {
+	panic("not implemented")
+}
+
+func (e *gatedExchange) GetBlocks(ctx context.Context, _ []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for _, b := range e.blks {
+			select {
+			case <-e.gate:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (e *gatedExchange) NotifyNewBlocks(context.Context, ...blocks.Block) error { return nil }
+func (e *gatedExchange) Close() error                                           { return nil }
+
+func TestFetchWaitTimes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	const step = 10 * time.Millisecond
+	blks := random.BlocksOfSize(5, blockSize)
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+
+	t.Run("slow consumer", func(t *testing.T) {
+		t.Parallel()
+		clk := clock.NewMock()
+		exch := &streamingExchange{blks: blks}
+		bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch, WithClock(clk)).(*blockService)
+
+		out := bserv.GetBlocks(ctx, ks)
+		// wait for the exchange to be drained up to the consumer
+		require.Eventually(t, func() bool { return exch.sent.Load() == 2 }, time.Second, time.Millisecond)
+		for range blks {
+			clk.Add(step)
+			<-out
+		}
+		_, ok := <-out
+		require.False(t, ok)
+		st := bserv.Stats(false)
+		require.GreaterOrEqual(t, st.ConsumerWaitTime, time.Duration(len(blks)-1)*step)
+		require.Less(t, st.ExchangeWaitTime, step)
+	})
+
+	t.Run("slow exchange", func(t *testing.T) {
+		t.Parallel()
+		clk := clock.NewMock()
+		exch := &gatedExchange{blks: blks, gate: make(chan struct{})}
+		bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch, WithClock(clk), WithRetrievalDebug()).(*blockService)
+
+		results, err := bserv.GetBlocksDebug(ctx, ks)
+		require.NoError(t, err)
+		var exchangeWait, consumerWait time.Duration
+		for range blks {
+			clk.Add(step)
+			exch.gate <- struct{}{}
+			r := <-results
+			exchangeWait += r.ExchangeWait
+			consumerWait += r.ConsumerWait
+		}
+		_, ok := <-results
+		require.False(t, ok)
+		// the first wait may have started after the clock moved
+		require.GreaterOrEqual(t, exchangeWait, time.Duration(len(blks)-1)*step)
+		require.Zero(t, consumerWait)
+		st := bserv.Stats(false)
+		require.Equal(t, exchangeWait, st.ExchangeWaitTime)
+		require.Zero(t, st.ConsumerWaitTime)
+	})
+}
+
+// TestFetchPipelineClose checks the output of GetBlocks is closed once every
+// block has been delivered, or right away on cancellation, with and without a
+// buffer between the exchange and the consumer.
+func TestFetchPipelineClose(t *testing.T) {
+	t.Parallel()
+
+	blks := random.BlocksOfSize(6, blockSize)
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	for _, size := range []int{0, 4} {
+		bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), &streamingExchange{blks: blks}, WithFetchBuffer(size))
+		var got []blocks.Block
+		for b := range bserv.GetBlocks(context.Background(), ks) {
+			got = append(got, b)
+		}
+		require.Equal(t, blks, got, "buffer of %d", size)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		exch := &gatedExchange{blks: blks, gate: make(chan struct{}, len(blks))}
+		for range 3 {
+			exch.gate <- struct{}{}
+		}
+		bserv = New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch, WithFetchBuffer(size))
+		out := bserv.GetBlocks(ctx, ks)
+		<-out
+		cancel()
+		// the blocks already queued may still come out, then the channel is
+		// closed while the exchange is stuck
+		require.Eventually(t, func() bool {
+			for {
+				select {
+				case _, ok := <-out:
+					if !ok {
+						return true
+					}
+				default:
+					return false
+				}
+			}
+		}, time.Second, time.Millisecond, "buffer of %d", size)
+	}
+}
@@ -0,0 +1,194 @@
+package blockservice
+
+import (
+	"context"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// WithFetchCacheBlockstore writes the blocks fetched from the exchange to
+// cache instead of the primary blockstore, so the primary blockstore only
+// holds the blocks added explicitly and cache can be garbage collected on its
+// own. Reads look in the primary blockstore, then in cache, then ask the
+// exchange.
+func WithFetchCacheBlockstore(cache blockstore.Blockstore) Option {
+	return func(bs *blockService) {
+		if cache == nil {
+			bs.invalidOption("WithFetchCacheBlockstore: nil blockstore")
+			return
+		}
+		bs.fetchCache = cache
+	}
+}
+
+// Stores selects blockstores of a blockservice using a fetch cache, values
+// can be combined with a bitwise or.
+type Stores uint8
+
+const (
+	// PrimaryStore is the blockstore returned by Blockstore.
+	PrimaryStore Stores = 1 << iota
+	// FetchCacheStore is the blockstore of [WithFetchCacheBlockstore].
+	FetchCacheStore
+
+	AllStores = PrimaryStore | FetchCacheStore
+)
+
+// FetchCachingBlockService is a [BlockService] which can keep the blocks
+// fetched from the exchange apart from the blocks added to it, see
+// [WithFetchCacheBlockstore].
+// Without a fetch cache it behaves as if the cache was always empty.
+type FetchCachingBlockService interface {
+	BlockService
+
+	// FetchCacheBlockstore returns the fetch cache, it can be nil.
+	FetchCacheBlockstore() blockstore.Blockstore
+
+	// Has reports whether c is in the primary blockstore or the fetch cache.
+	Has(ctx context.Context, c cid.Cid) (bool, error)
+
+	// AllKeysChan lists the keys of the primary blockstore, then the keys of
+	// the fetch cache which are not in the primary blockstore, so every key is
+	// listed once.
+	AllKeysChan(ctx context.Context) (<-chan cid.Cid, error)
+
+	// DeleteBlockFrom deletes c from the selected blockstores, DeleteBlock
+	// deletes it from all of them.
+	DeleteBlockFrom(ctx context.Context, c cid.Cid, from Stores) error
+}
+
+var _ FetchCachingBlockService = (*blockService)(nil)
+
+func (s *blockService) FetchCacheBlockstore() blockstore.Blockstore {
+	return s.fetchCache
+}
+
+func (s *blockService) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.Has", trace.WithAttributes(attribute.Stringer("CID", c)))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	has, err := s.blockstore.Has(ctx, c)
+	if err != nil || has || s.fetchCache == nil {
+		return has, err
+	}
+	return s.fetchCache.Has(ctx, c)
+}
+
+func (s *blockService) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	primary, err := s.blockstore.AllKeysChan(ctx)
+	if err != nil || s.fetchCache == nil {
+		return primary, err
+	}
+	cached, err := s.fetchCache.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		send := func(c cid.Cid) bool {
+			select {
+			case out <- c:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for c := range primary {
+			if !send(c) {
+				return
+			}
+		}
+		for c := range cached {
+			has, err := s.blockstore.Has(ctx, c)
+			if err != nil {
+				logger.Debugf("AllKeysChan: %s", err)
+			}
+			if has {
+				continue
+			}
+			if !send(c) {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (s *blockService) DeleteBlockFrom(ctx context.Context, c cid.Cid, from Stores) error {
+	ctx, span := internal.StartSpan(ctx, "blockService.DeleteBlock", trace.WithAttributes(attribute.Stringer("CID", c)))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return ErrReadOnly
+	}
+
+	ctx, done, err := s.track(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	ctx, cancel := s.withTimeout(ctx, s.timeouts.Delete)
+	defer cancel()
+
+	_, err = s.deleteBlock(ctx, c, from, deleteOptionsFromContext(ctx))
+	return err
+}
+
+// fetchStore returns the blockstore the blocks fetched through bs are written
+// to.
+func (s *blockService) fetchStore(bs BlockService) blockstore.Blockstore {
+	if s != nil && s.fetchCache != nil {
+		return s.fetchCache
+	}
+	return bs.Blockstore()
+}
+
+// markFetchStored is markStored for a block written to the fetchStore, the
+// recent CID cache only tracks the primary blockstore.
+func (s *blockService) markFetchStored(c cid.Cid) {
+	if s != nil && s.fetchCache == nil {
+		s.markStored(c)
+	}
+}
+
+// getFromFetchCache looks c up in the fetch cache, it returns false when there
+// is no fetch cache or it doesn't have the block.
+func (s *blockService) getFromFetchCache(ctx context.Context, c cid.Cid) (blocks.Block, bool) {
+	if s == nil || s.fetchCache == nil {
+		return nil, false
+	}
+	blk, err := s.fetchCache.Get(ctx, c)
+	if err != nil {
+		if !ipld.IsNotFound(err) {
+			logger.Debugf("fetch cache get %s: %s", c, err)
+		}
+		return nil, false
+	}
+	return blk, true
+}
+
+// getSizeFromFetchCache is like getFromFetchCache for the size of c.
+func (s *blockService) getSizeFromFetchCache(ctx context.Context, c cid.Cid) (int, bool) {
+	if s == nil || s.fetchCache == nil {
+		return 0, false
+	}
+	size, err := s.fetchCache.GetSize(ctx, c)
+	if err != nil {
+		if !ipld.IsNotFound(err) {
+			logger.Debugf("fetch cache getsize %s: %s", c, err)
+		}
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,78 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithFetchCacheBlockstore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	primary := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	cache := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(primary, offline.Exchange(exchbstore), WithFetchCacheBlockstore(cache)).(*blockService)
+
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[1:]))
+	_, err := bserv.GetBlock(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[2].Cid()}) {
+	}
+
+	// added blocks go to the primary blockstore, fetched ones to the cache
+	for i, b := range blks {
+		inPrimary, err := primary.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		inCache, err := cache.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.Equal(t, i == 0, inPrimary)
+		require.Equal(t, i != 0, inCache)
+
+		has, err := bserv.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	// the cache is read before the exchange
+	require.NoError(t, exchbstore.DeleteBlock(ctx, blks[1].Cid()))
+	_, err = bserv.GetBlock(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	size, err := bserv.GetSize(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blockSize, size)
+
+	// a fetched block added explicitly is listed once
+	require.NoError(t, bserv.AddBlock(ctx, blks[2]))
+	keys, err := bserv.AllKeysChan(ctx)
+	require.NoError(t, err)
+	// the blockstore lists raw CIDs, compare the multihashes
+	var all []string
+	for k := range keys {
+		all = append(all, k.Hash().String())
+	}
+	require.ElementsMatch(t, []string{blks[0].Cid().Hash().String(), blks[1].Cid().Hash().String(), blks[2].Cid().Hash().String()}, all)
+
+	require.NoError(t, bserv.DeleteBlockFrom(ctx, blks[2].Cid(), FetchCacheStore))
+	has, err := cache.Has(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = bserv.Has(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	require.NoError(t, bserv.DeleteBlock(ctx, blks[1].Cid()))
+	has, err = bserv.Has(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+}
@@ -0,0 +1,51 @@
+package blockservice
+
+import (
+	"fmt"
+
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// DefaultMaxFetchedBlockSize is the default limit of [WithMaxFetchedBlockSize],
+// it matches the 2MiB maximum block size of the bitswap protocol.
+const DefaultMaxFetchedBlockSize = exchange.MaxBlockSize
+
+// WithMaxFetchedBlockSize sets the maximum size of the blocks accepted from the
+// exchange. Bigger blocks are neither written to the blockstore nor returned,
+// GetBlock fails with a [*BlockTooLargeError] and GetBlocks skips them.
+// 0 disables the check, the default is [DefaultMaxFetchedBlockSize].
+func WithMaxFetchedBlockSize(n int) Option {
+	return func(bs *blockService) {
+		if n < 0 {
+			bs.invalidOption("WithMaxFetchedBlockSize: negative size %d", n)
+			return
+		}
+		bs.maxFetchedBlockSize = n
+	}
+}
+
+// BlockTooLargeError is returned when the exchange returned a block bigger than
+// the limit set with [WithMaxFetchedBlockSize].
+type BlockTooLargeError struct {
+	Cid  cid.Cid
+	Size int
+	Max  int
+}
+
+func (e *BlockTooLargeError) Error() string {
+	return fmt.Sprintf("block %s from the exchange is too large: %d bytes, the maximum is %d", e.Cid, e.Size, e.Max)
+}
+
+// checkFetchedSize returns a [*BlockTooLargeError] if b is over the limit.
+func (s *blockService) checkFetchedSize(b blocks.Block) error {
+	if s == nil || s.maxFetchedBlockSize == 0 {
+		return nil
+	}
+	if size := len(b.RawData()); size > s.maxFetchedBlockSize {
+		s.stats.oversizedBlocks.Add(1)
+		return &BlockTooLargeError{Cid: b.Cid(), Size: size, Max: s.maxFetchedBlockSize}
+	}
+	return nil
+}
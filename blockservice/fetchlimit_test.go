@@ -0,0 +1,46 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxFetchedBlockSize(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	small := random.BlocksOfSize(1, blockSize)[0]
+	big := random.BlocksOfSize(2, 2*blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, append(big, small)))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithMaxFetchedBlockSize(blockSize))
+
+	_, err := bserv.GetBlock(ctx, big[0].Cid())
+	var tooLarge *BlockTooLargeError
+	require.True(t, errors.As(err, &tooLarge))
+	require.Equal(t, big[0].Cid(), tooLarge.Cid)
+	require.Equal(t, 2*blockSize, tooLarge.Size)
+
+	var got []cid.Cid
+	for b := range bserv.GetBlocks(ctx, []cid.Cid{big[1].Cid(), small.Cid()}) {
+		got = append(got, b.Cid())
+	}
+	require.Equal(t, []cid.Cid{small.Cid()}, got)
+	require.EqualValues(t, 2, bserv.(*blockService).Stats(false).OversizedBlocks)
+
+	for _, b := range big {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.False(t, has, "oversized blocks must not be cached")
+	}
+}
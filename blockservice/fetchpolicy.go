@@ -0,0 +1,56 @@
+package blockservice
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ErrFetchNotAllowed is returned for the CIDs whose codec may not be fetched
+// from the exchange according to [WithFetchCodecPolicy].
+var ErrFetchNotAllowed = errors.New("fetching this codec from the exchange is not allowed")
+
+// WithFetchCodecPolicy sets which codecs may be fetched from the exchange.
+// Blocks of other codecs are still served from the local blockstore but a
+// miss fails with [ErrFetchNotAllowed] instead of asking the exchange, so they
+// are never fetched, cached or provided.
+func WithFetchCodecPolicy(allow func(codec uint64) bool) Option {
+	return func(bs *blockService) {
+		if allow == nil {
+			bs.invalidOption("WithFetchCodecPolicy: nil policy")
+			return
+		}
+		bs.fetchCodecPolicy = allow
+	}
+}
+
+// checkFetchAllowed returns an error wrapping [ErrFetchNotAllowed] if c may not
+// be fetched from the exchange.
+func (s *blockService) checkFetchAllowed(c cid.Cid) error {
+	if s == nil || s.fetchCodecPolicy == nil {
+		return nil
+	}
+	if codec := c.Prefix().Codec; !s.fetchCodecPolicy(codec) {
+		return fmt.Errorf("%w: %s (codec 0x%x)", ErrFetchNotAllowed, c, codec)
+	}
+	return nil
+}
+
+// filterFetchAllowed removes the CIDs which may not be fetched from ks,
+// reporting them to tracker.
+func (s *blockService) filterFetchAllowed(ks []cid.Cid, tracker *blockErrorTracker) []cid.Cid {
+	if s == nil || s.fetchCodecPolicy == nil {
+		return ks
+	}
+	allowed := ks[:0]
+	for _, c := range ks {
+		if err := s.checkFetchAllowed(c); err != nil {
+			logger.Debug(err)
+			tracker.fail(c, err)
+			continue
+		}
+		allowed = append(allowed, c)
+	}
+	return allowed
+}
@@ -0,0 +1,57 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchCodecPolicy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	toCBOR := func(b blocks.Block) blocks.Block {
+		blk, err := blocks.NewBlockWithCid(b.RawData(), cid.NewCidV1(cid.DagCBOR, b.Cid().Hash()))
+		require.NoError(t, err)
+		return blk
+	}
+	blks := random.BlocksOfSize(3, blockSize)
+	raw, localCBOR, remoteCBOR := blks[0], toCBOR(blks[1]), toCBOR(blks[2])
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, localCBOR))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, []blocks.Block{raw, remoteCBOR}))
+
+	errs := make(map[cid.Cid]error)
+	bserv := New(bstore, offline.Exchange(exchbstore),
+		WithFetchCodecPolicy(func(codec uint64) bool { return codec == cid.Raw || codec == cid.DagProtobuf }),
+		WithBlockErrorHandler(func(c cid.Cid, err error) { errs[c] = err }),
+	)
+
+	// local reads are not affected
+	_, err := bserv.GetBlock(ctx, localCBOR.Cid())
+	require.NoError(t, err)
+	_, err = bserv.GetBlock(ctx, remoteCBOR.Cid())
+	require.ErrorIs(t, err, ErrFetchNotAllowed)
+
+	got := make(map[cid.Cid]struct{})
+	for b := range bserv.GetBlocks(ctx, []cid.Cid{raw.Cid(), localCBOR.Cid(), remoteCBOR.Cid()}) {
+		got[b.Cid()] = struct{}{}
+	}
+	require.Equal(t, map[cid.Cid]struct{}{raw.Cid(): {}, localCBOR.Cid(): {}}, got)
+	require.Len(t, errs, 1)
+	require.ErrorIs(t, errs[remoteCBOR.Cid()], ErrFetchNotAllowed)
+
+	has, err := bstore.Has(ctx, remoteCBOR.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+}
@@ -0,0 +1,56 @@
+package blockservice
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"golang.org/x/time/rate"
+)
+
+// WithFetchRateLimit bounds the volume of data pulled from the exchange to
+// bytesPerSecond with bursts of up to burst bytes. The limit is shared by
+// every GetBlock and GetBlocks call of the blockservice, including their
+// sessions: once it is exhausted the blocks received from the exchange are
+// held, and GetBlocks stops reading from the exchange, letting its flow
+// control back off, until enough tokens have accumulated.
+// Blocks larger than burst wait for a full bucket. The waits are reported in
+// [Stats.FetchThrottles] and [Stats.FetchThrottledTime].
+func WithFetchRateLimit(bytesPerSecond int64, burst int64) Option {
+	return func(bs *blockService) {
+		if bytesPerSecond <= 0 || burst <= 0 {
+			bs.invalidOption("WithFetchRateLimit: the limit must be positive (%d B/s, burst %d)", bytesPerSecond, burst)
+			return
+		}
+		bs.fetchLimiter = rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(burst, int64(maxBurst))))
+	}
+}
+
+// maxBurst keeps the burst within an int on 32 bits platforms.
+const maxBurst = 1<<31 - 1
+
+// throttleFetch waits until the rate limit of [WithFetchRateLimit] allows a
+// block of the size of blk to be received, it returns the error of ctx if it
+// is canceled first.
+func (s *blockService) throttleFetch(ctx context.Context, blk blocks.Block) error {
+	if s == nil || s.fetchLimiter == nil {
+		return nil
+	}
+	n := min(len(blk.RawData()), s.fetchLimiter.Burst())
+	now := s.clock.Now()
+	r := s.fetchLimiter.ReserveN(now, n)
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+	s.stats.fetchThrottles.Add(1)
+	s.stats.fetchThrottledNanos.Add(int64(delay))
+	timer := s.clock.Timer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.CancelAt(s.clock.Now())
+		return ctx.Err()
+	}
+}
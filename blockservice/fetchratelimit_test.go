@@ -0,0 +1,93 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithFetchRateLimit(t *testing.T) {
+	t.Parallel()
+
+	blks := random.BlocksOfSize(10, blockSize)
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(context.Background(), blks))
+
+	t.Run("GetBlocks", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		clk := clock.NewMock()
+		bserv := New(bstore, offline.Exchange(exchbstore), WithFetchRateLimit(400, 2*blockSize), WithClock(clk)).(*blockService)
+
+		// the burst goes through, the 32 other bytes take 80ms
+		start := clk.Now()
+		out := bserv.GetBlocks(ctx, ks)
+		done := make(chan int)
+		go func() {
+			n := 0
+			for range out {
+				n++
+			}
+			done <- n
+		}()
+		var n int
+		require.Eventually(t, func() bool {
+			select {
+			case n = <-done:
+				return true
+			default:
+				clk.Add(time.Millisecond)
+				return false
+			}
+		}, 5*time.Second, time.Millisecond)
+		require.Equal(t, len(blks), n)
+		require.GreaterOrEqual(t, clk.Since(start), 80*time.Millisecond)
+		stats := bserv.Stats(false)
+		require.NotZero(t, stats.FetchThrottles)
+		require.GreaterOrEqual(t, stats.FetchThrottledTime, 70*time.Millisecond)
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		t.Parallel()
+		ctx := context.Background()
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, offline.Exchange(exchbstore), WithFetchRateLimit(1, blockSize))
+
+		// the session and GetBlock drain the same bucket
+		_, err := NewSession(ctx, bserv).GetBlock(ctx, ks[0])
+		require.NoError(t, err)
+		tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, err = bserv.GetBlock(tctx, ks[1])
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// a canceled wait closes GetBlocks promptly
+		tctx, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		for range bserv.GetBlocks(tctx, ks[2:]) {
+		}
+		require.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		_, err := NewWithOptions(bstore, nil, WithFetchRateLimit(0, 1))
+		require.ErrorContains(t, err, "WithFetchRateLimit")
+	})
+}
@@ -0,0 +1,55 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// WithMaxConcurrentFetches limits how many exchange fetches run at the same
+// time across the blockservice and its sessions. A GetBlock miss counts as one
+// fetch for its duration, a GetBlocks call as one for the whole time it
+// receives blocks from the exchange. Callers over the limit wait for a slot,
+// until their context is done.
+// 0 means no limit, which is the default.
+func WithMaxConcurrentFetches(n int) Option {
+	return func(bs *blockService) {
+		if n < 0 {
+			bs.invalidOption("WithMaxConcurrentFetches: negative limit %d", n)
+			return
+		}
+		if n == 0 {
+			bs.fetchSlots = nil
+			return
+		}
+		bs.fetchSlots = semaphore.NewWeighted(int64(n))
+	}
+}
+
+// acquireFetch waits for a fetch slot and returns the function releasing it.
+// The error wraps the context error when ctx is done first.
+func (s *blockService) acquireFetch(ctx context.Context) (func(), error) {
+	if s == nil {
+		return noRelease, nil
+	}
+	if s.fetchSlots != nil {
+		if err := s.fetchSlots.Acquire(ctx, 1); err != nil {
+			return nil, fmt.Errorf("waiting for an exchange fetch slot: %w", err)
+		}
+	}
+
+	n := s.stats.fetchesInFlight.Add(1)
+	for {
+		peak := s.stats.peakFetchesInFlight.Load()
+		if n <= peak || s.stats.peakFetchesInFlight.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	return func() {
+		s.stats.fetchesInFlight.Add(-1)
+		if s.fetchSlots != nil {
+			s.fetchSlots.Release(1)
+		}
+	}, nil
+}
@@ -0,0 +1,57 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	t.Parallel()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	exch := &hangingExchange{getsStarted: make(chan struct{}, 10)}
+	errs := make(chan error, 1)
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch,
+		WithMaxConcurrentFetches(1),
+		WithBlockErrorHandler(func(_ cid.Cid, err error) { errs <- err }),
+	).(*blockService)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		bserv.GetBlock(ctx, blks[0].Cid())
+	}()
+	<-exch.getsStarted
+	require.EqualValues(t, 1, bserv.Stats(false).FetchesInFlight)
+
+	// waiters time out with the deadline error, without reaching the exchange
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer shortCancel()
+	_, err := bserv.GetBlock(shortCtx, blks[1].Cid())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	for range bserv.GetBlocks(shortCtx, []cid.Cid{blks[2].Cid()}) {
+	}
+	require.ErrorIs(t, <-errs, context.DeadlineExceeded)
+	require.Empty(t, exch.getsStarted)
+
+	cancel()
+	<-firstDone
+	stats := bserv.Stats(false)
+	require.EqualValues(t, 0, stats.FetchesInFlight)
+	require.EqualValues(t, 1, stats.PeakFetchesInFlight)
+
+	// the slot is free again
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go bserv.GetBlock(ctx, blks[1].Cid())
+	<-exch.getsStarted
+}
@@ -0,0 +1,185 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/sync/semaphore"
+)
+
+// WithFetchWindow bounds to n the blocks GetBlocks wants from the exchange
+// which the consumer has not read yet. The misses are handed to the exchange in
+// windows of n/2 CIDs, each one once the consumer has read as many blocks of
+// the previous ones, so a slow consumer doesn't make the exchange download
+// blocks which would only be buffered. Blocks the exchange can't find keep
+// their place in the window until the exchange gives up on their window.
+// The default is 0, all the misses are handed to the exchange at once.
+func WithFetchWindow(n int) Option {
+	return func(bs *blockService) {
+		if n < 0 {
+			bs.invalidOption("WithFetchWindow: negative size %d", n)
+			return
+		}
+		bs.fetchWindow = n
+	}
+}
+
+const (
+	windowWanted = iota
+	windowReceived
+)
+
+// fetchWindow submits the wants of a GetBlocks call window by window, a nil
+// fetchWindow is the unbounded default.
+type fetchWindow struct {
+	s       *blockService
+	ctx     context.Context
+	fetch   exchange.Fetcher
+	step    int
+	credits *semaphore.Weighted
+	out     chan blocks.Block
+	wanted  *wanted
+
+	lk    sync.Mutex
+	state map[cid.Cid]int
+}
+
+// windowedGetBlocks is fetch.GetBlocks following the window of
+// [WithFetchWindow], the blocks returned must be passed to consumed once read
+// by the consumer or failed. The CIDs are recorded in wt as they are handed to
+// the exchange.
+func (s *blockService) windowedGetBlocks(ctx context.Context, fetch exchange.Fetcher, ks []cid.Cid, wt *wanted) (<-chan blocks.Block, *fetchWindow, error) {
+	if s == nil || s.fetchWindow == 0 || len(ks) <= s.fetchWindow {
+		wt.add(ks...)
+		rblocks, err := fetch.GetBlocks(ctx, ks)
+		return rblocks, nil, err
+	}
+	w := &fetchWindow{
+		s:       s,
+		ctx:     ctx,
+		fetch:   fetch,
+		step:    max(1, (s.fetchWindow+1)/2),
+		credits: semaphore.NewWeighted(int64(s.fetchWindow)),
+		out:     make(chan blocks.Block),
+		wanted:  wt,
+		state:   make(map[cid.Cid]int, len(ks)),
+	}
+	ks = dedupCids(ks)
+	// the first window is submitted synchronously to report the errors of the
+	// exchange
+	first := ks[:w.step]
+	rblocks, err := w.submit(first)
+	if err != nil {
+		return nil, nil, err
+	}
+	go w.run(rblocks, first, ks[w.step:])
+	return w.out, w, nil
+}
+
+func dedupCids(ks []cid.Cid) []cid.Cid {
+	seen := make(map[cid.Cid]struct{}, len(ks))
+	out := make([]cid.Cid, 0, len(ks))
+	for _, c := range ks {
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		out = append(out, c)
+	}
+	return out
+}
+
+// submit wants the CIDs of window once the consumer has made room for them.
+func (w *fetchWindow) submit(window []cid.Cid) (<-chan blocks.Block, error) {
+	if err := w.credits.Acquire(w.ctx, int64(len(window))); err != nil {
+		return nil, err
+	}
+	w.lk.Lock()
+	for _, c := range window {
+		w.state[c] = windowWanted
+	}
+	w.lk.Unlock()
+	w.wanted.add(window...)
+	rblocks, err := w.fetch.GetBlocks(w.ctx, window)
+	if err != nil {
+		w.giveUp(window)
+		return nil, err
+	}
+	return rblocks, nil
+}
+
+func (w *fetchWindow) run(rblocks <-chan blocks.Block, window, rest []cid.Cid) {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		close(w.out)
+	}()
+	// the windows not submitted yet are given up on, like on an error of the
+	// exchange
+	defer w.s.recoverPanic("fetch window")
+	for {
+		wg.Add(1)
+		go func(rblocks <-chan blocks.Block, window []cid.Cid) {
+			defer wg.Done()
+			defer w.s.recoverPanic("fetch window")
+			w.forward(rblocks, window)
+		}(rblocks, window)
+		if len(rest) == 0 {
+			return
+		}
+		window, rest = rest[:min(w.step, len(rest))], rest[min(w.step, len(rest)):]
+		var err error
+		rblocks, err = w.submit(window)
+		if err != nil {
+			if w.ctx.Err() == nil {
+				logger.Debugf("Error with GetBlocks: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// forward sends the blocks of a window to the output.
+func (w *fetchWindow) forward(rblocks <-chan blocks.Block, window []cid.Cid) {
+	defer w.giveUp(window)
+	for b := range rblocks {
+		w.lk.Lock()
+		if st, ok := w.state[b.Cid()]; ok && st == windowWanted {
+			w.state[b.Cid()] = windowReceived
+		}
+		w.lk.Unlock()
+		select {
+		case w.out <- b:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// giveUp frees the places of the CIDs of window which were not received.
+func (w *fetchWindow) giveUp(window []cid.Cid) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	for _, c := range window {
+		if st, ok := w.state[c]; ok && st == windowWanted {
+			delete(w.state, c)
+			w.credits.Release(1)
+		}
+	}
+}
+
+// consumed frees the place of c once read by the consumer or failed.
+func (w *fetchWindow) consumed(c cid.Cid) {
+	if w == nil {
+		return
+	}
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	if _, ok := w.state[c]; ok {
+		delete(w.state, c)
+		w.credits.Release(1)
+	}
+}
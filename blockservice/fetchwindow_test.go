@@ -0,0 +1,117 @@
+package blockservice
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// windowCall is a GetBlocks call recorded by [callNotifyingExchange].
+type windowCall struct {
+	ks []cid.Cid
+	// reading is the number of blocks the consumer had started to read
+	reading int64
+}
+
+// callNotifyingExchange sends its GetBlocks calls to calls.
+type callNotifyingExchange struct {
+	exchange.Interface
+
+	reading *atomic.Int64
+	calls   chan windowCall
+}
+
+func (e *callNotifyingExchange) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	e.calls <- windowCall{ks: ks, reading: e.reading.Load()}
+	return e.Interface.GetBlocks(ctx, ks)
+}
+
+func TestFetchWindow(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blks := random.BlocksOfSize(10, blockSize)
+	ks := cidsOf(blks...)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	var reading atomic.Int64
+	exch := &callNotifyingExchange{Interface: offline.Exchange(exchbstore), reading: &reading, calls: make(chan windowCall, len(blks))}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch, WithFetchWindow(4))
+
+	out := bserv.GetBlocks(ctx, ks)
+	read := func() bool {
+		reading.Add(1)
+		_, ok := <-out
+		return ok
+	}
+
+	// nothing is read, only the first two windows are wanted
+	for i := 0; i < 4; i += 2 {
+		call := <-exch.calls
+		require.Equal(t, ks[i:i+2], call.ks)
+		require.Zero(t, call.reading)
+	}
+	// the CIDs of the next windows are not wanted yet
+	inspector := bserv.(WantInspector)
+	for _, c := range ks[4:] {
+		wanted, _ := inspector.IsWanted(c)
+		require.False(t, wanted)
+	}
+
+	// reading a window worth of blocks makes room for the next one
+	require.True(t, read())
+	require.True(t, read())
+	call := <-exch.calls
+	require.Equal(t, ks[4:6], call.ks)
+	require.EqualValues(t, 2, call.reading)
+	for _, c := range ks[6:] {
+		wanted, _ := inspector.IsWanted(c)
+		require.False(t, wanted)
+	}
+
+	got := 2
+	for read() {
+		got++
+	}
+	require.Equal(t, len(blks), got)
+	for i := 6; i < len(blks); i += 2 {
+		call := <-exch.calls
+		require.Equal(t, ks[i:i+2], call.ks)
+		require.GreaterOrEqual(t, call.reading, int64(i-2), "window %v wanted before the consumer made room", call.ks)
+	}
+	require.Empty(t, exch.calls)
+}
+
+func TestFetchWindowMissingBlocks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// the exchange gives up on the missing blocks, freeing their places
+	blks := random.BlocksOfSize(10, blockSize)
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[5:]))
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithFetchWindow(2))
+
+	var got []cid.Cid
+	for b := range bserv.GetBlocks(ctx, ks) {
+		got = append(got, b.Cid())
+	}
+	require.ElementsMatch(t, ks[5:], got)
+}
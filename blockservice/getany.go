@@ -0,0 +1,178 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultGetBlockAnyParallelism is the number of candidates GetBlockAny
+// fetches at once, see [WithGetBlockAnyParallelism].
+const DefaultGetBlockAnyParallelism = 4
+
+// WithGetBlockAnyParallelism sets the number of candidates GetBlockAny fetches
+// from the exchange at once, it defaults to [DefaultGetBlockAnyParallelism].
+func WithGetBlockAnyParallelism(n int) Option {
+	return func(bs *blockService) {
+		if n <= 0 {
+			bs.invalidOption("WithGetBlockAnyParallelism: the parallelism must be positive, got %d", n)
+			return
+		}
+		bs.getAnyParallelism = n
+	}
+}
+
+// AnyBlockGetter gets content reachable under several CIDs, like different
+// codec wrappings of the same data.
+type AnyBlockGetter interface {
+	// GetBlockAny returns the block of the first candidate which can be
+	// retrieved, with its CID. The candidates are all looked up locally
+	// first, then the remaining ones are fetched from the exchange in
+	// parallel, the fetches are canceled once one succeeds.
+	// If no candidate can be retrieved the error is a [*CandidatesError].
+	GetBlockAny(ctx context.Context, candidates []cid.Cid) (blocks.Block, cid.Cid, error)
+}
+
+var (
+	_ AnyBlockGetter = (*blockService)(nil)
+	_ AnyBlockGetter = (*Session)(nil)
+)
+
+// CandidatesError is returned by GetBlockAny when none of the candidates
+// could be retrieved.
+type CandidatesError struct {
+	// Failed maps the candidates to the reason why they were not retrieved.
+	Failed map[cid.Cid]error
+}
+
+func (e *CandidatesError) Error() string {
+	return fmt.Sprintf("none of the %d candidates could be retrieved", len(e.Failed))
+}
+
+// Unwrap returns the errors of the candidates, so errors.Is matches
+// [ipld.ErrNotFound] when one of them was not found.
+func (e *CandidatesError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, err := range e.Failed {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// GetBlockAny races the candidates in a session of its own, so the fetches
+// share one exchange session.
+func (s *blockService) GetBlockAny(ctx context.Context, candidates []cid.Cid) (blocks.Block, cid.Cid, error) {
+	if ses := grabSessionFromContext(ctx, s); ses != nil {
+		return ses.GetBlockAny(ctx, candidates)
+	}
+
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlockAny", trace.WithAttributes(attribute.Int("candidates", len(candidates))))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	ses := newSession(ctx, s)
+	defer ses.Close()
+	return getBlockAny(ctx, candidates, s, ses, ses.grabSession)
+}
+
+// GetBlockAny is [blockService.GetBlockAny] in the context of the session.
+func (s *Session) GetBlockAny(ctx context.Context, candidates []cid.Cid) (blocks.Block, cid.Cid, error) {
+	ctx, span := internal.StartSpan(ctx, "Session.GetBlockAny", trace.WithAttributes(attribute.Int("candidates", len(candidates))))
+	defer span.End()
+	grabServiceFromBlockservice(s.bs).tagSpan(ctx, span)
+	s.linkSpan(span)
+	ctx = s.markSessionFetch(ctx)
+
+	s.refs.addRequested(candidates...)
+	blk, c, err := getBlockAny(ctx, candidates, s.bs, s, s.grabSession)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	s.refs.addReceived(c)
+	return blk, c, nil
+}
+
+func getBlockAny(ctx context.Context, candidates []cid.Cid, bs BlockService, ses *Session, fetchFactory func() exchange.Fetcher) (blocks.Block, cid.Cid, error) {
+	if len(candidates) == 0 {
+		return nil, cid.Undef, errors.New("GetBlockAny: no candidates")
+	}
+	candidates = dedupCids(candidates)
+	failed := make(map[cid.Cid]error, len(candidates))
+
+	// the local lookups are cheap, try them all before going to the network
+	remote := make([]cid.Cid, 0, len(candidates))
+	localCtx := ContextWithOffline(ctx)
+	for _, c := range candidates {
+		blk, err := getBlock(localCtx, c, bs, ses, fetchFactory)
+		switch {
+		case err == nil:
+			return blk, c, nil
+		case ipld.IsNotFound(err):
+			failed[c] = err
+			remote = append(remote, c)
+		default:
+			// rejected candidates or a failing blockstore
+			failed[c] = err
+		}
+	}
+	if len(remote) == 0 || isOffline(ctx) {
+		return nil, cid.Undef, &CandidatesError{Failed: failed}
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		c   cid.Cid
+		blk blocks.Block
+		err error
+	}
+	results := make(chan result, len(remote))
+	limiter := make(chan struct{}, grabServiceFromBlockservice(bs).getAnyParallelismOrDefault())
+	var wg sync.WaitGroup
+	go func() {
+		defer wg.Wait() // results is buffered, the fetches never block on it
+		for _, c := range remote {
+			select {
+			case limiter <- struct{}{}:
+			case <-raceCtx.Done():
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-limiter }()
+				blk, err := getBlock(raceCtx, c, bs, ses, fetchFactory)
+				results <- result{c, blk, err}
+			}()
+		}
+	}()
+
+	for range remote {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				return r.blk, r.c, nil
+			}
+			failed[r.c] = r.err
+		case <-ctx.Done():
+			return nil, cid.Undef, ctx.Err()
+		}
+	}
+	return nil, cid.Undef, &CandidatesError{Failed: failed}
+}
+
+func (s *blockService) getAnyParallelismOrDefault() int {
+	if s == nil || s.getAnyParallelism == 0 {
+		return DefaultGetBlockAnyParallelism
+	}
+	return s.getAnyParallelism
+}
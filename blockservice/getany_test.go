@@ -0,0 +1,127 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// hangingMissExchange hangs on the blocks it doesn't have until the fetch is
+// canceled, reporting the cancellations. The blocks it has are returned once
+// release is closed.
+type hangingMissExchange struct {
+	exchange.Interface
+	bstore   blockstore.Blockstore
+	started  chan cid.Cid
+	release  chan struct{}
+	canceled chan cid.Cid
+}
+
+func (e *hangingMissExchange) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	blk, err := e.bstore.Get(ctx, c)
+	if err == nil {
+		<-e.release
+		return blk, nil
+	}
+	e.started <- c
+	<-ctx.Done()
+	e.canceled <- c
+	return nil, ctx.Err()
+}
+
+func TestGetBlockAny(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	ks := []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.Put(ctx, blks[2]))
+
+	t.Run("local first", func(t *testing.T) {
+		t.Parallel()
+		exch := &callRecordingExchange{Interface: offline.Exchange(exchbstore)}
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		require.NoError(t, bstore.Put(ctx, blks[1]))
+		bserv := New(bstore, exch)
+
+		blk, c, err := bserv.(AnyBlockGetter).GetBlockAny(ctx, ks)
+		require.NoError(t, err)
+		require.Equal(t, blks[1].Cid(), c)
+		require.Equal(t, blks[1].RawData(), blk.RawData())
+		require.Empty(t, exch.calls)
+	})
+
+	t.Run("race", func(t *testing.T) {
+		t.Parallel()
+		exch := &hangingMissExchange{
+			Interface: offline.Exchange(exchbstore),
+			bstore:    exchbstore,
+			started:   make(chan cid.Cid, len(ks)),
+			release:   make(chan struct{}),
+			canceled:  make(chan cid.Cid, len(ks)),
+		}
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, exch, WithGetBlockAnyParallelism(3))
+		go func() {
+			<-exch.started
+			<-exch.started
+			close(exch.release)
+		}()
+
+		// the winner cancels the fetches of the other candidates
+		blk, c, err := bserv.(AnyBlockGetter).GetBlockAny(ctx, ks)
+		require.NoError(t, err)
+		require.Equal(t, blks[2].Cid(), c)
+		require.Equal(t, blks[2].RawData(), blk.RawData())
+		require.ElementsMatch(t, ks[:2], []cid.Cid{<-exch.canceled, <-exch.canceled})
+
+		// the winner was cached
+		has, err := bstore.Has(ctx, c)
+		require.NoError(t, err)
+		require.True(t, has)
+	})
+
+	t.Run("session", func(t *testing.T) {
+		t.Parallel()
+		exch := &callRecordingExchange{Interface: offline.Exchange(exchbstore)}
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		ses := NewSession(ctx, New(bstore, exch))
+
+		_, c, err := ses.GetBlockAny(ctx, []cid.Cid{blks[2].Cid(), blks[2].Cid()})
+		require.NoError(t, err)
+		require.Equal(t, blks[2].Cid(), c)
+		requested, received := ses.Refs()
+		require.Equal(t, []cid.Cid{blks[2].Cid()}, requested)
+		require.Equal(t, []cid.Cid{blks[2].Cid()}, received)
+	})
+
+	t.Run("all fail", func(t *testing.T) {
+		t.Parallel()
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, offline.Exchange(exchbstore)).(*blockService)
+
+		_, _, err := bserv.GetBlockAny(ctx, ks[:2])
+		var cerr *CandidatesError
+		require.ErrorAs(t, err, &cerr)
+		require.Len(t, cerr.Failed, 2)
+		require.True(t, ipld.IsNotFound(err))
+
+		_, _, err = bserv.GetBlockAny(ContextWithOffline(ctx), ks)
+		require.ErrorAs(t, err, &cerr)
+		require.Len(t, cerr.Failed, 3)
+
+		_, _, err = bserv.GetBlockAny(ctx, nil)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,112 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// healthCheckTimeout bounds Check when the context has a later deadline.
+const healthCheckTimeout = 5 * time.Second
+
+// HealthStatus is the state of a component in a [HealthReport].
+type HealthStatus string
+
+const (
+	HealthOK       HealthStatus = "ok"
+	HealthDegraded HealthStatus = "degraded"
+	HealthFailed   HealthStatus = "failed"
+	// HealthDisabled is reported for components which are not configured.
+	HealthDisabled HealthStatus = "disabled"
+)
+
+// ComponentHealth is the result of the probe of one component.
+type ComponentHealth struct {
+	Status  HealthStatus  `json:"status"`
+	Latency time.Duration `json:"latency"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// HealthReport is returned by Check, it can be serialized as JSON.
+type HealthReport struct {
+	// Healthy is true if the blockservice is able to serve blocks.
+	Healthy    bool            `json:"healthy"`
+	Blockstore ComponentHealth `json:"blockstore"`
+	Exchange   ComponentHealth `json:"exchange"`
+	Provider   ComponentHealth `json:"provider"`
+	// ReadOnly is true when the blockservice is in read-only mode.
+	ReadOnly bool `json:"read_only"`
+
+	// ProvideQueueLength and ProvideQueueCapacity describe the async provide
+	// queue, they are zero when there is none.
+	ProvideQueueLength   int `json:"provide_queue_length"`
+	ProvideQueueCapacity int `json:"provide_queue_capacity"`
+}
+
+// healthSentinel is the CID probed in the blockstore, it does not need to
+// be present.
+var healthSentinel = func() cid.Cid {
+	mh, err := multihash.Sum([]byte("blockservice health check"), multihash.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh)
+}()
+
+// Check performs a cheap probe of the blockstore and reports the state of the
+// exchange and of the provider, it is meant to back a health endpoint.
+// It never takes longer than the deadline of ctx, with a limit of 5s.
+func (s *blockService) Check(ctx context.Context) HealthReport {
+	ctx, span := internal.StartSpan(ctx, "blockService.Check")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	ctx, cancel := s.clock.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	report := HealthReport{ReadOnly: s.ReadOnly()}
+
+	s.lifecycleLk.Lock()
+	closed := s.closed
+	s.lifecycleLk.Unlock()
+	if closed {
+		report.Blockstore = ComponentHealth{Status: HealthFailed, Error: ErrServiceClosed.Error()}
+		report.Exchange = report.Blockstore
+		report.Provider = report.Blockstore
+		return report
+	}
+
+	start := s.clock.Now()
+	_, err := s.blockstore.Has(ctx, healthSentinel)
+	report.Blockstore = ComponentHealth{Status: HealthOK, Latency: s.clock.Since(start)}
+	if err != nil {
+		report.Blockstore.Status = HealthFailed
+		report.Blockstore.Error = err.Error()
+	}
+
+	report.Exchange.Status = HealthDisabled
+	if s.exchange != nil {
+		report.Exchange.Status = HealthOK
+	}
+
+	report.Provider.Status = HealthDisabled
+	if s.provider != nil {
+		report.Provider.Status = HealthOK
+		if q := s.provideQueue; q != nil {
+			report.ProvideQueueLength = len(q.queue)
+			report.ProvideQueueCapacity = cap(q.queue)
+			// an unbuffered queue hands the provides to the workers directly
+			if report.ProvideQueueCapacity != 0 && report.ProvideQueueLength >= report.ProvideQueueCapacity {
+				report.Provider.Status = HealthDegraded
+				report.Provider.Error = "provide queue is saturated"
+			}
+		}
+	}
+
+	report.Healthy = report.Blockstore.Status == HealthOK
+	return report
+}
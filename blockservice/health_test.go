@@ -0,0 +1,59 @@
+package blockservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+)
+
+type failingHasBlockstore struct {
+	blockstore.Blockstore
+}
+
+func (failingHasBlockstore) Has(context.Context, cid.Cid) (bool, error) {
+	return false, errors.New("disk on fire")
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProvider(&recordingProvider{})).(*blockService)
+	report := bserv.Check(ctx)
+	require.True(t, report.Healthy)
+	require.Equal(t, HealthOK, report.Blockstore.Status)
+	require.Equal(t, HealthDisabled, report.Exchange.Status)
+	require.Equal(t, HealthOK, report.Provider.Status)
+	_, err := json.Marshal(report)
+	require.NoError(t, err)
+
+	bserv = New(failingHasBlockstore{bstore}, nil).(*blockService)
+	report = bserv.Check(ctx)
+	require.False(t, report.Healthy)
+	require.Equal(t, HealthFailed, report.Blockstore.Status)
+	require.Equal(t, "disk on fire", report.Blockstore.Error)
+	require.Equal(t, HealthDisabled, report.Provider.Status)
+
+	require.NoError(t, bserv.Close())
+	require.False(t, bserv.Check(ctx).Healthy)
+}
+
+func TestCheckUnbufferedProvideQueue(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProvider(&recordingProvider{}), WithAsyncProvide(1, 0)).(*blockService)
+	defer bserv.Close()
+	report := bserv.Check(context.Background())
+	require.Equal(t, HealthOK, report.Provider.Status)
+	require.Empty(t, report.Provider.Error)
+	require.Zero(t, report.ProvideQueueCapacity)
+}
@@ -0,0 +1,201 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/boxo/blockservice/httpfetch"
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// WithHTTPBlockFallback fetches the blocks the exchange could not get from
+// trustless HTTP endpoints with a [httpfetch.Fetcher], or every missing block
+// when there is no exchange. The endpoints are tried round-robin and the
+// fetched blocks are verified against their CID, then checked, cached,
+// announced and provided like the blocks from the exchange.
+// The fallback is used once the exchange failed, or after the delay of
+// [WithHTTPFallbackDelay]. Requests with [ContextWithOffline] never use it.
+func WithHTTPBlockFallback(endpoints []string, opts ...httpfetch.Option) Option {
+	return func(bs *blockService) {
+		f, err := httpfetch.New(endpoints, opts...)
+		if err != nil {
+			bs.invalidOption("WithHTTPBlockFallback: %s", err)
+			return
+		}
+		bs.httpFallback = f
+	}
+}
+
+// WithHTTPFallbackDelay makes the HTTP fallback of [WithHTTPBlockFallback]
+// start d after the exchange was asked for blocks it did not return yet,
+// without stopping the exchange. By default the fallback only starts once the
+// exchange failed, which may never happen for exchanges waiting until the
+// context is canceled.
+func WithHTTPFallbackDelay(d time.Duration) Option {
+	return func(bs *blockService) {
+		if d < 0 {
+			bs.invalidOption("WithHTTPFallbackDelay: negative delay %s", d)
+			return
+		}
+		bs.httpFallbackDelay = d
+	}
+}
+
+// withHTTPFallback adds the fallback of [WithHTTPBlockFallback] to fetch,
+// which may be nil.
+func (s *blockService) withHTTPFallback(fetch exchange.Fetcher) exchange.Fetcher {
+	if s == nil || s.httpFallback == nil {
+		return fetch
+	}
+	return &httpFallbackFetcher{primary: fetch, http: s.httpFallback, delay: s.httpFallbackDelay, clock: s.clock}
+}
+
+type httpFallbackFetcher struct {
+	primary exchange.Fetcher
+	http    *httpfetch.Fetcher
+	delay   time.Duration
+	clock   clock.Clock
+}
+
+// fallbackTimer fires after the fallback delay, never if there is none.
+func (f *httpFallbackFetcher) fallbackTimer() (<-chan time.Time, func()) {
+	if f.delay == 0 {
+		return nil, func() {}
+	}
+	t := f.clock.Timer(f.delay)
+	return t.C, func() { t.Stop() }
+}
+
+func (f *httpFallbackFetcher) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if f.primary == nil {
+		return f.http.GetBlock(ctx, c)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		blk blocks.Block
+		err error
+	}
+	results := make(chan result, 2)
+	get := func(fetch exchange.Fetcher) {
+		blk, err := fetch.GetBlock(ctx, c)
+		results <- result{blk, err}
+	}
+	go get(f.primary)
+	timer, stop := f.fallbackTimer()
+	defer stop()
+
+	running, fallback := 1, false
+	startFallback := func() {
+		if !fallback {
+			fallback = true
+			running++
+			go get(f.http)
+		}
+	}
+	var err error
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				return r.blk, nil
+			}
+			err = r.err
+			if ctx.Err() == nil {
+				startFallback()
+			}
+		case <-timer:
+			startFallback()
+		}
+	}
+	return nil, err
+}
+
+func (f *httpFallbackFetcher) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	if f.primary == nil {
+		return f.http.GetBlocks(ctx, ks)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	primary, err := f.primary.GetBlocks(ctx, ks)
+	if err != nil {
+		logger.Debugf("exchange GetBlocks: %s, using the HTTP fallback", err)
+		primary = nil
+	}
+
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		pending := make(map[cid.Cid]struct{}, len(ks))
+		for _, c := range ks {
+			pending[c] = struct{}{}
+		}
+		var fallback <-chan blocks.Block
+		started := false
+		startFallback := func() {
+			started = true
+			rest := make([]cid.Cid, 0, len(pending))
+			for _, c := range ks {
+				if _, ok := pending[c]; ok {
+					rest = append(rest, c)
+				}
+			}
+			fallback, _ = f.http.GetBlocks(ctx, rest)
+		}
+		deliver := func(b blocks.Block) bool {
+			if _, ok := pending[b.Cid()]; !ok {
+				return true
+			}
+			delete(pending, b.Cid())
+			select {
+			case out <- b:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		timer, stop := f.fallbackTimer()
+		defer stop()
+
+		for len(pending) != 0 {
+			if primary == nil && !started {
+				startFallback()
+			}
+			if primary == nil && fallback == nil {
+				return
+			}
+			select {
+			case b, ok := <-primary:
+				if !ok {
+					primary = nil
+					continue
+				}
+				if !deliver(b) {
+					return
+				}
+			case b, ok := <-fallback:
+				if !ok {
+					fallback = nil
+					continue
+				}
+				if !deliver(b) {
+					return
+				}
+			case <-timer:
+				timer = nil
+				if !started {
+					startFallback()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,71 @@
+package blockservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithHTTPBlockFallback(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	served := make(map[string][]byte)
+	for _, b := range blks[1:] {
+		served[b.Cid().String()] = b.RawData()
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := served[strings.TrimPrefix(r.URL.Path, "/block/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Run("no exchange", func(t *testing.T) {
+		t.Parallel()
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, nil, WithHTTPBlockFallback([]string{srv.URL}))
+
+		_, err := bserv.GetBlock(ContextWithOffline(ctx), blks[1].Cid())
+		require.True(t, ipld.IsNotFound(err))
+
+		blk, err := bserv.GetBlock(ctx, blks[1].Cid())
+		require.NoError(t, err)
+		require.Equal(t, blks[1].RawData(), blk.RawData())
+		has, err := bstore.Has(ctx, blks[1].Cid())
+		require.NoError(t, err)
+		require.True(t, has, "fetched blocks are cached")
+	})
+
+	t.Run("exchange miss", func(t *testing.T) {
+		t.Parallel()
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		require.NoError(t, exchbstore.Put(ctx, blks[0]))
+		bserv := New(bstore, offline.Exchange(exchbstore), WithHTTPBlockFallback([]string{srv.URL}))
+
+		var got []cid.Cid
+		for b := range bserv.GetBlocks(ctx, []cid.Cid{blks[0].Cid(), blks[2].Cid(), blks[3].Cid()}) {
+			got = append(got, b.Cid())
+		}
+		require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[2].Cid(), blks[3].Cid()}, got)
+
+		_, err := bserv.GetBlock(ctx, blks[1].Cid())
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,318 @@
+// Package httpfetch implements an [exchange.Fetcher] retrieving raw blocks
+// from trustless HTTP endpoints, like the ones served by
+// [github.com/ipfs/boxo/blockservice/httpserver].
+//
+// Blocks are requested with GET {endpoint}{prefix}{cid} and their bytes are
+// hashed and checked against the CID before being returned.
+package httpfetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var logger = logging.Logger("blockservice/httpfetch")
+
+const (
+	// DefaultPathPrefix is the path between the endpoint and the CID.
+	DefaultPathPrefix = "/block/"
+	// DefaultTimeout bounds each HTTP request.
+	DefaultTimeout = 30 * time.Second
+	// DefaultParallelism is the number of requests GetBlocks runs at once.
+	DefaultParallelism = 8
+	// DefaultBackoff is how long an endpoint is skipped after its first
+	// failure, it doubles with each consecutive failure up to 32 times.
+	DefaultBackoff = 5 * time.Second
+	// DefaultMaxBlockSize is the size over which responses are rejected.
+	DefaultMaxBlockSize = 2 << 20
+
+	maxBackoffShift = 5
+	rawContentType  = "application/vnd.ipld.raw"
+)
+
+var (
+	// ErrNoEndpoint is returned when all the endpoints are backing off.
+	ErrNoEndpoint = errors.New("httpfetch: no endpoint available")
+	// ErrHashMismatch is wrapped by the errors returned for responses which
+	// don't hash to the requested CID.
+	ErrHashMismatch = errors.New("httpfetch: block does not match its CID")
+
+	errMissing = errors.New("httpfetch: block not found")
+)
+
+// Option configures a [Fetcher].
+type Option func(*Fetcher)
+
+// WithTimeout sets the timeout of each HTTP request, 0 means no timeout. It
+// defaults to [DefaultTimeout].
+func WithTimeout(d time.Duration) Option {
+	return func(f *Fetcher) {
+		f.timeout = d
+	}
+}
+
+// WithParallelism sets the number of requests GetBlocks runs at once, it
+// defaults to [DefaultParallelism].
+func WithParallelism(n int) Option {
+	return func(f *Fetcher) {
+		f.parallelism = n
+	}
+}
+
+// WithBackoff sets how long an endpoint is skipped after failing, it defaults
+// to [DefaultBackoff]. Missing blocks are not failures.
+func WithBackoff(d time.Duration) Option {
+	return func(f *Fetcher) {
+		f.backoff = d
+	}
+}
+
+// WithPathPrefix sets the path between the endpoint and the CID, it defaults
+// to [DefaultPathPrefix].
+func WithPathPrefix(prefix string) Option {
+	return func(f *Fetcher) {
+		f.prefix = prefix
+	}
+}
+
+// WithMaxBlockSize sets the size over which responses are rejected, it
+// defaults to [DefaultMaxBlockSize].
+func WithMaxBlockSize(n int) Option {
+	return func(f *Fetcher) {
+		f.maxBlockSize = n
+	}
+}
+
+// WithClient sets the HTTP client, it defaults to [http.DefaultClient].
+func WithClient(c *http.Client) Option {
+	return func(f *Fetcher) {
+		f.client = c
+	}
+}
+
+// Fetcher fetches blocks from a set of HTTP endpoints, picked round-robin.
+// The endpoints failing are skipped for a while, see [WithBackoff].
+type Fetcher struct {
+	endpoints    []*endpoint
+	client       *http.Client
+	timeout      time.Duration
+	parallelism  int
+	backoff      time.Duration
+	prefix       string
+	maxBlockSize int
+
+	next atomic.Uint32
+}
+
+var _ exchange.Fetcher = (*Fetcher)(nil)
+
+type endpoint struct {
+	url string
+
+	lk       sync.Mutex
+	failures int
+	until    time.Time
+}
+
+func (e *endpoint) available(now time.Time) bool {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	return !now.Before(e.until)
+}
+
+func (e *endpoint) failed(now time.Time, backoff time.Duration) {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	e.until = now.Add(backoff << min(e.failures, maxBackoffShift))
+	e.failures++
+}
+
+func (e *endpoint) succeeded() {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	e.failures = 0
+	e.until = time.Time{}
+}
+
+// New returns a Fetcher for the given endpoints, which are base URLs like
+// https://example.net.
+func New(endpoints []string, opts ...Option) (*Fetcher, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("httpfetch: no endpoints")
+	}
+	f := &Fetcher{
+		client:       http.DefaultClient,
+		timeout:      DefaultTimeout,
+		parallelism:  DefaultParallelism,
+		backoff:      DefaultBackoff,
+		prefix:       DefaultPathPrefix,
+		maxBlockSize: DefaultMaxBlockSize,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	switch {
+	case f.client == nil:
+		return nil, errors.New("httpfetch: nil client")
+	case f.timeout < 0:
+		return nil, fmt.Errorf("httpfetch: negative timeout %s", f.timeout)
+	case f.parallelism <= 0:
+		return nil, fmt.Errorf("httpfetch: the parallelism must be positive, got %d", f.parallelism)
+	case f.backoff < 0:
+		return nil, fmt.Errorf("httpfetch: negative backoff %s", f.backoff)
+	case f.maxBlockSize <= 0:
+		return nil, fmt.Errorf("httpfetch: the maximum block size must be positive, got %d", f.maxBlockSize)
+	}
+	for _, e := range endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("httpfetch: invalid endpoint %q: %w", e, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("httpfetch: invalid endpoint %q: not an http or https URL", e)
+		}
+		f.endpoints = append(f.endpoints, &endpoint{url: strings.TrimSuffix(e, "/")})
+	}
+	return f, nil
+}
+
+// GetBlock fetches c from the first endpoint having it. It returns an
+// [ipld.ErrNotFound] if none has it, or the error of the last endpoint which
+// failed.
+func (f *Fetcher) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	var lastErr error
+	tried := false
+	n := uint32(len(f.endpoints))
+	start := f.next.Add(1) - 1
+	for i := range n {
+		e := f.endpoints[(start+i)%n]
+		if !e.available(time.Now()) {
+			continue
+		}
+		tried = true
+		blk, err := f.fetch(ctx, e, c)
+		if err == nil {
+			e.succeeded()
+			return blk, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.Is(err, errMissing) {
+			continue
+		}
+		logger.Debugf("fetching %s from %s: %s", c, e.url, err)
+		e.failed(time.Now(), f.backoff)
+		lastErr = err
+	}
+	switch {
+	case lastErr != nil:
+		return nil, lastErr
+	case !tried:
+		return nil, ErrNoEndpoint
+	default:
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+}
+
+// GetBlocks fetches the blocks of ks, running up to the parallelism of
+// [WithParallelism] requests at once. The blocks which can't be fetched are
+// missing from the channel.
+func (f *Fetcher) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	todo := make(chan cid.Cid)
+	var wg sync.WaitGroup
+	for range min(f.parallelism, len(ks)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range todo {
+				blk, err := f.GetBlock(ctx, c)
+				if err != nil {
+					continue
+				}
+				select {
+				case out <- blk:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		defer func() {
+			close(todo)
+			wg.Wait()
+			close(out)
+		}()
+		seen := make(map[cid.Cid]struct{}, len(ks))
+		for _, c := range ks {
+			if _, ok := seen[c]; ok {
+				continue
+			}
+			seen[c] = struct{}{}
+			select {
+			case todo <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (f *Fetcher) fetch(ctx context.Context, e *endpoint, c cid.Cid) (blocks.Block, error) {
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url+f.prefix+c.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", rawContentType)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, errMissing
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(f.maxBlockSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > f.maxBlockSize {
+		return nil, fmt.Errorf("block %s is larger than %d bytes", c, f.maxBlockSize)
+	}
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sum.Hash(), c.Hash()) {
+		return nil, fmt.Errorf("%w: %s from %s", ErrHashMismatch, c, e.url)
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
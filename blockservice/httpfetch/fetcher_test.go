@@ -0,0 +1,87 @@
+package httpfetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// serve returns a server answering with the blocks of blks, or with status
+// when it is not 0. hits counts the requests.
+func serve(t *testing.T, blks []blocks.Block, status int, hits *atomic.Int32) *httptest.Server {
+	byCid := make(map[string][]byte)
+	for _, b := range blks {
+		byCid[b.Cid().String()] = b.RawData()
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		data, ok := byCid[strings.TrimPrefix(r.URL.Path, DefaultPathPrefix)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetcher(t *testing.T) {
+	ctx := context.Background()
+	blks := random.BlocksOfSize(3, 32)
+
+	var okHits, failHits, badHits atomic.Int32
+	good := serve(t, blks[:2], 0, &okHits)
+	failing := serve(t, nil, http.StatusInternalServerError, &failHits)
+	corrupted, err := blocks.NewBlockWithCid(blks[1].RawData(), blks[0].Cid())
+	require.NoError(t, err)
+	bad := serve(t, []blocks.Block{corrupted}, 0, &badHits)
+
+	f, err := New([]string{failing.URL, good.URL + "/"}, WithBackoff(time.Hour))
+	require.NoError(t, err)
+	for range 3 {
+		blk, err := f.GetBlock(ctx, blks[0].Cid())
+		require.NoError(t, err)
+		require.Equal(t, blks[0].RawData(), blk.RawData())
+	}
+	// the failing endpoint is skipped once it failed
+	require.EqualValues(t, 1, failHits.Load())
+
+	_, err = f.GetBlock(ctx, blks[2].Cid())
+	require.True(t, ipld.IsNotFound(err))
+
+	ch, err := f.GetBlocks(ctx, []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid(), blks[1].Cid()})
+	require.NoError(t, err)
+	var got []cid.Cid
+	for b := range ch {
+		got = append(got, b.Cid())
+	}
+	require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, got)
+
+	f, err = New([]string{bad.URL})
+	require.NoError(t, err)
+	_, err = f.GetBlock(ctx, blks[0].Cid())
+	require.ErrorIs(t, err, ErrHashMismatch)
+	_, err = f.GetBlock(ctx, blks[0].Cid())
+	require.ErrorIs(t, err, ErrNoEndpoint)
+	require.EqualValues(t, 1, badHits.Load())
+
+	_, err = New(nil)
+	require.Error(t, err)
+	_, err = New([]string{"ftp://example.net"})
+	require.Error(t, err)
+}
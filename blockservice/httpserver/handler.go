@@ -0,0 +1,159 @@
+// Package httpserver implements a minimal trustless HTTP endpoint serving raw
+// blocks out of a [blockservice.BlockService].
+//
+// It answers GET and HEAD requests for {prefix}{cid} with the raw bytes of the
+// block, without any of the path resolution of the gateway.
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var logger = logging.Logger("blockservice/httpserver")
+
+// DefaultPathPrefix is the path under which blocks are served by default.
+const DefaultPathPrefix = "/block/"
+
+const rawContentType = "application/vnd.ipld.raw"
+
+// Option configures the handler returned by [NewHTTPHandler].
+type Option func(*handler)
+
+// WithPathPrefix sets the path prefix in front of the CID, it defaults to
+// [DefaultPathPrefix].
+func WithPathPrefix(prefix string) Option {
+	return func(h *handler) {
+		h.prefix = prefix
+	}
+}
+
+type handler struct {
+	bs     blockservice.BlockService
+	prefix string
+}
+
+// sizer is implemented by blockservices able to tell the size of a block.
+type sizer interface {
+	GetSize(ctx context.Context, c cid.Cid) (int, error)
+}
+
+// NewHTTPHandler returns a handler serving the raw bytes of the blocks of bs
+// at GET {prefix}{cid}. The allowlist and content blocker of bs are enforced,
+// and the offline=true query parameter restricts the request to the local
+// blockstore.
+func NewHTTPHandler(bs blockservice.BlockService, opts ...Option) http.Handler {
+	h := &handler{
+		bs:     bs,
+		prefix: DefaultPathPrefix,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cidStr, ok := strings.CutPrefix(r.URL.Path, h.prefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		http.Error(w, "invalid CID: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if offline, _ := strconv.ParseBool(r.URL.Query().Get("offline")); offline {
+		ctx = blockservice.ContextWithOffline(ctx)
+	}
+
+	etag := `"` + c.String() + `.raw"`
+	if inm := r.Header.Get("If-None-Match"); inm != "" && inm == etag {
+		// the cached copy is only still valid if the block can be served:
+		// GetSize applies the allowlist and the content blocker, and fails
+		// if the block is not available
+		if _, err := h.getSize(ctx, c); err != nil {
+			writeError(w, c, err)
+			return
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var data []byte
+	var size int
+	if r.Method == http.MethodHead {
+		size, err = h.getSize(ctx, c)
+	} else {
+		var blk blocks.Block
+		blk, err = h.bs.GetBlock(ctx, c)
+		if err == nil {
+			data = blk.RawData()
+			size = len(data)
+		}
+	}
+	if err != nil {
+		writeError(w, c, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", rawContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.Header().Set("Etag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if data != nil {
+		if _, err := w.Write(data); err != nil {
+			logger.Debugf("failed to write block %s: %s", c, err)
+		}
+	}
+}
+
+func (h *handler) getSize(ctx context.Context, c cid.Cid) (int, error) {
+	if s, ok := h.bs.(sizer); ok {
+		return s.GetSize(ctx, c)
+	}
+	blk, err := h.bs.GetBlock(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return len(blk.RawData()), nil
+}
+
+func writeError(w http.ResponseWriter, c cid.Cid, err error) {
+	var code int
+	switch {
+	case ipld.IsNotFound(err):
+		code = http.StatusNotFound
+	case errors.Is(err, blockservice.ErrBlocked),
+		errors.Is(err, verifcid.ErrPossiblyInsecureHashFunction),
+		errors.Is(err, verifcid.ErrBelowMinimumHashLength),
+		errors.Is(err, verifcid.ErrAboveMaximumHashLength):
+		code = http.StatusGone
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		code = http.StatusGatewayTimeout
+	default:
+		code = http.StatusInternalServerError
+		logger.Errorf("failed to serve block %s: %s", c, err)
+	}
+	http.Error(w, err.Error(), code)
+}
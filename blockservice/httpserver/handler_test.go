@@ -0,0 +1,89 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/ipfs/boxo/blockservice"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, 32)
+	local, remote, blocked := blks[0], blks[1], blks[2]
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, local))
+	require.NoError(t, exchbstore.Put(ctx, remote))
+	bs := blockservice.New(bstore, offline.Exchange(exchbstore), blockservice.WithContentBlocker(func(c cid.Cid) error {
+		if c == blocked.Cid() {
+			return errors.New("denied")
+		}
+		return nil
+	}))
+
+	srv := httptest.NewServer(NewHTTPHandler(bs))
+	defer srv.Close()
+
+	do := func(method, path string, header ...string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		require.NoError(t, err)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/block/"+local.Cid().String())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `"`+local.Cid().String()+`.raw"`, resp.Header.Get("Etag"))
+	require.Equal(t, strconv.Itoa(len(local.RawData())), resp.Header.Get("Content-Length"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, local.RawData(), body)
+
+	resp = do(http.MethodHead, "/block/"+local.Cid().String())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, strconv.Itoa(len(local.RawData())), resp.Header.Get("Content-Length"))
+
+	resp = do(http.MethodGet, "/block/"+remote.Cid().String()+"?offline=true")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = do(http.MethodGet, "/block/"+remote.Cid().String())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/block/"+blocked.Cid().String())
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+
+	// the ETag is only honored for the blocks which can be served
+	etag := func(c cid.Cid) string { return `"` + c.String() + `.raw"` }
+	resp = do(http.MethodGet, "/block/"+local.Cid().String(), "If-None-Match", etag(local.Cid()))
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	resp = do(http.MethodGet, "/block/"+blocked.Cid().String(), "If-None-Match", etag(blocked.Cid()))
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+	missing := random.BlocksOfSize(1, 32)[0].Cid()
+	resp = do(http.MethodGet, "/block/"+missing.String()+"?offline=true", "If-None-Match", etag(missing))
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/block/not-a-cid")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(http.MethodPost, "/block/"+local.Cid().String())
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,60 @@
+package blockservice
+
+import (
+	"context"
+
+	"github.com/ipfs/boxo/verifcid"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InsecureAllowlist is the [verifcid.Allowlist] installed by
+// [InsecureAllowAllHashes]. Tools can compare the result of
+// [BoundedBlockService.Allowlist] against it to refuse running with such a
+// blockservice.
+var InsecureAllowlist verifcid.Allowlist = insecureAllowlist{}
+
+type insecureAllowlist struct{}
+
+func (insecureAllowlist) IsAllowed(uint64) bool { return true }
+
+// InsecureAllowAllHashes disables the verifcid checks: every hash function and
+// digest length is accepted. This is only meant for tests and trusted
+// ingestion of legacy data, never for a node fetching content from the
+// network.
+func InsecureAllowAllHashes() Option {
+	return func(bs *blockService) {
+		bs.allowlist = InsecureAllowlist
+	}
+}
+
+// validateCid is [verifcid.ValidateCid] unless the checks were disabled with
+// [InsecureAllowAllHashes], errors are wrapped in an [*AllowlistError].
+func validateCid(allowlist verifcid.Allowlist, c cid.Cid) error {
+	if allowlist == InsecureAllowlist {
+		return nil
+	}
+	if err := verifcid.ValidateCid(allowlist, c); err != nil {
+		return &AllowlistError{Cid: c, Err: err}
+	}
+	return nil
+}
+
+// tagSpan marks span when the service runs with [InsecureAllowAllHashes] or
+// is read-only, and when the provides of the operation are suppressed by
+// [ContextWithNoProvide].
+func (s *blockService) tagSpan(ctx context.Context, span trace.Span) {
+	if s == nil {
+		return
+	}
+	if s.allowlist == InsecureAllowlist {
+		span.SetAttributes(attribute.Bool("insecure_allowlist", true))
+	}
+	if s.readOnly.Load() {
+		span.SetAttributes(attribute.Bool("read_only", true))
+	}
+	if s.provider != nil && isNoProvide(ctx) {
+		span.SetAttributes(attribute.Bool("provide_suppressed", true))
+	}
+}
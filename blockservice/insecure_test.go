@@ -0,0 +1,44 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestInsecureAllowAllHashes(t *testing.T) {
+	recordSpans()
+	ctx := context.Background()
+
+	data := []byte("legacy data with a truncated hash")
+	c, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.SHA2_256, MhLength: 8}.Sum(data)
+	require.NoError(t, err)
+	blk, err := blocks.NewBlockWithCid(data, c)
+	require.NoError(t, err)
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	secure := New(bstore, nil)
+	require.ErrorIs(t, secure.AddBlock(ctx, blk), verifcid.ErrBelowMinimumHashLength)
+
+	bserv := New(bstore, nil, InsecureAllowAllHashes())
+	require.Equal(t, InsecureAllowlist, bserv.(BoundedBlockService).Allowlist())
+	require.NotEqual(t, InsecureAllowlist, secure.(BoundedBlockService).Allowlist())
+
+	require.NoError(t, bserv.AddBlock(ctx, blk))
+	got, err := bserv.GetBlock(ctx, c)
+	require.NoError(t, err)
+	require.Equal(t, data, got.RawData())
+
+	insecure := attribute.Bool("insecure_allowlist", true)
+	require.NotEmpty(t, findSpans("Blockservice.blockService.AddBlock", insecure))
+	require.NotEmpty(t, findSpans("Blockservice.blockService.GetBlock", insecure))
+}
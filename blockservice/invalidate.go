@@ -0,0 +1,25 @@
+package blockservice
+
+import (
+	"context"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+)
+
+// CacheInvalidator is implemented by the caching blockstores, like the bloom
+// filter or ARC wrappers, which could keep reporting a deleted block as
+// stored: AddBlock would then skip writing it again and the block would be
+// lost. The blockservice calls it after every delete which did not fail.
+type CacheInvalidator interface {
+	// InvalidateCache forgets what the cache knows about c, the next lookups
+	// go to the blockstore below.
+	InvalidateCache(ctx context.Context, c cid.Cid)
+}
+
+// invalidateCache calls InvalidateCache on bs if it is a CacheInvalidator.
+func invalidateCache(ctx context.Context, bs blockstore.Blockstore, c cid.Cid) {
+	if ci, ok := bs.(CacheInvalidator); ok {
+		ci.InvalidateCache(ctx, c)
+	}
+}
@@ -0,0 +1,102 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// hasCachingBlockstore remembers the blocks Has found, its DeleteBlock
+// forgets to update the cache.
+type hasCachingBlockstore struct {
+	blockstore.Blockstore
+
+	lk  sync.Mutex
+	has map[cid.Cid]bool
+}
+
+func (bs *hasCachingBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	if bs.has[c] {
+		return true, nil
+	}
+	has, err := bs.Blockstore.Has(ctx, c)
+	if has {
+		bs.has[c] = true
+	}
+	return has, err
+}
+
+// invalidatingBlockstore is a hasCachingBlockstore implementing
+// CacheInvalidator.
+type invalidatingBlockstore struct {
+	*hasCachingBlockstore
+}
+
+func (bs invalidatingBlockstore) InvalidateCache(_ context.Context, c cid.Cid) {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	delete(bs.has, c)
+}
+
+func TestDeleteInvalidatesCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	newCaching := func() *hasCachingBlockstore {
+		return &hasCachingBlockstore{
+			Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+			has:        make(map[cid.Cid]bool),
+		}
+	}
+	// addAfterDelete adds blk, deletes it and adds it again through bserv,
+	// then reports whether the blockstore below the cache has it.
+	addAfterDelete := func(t *testing.T, bserv BlockService, below blockstore.Blockstore) bool {
+		blk := random.BlocksOfSize(1, blockSize)[0]
+		require.NoError(t, bserv.AddBlock(ctx, blk))
+		has, err := bserv.Blockstore().Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+		require.NoError(t, bserv.DeleteBlock(ctx, blk.Cid()))
+		require.NoError(t, bserv.AddBlock(ctx, blk))
+		has, err = below.Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		return has
+	}
+
+	t.Run("stale cache", func(t *testing.T) {
+		t.Parallel()
+		// the scenario fixed by CacheInvalidator: the cache skips the write
+		bstore := newCaching()
+		require.False(t, addAfterDelete(t, New(bstore, nil), bstore.Blockstore))
+	})
+
+	t.Run("invalidated", func(t *testing.T) {
+		t.Parallel()
+		bstore := newCaching()
+		require.True(t, addAfterDelete(t, New(invalidatingBlockstore{bstore}, nil), bstore.Blockstore))
+	})
+
+	t.Run("missing block", func(t *testing.T) {
+		t.Parallel()
+		// a cache reporting a block the blockstore below does not have
+		bstore := newCaching()
+		blk := random.BlocksOfSize(1, blockSize)[0]
+		bstore.has[blk.Cid()] = true
+		bserv := New(invalidatingBlockstore{bstore}, nil)
+		// the blockstore package does not report the deletion of missing blocks
+		require.NoError(t, bserv.DeleteBlock(ctx, blk.Cid()))
+		require.NoError(t, bserv.AddBlock(ctx, blk))
+		has, err := bstore.Blockstore.Has(ctx, blk.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	})
+}
@@ -0,0 +1,109 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+// ErrAbandonedOutput is reported for the blocks of a GetBlocks call aborted
+// by [WithLeakAbort].
+var ErrAbandonedOutput = errors.New("GetBlocks channel abandoned by its consumer")
+
+// WithLeakDetection logs a warning, with the stack of the call, for the
+// GetBlocks calls whose consumer has not read a block for warnAfter, which
+// usually means the channel was abandoned without canceling the context and
+// the goroutine producing the blocks is leaked. The warnings are counted by
+// the LeakWarnings stat, once per call.
+// It is meant for debugging: the stack of every GetBlocks call is captured.
+func WithLeakDetection(warnAfter time.Duration) Option {
+	return func(bs *blockService) {
+		if warnAfter <= 0 {
+			bs.invalidOption("WithLeakDetection: the delay must be positive, got %s", warnAfter)
+			return
+		}
+		bs.leakWarnAfter = warnAfter
+	}
+}
+
+// WithLeakAbort aborts the GetBlocks calls whose consumer has not read a
+// block for abortAfter, which should be much longer than any legitimate
+// pause of the consumers. The blocks not returned are reported with
+// [ErrAbandonedOutput] and the aborts are counted by the LeaksAborted stat.
+func WithLeakAbort(abortAfter time.Duration) Option {
+	return func(bs *blockService) {
+		if abortAfter <= 0 {
+			bs.invalidOption("WithLeakAbort: the delay must be positive, got %s", abortAfter)
+			return
+		}
+		bs.leakAbortAfter = abortAfter
+	}
+}
+
+// leakWatch watches the sends of a blockOutput for [WithLeakDetection] and
+// [WithLeakAbort]. A nil leakWatch watches nothing.
+type leakWatch struct {
+	s      *blockService
+	stack  []byte
+	abort  context.CancelFunc
+	warned bool
+}
+
+// newLeakWatch returns the watch of a GetBlocks call and the context of its
+// producer, which is canceled by an abort. It returns ctx and nil when leak
+// detection is off.
+func (s *blockService) newLeakWatch(ctx context.Context) (context.Context, *leakWatch) {
+	if s == nil || (s.leakWarnAfter == 0 && s.leakAbortAfter == 0) {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &leakWatch{s: s, stack: debug.Stack(), abort: cancel}
+}
+
+// stop releases the resources of the watch.
+func (w *leakWatch) stop() {
+	if w != nil {
+		w.abort()
+	}
+}
+
+// sendWatched is send timing the wait for the consumer, o.lk is held.
+func (o *blockOutput) sendWatched(b blocks.Block) bool {
+	w := o.leaks
+	clk := w.s.clock
+	start := clk.Now()
+	var warn, abort <-chan time.Time
+	if w.s.leakWarnAfter > 0 && !w.warned {
+		t := clk.Timer(w.s.leakWarnAfter)
+		defer t.Stop()
+		warn = t.C
+	}
+	if w.s.leakAbortAfter > 0 {
+		t := clk.Timer(w.s.leakAbortAfter)
+		defer t.Stop()
+		abort = t.C
+	}
+	for {
+		select {
+		case o.ch <- b:
+			o.delivered(b)
+			return true
+		case <-o.ctx.Done():
+			return false
+		case <-warn:
+			warn = nil
+			w.warned = true
+			w.s.stats.leakWarnings.Add(1)
+			logger.Warnf("GetBlocks consumer has not read a block for %s, its channel may have been abandoned without canceling the context, GetBlocks was called from:\n%s", clk.Since(start), w.stack)
+		case <-abort:
+			w.s.stats.leaksAborted.Add(1)
+			logger.Errorf("aborted GetBlocks whose consumer has not read a block for %s, GetBlocks was called from:\n%s", clk.Since(start), w.stack)
+			o.tracker.finish(o.ctx, ErrAbandonedOutput)
+			w.abort()
+			return false
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeakDetection(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.PutMany(ctx, blks))
+
+	clk := clock.NewMock()
+	rec := &errorRecorder{}
+	bserv := New(bstore, nil, WithClock(clk), WithBlockErrorHandler(rec.handle),
+		WithLeakDetection(time.Minute), WithLeakAbort(time.Hour)).(*blockService)
+
+	out := bserv.GetBlocks(ctx, ks)
+	<-out
+	// the consumer stops reading
+	require.Eventually(t, func() bool {
+		clk.Add(10 * time.Second)
+		return bserv.Stats(false).LeakWarnings == 1
+	}, 5*time.Second, time.Millisecond)
+	require.Zero(t, bserv.Stats(false).LeaksAborted)
+
+	// a slow consumer is only warned about once
+	<-out
+	clk.Add(2 * time.Minute)
+	require.EqualValues(t, 1, bserv.Stats(false).LeakWarnings)
+
+	require.Eventually(t, func() bool {
+		clk.Add(10 * time.Minute)
+		return bserv.Stats(false).LeaksAborted == 1
+	}, 5*time.Second, time.Millisecond)
+	// the producer is stopped and the channel closed
+	for range out {
+	}
+	require.ErrorIs(t, rec.get(ks[2]), ErrAbandonedOutput)
+	require.EqualValues(t, 1, bserv.Stats(false).LeakWarnings)
+}
+
+func TestLeakDetectionOff(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.PutMany(ctx, blks))
+	bserv := New(bstore, nil).(*blockService)
+
+	_, leaks := bserv.newLeakWatch(ctx)
+	require.Nil(t, leaks)
+	var got int
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[0].Cid(), blks[1].Cid()}) {
+		got++
+	}
+	require.Equal(t, 2, got)
+
+	_, err := NewWithOptions(bstore, nil, WithLeakDetection(0))
+	require.Error(t, err)
+	_, err = NewWithOptions(bstore, nil, WithLeakAbort(-time.Second))
+	require.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrServiceClosed is returned by operations started after Close.
+var ErrServiceClosed = errors.New("blockservice is closed")
+
+// defaultCloseTimeout bounds how long Close waits for the in-flight
+// operations and the pending work to finish.
+const defaultCloseTimeout = time.Minute
+
+// WithCloseTimeout bounds how long Close waits for in-flight operations to
+// return and for pending work to be flushed before closing the exchange, the
+// default is one minute.
+func WithCloseTimeout(d time.Duration) Option {
+	return func(bs *blockService) {
+		if d < 0 {
+			bs.invalidOption("WithCloseTimeout: negative timeout %s", d)
+			return
+		}
+		bs.closeTimeout = d
+	}
+}
+
+// track registers an operation which must finish before Close closes the
+// exchange. The returned context is canceled when Close is called, done must
+// be called once the operation has finished using the blockservice.
+// It handles a nil receiver by tracking nothing.
+func (s *blockService) track(ctx context.Context) (context.Context, func(), error) {
+	if s == nil {
+		return ctx, func() {}, nil
+	}
+
+	s.lifecycleLk.Lock()
+	if s.closed {
+		s.lifecycleLk.Unlock()
+		return ctx, nil, ErrServiceClosed
+	}
+	s.inflight.Add(1)
+	s.lifecycleLk.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.serviceCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+		s.inflight.Done()
+	}, nil
+}
+
+// waitInflight waits for the tracked operations to finish or ctx to expire.
+func (s *blockService) waitInflight(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
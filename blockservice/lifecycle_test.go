@@ -0,0 +1,103 @@
+package blockservice
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+var _ exchange.Interface = (*hangingExchange)(nil)
+
+// hangingExchange never finds anything and records if it is used after Close.
+type hangingExchange struct {
+	closed      atomic.Bool
+	usedClosed  atomic.Bool
+	getsStarted chan struct{}
+}
+
+func (e *hangingExchange) GetBlock(ctx context.Context, _ cid.Cid) (blocks.Block, error) {
+	e.getsStarted <- struct{}{}
+	<-ctx.Done()
+	if e.closed.Load() {
+		e.usedClosed.Store(true)
+	}
+	return nil, ctx.Err()
+}
+
+func (e *hangingExchange) GetBlocks(ctx context.Context, _ []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	go func() {
+		e.getsStarted <- struct{}{}
+		<-ctx.Done()
+		if e.closed.Load() {
+			e.usedClosed.Store(true)
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
+func (e *hangingExchange) NotifyNewBlocks(context.Context, ...blocks.Block) error { return nil }
+
+func (e *hangingExchange) Close() error {
+	e.closed.Store(true)
+	return nil
+}
+
+func TestCloseWaitsForInflightOperations(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	exch := &hangingExchange{getsStarted: make(chan struct{}, 2)}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch)
+
+	blks := random.BlocksOfSize(2, blockSize)
+	out := bserv.GetBlocks(ctx, []cid.Cid{blks[0].Cid()})
+	getErr := make(chan error, 1)
+	go func() {
+		_, err := NewSession(ctx, bserv).GetBlock(ctx, blks[1].Cid())
+		getErr <- err
+	}()
+	<-exch.getsStarted
+	<-exch.getsStarted
+
+	require.NoError(t, bserv.Close())
+	require.False(t, exch.usedClosed.Load(), "the exchange must be closed after the operations returned")
+	select {
+	case _, ok := <-out:
+		require.False(t, ok)
+	default:
+		t.Fatal("GetBlocks channel must be closed when Close returns")
+	}
+	require.ErrorIs(t, <-getErr, context.Canceled)
+
+	_, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.ErrorIs(t, err, ErrServiceClosed)
+	require.ErrorIs(t, bserv.AddBlock(ctx, blks[0]), ErrServiceClosed)
+	_, ok := <-bserv.GetBlocks(ctx, []cid.Cid{blks[0].Cid()})
+	require.False(t, ok)
+}
+
+func TestCloseTimeout(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithCloseTimeout(10*time.Millisecond)).(*blockService)
+
+	// an operation ignoring cancellation must not block Close forever
+	_, done, err := bserv.track(context.Background())
+	require.NoError(t, err)
+	defer done()
+	require.NoError(t, bserv.Close())
+}
@@ -0,0 +1,87 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// ErrCorruptBlock is returned when [WithHashOnLocalRead] finds that the
+// stored copy of a block does not hash to its CID and the block could not be
+// fetched again, because the call is offline for example. It matches
+// [ErrHashMismatch].
+type ErrCorruptBlock struct {
+	Cid cid.Cid
+}
+
+func (e ErrCorruptBlock) Error() string {
+	return fmt.Sprintf("stored block %s is corrupt: %s", e.Cid, ErrHashMismatch)
+}
+
+// Is matches any ErrCorruptBlock and [ErrHashMismatch].
+func (e ErrCorruptBlock) Is(err error) bool {
+	if _, ok := err.(ErrCorruptBlock); ok {
+		return true
+	}
+	return err == ErrHashMismatch
+}
+
+// WithHashOnLocalRead makes GetBlock and GetBlocks hash the blocks read from
+// the blockstore and compare them with their CID. A corrupt copy is deleted,
+// counted in the CorruptBlocks stat, and the block is fetched again from the
+// exchange as if it was missing; offline the call fails with
+// [ErrCorruptBlock] instead. The delete is subject to [WithDeleteGuard] and
+// audited with the tag "corrupt" when the operation has none. See
+// [WithHashOnLocalReadSampling] to only hash some of the reads.
+func WithHashOnLocalRead() Option {
+	return WithHashOnLocalReadSampling(1)
+}
+
+// WithHashOnLocalReadSampling is [WithHashOnLocalRead] hashing one read out of
+// oneInN, starting with the first one.
+func WithHashOnLocalReadSampling(oneInN int) Option {
+	return func(bs *blockService) {
+		if oneInN <= 0 {
+			bs.invalidOption("WithHashOnLocalReadSampling: the sampling rate must be positive, got %d", oneInN)
+			return
+		}
+		bs.hashOnLocalRead = uint64(oneInN)
+	}
+}
+
+// corruptAuditTag is the audit tag of the deletes of corrupt blocks made
+// without one.
+const corruptAuditTag = "corrupt"
+
+// checkLocalRead hashes blk, read from bs, if [WithHashOnLocalRead] samples
+// it. A corrupt block is deleted from bs and an [ErrCorruptBlock] returned.
+func (s *blockService) checkLocalRead(ctx context.Context, bs blockstore.Blockstore, blk blocks.Block) error {
+	if s == nil || s.hashOnLocalRead == 0 {
+		return nil
+	}
+	if (s.stats.localReads.Add(1)-1)%s.hashOnLocalRead != 0 {
+		return nil
+	}
+	err := verifyBlock(0, blk)
+	if err == nil || !errors.Is(err, ErrHashMismatch) {
+		// the CIDs which can't be hashed were accepted by the allowlist
+		return nil
+	}
+	c := blk.Cid()
+	s.stats.corruptBlocks.Add(1)
+	logger.Errorf("stored block %s does not match its CID, deleting it", c)
+	if s.isReadOnly() {
+		return ErrCorruptBlock{Cid: c}
+	}
+	if auditTag(ctx) == "" {
+		ctx = ContextWithAuditTag(ctx, corruptAuditTag)
+	}
+	if _, err := s.deleteBlock(ctx, c, PrimaryStore, deleteOptions{ignoreNotFound: true}); err != nil {
+		logger.Errorf("failed to delete the corrupt block %s: %s", c, err)
+	}
+	return ErrCorruptBlock{Cid: c}
+}
@@ -0,0 +1,107 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptStore returns a blockstore holding corrupt copies of blks.
+func corruptStore(t *testing.T, blks []blocks.Block) blockstore.Blockstore {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	for _, b := range blks {
+		corrupt, err := blocks.NewBlockWithCid([]byte("bit rot"), b.Cid())
+		require.NoError(t, err)
+		require.NoError(t, bstore.Put(context.Background(), corrupt))
+	}
+	return bstore
+}
+
+func TestHashOnLocalReadRepairs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	bstore := corruptStore(t, blks)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithHashOnLocalRead()).(*blockService)
+
+	blk, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), blk.RawData())
+
+	var got []blocks.Block
+	for b := range bserv.GetBlocks(ctx, []cid.Cid{blks[1].Cid(), blks[2].Cid()}) {
+		got = append(got, b)
+	}
+	require.ElementsMatch(t, blks[1:], got)
+	require.EqualValues(t, 3, bserv.Stats(false).CorruptBlocks)
+
+	// the repaired copies are stored
+	for _, b := range blks {
+		stored, err := bstore.Get(ctx, b.Cid())
+		require.NoError(t, err)
+		require.Equal(t, b.RawData(), stored.RawData())
+	}
+}
+
+func TestHashOnLocalReadOffline(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	bstore := corruptStore(t, blks)
+	failed := make(map[cid.Cid]error)
+	rec := &auditRecorder{}
+	bserv := New(bstore, nil, WithHashOnLocalRead(), WithAuditSink(rec.record), WithBlockErrorHandler(func(c cid.Cid, err error) {
+		failed[c] = err
+	}))
+
+	_, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.Equal(t, ErrCorruptBlock{Cid: blks[0].Cid()}, err)
+	require.ErrorIs(t, err, ErrHashMismatch)
+	has, err := bstore.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[1].Cid()}) {
+		t.Fatal("no block expected")
+	}
+	require.Equal(t, map[cid.Cid]error{blks[1].Cid(): ErrCorruptBlock{Cid: blks[1].Cid()}}, failed)
+
+	// the deletes are audited
+	require.NoError(t, bserv.Close())
+	require.Equal(t, []string{
+		string(AuditDelete) + " " + blks[0].Cid().String() + " corrupt",
+		string(AuditDelete) + " " + blks[1].Cid().String() + " corrupt",
+	}, rec.ops())
+}
+
+func TestHashOnLocalReadSampling(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	bstore := corruptStore(t, blks)
+	bserv := New(bstore, nil, WithHashOnLocalReadSampling(2)).(*blockService)
+
+	// the first read is hashed, the second is not
+	_, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.ErrorIs(t, err, ErrCorruptBlock{})
+	blk, err := bserv.GetBlock(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.Equal(t, []byte("bit rot"), blk.RawData())
+	require.EqualValues(t, 1, bserv.Stats(false).CorruptBlocks)
+
+	_, err = NewWithOptions(bstore, nil, WithHashOnLocalReadSampling(0))
+	require.Error(t, err)
+}
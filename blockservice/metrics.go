@@ -0,0 +1,220 @@
+package blockservice
+
+import (
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the 1<<18+15 is to observe old file chunks that are 1<<18 + 14 in size
+var blockSizeBuckets = []float64{1 << 6, 1 << 8, 1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1<<18 + 15, 1 << 20, 1 << 21}
+
+// Values used for the direction label of the block size histogram.
+const (
+	directionAdded   = "added"
+	directionFetched = "fetched"
+)
+
+// WithPrometheusRegistry enables the blockservice metrics and registers them
+// on the given registry. Metrics are disabled unless this option is used.
+func WithPrometheusRegistry(reg prometheus.Registerer) Option {
+	return func(bs *blockService) {
+		if reg == nil {
+			bs.invalidOption("WithPrometheusRegistry: nil registry")
+			return
+		}
+		bs.promRegistry = reg
+	}
+}
+
+// WithCodecMetrics adds a codec label to the block size histogram.
+// The label is bounded to a small set of well known codecs, everything else
+// is reported as "other".
+func WithCodecMetrics() Option {
+	return func(bs *blockService) {
+		bs.codecMetrics = true
+	}
+}
+
+type metrics struct {
+	blockSize  *prometheus.HistogramVec
+	codecLabel bool
+	putRetries prometheus.Counter
+	writeBytes *prometheus.CounterVec
+
+	notifyFailures      *prometheus.CounterVec
+	recoveredPanics     prometheus.Counter
+	allowlistRejections *prometheus.CounterVec
+}
+
+func newMetrics(reg prometheus.Registerer, codecLabel bool) *metrics {
+	labels := []string{"direction"}
+	if codecLabel {
+		labels = append(labels, "codec")
+	}
+
+	blockSize := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "ipfs",
+			Subsystem: "blockservice",
+			Name:      "block_size_bytes",
+			Help:      "Size of the blocks added to or fetched by the blockservice.",
+			Buckets:   blockSizeBuckets,
+		},
+		labels,
+	)
+	if err := reg.Register(blockSize); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			blockSize = are.ExistingCollector.(*prometheus.HistogramVec)
+		} else {
+			logger.Errorf("failed to register ipfs_blockservice_block_size_bytes: %v", err)
+		}
+	}
+
+	putRetries := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "blockservice",
+		Name:      "put_retries_total",
+		Help:      "Number of blockstore writes retried after a transient failure.",
+	})
+	if err := reg.Register(putRetries); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			putRetries = are.ExistingCollector.(prometheus.Counter)
+		} else {
+			logger.Errorf("failed to register ipfs_blockservice_put_retries_total: %v", err)
+		}
+	}
+
+	writeBytes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "blockservice",
+		Name:      "write_bytes_total",
+		Help:      "Bytes offered to and written by each write path of the blockservice.",
+	}, []string{"path", "kind"})
+	if err := reg.Register(writeBytes); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			writeBytes = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			logger.Errorf("failed to register ipfs_blockservice_write_bytes_total: %v", err)
+		}
+	}
+
+	notifyFailures := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "blockservice",
+		Name:      "notify_failures_total",
+		Help:      "Number of failed announcements of new blocks to the exchange by each write path of the blockservice.",
+	}, []string{"path"})
+	if err := reg.Register(notifyFailures); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			notifyFailures = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			logger.Errorf("failed to register ipfs_blockservice_notify_failures_total: %v", err)
+		}
+	}
+
+	recoveredPanics := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "blockservice",
+		Name:      "recovered_panics_total",
+		Help:      "Number of panics recovered by GetBlocks.",
+	})
+	if err := reg.Register(recoveredPanics); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			recoveredPanics = are.ExistingCollector.(prometheus.Counter)
+		} else {
+			logger.Errorf("failed to register ipfs_blockservice_recovered_panics_total: %v", err)
+		}
+	}
+
+	allowlistRejections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ipfs",
+		Subsystem: "blockservice",
+		Name:      "allowlist_rejections_total",
+		Help:      "Number of CIDs rejected by the allowlist, by hash function and operation.",
+	}, []string{"hash", "operation"})
+	if err := reg.Register(allowlistRejections); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			allowlistRejections = are.ExistingCollector.(*prometheus.CounterVec)
+		} else {
+			logger.Errorf("failed to register ipfs_blockservice_allowlist_rejections_total: %v", err)
+		}
+	}
+
+	return &metrics{
+		blockSize:  blockSize,
+		codecLabel: codecLabel,
+		putRetries: putRetries,
+		writeBytes: writeBytes,
+
+		notifyFailures:      notifyFailures,
+		recoveredPanics:     recoveredPanics,
+		allowlistRejections: allowlistRejections,
+	}
+}
+
+// observeBlockSize records the size of b, it is a no-op when metrics are
+// disabled or when s is not backed by this package.
+func (s *blockService) observeBlockSize(direction string, b blocks.Block) {
+	if s == nil || s.metrics == nil {
+		return
+	}
+	size := float64(len(b.RawData()))
+	if !s.metrics.codecLabel {
+		s.metrics.blockSize.WithLabelValues(direction).Observe(size)
+		return
+	}
+	s.metrics.blockSize.WithLabelValues(direction, codecLabel(b.Cid())).Observe(size)
+}
+
+// codecLabel returns a bounded label value for the codec of c.
+func codecLabel(c cid.Cid) string {
+	switch c.Prefix().Codec {
+	case cid.Raw:
+		return "raw"
+	case cid.DagProtobuf:
+		return "dag-pb"
+	case cid.DagCBOR:
+		return "dag-cbor"
+	case cid.DagJSON:
+		return "dag-json"
+	case cid.Libp2pKey:
+		return "libp2p-key"
+	default:
+		return "other"
+	}
+}
+
+func newLiveSessionsGauge(reg prometheus.Registerer) prometheus.Gauge {
+	liveSessions := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ipfs",
+		Subsystem: "blockservice",
+		Name:      "live_sessions",
+		Help:      "Number of sessions tracked by the blockservice which have not been closed.",
+	})
+	if err := reg.Register(liveSessions); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			liveSessions = are.ExistingCollector.(prometheus.Gauge)
+		} else {
+			logger.Errorf("failed to register ipfs_blockservice_live_sessions: %v", err)
+		}
+	}
+	return liveSessions
+}
+
+func newProvideBacklogAgeGauge(reg prometheus.Registerer) prometheus.Gauge {
+	backlogAge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "ipfs",
+		Subsystem: "blockservice",
+		Name:      "provide_backlog_age_seconds",
+		Help:      "Age of the oldest provide waiting in the persistent provide queue.",
+	})
+	if err := reg.Register(backlogAge); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			backlogAge = are.ExistingCollector.(prometheus.Gauge)
+		} else {
+			logger.Errorf("failed to register ipfs_blockservice_provide_backlog_age_seconds: %v", err)
+		}
+	}
+	return backlogAge
+}
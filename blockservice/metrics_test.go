@@ -0,0 +1,55 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockSizeMetrics(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	reg := prometheus.NewRegistry()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithPrometheusRegistry(reg), WithCodecMetrics())
+
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlocks(ctx, blks[1:2]))
+	require.NoError(t, exchbstore.Put(ctx, blks[2]))
+	_, err := bserv.GetBlock(ctx, blks[2].Cid())
+	require.NoError(t, err)
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	counts := make(map[string]uint64)
+	for _, mf := range mfs {
+		if mf.GetName() != "ipfs_blockservice_block_size_bytes" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var direction, codec string
+			for _, l := range m.GetLabel() {
+				switch l.GetName() {
+				case "direction":
+					direction = l.GetValue()
+				case "codec":
+					codec = l.GetValue()
+				}
+			}
+			require.Equal(t, "dag-pb", codec)
+			counts[direction] = m.GetHistogram().GetSampleCount()
+		}
+	}
+	require.EqualValues(t, 2, counts[directionAdded])
+	require.EqualValues(t, 1, counts[directionFetched])
+}
@@ -0,0 +1,324 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// MigrateStats reports what [MigrateHashes] did.
+type MigrateStats struct {
+	// Scanned is the number of CIDs enumerated from the blockstore.
+	Scanned int
+	// Migrated is the number of blocks written under their new CID.
+	Migrated int
+	// MigratedBytes is the size of the blocks written under their new CID.
+	MigratedBytes int64
+	// AlreadyMigrated is the number of blocks whose new CID was already
+	// stored, by a previous run for example.
+	AlreadyMigrated int
+	// Deleted is the number of blocks removed under their old CID, see
+	// [WithMigrateDeleteOld].
+	Deleted int
+	// DeleteRefused is the number of old CIDs kept by the guard of
+	// [WithDeleteGuard].
+	DeleteRefused int
+	// DeleteFailed is the number of old CIDs which could not be deleted, they
+	// are reported by the [MigrateError].
+	DeleteFailed int
+}
+
+// MigrateError is returned by [MigrateHashes] when some blocks could not be
+// migrated, the other blocks have been migrated normally.
+type MigrateError struct {
+	// Failed maps the old CIDs which were not migrated to the reason why.
+	Failed map[cid.Cid]error
+}
+
+func (e *MigrateError) Error() string {
+	return fmt.Sprintf("failed to migrate %d blocks", len(e.Failed))
+}
+
+// MigrateOption configures [MigrateHashes].
+type MigrateOption func(*migrateOptions)
+
+type migrateOptions struct {
+	batchSize   int
+	concurrency int
+	deleteOld   bool
+	mapping     func(old, new cid.Cid)
+	progress    func(MigrateStats)
+}
+
+// WithMigrateBatchSize sets how many blocks are read and written at once, the
+// default is 256.
+func WithMigrateBatchSize(n int) MigrateOption {
+	return func(o *migrateOptions) {
+		o.batchSize = n
+	}
+}
+
+// WithMigrateConcurrency sets how many batches are migrated in parallel, the
+// default is 4.
+func WithMigrateConcurrency(n int) MigrateOption {
+	return func(o *migrateOptions) {
+		o.concurrency = n
+	}
+}
+
+// WithMigrateDeleteOld sets whether the blocks are deleted under their old CID
+// once written under the new one, the default is false.
+func WithMigrateDeleteOld(del bool) MigrateOption {
+	return func(o *migrateOptions) {
+		o.deleteOld = del
+	}
+}
+
+// WithMigrateMapping sets a callback receiving the old and new CID of every
+// migrated block, including the ones migrated by a previous run. It is never
+// called concurrently.
+func WithMigrateMapping(mapping func(old, new cid.Cid)) MigrateOption {
+	return func(o *migrateOptions) {
+		o.mapping = mapping
+	}
+}
+
+// WithMigrateProgress sets a callback receiving the cumulative stats after
+// each batch. It is never called concurrently.
+func WithMigrateProgress(progress func(MigrateStats)) MigrateOption {
+	return func(o *migrateOptions) {
+		o.progress = progress
+	}
+}
+
+// MigrateHashes makes the blocks of bs which are only readable with the older
+// allowlist from readable again after the allowlist of bs was tightened: their
+// data is hashed with the toHash multihash function and written with
+// bs.AddBlocks under a CIDv1 with the same codec.
+// The blockstore of bs is enumerated with AllKeysChan, so the codec is the one
+// of its keys: raw for the blockstores of the boxo blockstore package. Use
+// [WithMigrateMapping] to rewrite the references to the old CIDs.
+// Blocks already stored under their new CID are not written again, so an
+// interrupted migration can be run again.
+// Blocks which can't be migrated don't abort the migration, they are reported
+// in a [*MigrateError] once everything else has been migrated.
+// When bs has a [SecurityPolicy], the blocks migrated are the ones whose CID
+// it rejects.
+func MigrateHashes(ctx context.Context, bs BlockService, from verifcid.Allowlist, toHash uint64, opts ...MigrateOption) (MigrateStats, error) {
+	ctx, span := internal.StartSpan(ctx, "MigrateHashes")
+	defer span.End()
+
+	o := migrateOptions{
+		batchSize:   defaultCopyBatchSize,
+		concurrency: defaultCopyConcurrency,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.batchSize <= 0 {
+		o.batchSize = defaultCopyBatchSize
+	}
+	if o.concurrency <= 0 {
+		o.concurrency = 1
+	}
+
+	policy := grabSecurityPolicyFromBlockservice(bs)
+	if p, ok := policy.(allowlistPolicy); ok && !p.allowlist.IsAllowed(toHash) {
+		return MigrateStats{}, fmt.Errorf("MigrateHashes: the target hash function %#x is not allowed by the blockservice", toHash)
+	}
+	if _, err := mh.Sum(nil, toHash, -1); err != nil {
+		return MigrateStats{}, fmt.Errorf("MigrateHashes: %w", err)
+	}
+
+	keys, err := bs.Blockstore().AllKeysChan(ctx)
+	if err != nil {
+		return MigrateStats{}, err
+	}
+
+	m := &migrator{
+		bs:      bs,
+		toHash:  toHash,
+		opts:    &o,
+		failed:  make(map[cid.Cid]error),
+		limiter: make(chan struct{}, o.concurrency),
+	}
+
+	var wg sync.WaitGroup
+	var scanned int
+	start := func(batch []cid.Cid) bool {
+		m.lk.Lock()
+		m.stats.Scanned = scanned
+		m.lk.Unlock()
+		select {
+		case m.limiter <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-m.limiter }()
+			m.migrateBatch(ctx, batch)
+		}()
+		return true
+	}
+
+	batch := make([]cid.Cid, 0, o.batchSize)
+	for c := range keys {
+		scanned++
+		if policy.ValidateCid(c) == nil || validateCid(from, c) != nil {
+			continue
+		}
+		batch = append(batch, c)
+		if len(batch) == o.batchSize {
+			if !start(batch) {
+				break
+			}
+			batch = make([]cid.Cid, 0, o.batchSize)
+		}
+	}
+	if len(batch) != 0 && ctx.Err() == nil {
+		start(batch)
+	}
+	wg.Wait()
+
+	m.stats.Scanned = scanned
+	if err := ctx.Err(); err != nil {
+		return m.stats, err
+	}
+	if len(m.failed) != 0 {
+		return m.stats, &MigrateError{Failed: m.failed}
+	}
+	return m.stats, nil
+}
+
+type migrator struct {
+	bs      BlockService
+	toHash  uint64
+	opts    *migrateOptions
+	limiter chan struct{}
+
+	lk     sync.Mutex
+	stats  MigrateStats
+	failed map[cid.Cid]error
+}
+
+// newCid returns the CID of data hashed with the target hash function, with
+// the codec of old.
+func (m *migrator) newCid(old cid.Cid, data []byte) (cid.Cid, error) {
+	prefix := cid.Prefix{Version: 1, Codec: old.Type(), MhType: m.toHash, MhLength: -1}
+	return prefix.Sum(data)
+}
+
+// deleteOld deletes the old CID c of a migrated block from the primary
+// blockstore, through the blockservice when it is one of this package so the
+// delete is guarded, audited and forgotten by the caches.
+func (m *migrator) deleteOld(ctx context.Context, c cid.Cid) error {
+	s := grabServiceFromBlockservice(m.bs)
+	if s == nil {
+		return m.bs.Blockstore().DeleteBlock(ctx, c)
+	}
+	if s.ReadOnly() {
+		return ErrReadOnly
+	}
+	_, err := s.deleteBlock(ctx, c, PrimaryStore, deleteOptions{ignoreNotFound: true})
+	return err
+}
+
+func (m *migrator) migrateBatch(ctx context.Context, batch []cid.Cid) {
+	var stats MigrateStats
+	failed := make(map[cid.Cid]error)
+	type migration struct{ old, new cid.Cid }
+	var done []migration
+	var blks []blocks.Block
+	var written []migration
+
+	// the old CIDs are rejected by the blockservice, read the blockstore
+	bstore := m.bs.Blockstore()
+	for _, old := range batch {
+		blk, err := bstore.Get(ctx, old)
+		if err != nil {
+			failed[old] = err
+			continue
+		}
+		c, err := m.newCid(old, blk.RawData())
+		if err != nil {
+			failed[old] = err
+			continue
+		}
+		has, err := bstore.Has(ctx, c)
+		switch {
+		case err != nil:
+			failed[old] = err
+		case has:
+			stats.AlreadyMigrated++
+			done = append(done, migration{old, c})
+		default:
+			nb, err := blocks.NewBlockWithCid(blk.RawData(), c)
+			if err != nil {
+				failed[old] = err
+				continue
+			}
+			blks = append(blks, nb)
+			written = append(written, migration{old, c})
+		}
+	}
+
+	if len(blks) != 0 {
+		if err := m.bs.AddBlocks(ctx, blks); err != nil {
+			for _, w := range written {
+				failed[w.old] = err
+			}
+		} else {
+			stats.Migrated += len(blks)
+			for _, b := range blks {
+				stats.MigratedBytes += int64(len(b.RawData()))
+			}
+			done = append(done, written...)
+		}
+	}
+
+	if m.opts.deleteOld {
+		for _, d := range done {
+			err := m.deleteOld(ctx, d.old)
+			var refused ErrDeleteRefused
+			switch {
+			case err == nil:
+				stats.Deleted++
+			case errors.As(err, &refused):
+				stats.DeleteRefused++
+			default:
+				stats.DeleteFailed++
+				failed[d.old] = err
+			}
+		}
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.stats.Migrated += stats.Migrated
+	m.stats.MigratedBytes += stats.MigratedBytes
+	m.stats.AlreadyMigrated += stats.AlreadyMigrated
+	m.stats.Deleted += stats.Deleted
+	m.stats.DeleteRefused += stats.DeleteRefused
+	m.stats.DeleteFailed += stats.DeleteFailed
+	for k, err := range failed {
+		m.failed[k] = err
+	}
+	if m.opts.mapping != nil {
+		for _, d := range done {
+			m.opts.mapping(d.old, d.new)
+		}
+	}
+	if m.opts.progress != nil {
+		m.opts.progress(m.stats)
+	}
+}
@@ -0,0 +1,107 @@
+package blockservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/verifcid"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateHashes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	blks := random.BlocksOfSize(5, blockSize)
+	require.NoError(t, bstore.PutMany(ctx, blks))
+	bserv := New(bstore, nil, WithAllowlist(verifcid.NewAllowlist(map[uint64]bool{mh.SHA2_512: true})))
+
+	_, err := MigrateHashes(ctx, bserv, verifcid.DefaultAllowlist, mh.SHA2_256)
+	require.Error(t, err, "the target must be allowed")
+
+	// a block migrated by a previous run
+	require.NoError(t, bstore.Put(ctx, blockWithHash(t, blks[0].RawData(), mh.SHA2_512)))
+
+	mapping := make(map[string]cid.Cid)
+	var progress []MigrateStats
+	stats, err := MigrateHashes(ctx, bserv, verifcid.DefaultAllowlist, mh.SHA2_512,
+		WithMigrateBatchSize(2),
+		WithMigrateDeleteOld(true),
+		WithMigrateMapping(func(old, new cid.Cid) { mapping[string(old.Hash())] = new }),
+		WithMigrateProgress(func(s MigrateStats) { progress = append(progress, s) }),
+	)
+	require.NoError(t, err)
+	require.Equal(t, 6, stats.Scanned)
+	require.Equal(t, 4, stats.Migrated)
+	require.EqualValues(t, 4*blockSize, stats.MigratedBytes)
+	require.Equal(t, 1, stats.AlreadyMigrated)
+	require.Equal(t, 5, stats.Deleted)
+	require.Len(t, progress, 3)
+
+	require.Len(t, mapping, len(blks))
+	for _, b := range blks {
+		c, ok := mapping[string(b.Cid().Hash())]
+		require.True(t, ok)
+		got, err := bserv.GetBlock(ctx, c)
+		require.NoError(t, err)
+		require.Equal(t, b.RawData(), got.RawData())
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+
+	// nothing left to migrate
+	stats, err = MigrateHashes(ctx, bserv, verifcid.DefaultAllowlist, mh.SHA2_512)
+	require.NoError(t, err)
+	require.Equal(t, MigrateStats{Scanned: 5}, stats)
+}
+
+func TestMigrateHashesDeleteOldGuarded(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, bstore.PutMany(ctx, blks))
+	rec := &auditRecorder{}
+	bserv := New(bstore, nil,
+		WithAllowlist(verifcid.NewAllowlist(map[uint64]bool{mh.SHA2_512: true})),
+		WithAuditSink(rec.record),
+		WithDeleteGuard(func(_ context.Context, c cid.Cid) error {
+			// the blockstore enumerates CIDv1s
+			if bytes.Equal(c.Hash(), blks[0].Cid().Hash()) {
+				return errors.New("pinned")
+			}
+			return nil
+		}),
+	)
+
+	stats, err := MigrateHashes(ctx, bserv, verifcid.DefaultAllowlist, mh.SHA2_512, WithMigrateDeleteOld(true))
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Migrated)
+	require.Equal(t, 2, stats.Deleted)
+	require.Equal(t, 1, stats.DeleteRefused)
+	require.Zero(t, stats.DeleteFailed)
+
+	has, err := bstore.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.True(t, has, "the guard keeps the old CID")
+	require.NoError(t, bserv.Close())
+	var deleted []string
+	for _, op := range rec.ops() {
+		if strings.HasPrefix(op, string(AuditDelete)) {
+			deleted = append(deleted, op)
+		}
+	}
+	require.Len(t, deleted, 2)
+}
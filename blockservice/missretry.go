@@ -0,0 +1,61 @@
+package blockservice
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithMissRetry makes GetBlocks fetch again, through the same exchange session,
+// the blocks the exchange did not deliver once it gives up on a batch, up to
+// passes more times. Only the blocks still missing are requested, and no pass
+// starts once the context of the call is done. The blocks still missing after
+// the last pass are reported as not found, see [WithBlockErrorHandler].
+// Each pass is recorded as a "miss retry" event of the GetBlocks span and
+// counted in [Stats.MissRetries]. It is disabled by default.
+func WithMissRetry(passes int) Option {
+	return func(bs *blockService) {
+		if passes < 0 {
+			bs.invalidOption("WithMissRetry: negative number of passes %d", passes)
+			return
+		}
+		bs.missRetryPasses = passes
+	}
+}
+
+// missRetry counts the passes left of a getBlocks call. A nil missRetry
+// does nothing.
+type missRetry struct {
+	passes    int
+	requested *requestedBlocks
+}
+
+// newMissRetry returns nil unless WithMissRetry is used.
+func (s *blockService) newMissRetry(requested *requestedBlocks) *missRetry {
+	if s == nil || s.missRetryPasses == 0 {
+		return nil
+	}
+	return &missRetry{passes: s.missRetryPasses, requested: requested}
+}
+
+// nextMissRetry returns the blocks to fetch again once the exchange closed its
+// channel, none if there are no passes left or ctx is done.
+func (s *blockService) nextMissRetry(ctx context.Context, r *missRetry) []cid.Cid {
+	if r == nil || r.passes == 0 || ctx.Err() != nil {
+		return nil
+	}
+	ks := r.requested.remaining()
+	if len(ks) == 0 {
+		return nil
+	}
+	r.passes--
+	s.stats.missRetries.Add(1)
+	trace.SpanFromContext(ctx).AddEvent("miss retry", trace.WithAttributes(
+		attribute.Int("remaining", len(ks)),
+		attribute.Int("passes_left", r.passes),
+	))
+	logger.Debugf("fetching %d missing blocks again", len(ks))
+	return ks
+}
@@ -0,0 +1,143 @@
+package blockservice
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// stragglerExchange delivers the blocks it has, except that the first call
+// to GetBlocks skips the stragglers.
+type stragglerExchange struct {
+	blks       map[cid.Cid]blocks.Block
+	stragglers map[cid.Cid]struct{}
+
+	lk    sync.Mutex
+	calls [][]cid.Cid
+}
+
+func (e *stragglerExchange) GetBlock(context.Context, cid.Cid) (blocks.Block, error) {
+	panic("not implemented")
+}
+
+func (e *stragglerExchange) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	e.lk.Lock()
+	first := len(e.calls) == 0
+	e.calls = append(e.calls, slices.Clone(ks))
+	e.lk.Unlock()
+
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for _, c := range ks {
+			b, ok := e.blks[c]
+			if _, straggler := e.stragglers[c]; !ok || (first && straggler) {
+				continue
+			}
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (e *stragglerExchange) NotifyNewBlocks(context.Context, ...blocks.Block) error { return nil }
+func (e *stragglerExchange) Close() error                                           { return nil }
+
+func (e *stragglerExchange) requests() [][]cid.Cid {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	return e.calls
+}
+
+func TestWithMissRetry(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(5, blockSize)
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	newExchange := func() *stragglerExchange {
+		e := &stragglerExchange{
+			blks:       make(map[cid.Cid]blocks.Block),
+			stragglers: map[cid.Cid]struct{}{ks[1]: {}, ks[2]: {}},
+		}
+		// the last block is never delivered
+		for _, b := range blks[:4] {
+			e.blks[b.Cid()] = b
+		}
+		return e
+	}
+
+	t.Run("retries the misses", func(t *testing.T) {
+		t.Parallel()
+		exch := newExchange()
+		var lk sync.Mutex
+		failed := make(map[cid.Cid]error)
+		bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch,
+			WithMissRetry(2),
+			WithBlockErrorHandler(func(c cid.Cid, err error) {
+				lk.Lock()
+				defer lk.Unlock()
+				failed[c] = err
+			}),
+		)
+
+		var got []cid.Cid
+		for b := range bserv.GetBlocks(ctx, ks) {
+			got = append(got, b.Cid())
+		}
+		require.ElementsMatch(t, ks[:4], got)
+
+		calls := exch.requests()
+		require.Len(t, calls, 3)
+		require.Equal(t, ks, calls[0])
+		require.ElementsMatch(t, []cid.Cid{ks[1], ks[2], ks[4]}, calls[1])
+		require.Equal(t, []cid.Cid{ks[4]}, calls[2])
+		require.EqualValues(t, 2, bserv.(*blockService).Stats(false).MissRetries)
+		require.Len(t, failed, 1)
+		require.ErrorIs(t, failed[ks[4]], ipld.ErrNotFound{Cid: ks[4]})
+	})
+
+	t.Run("no pass once everything arrived", func(t *testing.T) {
+		t.Parallel()
+		exch := newExchange()
+		bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch, WithMissRetry(3))
+		for range bserv.GetBlocks(ctx, ks[:4]) {
+		}
+		require.Len(t, exch.requests(), 2)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		exch := newExchange()
+		bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch)
+		n := 0
+		for range bserv.GetBlocks(ctx, ks) {
+			n++
+		}
+		require.Equal(t, 2, n)
+		require.Len(t, exch.requests(), 1)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		_, err := NewWithOptions(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil, WithMissRetry(-1))
+		require.ErrorContains(t, err, "WithMissRetry")
+	})
+}
@@ -0,0 +1,111 @@
+package blockservice
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// MultihashGetter is implemented by blockstores able to look blocks up by
+// multihash, ignoring the CID version and codec.
+type MultihashGetter interface {
+	GetByMultihash(ctx context.Context, h mh.Multihash) ([]byte, error)
+}
+
+// variantCodecs are the codecs probed by the multihash lookup when the
+// blockstore does not implement [MultihashGetter].
+var variantCodecs = []uint64{cid.Raw, cid.DagProtobuf, cid.DagCBOR, cid.DagJSON}
+
+// WithMultihashLookup makes a blockstore miss retry the lookup by multihash,
+// so a block stored under a CIDv0 key is found when requested by its CIDv1
+// equivalent or with another codec, and the other way around. The block is
+// returned with the requested CID.
+// It uses [MultihashGetter] when the blockstore implements it, otherwise the
+// CIDv0 and CIDv1 variants of the common codecs are probed.
+// The blockstores of the boxo blockstore package are already keyed by
+// multihash and don't need this.
+func WithMultihashLookup() Option {
+	return func(bs *blockService) {
+		bs.multihashLookup = true
+	}
+}
+
+// getByMultihash looks for the block of c stored under another CID with the
+// same multihash.
+func (s *blockService) getByMultihash(ctx context.Context, c cid.Cid) (blocks.Block, bool) {
+	if s == nil || !s.multihashLookup {
+		return nil, false
+	}
+	if mg, ok := s.blockstore.(MultihashGetter); ok {
+		data, err := mg.GetByMultihash(ctx, c.Hash())
+		if err != nil {
+			return nil, false
+		}
+		blk, err := blocks.NewBlockWithCid(data, c)
+		return blk, err == nil
+	}
+	var found blocks.Block
+	s.probeVariants(ctx, c, func(v cid.Cid) bool {
+		blk, err := s.blockstore.Get(ctx, v)
+		if err != nil {
+			return false
+		}
+		found, err = blocks.NewBlockWithCid(blk.RawData(), c)
+		return err == nil
+	})
+	return found, found != nil
+}
+
+// getSizeByMultihash is like getByMultihash for the size of c.
+func (s *blockService) getSizeByMultihash(ctx context.Context, c cid.Cid) (int, bool) {
+	if s == nil || !s.multihashLookup {
+		return 0, false
+	}
+	if _, ok := s.blockstore.(MultihashGetter); ok {
+		blk, ok := s.getByMultihash(ctx, c)
+		if !ok {
+			return 0, false
+		}
+		return len(blk.RawData()), true
+	}
+	var size int
+	var found bool
+	s.probeVariants(ctx, c, func(v cid.Cid) bool {
+		// blockstores may return any size along with an error
+		n, err := s.blockstore.GetSize(ctx, v)
+		if err != nil {
+			return false
+		}
+		size, found = n, true
+		return true
+	})
+	return size, found
+}
+
+// probeVariants calls try with the CIDs sharing the multihash of c, until it
+// returns true.
+func (s *blockService) probeVariants(ctx context.Context, c cid.Cid, try func(cid.Cid) bool) {
+	h := c.Hash()
+	if c.Version() != 0 && canBeCidV0(h) && try(cid.NewCidV0(h)) {
+		return
+	}
+	for _, codec := range variantCodecs {
+		if ctx.Err() != nil {
+			return
+		}
+		v := cid.NewCidV1(codec, h)
+		if v == c {
+			continue
+		}
+		if try(v) {
+			return
+		}
+	}
+}
+
+func canBeCidV0(h mh.Multihash) bool {
+	dh, err := mh.Decode(h)
+	return err == nil && dh.Code == mh.SHA2_256 && dh.Length == 32
+}
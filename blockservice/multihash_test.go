@@ -0,0 +1,114 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// cidKeyedBlockstore only finds blocks by the exact CID they were put with.
+type cidKeyedBlockstore struct {
+	blockstore.Blockstore
+
+	lk   sync.Mutex
+	keys map[cid.Cid]struct{}
+}
+
+func newCidKeyedBlockstore() *cidKeyedBlockstore {
+	return &cidKeyedBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		keys:       make(map[cid.Cid]struct{}),
+	}
+}
+
+func (bs *cidKeyedBlockstore) has(c cid.Cid) bool {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	_, ok := bs.keys[c]
+	return ok
+}
+
+func (bs *cidKeyedBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	bs.lk.Lock()
+	bs.keys[b.Cid()] = struct{}{}
+	bs.lk.Unlock()
+	return bs.Blockstore.Put(ctx, b)
+}
+
+func (bs *cidKeyedBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if !bs.has(c) {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	return bs.Blockstore.Get(ctx, c)
+}
+
+func (bs *cidKeyedBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if !bs.has(c) {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+	return bs.Blockstore.GetSize(ctx, c)
+}
+
+func TestMultihashLookup(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// random.BlocksOfSize returns CIDv0 blocks
+	blks := random.BlocksOfSize(2, blockSize)
+	bstore := newCidKeyedBlockstore()
+	require.NoError(t, bstore.Put(ctx, blks[0]))
+	v1 := cid.NewCidV1(cid.Raw, blks[0].Cid().Hash())
+
+	_, err := New(bstore, nil).GetBlock(ctx, v1)
+	require.True(t, ipld.IsNotFound(err))
+
+	bserv := New(bstore, nil, WithMultihashLookup())
+	blk, err := bserv.GetBlock(ctx, v1)
+	require.NoError(t, err)
+	require.Equal(t, v1, blk.Cid())
+	require.Equal(t, blks[0].RawData(), blk.RawData())
+
+	missing := cid.NewCidV1(cid.DagCBOR, blks[1].Cid().Hash())
+	var got []cid.Cid
+	for b := range bserv.GetBlocks(ctx, []cid.Cid{v1, missing}) {
+		got = append(got, b.Cid())
+	}
+	require.Equal(t, []cid.Cid{v1}, got)
+
+	size, err := bserv.(*blockService).GetSize(ctx, v1)
+	require.NoError(t, err)
+	require.Equal(t, len(blks[0].RawData()), size)
+}
+
+// zeroSizeMissBlockstore returns a size of 0 along with its not found errors.
+type zeroSizeMissBlockstore struct {
+	*cidKeyedBlockstore
+}
+
+func (bs zeroSizeMissBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	size, err := bs.cidKeyedBlockstore.GetSize(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func TestMultihashLookupSizeOnError(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	bserv := New(zeroSizeMissBlockstore{newCidKeyedBlockstore()}, nil, WithMultihashLookup()).(*blockService)
+
+	_, found := bserv.getSizeByMultihash(ctx, cid.NewCidV1(cid.Raw, blk.Cid().Hash()))
+	require.False(t, found, "the size returned with an error is not a hit")
+}
@@ -0,0 +1,126 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/ipfs/boxo/provider"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/time/rate"
+)
+
+// WithProviders is like [WithProvider] for several providers, every provide
+// is sent to each of them. The rate limit of [WithProvideRateLimit] applies to
+// each provider separately and a failing provider doesn't prevent the others
+// from being called, the failures of each provider are counted in
+// [Stats.ProvideFailures].
+// [ProvidingBlockService.Provider] returns a provider fanning out to all of
+// them.
+func WithProviders(provs ...provider.Provider) Option {
+	return func(bs *blockService) {
+		for _, p := range provs {
+			if p == nil {
+				bs.invalidOption("WithProviders: nil provider")
+				return
+			}
+		}
+		bs.providers = provs
+	}
+}
+
+// provideTarget is one of the providers of the blockservice.
+type provideTarget struct {
+	index    int // in provideTargets, journaled by the persistent provide queue
+	provider provider.Provider
+	limiter  *rate.Limiter
+	backoff  *provideBackoff // nil without WithProvideBackoff
+	failures atomic.Uint64
+}
+
+// provide calls the provider, failures are logged and counted.
+// It returns errProviderSuspended without calling it while it is suspended.
+func (t *provideTarget) provide(ctx context.Context, c cid.Cid) error {
+	probe, ok := t.backoff.begin()
+	if !ok {
+		return errProviderSuspended
+	}
+	err := t.provider.Provide(ctx, c, true)
+	if err != nil {
+		t.failures.Add(1)
+		if !t.backoff.suspended() {
+			logger.Errorf("Provide: %s", err.Error())
+		}
+	}
+	if ctx.Err() != nil {
+		// a canceled provide says nothing about the provider
+		t.backoff.abort(probe)
+	} else {
+		t.backoff.end(probe, err)
+	}
+	return err
+}
+
+// setupProviders creates the targets of the providers, each with its own rate
+// limiter.
+func (s *blockService) setupProviders() {
+	switch len(s.providers) {
+	case 0:
+		return
+	case 1:
+		s.provider = s.providers[0]
+	default:
+		s.provider = multiProvider(s.providers)
+	}
+	s.provideTargets = make([]*provideTarget, len(s.providers))
+	for i, p := range s.providers {
+		t := &provideTarget{index: i, provider: p, backoff: s.newProvideBackoff(fmt.Sprintf("#%d (%T)", i, p))}
+		if s.provideLimiter != nil {
+			t.limiter = rate.NewLimiter(s.provideLimiter.Limit(), s.provideLimiter.Burst())
+		}
+		s.provideTargets[i] = t
+	}
+}
+
+// multiProvider fans out the provides to several providers.
+type multiProvider []provider.Provider
+
+var (
+	_ provider.Provider    = multiProvider(nil)
+	_ provider.ProvideMany = multiProvider(nil)
+)
+
+// Provide calls every provider, even when some fail, and returns their
+// joined errors.
+func (m multiProvider) Provide(ctx context.Context, c cid.Cid, announce bool) error {
+	var errs []error
+	for _, p := range m {
+		if err := p.Provide(ctx, c, announce); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ProvideMany calls ProvideMany on the providers implementing it and Provide
+// for every key on the others.
+func (m multiProvider) ProvideMany(ctx context.Context, keys []mh.Multihash) error {
+	var errs []error
+	for _, p := range m {
+		if many, ok := p.(provider.ProvideMany); ok {
+			if err := many.ProvideMany(ctx, keys); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		for _, k := range keys {
+			if err := p.Provide(ctx, cid.NewCidV1(cid.Raw, k), true); err != nil {
+				errs = append(errs, err)
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
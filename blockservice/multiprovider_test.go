@@ -0,0 +1,72 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/provider"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+var errProvide = errors.New("provide failed")
+
+type failingProvider struct {
+	recordingProvider
+}
+
+func (p *failingProvider) Provide(ctx context.Context, c cid.Cid, announce bool) error {
+	p.recordingProvider.Provide(ctx, c, announce)
+	return errProvide
+}
+
+func TestWithProviders(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dht, indexer := &recordingProvider{}, &failingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProviders(dht, indexer)).(*blockService)
+
+	blks := random.BlocksOfSize(2, blockSize)
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+
+	// the failing indexer doesn't prevent the other provides
+	require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, dht.Provided())
+	require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, indexer.Provided())
+	require.Equal(t, []uint64{0, 2}, bserv.Stats(false).ProvideFailures)
+
+	// Provider fans out too
+	composite := bserv.Provider()
+	c := random.BlocksOfSize(1, blockSize)[0].Cid()
+	require.ErrorIs(t, composite.Provide(ctx, c, true), errProvide)
+	require.Contains(t, dht.Provided(), c)
+	require.NoError(t, composite.(provider.ProvideMany).ProvideMany(ctx, nil))
+}
+
+func TestWithProvidersRateLimitPerProvider(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dht, indexer := &recordingProvider{}, &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil,
+		WithProviders(dht, indexer),
+		WithProvideRateLimit(0, 1),
+		WithProvidePolicy(ProvideDrop),
+	).(*blockService)
+
+	blks := random.BlocksOfSize(2, blockSize)
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlock(ctx, blks[1]))
+
+	// each provider has its own budget of one provide
+	require.Equal(t, []cid.Cid{blks[0].Cid()}, dht.Provided())
+	require.Equal(t, []cid.Cid{blks[0].Cid()}, indexer.Provided())
+	require.EqualValues(t, 2, bserv.Stats(false).ProvidesDropped)
+}
@@ -0,0 +1,240 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blocks "github.com/ipfs/go-block-format"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithNotifyCoalescing batches the NotifyNewBlocks calls of AddBlock,
+// AddBlocks and the caching of the fetched blocks across calls, to relieve
+// the exchange during long imports. The blocks are handed to the exchange by
+// a background goroutine once maxBlocks are pending or maxDelay after the
+// first of them, and before Sync and Close return.
+// The operations no longer wait for the exchange nor return its errors, the
+// failures are reported as usual by [WithNotifyErrorHandler] and the stats.
+// The blocks are handed to the exchange with the baggage of the operation
+// which stored them, in a span linked to its span, and are checked against the
+// content blocker again first. The backlog is reported in [Stats.NotifyQueue]
+// and waited for by WaitIdle.
+func WithNotifyCoalescing(maxDelay time.Duration, maxBlocks int) Option {
+	return func(bs *blockService) {
+		if maxDelay <= 0 || maxBlocks <= 0 {
+			bs.invalidOption("WithNotifyCoalescing: the delay and the number of blocks must be positive, got %s and %d", maxDelay, maxBlocks)
+			return
+		}
+		bs.notifyMaxDelay = maxDelay
+		bs.notifyMaxBlocks = maxBlocks
+	}
+}
+
+// pendingNotify is a block waiting for the coalescer, p is the write path
+// which stored it and origin the operation.
+type pendingNotify struct {
+	p      writePath
+	b      blocks.Block
+	origin taskOrigin
+	since  time.Time
+}
+
+// notifyCoalescer hands the blocks of notifyNewBlocks to the exchange in
+// batches, its methods handle a nil receiver.
+type notifyCoalescer struct {
+	s *blockService
+	// ctx is the context of the background flushes, canceled once Close gave
+	// up on them.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lk      sync.Mutex
+	pending []pendingNotify
+	timer   *clock.Timer // armed while blocks are pending
+	closed  bool
+
+	// flushLk serializes the flushes, so a flush returns once the blocks
+	// pending when it started have been handed to the exchange.
+	flushLk sync.Mutex
+	kick    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+
+	dropped atomic.Uint64
+}
+
+func newNotifyCoalescer(s *blockService) *notifyCoalescer {
+	c := &notifyCoalescer{
+		s:    s,
+		kick: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	// the blocks taken are handed to the exchange even if the blockservice is
+	// closing, Close waits for them until its timeout
+	c.ctx, c.cancel = context.WithCancel(context.WithoutCancel(s.serviceCtx))
+	if s.promRegistry != nil {
+		registerQueueMetrics(s.promRegistry, "notify", c.stats)
+	}
+	go c.run()
+	return c
+}
+
+func (c *notifyCoalescer) run() {
+	defer close(c.done)
+	for {
+		select {
+		case <-c.kick:
+			c.flush(c.ctx)
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// add queues the blocks of bs stored by p during the operation of ctx, it
+// returns false once the coalescer is closed.
+func (c *notifyCoalescer) add(ctx context.Context, p writePath, bs []blocks.Block) bool {
+	if c == nil {
+		return false
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		return false
+	}
+	origin, now := originOf(ctx), c.s.clock.Now()
+	for _, b := range bs {
+		c.pending = append(c.pending, pendingNotify{p: p, b: b, origin: origin, since: now})
+	}
+	if len(c.pending) >= c.s.notifyMaxBlocks {
+		c.signal()
+		return true
+	}
+	if c.timer == nil {
+		c.timer = c.s.clock.AfterFunc(c.s.notifyMaxDelay, c.signal)
+	}
+	return true
+}
+
+func (c *notifyCoalescer) signal() {
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+// flush hands the pending blocks to the exchange, by batches of
+// notifyMaxBlocks.
+func (c *notifyCoalescer) flush(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	c.flushLk.Lock()
+	defer c.flushLk.Unlock()
+
+	c.lk.Lock()
+	pending := c.pending
+	c.pending = nil
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.lk.Unlock()
+
+	for len(pending) != 0 {
+		n := min(len(pending), c.s.notifyMaxBlocks)
+		c.notify(ctx, pending[:n])
+		pending = pending[n:]
+	}
+}
+
+// waitIdle hands the pending blocks to the exchange without waiting for the
+// delay, it returns the error of ctx if it expired meanwhile.
+func (c *notifyCoalescer) waitIdle(ctx context.Context) error {
+	c.flush(ctx)
+	return ctx.Err()
+}
+
+// notify hands the blocks of batch which are not blocked to the exchange, the
+// failures are reported for the write path of each block.
+func (c *notifyCoalescer) notify(ctx context.Context, batch []pendingNotify) {
+	allowed := batch[:0:0]
+	for _, pn := range batch {
+		if !c.s.blocked(pn.b.Cid()) {
+			allowed = append(allowed, pn)
+		}
+	}
+	batch = allowed
+	if len(batch) == 0 {
+		return
+	}
+	// the span is linked to the span of every operation, the baggage is the
+	// one of the first
+	ctx, span := batch[0].origin.startSpan(ctx, "notifyCoalescer.notify", attribute.Int("Blocks", len(batch)))
+	defer span.End()
+	linked := map[trace.SpanID]bool{batch[0].origin.span.SpanID(): true}
+	bs := make([]blocks.Block, len(batch))
+	for i, pn := range batch {
+		bs[i] = pn.b
+		if id := pn.origin.span.SpanID(); pn.origin.span.IsValid() && !linked[id] {
+			linked[id] = true
+			span.AddLink(trace.Link{SpanContext: pn.origin.span})
+		}
+	}
+	err := c.s.exchange.NotifyNewBlocks(ctx, bs...)
+	if err == nil {
+		return
+	}
+	var byPath [writePathCount][]blocks.Block
+	for _, pn := range batch {
+		byPath[pn.p] = append(byPath[pn.p], pn.b)
+	}
+	for p, failed := range byPath {
+		if len(failed) != 0 {
+			c.s.notifyFailed(ctx, writePath(p), failed, err)
+		}
+	}
+}
+
+// stats returns the backlog of the coalescer, a nil coalescer is empty.
+func (c *notifyCoalescer) stats() QueueStats {
+	if c == nil {
+		return QueueStats{}
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	st := QueueStats{Depth: len(c.pending), Dropped: c.dropped.Load()}
+	if len(c.pending) != 0 {
+		st.OldestAge = c.s.clock.Since(c.pending[0].since)
+	}
+	return st
+}
+
+// close stops the background goroutine, then hands the pending blocks to the
+// exchange. The blocks added later are handed to the exchange directly.
+func (c *notifyCoalescer) close(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	c.lk.Lock()
+	c.closed = true
+	c.lk.Unlock()
+	close(c.stop)
+	defer c.cancel()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.lk.Lock()
+		c.dropped.Add(uint64(len(c.pending)))
+		c.pending = nil
+		c.lk.Unlock()
+		logger.Warnf("pending notifications of new blocks were not flushed before closing: %s", ctx.Err())
+		return
+	}
+	c.flush(ctx)
+}
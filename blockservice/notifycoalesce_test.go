@@ -0,0 +1,203 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// batchNotifyExchange records the batches of NotifyNewBlocks.
+type batchNotifyExchange struct {
+	exchange.Interface
+
+	lk      sync.Mutex
+	batches [][]cid.Cid
+}
+
+func (e *batchNotifyExchange) NotifyNewBlocks(ctx context.Context, blks ...blocks.Block) error {
+	batch := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		batch[i] = b.Cid()
+	}
+	e.lk.Lock()
+	e.batches = append(e.batches, batch)
+	e.lk.Unlock()
+	return e.Interface.NotifyNewBlocks(ctx, blks...)
+}
+
+func (e *batchNotifyExchange) notified() [][]cid.Cid {
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	return slices.Clone(e.batches)
+}
+
+func cidsOf(blks ...blocks.Block) []cid.Cid {
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	return ks
+}
+
+func TestWithNotifyCoalescing(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(9, blockSize)
+	clk := clock.NewMock()
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.Put(ctx, blks[8]))
+	exch := &batchNotifyExchange{Interface: offline.Exchange(exchbstore)}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch, WithNotifyCoalescing(time.Second, 3), WithClock(clk)).(*blockService)
+
+	// flushed after the delay
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlock(ctx, blks[1]))
+	require.Empty(t, exch.notified())
+	require.Equal(t, 2, bserv.Stats(false).NotifyQueue.Depth)
+	clk.Add(time.Second)
+	require.Eventually(t, func() bool { return len(exch.notified()) == 1 }, 5*time.Second, time.Millisecond)
+	require.Equal(t, cidsOf(blks[0], blks[1]), exch.notified()[0])
+	require.Zero(t, bserv.Stats(false).NotifyQueue.Depth)
+
+	// flushed once enough blocks are pending
+	require.NoError(t, bserv.AddBlocks(ctx, blks[2:5]))
+	require.Eventually(t, func() bool { return len(exch.notified()) == 2 }, 5*time.Second, time.Millisecond)
+	require.ElementsMatch(t, cidsOf(blks[2:5]...), exch.notified()[1])
+
+	// flushed by Sync, the fetched blocks too
+	require.NoError(t, bserv.AddBlock(ctx, blks[5]))
+	_, err := bserv.GetBlock(ctx, blks[8].Cid())
+	require.NoError(t, err)
+	require.NoError(t, bserv.Sync(ctx))
+	require.Len(t, exch.notified(), 3)
+	require.Equal(t, cidsOf(blks[5], blks[8]), exch.notified()[2])
+
+	// and by Close
+	require.NoError(t, bserv.AddBlocks(ctx, blks[6:8]))
+	require.NoError(t, bserv.Close())
+	require.Len(t, exch.notified(), 4)
+	require.ElementsMatch(t, cidsOf(blks[6:8]...), exch.notified()[3])
+
+	_, err = NewWithOptions(bstore, exch, WithNotifyCoalescing(0, 3))
+	require.Error(t, err)
+	_, err = NewWithOptions(bstore, exch, WithNotifyCoalescing(time.Second, 0))
+	require.Error(t, err)
+}
+
+func TestNotifyCoalescingFailures(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.Put(ctx, blks[2]))
+	var lk sync.Mutex
+	var failed []cid.Cid
+	handler := func(err error, ks []cid.Cid) {
+		require.ErrorIs(t, err, errOverloaded)
+		lk.Lock()
+		failed = append(failed, ks...)
+		lk.Unlock()
+	}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, failingNotifyExchange{offline.Exchange(exchbstore)},
+		WithNotifyCoalescing(time.Hour, 10),
+		WithNotifyErrorHandler(handler),
+	).(*blockService)
+
+	// the errors are reported by path, not returned
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlocks(ctx, blks[1:2]))
+	_, err := bserv.GetBlock(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.NoError(t, bserv.Sync(ctx))
+	require.ElementsMatch(t, cidsOf(blks...), failed)
+	st := bserv.Stats(false)
+	require.EqualValues(t, 1, st.AddNotifyFailures)
+	require.EqualValues(t, 1, st.AddBatchNotifyFailures)
+	require.EqualValues(t, 1, st.FetchCacheNotifyFailures)
+}
+
+func TestNotifyCoalescingBacklog(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	var blocked sync.Map
+	reg := prometheus.NewRegistry()
+	clk := clock.NewMock()
+	exch := &batchNotifyExchange{Interface: offline.Exchange(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())))}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch,
+		WithNotifyCoalescing(time.Hour, 10),
+		WithClock(clk),
+		WithPrometheusRegistry(reg),
+		WithContentBlocker(func(c cid.Cid) error {
+			if _, ok := blocked.Load(c); ok {
+				return errors.New("blocked")
+			}
+			return nil
+		}),
+	).(*blockService)
+	defer bserv.Close()
+
+	ctx1, root1 := otel.Tracer("test").Start(context.Background(), "root")
+	ctx2, root2 := otel.Tracer("test").Start(context.Background(), "root")
+	require.NoError(t, bserv.AddBlock(ctx1, blks[0]))
+	require.NoError(t, bserv.AddBlock(ctx2, blks[1]))
+	require.NoError(t, bserv.AddBlock(ctx1, blks[2]))
+	root1.End()
+	root2.End()
+
+	clk.Add(time.Minute)
+	st := bserv.Stats(false).NotifyQueue
+	require.Equal(t, 3, st.Depth)
+	require.Equal(t, time.Minute, st.OldestAge)
+	expected := `
+# HELP ipfs_blockservice_queue_depth Number of items queued or being processed by a background queue of the blockservice.
+# TYPE ipfs_blockservice_queue_depth gauge
+ipfs_blockservice_queue_depth{queue="notify"} 3
+`
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "ipfs_blockservice_queue_depth"))
+
+	// a block blocked while it waits is not announced
+	blocked.Store(blks[2].Cid(), struct{}{})
+	require.NoError(t, bserv.WaitIdle(context.Background()))
+	require.Equal(t, [][]cid.Cid{cidsOf(blks[0], blks[1])}, exch.notified())
+	require.Equal(t, QueueStats{}, bserv.Stats(false).NotifyQueue)
+
+	// the span of the batch is linked to both operations
+	var found bool
+	for _, span := range findSpans("Blockservice.notifyCoalescer.notify", attribute.Int("Blocks", 2)) {
+		var traces []string
+		for _, l := range span.Links() {
+			traces = append(traces, l.SpanContext.TraceID().String())
+		}
+		if slices.Contains(traces, root1.SpanContext().TraceID().String()) {
+			require.ElementsMatch(t, []string{root1.SpanContext().TraceID().String(), root2.SpanContext().TraceID().String()}, traces)
+			found = true
+		}
+	}
+	require.True(t, found)
+}
@@ -0,0 +1,53 @@
+package blockservice
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// WithNotifyErrorHandler sets a function called with the error and the CIDs
+// of every failed call to NotifyNewBlocks of the exchange, so applications can
+// react to an overloaded or stopping exchange. It is called from the operation
+// which made the call, possibly concurrently, so it must not block.
+// The failures are counted by [Stats] and logged at most once a minute
+// whether or not a handler is set.
+func WithNotifyErrorHandler(handler func(error, []cid.Cid)) Option {
+	return func(bs *blockService) {
+		if handler == nil {
+			bs.invalidOption("WithNotifyErrorHandler: nil handler")
+			return
+		}
+		bs.notifyErrorHandler = handler
+	}
+}
+
+// callNotifyErrorHandler calls the handler of [WithNotifyErrorHandler], a
+// panic is recovered so the failure is still counted and logged.
+func (s *blockService) callNotifyErrorHandler(err error, ks []cid.Cid) {
+	defer s.recoverPanic("notify error handler")
+	s.notifyErrorHandler(err, ks)
+}
+
+// notifyFailed records the failure err of the announcement of bs by the write
+// path p.
+func (s *blockService) notifyFailed(ctx context.Context, p writePath, bs []blocks.Block, err error) {
+	if s == nil {
+		return
+	}
+	s.stats.notifyFailures[p].Add(1)
+	if s.metrics != nil {
+		s.metrics.notifyFailures.WithLabelValues(p.label()).Inc()
+	}
+	if s.notifyErrorHandler != nil {
+		s.callNotifyErrorHandler(err, blockCids(bs))
+	}
+	if ctx.Err() != nil {
+		// the exchange gave up on a canceled operation, nothing to report
+		return
+	}
+	s.notifyErrorLog.Do(func() {
+		logger.Errorf("NotifyNewBlocks (%s): %s, further failures are only counted for a minute", p.label(), err)
+	})
+}
@@ -0,0 +1,84 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	exchange "github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+var errOverloaded = errors.New("overloaded")
+
+// failingNotifyExchange fails every NotifyNewBlocks call.
+type failingNotifyExchange struct {
+	exchange.Interface
+}
+
+func (failingNotifyExchange) NotifyNewBlocks(context.Context, ...blocks.Block) error {
+	return errOverloaded
+}
+
+func TestNotifyFailures(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var lk sync.Mutex
+	var notified []cid.Cid
+	reg := prometheus.NewRegistry()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, failingNotifyExchange{offline.Exchange(exchbstore)}, WithPrometheusRegistry(reg), WithNotifyErrorHandler(func(err error, ks []cid.Cid) {
+		require.ErrorIs(t, err, errOverloaded)
+		lk.Lock()
+		defer lk.Unlock()
+		notified = append(notified, ks...)
+	})).(*blockService)
+
+	blks := random.BlocksOfSize(6, blockSize)
+	// the adds succeed regardless
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlocks(ctx, blks[1:3]))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[3:]))
+	_, err := bserv.GetBlock(ctx, blks[3].Cid())
+	require.ErrorIs(t, err, errOverloaded)
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[4].Cid(), blks[5].Cid()}) {
+	}
+
+	st := bserv.Stats(false)
+	require.EqualValues(t, 1, st.AddNotifyFailures)
+	require.EqualValues(t, 1, st.AddBatchNotifyFailures)
+	// GetBlocks stops at the first failure
+	require.EqualValues(t, 2, st.FetchCacheNotifyFailures)
+	lk.Lock()
+	require.Len(t, notified, 5)
+	require.Equal(t, []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid(), blks[3].Cid()}, notified[:4])
+	require.Contains(t, []cid.Cid{blks[4].Cid(), blks[5].Cid()}, notified[4])
+	lk.Unlock()
+
+	require.Equal(t, 1.0, testutil.ToFloat64(bserv.metrics.notifyFailures.WithLabelValues("add")))
+	require.Equal(t, 1.0, testutil.ToFloat64(bserv.metrics.notifyFailures.WithLabelValues("add-batch")))
+	require.Equal(t, 2.0, testutil.ToFloat64(bserv.metrics.notifyFailures.WithLabelValues("fetch-cache")))
+
+	require.EqualValues(t, 1, bserv.Stats(true).AddNotifyFailures)
+	require.Zero(t, bserv.Stats(false).FetchCacheNotifyFailures)
+}
+
+func TestNotifyErrorHandlerNil(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	_, err := NewWithOptions(bstore, nil, WithNotifyErrorHandler(nil))
+	require.ErrorContains(t, err, "WithNotifyErrorHandler")
+}
@@ -0,0 +1,87 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+// blockOutput is the channel returned by GetBlocks. It is closed as soon as
+// the context is done, even while the producer is stuck in a slow blockstore
+// or exchange call, so consumers never wait on a canceled GetBlocks.
+type blockOutput struct {
+	ctx     context.Context
+	ch      chan blocks.Block
+	tracker *blockErrorTracker
+	leaks   *leakWatch    // nil unless leak detection is on
+	codecs  *codecSummary // nil unless the span of GetBlocks is recording
+
+	// lk serializes the sends with the close
+	lk     sync.Mutex
+	closed bool
+	stop   func() bool
+}
+
+func newBlockOutput(ctx context.Context, tracker *blockErrorTracker) *blockOutput {
+	o := &blockOutput{
+		ctx:     ctx,
+		ch:      make(chan blocks.Block),
+		tracker: tracker,
+	}
+	o.stop = context.AfterFunc(ctx, func() {
+		o.lk.Lock()
+		defer o.lk.Unlock()
+		if o.closed {
+			return
+		}
+		// the producer may still be running, report what it hasn't
+		// delivered now as the handler must be called before closing
+		o.tracker.finish(ctx, nil)
+		o.closeLocked()
+	})
+	return o
+}
+
+// send delivers b, returning false if the context is done.
+func (o *blockOutput) send(b blocks.Block) bool {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	if o.closed {
+		return false
+	}
+	if o.leaks != nil {
+		return o.sendWatched(b)
+	}
+	select {
+	case o.ch <- b:
+		o.delivered(b)
+		return true
+	case <-o.ctx.Done():
+		return false
+	}
+}
+
+// close closes the channel if the context hasn't already done it, the
+// producer must call it once it is done sending.
+func (o *blockOutput) close() {
+	o.stop()
+	o.leaks.stop()
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.codecs.end()
+	if !o.closed {
+		o.closeLocked()
+	}
+}
+
+// delivered records b was received by the consumer.
+func (o *blockOutput) delivered(b blocks.Block) {
+	o.tracker.delivered(b.Cid())
+	o.codecs.add(b)
+}
+
+func (o *blockOutput) closeLocked() {
+	o.closed = true
+	close(o.ch)
+}
@@ -0,0 +1,74 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// stuckBlockstore blocks the reads and writes, ignoring their context, until
+// they are released.
+type stuckBlockstore struct {
+	blockstore.Blockstore
+	entered    chan struct{}
+	releaseGet chan struct{}
+	releasePut chan struct{}
+}
+
+func (bs *stuckBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	bs.entered <- struct{}{}
+	<-bs.releasePut
+	return bs.Blockstore.Put(ctx, b)
+}
+
+func (bs *stuckBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	bs.entered <- struct{}{}
+	<-bs.releaseGet
+	return bs.Blockstore.Get(ctx, c)
+}
+
+func TestGetBlocksClosesOnCancel(t *testing.T) {
+	t.Parallel()
+
+	for _, fetchBuffer := range []int{0, 4} {
+		blk := random.BlocksOfSize(1, blockSize)[0]
+		exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		require.NoError(t, exchbstore.Put(context.Background(), blk))
+		bstore := &stuckBlockstore{
+			Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+			entered:    make(chan struct{}, 2),
+			releaseGet: make(chan struct{}),
+			releasePut: make(chan struct{}),
+		}
+		defer close(bstore.releasePut)
+		errs := make(map[cid.Cid]error)
+		bserv := New(bstore, offline.Exchange(exchbstore),
+			WithFetchBuffer(fetchBuffer),
+			WithBlockErrorHandler(func(c cid.Cid, err error) { errs[c] = err }),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		out := bserv.GetBlocks(ctx, []cid.Cid{blk.Cid()})
+		<-bstore.entered // stuck in the local lookup
+		close(bstore.releaseGet)
+		<-bstore.entered // then stuck writing the fetched block
+		cancel()
+
+		select {
+		case _, ok := <-out:
+			require.False(t, ok)
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("output not closed after cancellation")
+		}
+		require.ErrorIs(t, errs[blk.Cid()], context.Canceled)
+	}
+}
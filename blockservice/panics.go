@@ -0,0 +1,64 @@
+package blockservice
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// WithStrictPanics makes the recovered panics crash the program once they
+// have been reported, as they would without the recovery. By default GetBlocks
+// recovers the panics of its goroutines, including the ones of
+// [WithFetchWindow] and [WithFetchBuffer], of the validator of
+// [WithFetchedBlockValidator] and of the handler of [WithBlockErrorHandler],
+// so one bad callback or blockstore can't take the program down or leave the
+// consumer waiting on a channel which is never closed. The panics of the
+// handlers of [WithNotifyErrorHandler] and [WithShadowMismatchHandler], and of
+// the shadow reads, are recovered too.
+func WithStrictPanics() Option {
+	return func(bs *blockService) {
+		bs.strictPanics = true
+	}
+}
+
+// PanicError is reported for the blocks which could not be returned because
+// of a recovered panic, see [WithStrictPanics].
+type PanicError struct {
+	// Value is the value passed to panic and Stack the stack of the
+	// goroutine which panicked.
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("recovered panic: %v", e.Value)
+}
+
+// recovered records the panic r recovered in where, it is counted by the
+// RecoveredPanics stat and logged with its stack.
+func (s *blockService) recovered(where string, r any) *PanicError {
+	err := &PanicError{Value: r, Stack: debug.Stack()}
+	if s != nil {
+		s.stats.recoveredPanics.Add(1)
+		if s.metrics != nil {
+			s.metrics.recoveredPanics.Inc()
+		}
+	}
+	logger.Errorf("recovered panic in %s: %v\n%s", where, r, err.Stack)
+	return err
+}
+
+// recoverPanic is deferred by the callbacks and goroutines whose panics are
+// recovered and reported nowhere else, where names them in the log.
+func (s *blockService) recoverPanic(where string) {
+	if r := recover(); r != nil {
+		s.recovered(where, r)
+		s.repanic(r)
+	}
+}
+
+// repanic panics again with r in the strict mode of [WithStrictPanics].
+func (s *blockService) repanic(r any) {
+	if s != nil && s.strictPanics {
+		panic(r)
+	}
+}
@@ -0,0 +1,248 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// panickingBlockstore panics when reading the block bad.
+type panickingBlockstore struct {
+	blockstore.Blockstore
+	bad cid.Cid
+}
+
+func (bs *panickingBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if c == bs.bad {
+		panic("corrupt index")
+	}
+	return bs.Blockstore.Get(ctx, c)
+}
+
+// errorRecorder is a block error handler recording the errors.
+type errorRecorder struct {
+	lk   sync.Mutex
+	errs map[cid.Cid]error
+}
+
+func (r *errorRecorder) handle(c cid.Cid, err error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if r.errs == nil {
+		r.errs = make(map[cid.Cid]error)
+	}
+	r.errs[c] = err
+}
+
+func (r *errorRecorder) get(c cid.Cid) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return r.errs[c]
+}
+
+func TestGetBlocksProducerPanic(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	inner := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, inner.PutMany(ctx, blks))
+	rec := &errorRecorder{}
+	bserv := New(&panickingBlockstore{Blockstore: inner, bad: blks[1].Cid()}, nil, WithBlockErrorHandler(rec.handle)).(*blockService)
+
+	var got []blocks.Block
+	for b := range bserv.GetBlocks(ctx, []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}) {
+		got = append(got, b)
+	}
+	// the channel is closed and the blocks not returned report the panic
+	require.Equal(t, []blocks.Block{blks[0]}, got)
+	for _, b := range blks[1:] {
+		var perr *PanicError
+		require.ErrorAs(t, rec.get(b.Cid()), &perr)
+		require.Equal(t, "corrupt index", perr.Value)
+		require.NotEmpty(t, perr.Stack)
+	}
+	require.EqualValues(t, 1, bserv.Stats(false).RecoveredPanics)
+}
+
+func TestGetBlocksHookPanics(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	newService := func(opts ...Option) *blockService {
+		exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		require.NoError(t, exchbstore.PutMany(ctx, blks))
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		return New(bstore, offline.Exchange(exchbstore), opts...).(*blockService)
+	}
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	bad := blks[1].Cid()
+
+	t.Run("validator", func(t *testing.T) {
+		t.Parallel()
+		rec := &errorRecorder{}
+		bserv := newService(WithBlockErrorHandler(rec.handle), WithFetchedBlockValidator(func(b blocks.Block) error {
+			if b.Cid() == bad {
+				panic("bad decoder")
+			}
+			return nil
+		}))
+		var got []cid.Cid
+		for b := range bserv.GetBlocks(ctx, ks) {
+			got = append(got, b.Cid())
+		}
+		// only the block whose validation panicked is lost
+		require.ElementsMatch(t, []cid.Cid{ks[0], ks[2], ks[3]}, got)
+		var ierr *InvalidBlockError
+		require.ErrorAs(t, rec.get(bad), &ierr)
+		var perr *PanicError
+		require.ErrorAs(t, ierr, &perr)
+		require.EqualValues(t, 1, bserv.Stats(false).RecoveredPanics)
+	})
+
+	t.Run("error handler", func(t *testing.T) {
+		t.Parallel()
+		var lk sync.Mutex
+		var reported []cid.Cid
+		bserv := newService(WithBlockErrorHandler(func(c cid.Cid, err error) {
+			lk.Lock()
+			reported = append(reported, c)
+			lk.Unlock()
+			panic("bad handler")
+		}))
+		missing := random.BlocksOfSize(2, blockSize)
+		var got []cid.Cid
+		for b := range bserv.GetBlocks(ctx, append([]cid.Cid{missing[0].Cid(), missing[1].Cid()}, ks...)) {
+			got = append(got, b.Cid())
+		}
+		require.ElementsMatch(t, ks, got)
+		// every missing block is still reported
+		lk.Lock()
+		require.ElementsMatch(t, []cid.Cid{missing[0].Cid(), missing[1].Cid()}, reported)
+		lk.Unlock()
+		require.EqualValues(t, 2, bserv.Stats(false).RecoveredPanics)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		t.Parallel()
+		bserv := newService(WithStrictPanics(), WithFetchedBlockValidator(func(blocks.Block) error {
+			panic("bad decoder")
+		}))
+		// GetBlock validates in the caller's goroutine
+		require.PanicsWithValue(t, "bad decoder", func() { _, _ = bserv.GetBlock(ctx, bad) })
+
+		bserv = newService(WithFetchedBlockValidator(func(blocks.Block) error {
+			panic(errors.New("bad decoder"))
+		}))
+		_, err := bserv.GetBlock(ctx, bad)
+		var perr *PanicError
+		require.ErrorAs(t, err, &perr)
+	})
+}
+
+// panickingExchange panics on the GetBlocks calls after the first one.
+type panickingExchange struct {
+	exchange.Interface
+	calls atomic.Int32
+}
+
+func (e *panickingExchange) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	if e.calls.Add(1) > 1 {
+		panic("bad exchange")
+	}
+	return e.Interface.GetBlocks(ctx, ks)
+}
+
+func TestBackgroundPanics(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	t.Run("notify error handler", func(t *testing.T) {
+		t.Parallel()
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		exch := failingNotifyExchange{offline.Exchange(bstore)}
+		bserv := New(bstore, exch, WithNotifyErrorHandler(func(error, []cid.Cid) {
+			panic("bad handler")
+		})).(*blockService)
+		require.NoError(t, bserv.AddBlock(ctx, random.BlocksOfSize(1, blockSize)[0]))
+		st := bserv.Stats(false)
+		require.EqualValues(t, 1, st.AddNotifyFailures)
+		require.EqualValues(t, 1, st.RecoveredPanics)
+	})
+
+	t.Run("shadow mismatch handler", func(t *testing.T) {
+		t.Parallel()
+		blk := random.BlocksOfSize(1, blockSize)[0]
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		require.NoError(t, bstore.Put(ctx, blk))
+		candidate := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, nil, WithShadowBlockstore(candidate, 1), WithShadowMismatchHandler(func(cid.Cid, ShadowMismatch) {
+			panic("bad handler")
+		})).(*blockService)
+		_, err := bserv.GetBlock(ctx, blk.Cid())
+		require.NoError(t, err)
+		require.NoError(t, bserv.Close())
+		st := bserv.Stats(false)
+		require.EqualValues(t, 1, st.ShadowMismatches)
+		require.EqualValues(t, 1, st.RecoveredPanics)
+	})
+
+	t.Run("fetch window", func(t *testing.T) {
+		t.Parallel()
+		blks := random.BlocksOfSize(4, blockSize)
+		exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		require.NoError(t, exchbstore.PutMany(ctx, blks))
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		rec := &errorRecorder{}
+		bserv := New(bstore, &panickingExchange{Interface: offline.Exchange(exchbstore)},
+			WithFetchWindow(2), WithBlockErrorHandler(rec.handle)).(*blockService)
+
+		// the first window is delivered, the channel is closed once the
+		// next one panics
+		var got []blocks.Block
+		for b := range bserv.GetBlocks(ctx, cidsOf(blks...)) {
+			got = append(got, b)
+		}
+		require.Equal(t, blks[:1], got)
+		for _, b := range blks[1:] {
+			require.Error(t, rec.get(b.Cid()))
+		}
+		require.EqualValues(t, 1, bserv.Stats(false).RecoveredPanics)
+	})
+
+	t.Run("fetch buffer", func(t *testing.T) {
+		t.Parallel()
+		blks := random.BlocksOfSize(2, blockSize)
+		bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil, WithFetchBuffer(2)).(*blockService)
+		var sent []blocks.Block
+		buf := bserv.newDeliveryBuffer(ctx, nil, func(b blocks.Block) bool {
+			if b == blks[0] {
+				panic("bad consumer")
+			}
+			sent = append(sent, b)
+			return true
+		})
+		require.True(t, buf.push(blks[0], nil))
+		require.True(t, buf.push(blks[1], nil))
+		buf.close()
+		// only the block whose delivery panicked is lost
+		require.Equal(t, blks[1:], sent)
+		require.EqualValues(t, 1, bserv.Stats(false).RecoveredPanics)
+	})
+}
@@ -0,0 +1,74 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// WithParallelPut makes AddBlocks split the blocks it writes into up to shards
+// contiguous shards written by concurrent PutMany calls, for blockstores which
+// commit batches serially. Each shard is split into batches by
+// [WithMaxBatchSize] and its batches are notified and provided as soon as they
+// are written, so the blocks are announced in the order the shards commit and
+// not in the order of the call, and the blocks of a failed shard are not
+// announced. Once the context is canceled no new batch is written.
+// The errors of the shards are joined, wrapped in a [*PartialWriteError] if
+// other batches were written.
+func WithParallelPut(shards int) Option {
+	return func(bs *blockService) {
+		if shards <= 0 {
+			bs.invalidOption("WithParallelPut: the number of shards must be positive, got %d", shards)
+			return
+		}
+		bs.parallelPut = shards
+	}
+}
+
+// putShards writes toput, claimed by [claimWrites], in batches, running one
+// goroutine per shard of [WithParallelPut]. It returns the number of blocks written and the CIDs of
+// the blocks which were not.
+func (s *blockService) putShards(ctx context.Context, toput []blocks.Block, claims []*writeClaim, progress *progressReporter) (int, []cid.Cid, error) {
+	shards := max(min(s.parallelPut, len(toput)), 1)
+	size := (len(toput) + shards - 1) / shards
+
+	var (
+		wg        sync.WaitGroup
+		lk        sync.Mutex
+		written   int
+		unwritten []cid.Cid
+		errs      []error
+	)
+	for start := 0; start < len(toput); start += size {
+		end := min(start+size, len(toput))
+		shard, shardClaims := toput[start:end], claims[start:end]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for len(shard) != 0 {
+				err := ctx.Err()
+				if err == nil {
+					n := s.nextBatchLen(shard)
+					if err = s.putBatch(ctx, shard[:n], shardClaims[:n]); err == nil {
+						lk.Lock()
+						written += n
+						lk.Unlock()
+						progress.written(shard[:n])
+						shard = shard[n:]
+						continue
+					}
+				}
+				lk.Lock()
+				errs = append(errs, err)
+				unwritten = append(unwritten, blockCids(shard)...)
+				lk.Unlock()
+				return
+			}
+		}()
+	}
+	wg.Wait()
+	return written, unwritten, errors.Join(errs...)
+}
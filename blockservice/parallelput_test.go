@@ -0,0 +1,108 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// slowPutManyBlockstore sleeps in PutMany and records the peak number of
+// concurrent calls, the batches containing fail are rejected.
+type slowPutManyBlockstore struct {
+	blockstore.Blockstore
+	latency  time.Duration
+	fail     cid.Cid
+	inflight atomic.Int32
+	peak     atomic.Int32
+}
+
+func (bs *slowPutManyBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	n := bs.inflight.Add(1)
+	defer bs.inflight.Add(-1)
+	for {
+		peak := bs.peak.Load()
+		if n <= peak || bs.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(bs.latency)
+	for _, b := range blks {
+		if b.Cid() == bs.fail {
+			return errors.New("write failed")
+		}
+	}
+	return bs.Blockstore.PutMany(ctx, blks)
+}
+
+func TestWithParallelPut(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(16, blockSize)
+	bstore := &slowPutManyBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		latency:    10 * time.Millisecond,
+	}
+	exch := &notifyRecordingExchange{Interface: offline.Exchange(bstore), notified: make(map[cid.Cid]int)}
+	var progressed atomic.Int32
+	bserv := New(bstore, exch, WithParallelPut(4), WithMaxBatchSize(2, 0), WithProgress(func(e ProgressEvent) {
+		progressed.Store(int32(e.Blocks))
+	}))
+
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+	require.EqualValues(t, 4, bstore.peak.Load())
+	require.EqualValues(t, len(blks), progressed.Load())
+	for _, b := range blks {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+		require.Equal(t, 1, exch.notified[b.Cid()])
+	}
+
+	// the shard of the failing block, 4 to 7, stops, the other shards are
+	// written
+	blks = random.BlocksOfSize(16, blockSize)
+	bstore.fail = blks[5].Cid()
+	err := bserv.AddBlocks(ctx, blks)
+	var perr *PartialWriteError
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, 12, perr.Written)
+	require.ElementsMatch(t, cidsOf(blks[4:8]...), perr.Unwritten)
+	for i, b := range blks {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.Equal(t, i < 4 || i > 7, has)
+		require.Equal(t, i < 4 || i > 7, exch.notified[b.Cid()] == 1)
+	}
+}
+
+func BenchmarkParallelPut(b *testing.B) {
+	blks := random.BlocksOfSize(256, blockSize)
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			ctx := context.Background()
+			for range b.N {
+				bstore := &slowPutManyBlockstore{
+					Blockstore: blockstore.NewBlockstore(ds.NewMapDatastore()),
+					latency:    time.Millisecond,
+				}
+				bserv := New(bstore, nil, WithParallelPut(shards), WithMaxBatchSize(16, 0))
+				if err := bserv.AddBlocks(ctx, blks); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
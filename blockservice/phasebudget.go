@@ -0,0 +1,103 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithPhaseBudgets splits the time left before the deadline of a GetBlocks
+// call between its two phases: the local lookups get localFraction of it and
+// the exchange fetch the rest, plus what the lookups did not use. When the
+// lookups run out of budget, the CIDs not looked up yet are fetched from the
+// exchange so slow local reads can't starve the fetch. Calls without a
+// deadline are not split, nor is anything without this option.
+// The span of GetBlocks records the budgets, and a getBlocks.budget span
+// started under it once the fetch is over records which phase exhausted its
+// budget, as does the span of the fetch with [WithDetailedTracing].
+func WithPhaseBudgets(localFraction float64) Option {
+	return func(bs *blockService) {
+		if !(localFraction > 0 && localFraction < 1) {
+			bs.invalidOption("WithPhaseBudgets: the local fraction must be in (0, 1), got %v", localFraction)
+			return
+		}
+		bs.localBudgetFraction = localFraction
+	}
+}
+
+// phaseBudget is the split of the deadline of a GetBlocks call. A nil
+// phaseBudget doesn't split anything.
+type phaseBudget struct {
+	localDeadline time.Time
+	// localExhausted is set when the local lookups ran out of budget
+	localExhausted bool
+}
+
+// newPhaseBudget returns the budget of a GetBlocks call whose context is
+// ctx, recording it on span. It returns nil when there is nothing to split.
+func (s *blockService) newPhaseBudget(ctx context.Context, span trace.Span) *phaseBudget {
+	if s == nil || s.localBudgetFraction == 0 {
+		return nil
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	total := s.clock.Until(deadline)
+	if total <= 0 {
+		return nil
+	}
+	local := time.Duration(float64(total) * s.localBudgetFraction)
+	span.SetAttributes(
+		attribute.Int64("budget_total_ms", total.Milliseconds()),
+		attribute.Int64("budget_local_ms", local.Milliseconds()),
+	)
+	return &phaseBudget{localDeadline: deadline.Add(local - total)}
+}
+
+// localContext returns the context of the local lookups.
+func (b *phaseBudget) localContext(ctx context.Context, s *blockService) (context.Context, context.CancelFunc) {
+	if b == nil {
+		return ctx, func() {}
+	}
+	return s.clock.WithDeadline(ctx, b.localDeadline)
+}
+
+// lookupCut reports whether a failed lookup was cut by the local budget
+// rather than by the deadline of the call, recording it.
+func (b *phaseBudget) lookupCut(ctx, localCtx context.Context) bool {
+	if b == nil || localCtx.Err() == nil || ctx.Err() != nil {
+		return false
+	}
+	b.localExhausted = true
+	return true
+}
+
+// record sets the phase which exhausted its budget, if any, on the span of
+// the fetch and on a getBlocks.budget span under the span of the operation,
+// which has ended by the time the fetch is over.
+func (b *phaseBudget) record(ctx context.Context, fetchSpan trace.Span) {
+	var exhausted string
+	switch {
+	case b == nil:
+		return
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		exhausted = "fetch"
+	case b.localExhausted:
+		exhausted = "local"
+	default:
+		return
+	}
+	attr := attribute.String("budget_exhausted", exhausted)
+	fetchSpan.SetAttributes(attr)
+	if op := trace.SpanFromContext(ctx); op.IsRecording() {
+		op.SetAttributes(attr)
+		return
+	}
+	_, span := internal.StartSpan(ctx, "getBlocks.budget", trace.WithAttributes(attr))
+	span.End()
+}
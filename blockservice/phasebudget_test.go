@@ -0,0 +1,102 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// stuckReadBlockstore hangs reading stuck until the context is done.
+type stuckReadBlockstore struct {
+	blockstore.Blockstore
+	stuck cid.Cid
+}
+
+func (bs *stuckReadBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if c == bs.stuck {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return bs.Blockstore.Get(ctx, c)
+}
+
+func TestPhaseBudgets(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	ks := []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}
+	inner := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, inner.Put(context.Background(), blks[0]))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(context.Background(), blks))
+
+	clk := clock.NewMock()
+	bserv := New(&stuckReadBlockstore{Blockstore: inner, stuck: blks[1].Cid()}, offline.Exchange(exchbstore),
+		WithClock(clk), WithPhaseBudgets(0.23))
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	defer root.End()
+	ctx, cancel := clk.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out := bserv.GetBlocks(ctx, ks)
+	require.Equal(t, blks[0], <-out)
+	// the stuck read uses up the local budget, the lookups left are fetched
+	got := make(chan []blocks.Block)
+	go func() {
+		var rest []blocks.Block
+		for b := range out {
+			rest = append(rest, b)
+		}
+		got <- rest
+	}()
+	var rest []blocks.Block
+	require.Eventually(t, func() bool {
+		select {
+		case rest = <-got:
+			return true
+		default:
+			clk.Add(100 * time.Millisecond)
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+	require.ElementsMatch(t, blks[1:], rest)
+	require.Less(t, clk.Now().Sub(time.Unix(0, 0)), 10*time.Second)
+
+	require.NotEmpty(t, findSpans("Blockservice.blockService.GetBlocks", attribute.Int64("budget_local_ms", 2300)))
+	// recorded under the span of GetBlocks without WithDetailedTracing
+	require.Eventually(t, func() bool {
+		for _, span := range findSpans("Blockservice.getBlocks.budget", attribute.String("budget_exhausted", "local")) {
+			if span.SpanContext().TraceID() == root.SpanContext().TraceID() {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+
+	_, err := NewWithOptions(inner, nil, WithPhaseBudgets(1))
+	require.Error(t, err)
+}
+
+func TestPhaseBudgetsOff(t *testing.T) {
+	t.Parallel()
+
+	// without a deadline there is nothing to split
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil, WithPhaseBudgets(0.5)).(*blockService)
+	require.Nil(t, bserv.newPhaseBudget(context.Background(), nil))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	require.Nil(t, New(bserv.Blockstore(), nil).(*blockService).newPhaseBudget(ctx, nil))
+}
@@ -0,0 +1,196 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// PinningBlockService is a [BlockService] able to fetch blocks and pin them
+// without letting the garbage collector run in between.
+type PinningBlockService interface {
+	BlockService
+
+	// GetBlockAndPin gets the block for c like GetBlock, then calls pin with
+	// its CID while holding the pin lock of the [blockstore.GCLocker].
+	// pin is not called if the block could not be retrieved, its error is
+	// returned as is.
+	GetBlockAndPin(ctx context.Context, c cid.Cid, pin func(cid.Cid) error) (blocks.Block, error)
+
+	// GetBlocksAndPin is like GetBlockAndPin for many blocks, pin is called once
+	// with the CIDs of the blocks which were retrieved, and not at all if none
+	// were.
+	GetBlocksAndPin(ctx context.Context, ks []cid.Cid, pin func([]cid.Cid) error) ([]blocks.Block, error)
+}
+
+var _ PinningBlockService = (*blockService)(nil)
+
+// WithGCLocker sets the [blockstore.GCLocker] used by GetBlockAndPin and
+// GetBlocksAndPin. By default the blockstore is used if it implements
+// [blockstore.GCLocker], otherwise no lock is taken.
+func WithGCLocker(locker blockstore.GCLocker) Option {
+	return func(bs *blockService) {
+		if locker == nil {
+			bs.invalidOption("WithGCLocker: nil locker")
+			return
+		}
+		bs.gcLocker = locker
+	}
+}
+
+// WithPinner sets the function pinning the blocks added with a context marked
+// by [ContextWithPinRoot]. It is called once per block, after the block is
+// stored, and the pin lock of the [blockstore.GCLocker] is held from before
+// the write until it returns, so the garbage collector can't remove the block
+// in between, see [WithGCLocker].
+func WithPinner(pin func(ctx context.Context, c cid.Cid) error) Option {
+	return func(bs *blockService) {
+		if pin == nil {
+			bs.invalidOption("WithPinner: nil pinner")
+			return
+		}
+		bs.pinner = pin
+	}
+}
+
+type pinRootKey struct{}
+
+// ContextWithPinRoot marks the adds made with the returned context as adding
+// roots: the blocks given to AddBlock, AddBlocks and AddBlocksAtomic are
+// pinned with the pinner of [WithPinner], including the ones which were
+// already stored. Usually only the add of the root of a DAG is marked, once
+// its children have been added. It does nothing without a pinner.
+func ContextWithPinRoot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pinRootKey{}, struct{}{})
+}
+
+// UnpinnedError is returned by the adds marked by [ContextWithPinRoot] whose
+// blocks were stored but could not be pinned.
+type UnpinnedError struct {
+	// Unpinned lists the CIDs of the stored blocks which are not pinned.
+	Unpinned []cid.Cid
+	// Err is the error of the first failed pin.
+	Err error
+}
+
+func (e *UnpinnedError) Error() string {
+	return fmt.Sprintf("stored %d blocks but failed to pin them: %s", len(e.Unpinned), e.Err)
+}
+
+func (e *UnpinnedError) Unwrap() error {
+	return e.Err
+}
+
+// rootPin pins the blocks of an add marked by ContextWithPinRoot while holding
+// the pin lock. A nil rootPin does nothing.
+type rootPin struct {
+	pinner func(context.Context, cid.Cid) error
+	unlock func()
+}
+
+// startRootPin takes the pin lock if ctx is marked by ContextWithPinRoot and a
+// pinner is set, it must be called before the blocks are written.
+func (s *blockService) startRootPin(ctx context.Context) *rootPin {
+	if s.pinner == nil || ctx.Value(pinRootKey{}) == nil {
+		return nil
+	}
+	return &rootPin{pinner: s.pinner, unlock: s.pinLock(ctx)}
+}
+
+// pin pins the stored blocks of bs, it returns an [*UnpinnedError] if some
+// could not be pinned.
+func (p *rootPin) pin(ctx context.Context, bs ...blocks.Block) error {
+	if p == nil {
+		return nil
+	}
+	var unpinned []cid.Cid
+	var firstErr error
+	for _, b := range bs {
+		if err := p.pinner(ctx, b.Cid()); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			unpinned = append(unpinned, b.Cid())
+		}
+	}
+	if unpinned != nil {
+		return &UnpinnedError{Unpinned: unpinned, Err: firstErr}
+	}
+	return nil
+}
+
+func (p *rootPin) release() {
+	if p != nil {
+		p.unlock()
+	}
+}
+
+// pinLock takes the pin lock if a GCLocker is available, the returned function
+// releases it.
+func (s *blockService) pinLock(ctx context.Context) func() {
+	locker := s.gcLocker
+	if locker == nil {
+		locker, _ = s.blockstore.(blockstore.GCLocker)
+	}
+	if locker == nil {
+		return func() {}
+	}
+	unlocker := locker.PinLock(ctx)
+	return func() { unlocker.Unlock(context.WithoutCancel(ctx)) }
+}
+
+func (s *blockService) GetBlockAndPin(ctx context.Context, c cid.Cid, pin func(cid.Cid) error) (blocks.Block, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlockAndPin")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	unlock := s.pinLock(ctx)
+	defer unlock()
+
+	blk, err := s.GetBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := pin(blk.Cid()); err != nil {
+		return nil, err
+	}
+	return blk, nil
+}
+
+func (s *blockService) GetBlocksAndPin(ctx context.Context, ks []cid.Cid, pin func([]cid.Cid) error) ([]blocks.Block, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlocksAndPin")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if err := s.checkBatchRequest(len(ks)); err != nil {
+		return nil, err
+	}
+
+	unlock := s.pinLock(ctx)
+	defer unlock()
+
+	var blks []blocks.Block
+	for blk := range s.GetBlocks(ctx, ks) {
+		blks = append(blks, blk)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(blks) == 0 {
+		return nil, nil
+	}
+
+	received := make([]cid.Cid, len(blks))
+	for i, blk := range blks {
+		received[i] = blk.Cid()
+	}
+	if err := pin(received); err != nil {
+		return nil, err
+	}
+	return blks, nil
+}
@@ -0,0 +1,175 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBlockAndPinHoldsPinLock(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(1, blockSize)
+	locker := blockstore.NewGCLocker()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.Put(ctx, blks[0]))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithGCLocker(locker)).(PinningBlockService)
+
+	gcDone := make(chan struct{})
+	_, err := bserv.GetBlockAndPin(ctx, blks[0].Cid(), func(c cid.Cid) error {
+		go func() {
+			locker.GCLock(ctx).Unlock(ctx)
+			close(gcDone)
+		}()
+		require.Eventually(t, func() bool { return locker.GCRequested(ctx) }, time.Second, time.Millisecond)
+		select {
+		case <-gcDone:
+			t.Error("GC ran before the pin callback returned")
+		case <-time.After(10 * time.Millisecond):
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	<-gcDone
+}
+
+func TestGetBlockAndPinErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	locker := blockstore.NewGCLocker()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, blks[0]))
+	bserv := New(bstore, nil, WithGCLocker(locker)).(PinningBlockService)
+
+	errPin := errors.New("pin failed")
+	_, err := bserv.GetBlockAndPin(ctx, blks[0].Cid(), func(cid.Cid) error { return errPin })
+	require.ErrorIs(t, err, errPin)
+
+	_, err = bserv.GetBlockAndPin(ctx, blks[1].Cid(), func(cid.Cid) error {
+		t.Error("pin called for a missing block")
+		return nil
+	})
+	require.Error(t, err)
+
+	require.Panics(t, func() {
+		_, _ = bserv.GetBlockAndPin(ctx, blks[0].Cid(), func(cid.Cid) error { panic("boom") })
+	})
+
+	// the lock was released every time
+	locker.GCLock(ctx).Unlock(ctx)
+}
+
+func TestGetBlocksAndPin(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	bstore := blockstore.NewGCBlockstore(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), blockstore.NewGCLocker())
+	require.NoError(t, bstore.PutMany(ctx, blks[:2]))
+	bserv := New(bstore, nil).(PinningBlockService)
+
+	var pinned []cid.Cid
+	got, err := bserv.GetBlocksAndPin(ctx, []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}, func(ks []cid.Cid) error {
+		pinned = ks
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, pinned)
+
+	got, err = bserv.GetBlocksAndPin(ctx, []cid.Cid{blks[2].Cid()}, func([]cid.Cid) error {
+		t.Error("pin called without any block")
+		return nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func TestWithPinner(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	locker := blockstore.NewGCLocker()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	var pinned []cid.Cid
+	gcDone := make(chan struct{})
+	bserv := New(bstore, nil, WithGCLocker(locker), WithPinner(func(ctx context.Context, c cid.Cid) error {
+		has, err := bstore.Has(ctx, c)
+		require.NoError(t, err)
+		require.True(t, has, "pinned before being stored")
+		if len(pinned) == 0 {
+			go func() {
+				locker.GCLock(ctx).Unlock(ctx)
+				close(gcDone)
+			}()
+			require.Eventually(t, func() bool { return locker.GCRequested(ctx) }, time.Second, time.Millisecond)
+			select {
+			case <-gcDone:
+				t.Error("GC ran before the pinner returned")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		pinned = append(pinned, c)
+		return nil
+	}))
+
+	// unmarked adds are not pinned
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.Empty(t, pinned)
+
+	rootCtx := ContextWithPinRoot(ctx)
+	require.NoError(t, bserv.AddBlock(rootCtx, blks[1]))
+	<-gcDone
+	require.Equal(t, []cid.Cid{blks[1].Cid()}, pinned)
+
+	// the blocks already stored are pinned too
+	require.NoError(t, bserv.AddBlocks(rootCtx, blks[:3]))
+	require.Equal(t, []cid.Cid{blks[1].Cid(), blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}, pinned)
+}
+
+func TestWithPinnerErrors(t *testing.T) {
+	t.Parallel()
+	ctx := ContextWithPinRoot(context.Background())
+
+	blks := random.BlocksOfSize(2, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	errPin := errors.New("pin failed")
+	bserv := New(bstore, nil, WithPinner(func(_ context.Context, c cid.Cid) error {
+		if c == blks[1].Cid() {
+			return errPin
+		}
+		return nil
+	}))
+
+	err := bserv.AddBlocks(ctx, blks)
+	require.ErrorIs(t, err, errPin)
+	var unpinned *UnpinnedError
+	require.ErrorAs(t, err, &unpinned)
+	require.Equal(t, []cid.Cid{blks[1].Cid()}, unpinned.Unpinned)
+	// the blocks are stored anyway
+	for _, b := range blks {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	err = bserv.AddBlock(ctx, blks[1])
+	require.ErrorAs(t, err, &unpinned)
+
+	_, err = NewWithOptions(bstore, nil, WithPinner(nil))
+	require.Error(t, err)
+}
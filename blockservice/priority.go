@@ -0,0 +1,115 @@
+package blockservice
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// PrioritizedCid is a CID requested with a priority, higher priorities are
+// fetched first.
+type PrioritizedCid struct {
+	Cid      cid.Cid
+	Priority int
+}
+
+// PriorityFetcher is implemented by exchange sessions able to fetch blocks
+// according to their priority.
+type PriorityFetcher interface {
+	GetBlocksWithPriority(ctx context.Context, ks []PrioritizedCid) (<-chan blocks.Block, error)
+}
+
+// GetBlocksWithPriority is like [Session.GetBlocks] but the blocks with a
+// higher priority are requested first.
+// Blocks found locally are returned right away whatever their priority. The
+// missing ones are passed to the exchange session if it implements
+// [PriorityFetcher], otherwise they are requested in waves of equal priority,
+// each wave being requested once the previous one is complete. With a single
+// priority this is the same as GetBlocks.
+func (s *Session) GetBlocksWithPriority(ctx context.Context, ks []PrioritizedCid) <-chan blocks.Block {
+	ctx, span := internal.StartSpan(ctx, "Session.GetBlocksWithPriority")
+	defer span.End()
+	grabServiceFromBlockservice(s.bs).tagSpan(ctx, span)
+	s.linkSpan(span)
+	ctx = s.markSessionFetch(ctx)
+
+	cids := make([]cid.Cid, len(ks))
+	priorities := make(map[cid.Cid]int, len(ks))
+	for i, k := range ks {
+		cids[i] = k.Cid
+		if p, ok := priorities[k.Cid]; !ok || k.Priority > p {
+			priorities[k.Cid] = k.Priority
+		}
+	}
+	fetchFactory := func() exchange.Fetcher {
+		fetch := s.grabSession()
+		if fetch == nil {
+			return nil
+		}
+		return prioritizedFetcher{Fetcher: fetch, priorities: priorities}
+	}
+
+	s.refs.addRequested(cids...)
+	s.wants.add(cids)
+	return s.filterCanceled(ctx, cids, getBlocks(ctx, cids, s.bs, s, fetchFactory))
+}
+
+// prioritizedFetcher requests the blocks passed to GetBlocks according to
+// their priority.
+type prioritizedFetcher struct {
+	exchange.Fetcher
+	priorities map[cid.Cid]int
+}
+
+func (f prioritizedFetcher) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	prioritized := make([]PrioritizedCid, len(ks))
+	for i, k := range ks {
+		prioritized[i] = PrioritizedCid{Cid: k, Priority: f.priorities[k]}
+	}
+	if pf, ok := f.Fetcher.(PriorityFetcher); ok {
+		return pf.GetBlocksWithPriority(ctx, prioritized)
+	}
+
+	slices.SortStableFunc(prioritized, func(a, b PrioritizedCid) int {
+		return cmp.Compare(b.Priority, a.Priority)
+	})
+	var waves [][]cid.Cid
+	for i, k := range prioritized {
+		if i == 0 || k.Priority != prioritized[i-1].Priority {
+			waves = append(waves, nil)
+		}
+		waves[len(waves)-1] = append(waves[len(waves)-1], k.Cid)
+	}
+	if len(waves) <= 1 {
+		return f.Fetcher.GetBlocks(ctx, ks)
+	}
+
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for _, wave := range waves {
+			rblocks, err := f.Fetcher.GetBlocks(ctx, wave)
+			if err != nil {
+				logger.Debugf("Error with GetBlocks: %s", err)
+				return
+			}
+			for b := range rblocks {
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,90 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// callRecordingExchange records the CIDs of each GetBlocks call.
+type callRecordingExchange struct {
+	exchange.Interface
+
+	lk    sync.Mutex
+	calls [][]cid.Cid
+}
+
+func (e *callRecordingExchange) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	e.lk.Lock()
+	e.calls = append(e.calls, ks)
+	e.lk.Unlock()
+	return e.Interface.GetBlocks(ctx, ks)
+}
+
+func TestGetBlocksWithPriority(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(5, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, blks[4]))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[:4]))
+	exch := &callRecordingExchange{Interface: offline.Exchange(exchbstore)}
+	ses := NewSession(ctx, New(bstore, exch))
+
+	out := ses.GetBlocksWithPriority(ctx, []PrioritizedCid{
+		{Cid: blks[0].Cid(), Priority: 1},
+		{Cid: blks[1].Cid(), Priority: 5},
+		{Cid: blks[2].Cid(), Priority: 1},
+		{Cid: blks[3].Cid(), Priority: 5},
+		{Cid: blks[4].Cid(), Priority: 0},
+	})
+	var got []cid.Cid
+	for b := range out {
+		got = append(got, b.Cid())
+	}
+
+	// the local block comes first, then the waves by decreasing priority
+	require.Len(t, got, 5)
+	require.Equal(t, blks[4].Cid(), got[0])
+	require.ElementsMatch(t, []cid.Cid{blks[1].Cid(), blks[3].Cid()}, got[1:3])
+	require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[2].Cid()}, got[3:])
+	require.Equal(t, [][]cid.Cid{
+		{blks[1].Cid(), blks[3].Cid()},
+		{blks[0].Cid(), blks[2].Cid()},
+	}, exch.calls)
+}
+
+func TestGetBlocksWithSinglePriority(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	exch := &callRecordingExchange{Interface: offline.Exchange(exchbstore)}
+	ses := NewSession(ctx, New(bstore, exch))
+
+	ks := make([]PrioritizedCid, len(blks))
+	for i, b := range blks {
+		ks[i] = PrioritizedCid{Cid: b.Cid()}
+	}
+	var n int
+	for range ses.GetBlocksWithPriority(ctx, ks) {
+		n++
+	}
+	require.Equal(t, 3, n)
+	require.Len(t, exch.calls, 1)
+}
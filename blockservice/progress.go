@@ -0,0 +1,86 @@
+package blockservice
+
+import (
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+// ProgressEvent reports the progress of an AddBlocks call, the values are
+// cumulative since the start of the call.
+type ProgressEvent struct {
+	// Blocks is the number of blocks written to the blockstore.
+	Blocks int
+	// Bytes is the size of the blocks written to the blockstore.
+	Bytes int64
+	// Duplicates is the number of blocks skipped because the blockstore
+	// already had them.
+	Duplicates int
+	// Elapsed is the time since the start of the call.
+	Elapsed time.Duration
+}
+
+// WithProgress sets a function called by AddBlocks after each batch is
+// written to the blockstore, see [WithMaxBatchSize]. A call writing nothing
+// reports a single event. [CopyBlocks] reports through the progress function of
+// its destination too.
+// It is called synchronously before AddBlocks returns, and never concurrently
+// even when several AddBlocks calls run in parallel.
+func WithProgress(progress func(ProgressEvent)) Option {
+	return func(bs *blockService) {
+		bs.progress = progress
+	}
+}
+
+// progressReporter accumulates the progress of one AddBlocks call.
+type progressReporter struct {
+	s     *blockService
+	start time.Time
+
+	lk    sync.Mutex // the batches of WithParallelPut report concurrently
+	event ProgressEvent
+}
+
+func (s *blockService) newProgressReporter() *progressReporter {
+	if s.progress == nil {
+		return nil
+	}
+	return &progressReporter{s: s, start: s.clock.Now()}
+}
+
+func (p *progressReporter) duplicates(n int) {
+	if p == nil {
+		return
+	}
+	p.event.Duplicates += n
+}
+
+// written reports bs have been written.
+func (p *progressReporter) written(bs []blocks.Block) {
+	if p == nil {
+		return
+	}
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.event.Blocks += len(bs)
+	for _, b := range bs {
+		p.event.Bytes += int64(len(b.RawData()))
+	}
+	p.report()
+}
+
+// done reports an event if nothing was written.
+func (p *progressReporter) done() {
+	if p == nil || p.event.Blocks != 0 {
+		return
+	}
+	p.report()
+}
+
+func (p *progressReporter) report() {
+	p.event.Elapsed = p.s.clock.Since(p.start)
+	p.s.progressLk.Lock()
+	defer p.s.progressLk.Unlock()
+	p.s.progress(p.event)
+}
@@ -0,0 +1,40 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddBlocksProgress(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(5, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, blks[0]))
+
+	var events []ProgressEvent
+	bserv := New(bstore, nil, WithMaxBatchSize(2, 0), WithProgress(func(e ProgressEvent) {
+		events = append(events, e)
+	}))
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+
+	require.Len(t, events, 2)
+	require.Equal(t, 2, events[0].Blocks)
+	require.Equal(t, 4, events[1].Blocks)
+	require.EqualValues(t, 4*blockSize, events[1].Bytes)
+	require.Equal(t, 1, events[1].Duplicates)
+	require.GreaterOrEqual(t, events[1].Elapsed, events[0].Elapsed)
+
+	events = nil
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+	require.Len(t, events, 1, "a call writing nothing reports once")
+	require.Zero(t, events[0].Blocks)
+	require.Equal(t, 5, events[0].Duplicates)
+}
@@ -0,0 +1,520 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/boxo/provider"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
+)
+
+// ProvidingBlockService is a BlockService which announces the blocks it
+// stores through a [provider.Provider].
+type ProvidingBlockService interface {
+	BlockService
+
+	// Provider can return nil, then no provider is used.
+	Provider() provider.Provider
+}
+
+var _ ProvidingBlockService = (*blockService)(nil)
+
+// ProvidePolicy selects what happens to a Provide call when the provide
+// rate limit is exhausted.
+type ProvidePolicy int
+
+const (
+	// ProvideWait blocks the operation until the rate limit allows the
+	// provide or the operation's context is canceled.
+	ProvideWait ProvidePolicy = iota
+	// ProvideDrop skips the provide and counts it in [Stats.ProvidesDropped].
+	ProvideDrop
+	// ProvideQueue hands the provide to the async provide queue which will
+	// perform it once the rate limit allows it.
+	ProvideQueue
+)
+
+// ProvideOn selects which operations trigger provides, values can be
+// combined with a bitwise or.
+type ProvideOn uint8
+
+const (
+	// ProvideOnAdd provides blocks added through AddBlock and AddBlocks.
+	ProvideOnAdd ProvideOn = 1 << iota
+	// ProvideOnFetch provides blocks fetched from the exchange and cached in
+	// the blockstore.
+	ProvideOnFetch
+)
+
+// WithProvider allows to advertise anything that is added or fetched through
+// the blockservice.
+func WithProvider(p provider.Provider) Option {
+	return func(bs *blockService) {
+		bs.providers = nil
+		if p != nil {
+			bs.providers = []provider.Provider{p}
+		}
+	}
+}
+
+// WithProvideOn selects which operations trigger provides, the default is
+// ProvideOnAdd | ProvideOnFetch.
+func WithProvideOn(on ProvideOn) Option {
+	return func(bs *blockService) {
+		bs.provideOn = on
+	}
+}
+
+// WithProvideFilter sets a callback which is consulted before each provide,
+// blocks for which it returns false are not announced. It is not consulted for
+// the operations carrying [ContextWithNoProvide].
+func WithProvideFilter(filter func(cid.Cid) bool) Option {
+	return func(bs *blockService) {
+		bs.provideFilter = filter
+	}
+}
+
+// WithProvideRateLimit bounds the rate of Provide calls to perSecond with
+// bursts of up to burst calls. The limit is shared between every code path of
+// the blockservice and applies to each provider of [WithProviders] separately,
+// what happens when it is exhausted is selected by [WithProvidePolicy].
+func WithProvideRateLimit(perSecond float64, burst int) Option {
+	return func(bs *blockService) {
+		if perSecond < 0 || burst < 0 {
+			bs.invalidOption("WithProvideRateLimit: negative limit (%g/s, burst %d)", perSecond, burst)
+			return
+		}
+		bs.provideLimiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	}
+}
+
+// WithProvidePolicy sets the behavior of provides when the rate limit is
+// exhausted, the default is [ProvideWait].
+func WithProvidePolicy(p ProvidePolicy) Option {
+	return func(bs *blockService) {
+		if p < ProvideWait || p > ProvideQueue {
+			bs.invalidOption("WithProvidePolicy: unknown policy %d", p)
+			return
+		}
+		bs.providePolicy = p
+	}
+}
+
+// defaultProvideQueueSize is the size of the queue used by [ProvideQueue]
+// when [WithAsyncProvide] is not used.
+const defaultProvideQueueSize = 1024
+
+// WithAsyncProvide makes every provide go through a queue of queueSize
+// entries drained by workers background goroutines, operations then only
+// wait for room in the queue.
+func WithAsyncProvide(workers, queueSize int) Option {
+	return func(bs *blockService) {
+		if workers <= 0 || queueSize < 0 {
+			bs.invalidOption("WithAsyncProvide: invalid %d workers and queue size %d", workers, queueSize)
+			return
+		}
+		bs.provideWorkers = workers
+		bs.provideQueueSize = queueSize
+	}
+}
+
+// ContextWithNoProvide returns a context which makes the blockservice and its
+// sessions store the blocks added or fetched without announcing them to the
+// providers, the exchange is still notified of the new blocks.
+// It takes precedence over [WithProvideOn] and [WithProvideFilter], the
+// suppression is recorded on the span of the operation.
+func ContextWithNoProvide(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noProvideKey{}, true)
+}
+
+type noProvideKey struct{}
+
+func isNoProvide(ctx context.Context) bool {
+	noProvide, _ := ctx.Value(noProvideKey{}).(bool)
+	return noProvide
+}
+
+// Provider returns the provider used by the blockservice, it can be nil.
+func (s *blockService) Provider() provider.Provider {
+	return s.provider
+}
+
+// provide announces c following the configured rate limit and policy,
+// on is the kind of operation which triggered the provide.
+// Failures are logged, they never fail the operation which triggered them.
+func (s *blockService) provide(ctx context.Context, on ProvideOn, c cid.Cid) {
+	if s == nil || s.provideOn&on == 0 {
+		return
+	}
+	s.provideCid(ctx, c)
+}
+
+// provideCid is provide whatever the operation which triggered it, it
+// reports whether the provide was queued or performed for one of the
+// providers at least, even if it failed.
+func (s *blockService) provideCid(ctx context.Context, c cid.Cid) bool {
+	if s.provider == nil || isNoProvide(ctx) || isAwaitedProvide(ctx) {
+		return false
+	}
+	if s.provideFilter != nil && !s.provideFilter(c) {
+		return false
+	}
+	if s.blocked(c) {
+		return false
+	}
+
+	if s.provideWorkers > 0 {
+		return s.provideQueue.enqueue(ctx, provideTask{cid: c})
+	}
+
+	started := false
+	for _, t := range s.provideTargets {
+		if err := s.provideTo(ctx, t, c); err != ErrProvideDropped && ctx.Err() == nil {
+			started = true
+		}
+	}
+	return started
+}
+
+// provideTo announces c to the provider of t following its rate limit. It
+// returns the error of the provider, [ErrProvideDropped], or errProvideQueued
+// when the provide was handed to the provide queue.
+func (s *blockService) provideTo(ctx context.Context, t *provideTarget, c cid.Cid) error {
+	if t.backoff.blocked() {
+		// don't spend a token of the limiter on a provide that won't happen
+		return s.provideSuspended(ctx, t, c)
+	}
+	if t.limiter != nil && !allow(s.clock, t.limiter) {
+		switch s.providePolicy {
+		case ProvideDrop:
+			s.stats.providesDropped.Add(1)
+			return ErrProvideDropped
+		case ProvideQueue:
+			s.provideQueue.enqueue(ctx, provideTask{cid: c, target: t})
+			return errProvideQueued
+		default:
+			if err := waitLimiter(ctx, s.clock, t.limiter); err != nil {
+				logger.Debugf("provide of %s skipped: %s", c, err)
+				s.stats.providesDropped.Add(1)
+				return err
+			}
+		}
+	}
+	err := t.provide(ctx, c)
+	if err == errProviderSuspended {
+		return s.provideSuspended(ctx, t, c)
+	}
+	return err
+}
+
+// provideSuspended queues the provide of c to the suspended provider of t,
+// or drops it if there is no queue.
+func (s *blockService) provideSuspended(ctx context.Context, t *provideTarget, c cid.Cid) error {
+	if s.provideQueue != nil && s.providePolicy != ProvideDrop {
+		s.provideQueue.enqueue(ctx, provideTask{cid: c, target: t})
+		return errProvideQueued
+	}
+	s.stats.providesDropped.Add(1)
+	return ErrProvideDropped
+}
+
+// needsProvideQueue reports if the options require a [provideQueue].
+func (s *blockService) needsProvideQueue() bool {
+	if s.provider == nil {
+		return false
+	}
+	return s.provideWorkers > 0 || (s.provideLimiter != nil && s.providePolicy == ProvideQueue)
+}
+
+// provideTask is a provide waiting in the [provideQueue].
+type provideTask struct {
+	cid cid.Cid
+	// target is nil when c must be provided to every provider.
+	target *provideTarget
+	origin taskOrigin
+	// seq and since identify the task and its queuing time in the queue
+	// stats.
+	seq   uint64
+	since time.Time
+}
+
+// journalID identifies the task in the journal of a persistent queue.
+func (t provideTask) journalID() journalID {
+	id := journalID{cid: t.cid, target: allTargets}
+	if t.target != nil {
+		id.target = t.target.index
+	}
+	return id
+}
+
+// provideQueue performs provides in background workers.
+type provideQueue struct {
+	s      *blockService
+	queue  chan provideTask
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lk      sync.Mutex
+	pending int           // queued or in-flight provides
+	idle    chan struct{} // closed when pending drops to zero
+	waiters map[journalID][]*provideWaiter
+	queued  map[uint64]time.Time // queuing time of the pending provides
+	nextSeq uint64
+	drops   atomic.Uint64
+
+	journal *provideJournal // nil unless the queue is persistent
+}
+
+func newProvideQueue(s *blockService, workers, size int) *provideQueue {
+	if workers <= 0 {
+		workers = 1
+	}
+	if size < 0 {
+		size = 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &provideQueue{
+		s:      s,
+		queue:  make(chan provideTask, size),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if s.promRegistry != nil {
+		registerQueueMetrics(s.promRegistry, "provide", q.stats)
+	}
+	if s.provideDatastore != nil {
+		q.journal = newProvideJournal(s.provideDatastore, s.clock)
+		q.wg.Add(1)
+		go q.replay()
+		if s.promRegistry != nil {
+			q.wg.Add(1)
+			go q.reportBacklogAge(newProvideBacklogAgeGauge(s.promRegistry))
+		}
+	}
+	q.wg.Add(workers)
+	for range workers {
+		go q.worker()
+	}
+	return q
+}
+
+// replay queues the provides left in the journal by a previous run.
+func (q *provideQueue) replay() {
+	defer q.wg.Done()
+	var after string
+	for {
+		entries, last, err := q.journal.next(q.ctx, after)
+		if err != nil {
+			if q.ctx.Err() == nil {
+				logger.Errorf("failed to read the provide journal: %s", err)
+			}
+			return
+		}
+		if last == after {
+			return
+		}
+		after = last
+
+		for _, e := range entries {
+			task := provideTask{cid: e.cid, since: e.since}
+			if e.target >= len(q.s.provideTargets) {
+				// the providers changed since the provide was journaled
+				q.journal.discard(q.ctx, e.journalID)
+				if !q.journal.add(q.ctx, task.journalID()) {
+					continue
+				}
+			} else {
+				if e.target != allTargets {
+					task.target = q.s.provideTargets[e.target]
+				}
+				if !q.journal.replayed(e.journalID, e.since) {
+					continue
+				}
+			}
+			q.started(&task)
+			select {
+			case q.queue <- task:
+			case <-q.ctx.Done():
+				q.journal.done(q.ctx, task.journalID(), false, nil)
+				q.ended(task)
+				return
+			}
+		}
+	}
+}
+
+// enqueue waits for room in the queue, giving up if ctx or the queue is
+// canceled. It reports whether the provide is queued.
+func (q *provideQueue) enqueue(ctx context.Context, task provideTask) bool {
+	if q.journal != nil && !q.journal.add(ctx, task.journalID()) {
+		// already queued
+		return true
+	}
+	task.origin = originOf(ctx)
+	q.started(&task)
+	select {
+	case q.queue <- task:
+		return true
+	case <-ctx.Done():
+	case <-q.ctx.Done():
+	}
+	q.dropped(task)
+	return false
+}
+
+// dropped accounts for a provide which won't happen, it stays in the journal
+// of a persistent queue.
+func (q *provideQueue) dropped(task provideTask) {
+	q.s.stats.providesDropped.Add(1)
+	q.drops.Add(1)
+	if q.journal != nil {
+		q.journal.done(q.ctx, task.journalID(), false, nil)
+	}
+	q.finishedAll(task, ErrProvideDropped)
+	q.ended(task)
+}
+
+// started accounts for a provide entering the queue.
+func (q *provideQueue) started(task *provideTask) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if q.pending == 0 {
+		q.idle = make(chan struct{})
+	}
+	q.pending++
+	q.nextSeq++
+	task.seq = q.nextSeq
+	if task.since.IsZero() {
+		task.since = q.s.clock.Now()
+	}
+	if q.queued == nil {
+		q.queued = make(map[uint64]time.Time)
+	}
+	q.queued[task.seq] = task.since
+}
+
+// ended accounts for a provide leaving the queue, performed or dropped.
+func (q *provideQueue) ended(task provideTask) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	delete(q.queued, task.seq)
+	q.pending--
+	if q.pending == 0 {
+		close(q.idle)
+	}
+}
+
+// drain waits until every queued provide has been performed.
+func (q *provideQueue) drain(ctx context.Context) error {
+	q.lk.Lock()
+	if q.pending == 0 {
+		q.lk.Unlock()
+		return nil
+	}
+	idle := q.idle
+	q.lk.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *provideQueue) worker() {
+	defer q.wg.Done()
+	for {
+		var task provideTask
+		select {
+		case task = <-q.queue:
+		case <-q.ctx.Done():
+			return
+		}
+
+		q.provide(task)
+	}
+}
+
+func (q *provideQueue) provide(task provideTask) {
+	if err := q.s.checkBlocker(task.cid); err != nil {
+		// blocked while queued
+		if q.journal != nil {
+			q.journal.done(q.ctx, task.journalID(), true, nil)
+		}
+		q.finishedAll(task, err)
+		q.ended(task)
+		return
+	}
+	targets := q.s.provideTargets
+	if task.target != nil {
+		targets = []*provideTarget{task.target}
+	}
+	ctx, span := task.origin.startSpan(q.ctx, "provideQueue.provide", attribute.Stringer("CID", task.cid))
+	defer span.End()
+	var failed []int
+	var errs []error
+	// finish reports the end of the provide to t to the waiters of t, those
+	// of the task are notified once every target is done
+	finish := func(t *provideTarget, err error) {
+		if err != nil {
+			failed = append(failed, t.index)
+			errs = append(errs, err)
+		}
+		if task.target == nil {
+			q.finished(journalID{cid: task.cid, target: t.index}, err)
+		}
+	}
+	for _, t := range targets {
+		for {
+			if t.limiter != nil {
+				if err := waitLimiter(ctx, q.s.clock, t.limiter); err != nil {
+					q.dropped(task)
+					return
+				}
+			}
+			err := t.provide(ctx, task.cid)
+			if err != errProviderSuspended {
+				finish(t, err)
+				break
+			}
+			if q.s.providePolicy == ProvideDrop {
+				q.s.stats.providesDropped.Add(1)
+				finish(t, ErrProvideDropped)
+				break
+			}
+			// keep the provide queued until the provider resumes
+			if err := t.backoff.wait(ctx); err != nil {
+				q.dropped(task)
+				return
+			}
+		}
+	}
+	provideErr := errors.Join(errs...)
+	if q.journal != nil {
+		if len(failed) == len(targets) {
+			// retried as a whole by the next run
+			failed = nil
+		}
+		q.journal.done(q.ctx, task.journalID(), provideErr == nil, failed)
+	}
+	q.finished(task.journalID(), provideErr)
+	q.ended(task)
+}
+
+func (q *provideQueue) close(ctx context.Context) {
+	q.cancel()
+	q.wg.Wait()
+	if q.journal != nil {
+		if err := q.journal.checkpoint(ctx); err != nil {
+			logger.Errorf("failed to checkpoint the provide journal: %s", err)
+		}
+	}
+}
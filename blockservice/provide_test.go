@@ -0,0 +1,179 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/provider"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var _ provider.Provider = (*recordingProvider)(nil)
+
+type recordingProvider struct {
+	lk       sync.Mutex
+	provided []cid.Cid
+}
+
+func (p *recordingProvider) Provide(_ context.Context, c cid.Cid, _ bool) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.provided = append(p.provided, c)
+	return nil
+}
+
+func (p *recordingProvider) Provided() []cid.Cid {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return append([]cid.Cid(nil), p.provided...)
+}
+
+func TestProvider(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithProvider(prov))
+
+	blks := random.BlocksOfSize(4, blockSize)
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlocks(ctx, blks[1:2]))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[2:]))
+	_, err := bserv.GetBlock(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[3].Cid()}) {
+	}
+
+	require.Len(t, prov.Provided(), 4)
+	require.Equal(t, prov, bserv.(ProvidingBlockService).Provider())
+}
+
+func TestProvideRateLimitDrop(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProvider(prov), WithProvideRateLimit(0, 1), WithProvidePolicy(ProvideDrop))
+
+	require.NoError(t, bserv.AddBlocks(ctx, random.BlocksOfSize(3, blockSize)))
+	require.Len(t, prov.Provided(), 1)
+	require.EqualValues(t, 2, bserv.(*blockService).Stats(false).ProvidesDropped)
+}
+
+func TestProvideRateLimitWait(t *testing.T) {
+	t.Parallel()
+
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProvider(prov), WithProvideRateLimit(0, 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.NoError(t, bserv.AddBlocks(ctx, random.BlocksOfSize(2, blockSize)))
+	require.Len(t, prov.Provided(), 1)
+	require.EqualValues(t, 1, bserv.(*blockService).Stats(false).ProvidesDropped)
+}
+
+func TestProvideRateLimitQueue(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProvider(prov), WithProvideRateLimit(100, 1), WithProvidePolicy(ProvideQueue))
+	defer bserv.Close()
+
+	require.NoError(t, bserv.AddBlocks(ctx, random.BlocksOfSize(3, blockSize)))
+	require.Eventually(t, func() bool { return len(prov.Provided()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.Zero(t, bserv.(*blockService).Stats(false).ProvidesDropped)
+}
+
+func TestProvideOn(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithProvider(prov), WithProvideOn(ProvideOnAdd))
+
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, exchbstore.PutMany(ctx, blks[1:]))
+	_, err := bserv.GetBlock(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	for range NewSession(ctx, bserv).GetBlocks(ctx, []cid.Cid{blks[2].Cid()}) {
+	}
+	require.Empty(t, prov.Provided(), "fetched blocks must not be provided")
+
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.Equal(t, []cid.Cid{blks[0].Cid()}, prov.Provided())
+}
+
+func TestProvideFilter(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProvider(prov), WithProvideFilter(func(c cid.Cid) bool {
+		return c == blks[1].Cid()
+	}))
+
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+	require.Equal(t, []cid.Cid{blks[1].Cid()}, prov.Provided())
+}
+
+func TestContextWithNoProvide(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &notifyRecordingExchange{Interface: offline.Exchange(exchbstore), notified: make(map[cid.Cid]int)}
+	var filtered atomic.Bool
+	bserv := New(bstore, exch, WithProvider(prov), WithProvideFilter(func(cid.Cid) bool {
+		filtered.Store(true)
+		return true
+	}))
+
+	ctx := ContextWithNoProvide(context.Background())
+	blks := random.BlocksOfSize(4, blockSize)
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlocks(ctx, blks[1:2]))
+	require.NoError(t, exchbstore.PutMany(context.Background(), blks[2:]))
+	_, err := bserv.GetBlock(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[3].Cid()}) {
+	}
+
+	// the blocks are stored and the exchange notified, but never provided
+	require.Empty(t, prov.Provided())
+	require.False(t, filtered.Load())
+	for _, b := range blks {
+		has, err := bstore.Has(context.Background(), b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	exch.lk.Lock()
+	require.Len(t, exch.notified, 4)
+	exch.lk.Unlock()
+
+	for _, name := range []string{"Blockservice.blockService.AddBlock", "Blockservice.blockService.GetBlock"} {
+		require.NotEmpty(t, findSpans(name, attribute.Bool("provide_suppressed", true)), name)
+	}
+}
@@ -0,0 +1,176 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errProviderSuspended is returned by [provideTarget.provide] while the
+// provider is suspended by [WithProvideBackoff].
+var errProviderSuspended = errors.New("provider suspended after consecutive failures")
+
+// WithProvideBackoff suspends the provides to a provider after failures
+// consecutive Provide errors. Once cooldown has elapsed a single provide is
+// attempted as a probe: provides resume if it succeeds, otherwise the provider
+// is suspended for another cooldown.
+// While a provider is suspended its provides are queued with [ProvideQueue] or
+// [WithAsyncProvide], where they wait for the provider to resume, and dropped
+// otherwise. Suspensions are counted in [Stats.ProvideSuspensions].
+func WithProvideBackoff(failures int, cooldown time.Duration) Option {
+	return func(bs *blockService) {
+		if failures <= 0 || cooldown <= 0 {
+			bs.invalidOption("WithProvideBackoff: invalid %d failures and %s cooldown", failures, cooldown)
+			return
+		}
+		bs.provideBackoffFailures = failures
+		bs.provideBackoffCooldown = cooldown
+	}
+}
+
+// provideBackoff is the suspension state of a provider.
+type provideBackoff struct {
+	s         *blockService
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	lk       sync.Mutex
+	failures int       // consecutive failures
+	until    time.Time // end of the suspension, zero when not suspended
+	probing  bool
+	changed  chan struct{} // closed when a probe ends
+}
+
+func (s *blockService) newProvideBackoff(name string) *provideBackoff {
+	if s.provideBackoffFailures == 0 {
+		return nil
+	}
+	return &provideBackoff{
+		s:         s,
+		name:      name,
+		threshold: s.provideBackoffFailures,
+		cooldown:  s.provideBackoffCooldown,
+		changed:   make(chan struct{}),
+	}
+}
+
+// begin reports if a provide may be attempted, probe is true if it is the
+// probe ending a suspension, end must then be called with its result.
+func (b *provideBackoff) begin() (probe, ok bool) {
+	if b == nil {
+		return false, true
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.until.IsZero() {
+		return false, true
+	}
+	if b.probing || b.s.clock.Now().Before(b.until) {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// end records the result of a provide started with begin.
+func (b *provideBackoff) end(probe bool, err error) {
+	if b == nil {
+		return
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if probe {
+		b.endProbeLocked()
+	}
+
+	if err == nil {
+		b.failures = 0
+		if !b.until.IsZero() && probe {
+			b.until = time.Time{}
+			logger.Infof("provider %s recovered, resuming provides", b.name)
+		}
+		return
+	}
+
+	b.failures++
+	switch {
+	case probe:
+		b.until = b.s.clock.Now().Add(b.cooldown)
+		logger.Debugf("provider %s is still failing: %s", b.name, err)
+	case b.until.IsZero() && b.failures >= b.threshold:
+		b.until = b.s.clock.Now().Add(b.cooldown)
+		b.s.stats.provideSuspensions.Add(1)
+		logger.Warnf("provider %s failed %d times in a row, suspending provides for %s: %s", b.name, b.failures, b.cooldown, err)
+	}
+}
+
+// abort ends a provide started with begin without recording its result.
+func (b *provideBackoff) abort(probe bool) {
+	if b == nil || !probe {
+		return
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	b.endProbeLocked()
+}
+
+func (b *provideBackoff) endProbeLocked() {
+	b.probing = false
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// suspended reports if the provider is currently suspended.
+func (b *provideBackoff) suspended() bool {
+	if b == nil {
+		return false
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return !b.until.IsZero()
+}
+
+// blocked reports if begin would refuse a provide right now.
+func (b *provideBackoff) blocked() bool {
+	if b == nil {
+		return false
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return !b.until.IsZero() && (b.probing || b.s.clock.Now().Before(b.until))
+}
+
+// wait waits until a provide may be attempted again.
+func (b *provideBackoff) wait(ctx context.Context) error {
+	b.lk.Lock()
+	until := b.until
+	changed := b.changed
+	probing := b.probing
+	b.lk.Unlock()
+
+	switch {
+	case until.IsZero():
+		return nil
+	case probing:
+		select {
+		case <-changed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	wait := b.s.clock.Until(until)
+	if wait <= 0 {
+		return nil
+	}
+	timer := b.s.clock.Timer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,133 @@
+package blockservice
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyProvider fails while failing is set.
+type flakyProvider struct {
+	recordingProvider
+	failing atomic.Bool
+}
+
+func (p *flakyProvider) Provide(ctx context.Context, c cid.Cid, announce bool) error {
+	p.recordingProvider.Provide(ctx, c, announce)
+	if p.failing.Load() {
+		return errProvide
+	}
+	return nil
+}
+
+func TestWithProvideBackoff(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	const cooldown = time.Minute
+	clk := clock.NewMock()
+	prov := &flakyProvider{}
+	prov.failing.Store(true)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProvider(prov), WithProvideBackoff(2, cooldown), WithClock(clk)).(*blockService)
+
+	blks := random.BlocksOfSize(5, blockSize)
+	for _, b := range blks[:4] {
+		require.NoError(t, bserv.AddBlock(ctx, b))
+	}
+
+	// the provider is suspended after two failures
+	require.Len(t, prov.Provided(), 2)
+	stats := bserv.Stats(false)
+	require.EqualValues(t, 1, stats.ProvideSuspensions)
+	require.Equal(t, 1, stats.ProvidersSuspended)
+	require.EqualValues(t, 2, stats.ProvidesDropped)
+
+	// the probe after the cooldown resumes the provides
+	prov.failing.Store(false)
+	clk.Add(cooldown - time.Second)
+	require.NoError(t, bserv.AddBlock(ctx, blks[4]))
+	require.NotContains(t, prov.Provided(), blks[4].Cid())
+	require.NoError(t, bserv.DeleteBlock(ctx, blks[4].Cid()))
+	clk.Add(time.Second)
+	require.NoError(t, bserv.AddBlock(ctx, blks[4]))
+	require.Contains(t, prov.Provided(), blks[4].Cid())
+	require.Zero(t, bserv.Stats(false).ProvidersSuspended)
+}
+
+func TestWithProvideBackoffFailedProbe(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	const cooldown = time.Minute
+	clk := clock.NewMock()
+	prov := &flakyProvider{}
+	prov.failing.Store(true)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProvider(prov), WithProvideBackoff(1, cooldown), WithClock(clk)).(*blockService)
+
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	clk.Add(cooldown)
+	require.NoError(t, bserv.AddBlock(ctx, blks[1]))
+	require.NoError(t, bserv.AddBlock(ctx, blks[2]))
+
+	// the failed probe starts another cooldown without counting a new suspension
+	require.Equal(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, prov.Provided())
+	require.EqualValues(t, 1, bserv.Stats(false).ProvideSuspensions)
+	require.Equal(t, 1, bserv.Stats(false).ProvidersSuspended)
+}
+
+func TestWithProvideBackoffKeepsQueuedProvides(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	const cooldown = time.Minute
+	clk := clock.NewMock()
+	prov := &flakyProvider{}
+	prov.failing.Store(true)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil,
+		WithProvider(prov),
+		WithProvideBackoff(1, cooldown),
+		WithClock(clk),
+		WithAsyncProvide(1, 16),
+	).(*blockService)
+	defer bserv.Close()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+	require.Eventually(t, func() bool { return bserv.Stats(false).ProvidersSuspended == 1 }, time.Second, time.Millisecond)
+
+	// the queued provides go through once the provider recovers
+	prov.failing.Store(false)
+	require.Eventually(t, func() bool {
+		clk.Add(cooldown)
+		p := prov.Provided()
+		for _, b := range blks[1:] {
+			if !cidsContain(p, b.Cid()) {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond)
+	require.Zero(t, bserv.Stats(false).ProvidesDropped)
+}
+
+func cidsContain(cids []cid.Cid, c cid.Cid) bool {
+	for _, k := range cids {
+		if k == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package blockservice
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// provideJournalBatch is how many journal entries are read at once when
+// replaying the journal.
+const provideJournalBatch = 256
+
+// provideBacklogAgeInterval is how often the backlog age metric is updated.
+const provideBacklogAgeInterval = 10 * time.Second
+
+var provideJournalPrefix = ds.NewKey("/provide-queue")
+
+// WithPersistentProvideQueue journals the CIDs waiting in the provide queue to
+// d, so the provides which did not happen before a restart are performed by the
+// next blockservice using the same datastore.
+// It implies [WithAsyncProvide] with a single worker unless it is set.
+// Entries are removed once provided, a failed provide is retried on the next
+// start, only with the providers of [WithProviders] it failed for.
+func WithPersistentProvideQueue(d ds.Datastore) Option {
+	return func(bs *blockService) {
+		if d == nil {
+			bs.invalidOption("WithPersistentProvideQueue: nil datastore")
+			return
+		}
+		bs.provideDatastore = d
+	}
+}
+
+// provideJournal stores the pending provides in a datastore, it also tracks
+// the provides queued by this process to skip the duplicates. The provides are
+// keyed by CID and target, the index of the provider in
+// [blockService.provideTargets] or allTargets.
+type provideJournal struct {
+	ds    ds.Datastore
+	clock clock.Clock
+
+	lk     sync.Mutex
+	queued map[journalID]time.Time // queued or in-flight, with the time they were journaled
+}
+
+// allTargets is the target of the provides to every provider.
+const allTargets = -1
+
+// journalID identifies a provide in a [provideJournal].
+type journalID struct {
+	cid    cid.Cid
+	target int
+}
+
+func newProvideJournal(d ds.Datastore, clk clock.Clock) *provideJournal {
+	return &provideJournal{
+		ds:     d,
+		clock:  clk,
+		queued: make(map[journalID]time.Time),
+	}
+}
+
+// journalKey is /provide-queue/<cid> for the provides to every provider and
+// /provide-queue/<cid>/<target> otherwise.
+func journalKey(id journalID) ds.Key {
+	k := provideJournalPrefix.ChildString(id.cid.String())
+	if id.target == allTargets {
+		return k
+	}
+	return k.ChildString(strconv.Itoa(id.target))
+}
+
+// add journals id, it returns false if it is already queued.
+func (j *provideJournal) add(ctx context.Context, id journalID) bool {
+	j.lk.Lock()
+	defer j.lk.Unlock()
+	if _, ok := j.queued[id]; ok {
+		return false
+	}
+	j.queued[id] = j.journal(ctx, id, j.clock.Now())
+	return true
+}
+
+// journal writes the entry of id unless a previous run left one, it returns
+// the time the provide was first journaled.
+func (j *provideJournal) journal(ctx context.Context, id journalID, since time.Time) time.Time {
+	k := journalKey(id)
+	if v, err := j.ds.Get(ctx, k); err == nil && len(v) == 8 {
+		// keep the age of the entry left by a previous run
+		return time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	}
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], uint64(since.UnixNano()))
+	if err := j.ds.Put(ctx, k, v[:]); err != nil {
+		logger.Errorf("failed to journal the provide of %s: %s", id.cid, err)
+	}
+	return since
+}
+
+// replayed marks id read from the journal as queued, it returns false if it
+// already is.
+func (j *provideJournal) replayed(id journalID, since time.Time) bool {
+	j.lk.Lock()
+	defer j.lk.Unlock()
+	if _, ok := j.queued[id]; ok {
+		return false
+	}
+	j.queued[id] = since
+	return true
+}
+
+// done forgets id, removing it from the journal if it was provided. A provide
+// to every provider which only failed for the targets of failed is replaced by
+// one entry per failed target, so the next run only retries those.
+func (j *provideJournal) done(ctx context.Context, id journalID, provided bool, failed []int) {
+	j.lk.Lock()
+	since := j.queued[id]
+	delete(j.queued, id)
+	j.lk.Unlock()
+	if !provided && len(failed) == 0 {
+		return
+	}
+	for _, target := range failed {
+		j.journal(ctx, journalID{cid: id.cid, target: target}, since)
+	}
+	j.discard(ctx, id)
+}
+
+// discard removes id from the journal.
+func (j *provideJournal) discard(ctx context.Context, id journalID) {
+	if err := j.ds.Delete(ctx, journalKey(id)); err != nil {
+		logger.Errorf("failed to remove %s from the provide journal: %s", id.cid, err)
+	}
+}
+
+// backlogAge returns the age of the oldest queued provide.
+func (j *provideJournal) backlogAge() time.Duration {
+	j.lk.Lock()
+	defer j.lk.Unlock()
+	var oldest time.Time
+	for _, since := range j.queued {
+		if oldest.IsZero() || since.Before(oldest) {
+			oldest = since
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return j.clock.Since(oldest)
+}
+
+// journalEntry is a provide read back from the journal.
+type journalEntry struct {
+	journalID
+	since time.Time
+}
+
+// next reads up to provideJournalBatch entries with a key after the given one,
+// it also returns the last key read.
+func (j *provideJournal) next(ctx context.Context, after string) ([]journalEntry, string, error) {
+	q := query.Query{
+		Prefix: provideJournalPrefix.String(),
+		Orders: []query.Order{query.OrderByKey{}},
+		Limit:  provideJournalBatch,
+	}
+	if after != "" {
+		q.Filters = []query.Filter{query.FilterKeyCompare{Op: query.GreaterThan, Key: after}}
+	}
+	res, err := j.ds.Query(ctx, q)
+	if err != nil {
+		return nil, after, err
+	}
+	defer res.Close()
+
+	var entries []journalEntry
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, after, r.Error
+		}
+		after = r.Key
+		e := journalEntry{since: j.clock.Now()}
+		e.journalID, err = parseJournalKey(ds.RawKey(r.Key))
+		if err != nil {
+			logger.Errorf("invalid provide journal entry %q: %s", r.Key, err)
+			continue
+		}
+		if len(r.Value) == 8 {
+			e.since = time.Unix(0, int64(binary.BigEndian.Uint64(r.Value)))
+		}
+		entries = append(entries, e)
+	}
+	return entries, after, nil
+}
+
+// parseJournalKey is the reverse of journalKey.
+func parseJournalKey(k ds.Key) (journalID, error) {
+	ns := k.Namespaces()[len(provideJournalPrefix.Namespaces()):]
+	if len(ns) == 0 || len(ns) > 2 {
+		return journalID{}, errors.New("unexpected key depth")
+	}
+	id := journalID{target: allTargets}
+	var err error
+	if id.cid, err = cid.Decode(ns[0]); err != nil {
+		return journalID{}, err
+	}
+	if len(ns) == 2 {
+		if id.target, err = strconv.Atoi(ns[1]); err != nil || id.target < 0 {
+			return journalID{}, fmt.Errorf("invalid target %q", ns[1])
+		}
+	}
+	return id, nil
+}
+
+// checkpoint flushes the journal to disk.
+func (j *provideJournal) checkpoint(ctx context.Context) error {
+	return j.ds.Sync(ctx, provideJournalPrefix)
+}
+
+// reportBacklogAge periodically updates the backlog age metric.
+func (q *provideQueue) reportBacklogAge(gauge prometheus.Gauge) {
+	defer q.wg.Done()
+	ticker := q.s.clock.Ticker(provideBacklogAgeInterval)
+	defer ticker.Stop()
+	for {
+		gauge.Set(q.journal.backlogAge().Seconds())
+		select {
+		case <-ticker.C:
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
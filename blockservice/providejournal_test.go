@@ -0,0 +1,126 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingProvider counts the provides and waits until its context is
+// canceled, failing them.
+type blockingProvider struct {
+	started chan cid.Cid
+}
+
+func (p *blockingProvider) Provide(ctx context.Context, c cid.Cid, _ bool) error {
+	p.started <- c
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func journalLen(t *testing.T, d ds.Datastore) int {
+	t.Helper()
+	res, err := d.Query(context.Background(), query.Query{Prefix: provideJournalPrefix.String(), KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	return len(entries)
+}
+
+func TestPersistentProvideQueue(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	journal := dssync.MutexWrap(ds.NewMapDatastore())
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+
+	blocking := &blockingProvider{started: make(chan cid.Cid, 10)}
+	bserv := New(bstore, nil, WriteThrough(), WithProvider(blocking),
+		WithPersistentProvideQueue(journal), WithCloseTimeout(10*time.Millisecond))
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+	<-blocking.started
+	// adding a queued block again doesn't queue it twice
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	q := bserv.(*blockService).provideQueue
+	q.lk.Lock()
+	require.Equal(t, 3, q.pending)
+	q.lk.Unlock()
+	require.Equal(t, 3, journalLen(t, journal))
+	require.NoError(t, bserv.Close())
+	require.Equal(t, 3, journalLen(t, journal), "failed provides stay in the journal")
+
+	// the next blockservice performs the provides left behind
+	prov := &recordingProvider{}
+	bserv = New(bstore, nil, WithProvider(prov), WithPersistentProvideQueue(journal))
+	defer bserv.Close()
+	require.Eventually(t, func() bool { return len(prov.Provided()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}, prov.Provided())
+	require.Eventually(t, func() bool { return journalLen(t, journal) == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPersistentProvideQueueFailedTarget(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	journal := dssync.MutexWrap(ds.NewMapDatastore())
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+
+	ok, failing := &recordingProvider{}, &failingProvider{}
+	bserv := New(bstore, nil, WithProviders(ok, failing), WithPersistentProvideQueue(journal)).(*blockService)
+	require.NoError(t, bserv.AddBlock(ctx, blk))
+	require.NoError(t, bserv.provideQueue.drain(ctx))
+	require.Equal(t, []cid.Cid{blk.Cid()}, ok.Provided())
+	require.Equal(t, []cid.Cid{blk.Cid()}, failing.Provided())
+	require.NoError(t, bserv.Close())
+
+	// only the provide to the failed target is left
+	res, err := journal.Query(ctx, query.Query{Prefix: provideJournalPrefix.String(), KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, journalKey(journalID{cid: blk.Cid(), target: 1}).String(), entries[0].Key)
+
+	first, second := &recordingProvider{}, &recordingProvider{}
+	bserv = New(bstore, nil, WithProviders(first, second), WithPersistentProvideQueue(journal)).(*blockService)
+	defer bserv.Close()
+	require.Eventually(t, func() bool { return journalLen(t, journal) == 0 }, 5*time.Second, 10*time.Millisecond)
+	require.Empty(t, first.Provided())
+	require.Equal(t, []cid.Cid{blk.Cid()}, second.Provided())
+}
+
+func TestProvideJournalTargets(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	c := random.BlocksOfSize(1, blockSize)[0].Cid()
+	d := dssync.MutexWrap(ds.NewMapDatastore())
+	j := newProvideJournal(d, clock.New())
+
+	// the provides of a CID to different targets are distinct
+	first, second := journalID{cid: c, target: 0}, journalID{cid: c, target: 1}
+	require.True(t, j.add(ctx, first))
+	require.True(t, j.add(ctx, second))
+	require.False(t, j.add(ctx, second))
+	require.Equal(t, 2, journalLen(t, d))
+
+	j.done(ctx, first, true, nil)
+	j.done(ctx, second, false, nil)
+	require.Equal(t, 1, journalLen(t, d))
+
+	entries, _, err := j.next(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, second, entries[0].journalID)
+}
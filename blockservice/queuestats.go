@@ -0,0 +1,96 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// QueueStats describes the backlog of a background queue of the blockservice.
+type QueueStats struct {
+	// Depth is the number of items queued or being processed.
+	Depth int
+	// OldestAge is how long the oldest item has been waiting, 0 when the queue
+	// is empty.
+	OldestAge time.Duration
+	// Dropped counts the items which left the queue without being processed.
+	Dropped uint64
+}
+
+// IdleWaiter is implemented by the blockservices owning background queues.
+type IdleWaiter interface {
+	// WaitIdle waits until every background queue is empty, like the provide
+	// queue of [WithAsyncProvide] or the notifications of
+	// [WithNotifyCoalescing], or returns the error of ctx if it expires first.
+	// Items queued meanwhile are waited for too.
+	WaitIdle(ctx context.Context) error
+}
+
+var _ IdleWaiter = (*blockService)(nil)
+
+func (s *blockService) WaitIdle(ctx context.Context) error {
+	if err := s.notifier.waitIdle(ctx); err != nil {
+		return err
+	}
+	if s.provideQueue == nil {
+		return nil
+	}
+	return s.provideQueue.drain(ctx)
+}
+
+// stats returns the backlog of the queue, a nil queue is empty.
+func (q *provideQueue) stats() QueueStats {
+	if q == nil {
+		return QueueStats{}
+	}
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	var oldest time.Time
+	for _, since := range q.queued {
+		if oldest.IsZero() || since.Before(oldest) {
+			oldest = since
+		}
+	}
+	st := QueueStats{Depth: q.pending, Dropped: q.drops.Load()}
+	if !oldest.IsZero() {
+		st.OldestAge = q.s.clock.Since(oldest)
+	}
+	return st
+}
+
+// registerQueueMetrics registers the ipfs_blockservice_queue_* metrics of the
+// queue named name, computed from stats when scraped.
+func registerQueueMetrics(reg prometheus.Registerer, name string, stats func() QueueStats) {
+	labels := prometheus.Labels{"queue": name}
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "ipfs",
+			Subsystem:   "blockservice",
+			Name:        "queue_depth",
+			Help:        "Number of items queued or being processed by a background queue of the blockservice.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().Depth) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "ipfs",
+			Subsystem:   "blockservice",
+			Name:        "queue_oldest_age_seconds",
+			Help:        "Age of the oldest item of a background queue of the blockservice.",
+			ConstLabels: labels,
+		}, func() float64 { return stats().OldestAge.Seconds() }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   "ipfs",
+			Subsystem:   "blockservice",
+			Name:        "queue_dropped_total",
+			Help:        "Number of items dropped by a background queue of the blockservice.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().Dropped) }),
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				logger.Errorf("failed to register the metrics of the %s queue: %v", name, err)
+			}
+		}
+	}
+}
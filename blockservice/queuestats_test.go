@@ -0,0 +1,82 @@
+package blockservice
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedProvider holds the provides until the gate is closed.
+type gatedProvider struct {
+	recordingProvider
+	gate chan struct{}
+}
+
+func (p *gatedProvider) Provide(ctx context.Context, c cid.Cid, announce bool) error {
+	select {
+	case <-p.gate:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.recordingProvider.Provide(ctx, c, announce)
+}
+
+func TestProvideQueueStats(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	reg := prometheus.NewRegistry()
+	prov := &gatedProvider{gate: make(chan struct{})}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	clk := clock.NewMock()
+	bserv := New(bstore, nil, WithProvider(prov), WithAsyncProvide(1, 1), WithPrometheusRegistry(reg), WithClock(clk)).(*blockService)
+	defer bserv.Close()
+
+	require.Equal(t, QueueStats{}, bserv.Stats(false).ProvideQueue)
+	require.NoError(t, bserv.WaitIdle(ctx))
+
+	// one provide held by the worker, one in the queue
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, bserv.AddBlocks(ctx, blks[:2]))
+	clk.Add(time.Minute)
+	st := bserv.Stats(false).ProvideQueue
+	require.Equal(t, 2, st.Depth)
+	require.Equal(t, time.Minute, st.OldestAge)
+
+	// a provide given up while waiting for room is dropped
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	bserv.provideQueue.enqueue(canceled, provideTask{cid: blks[2].Cid()})
+	require.EqualValues(t, 1, bserv.Stats(false).ProvideQueue.Dropped)
+
+	expected := `
+# HELP ipfs_blockservice_queue_depth Number of items queued or being processed by a background queue of the blockservice.
+# TYPE ipfs_blockservice_queue_depth gauge
+ipfs_blockservice_queue_depth{queue="provide"} 2
+# HELP ipfs_blockservice_queue_dropped_total Number of items dropped by a background queue of the blockservice.
+# TYPE ipfs_blockservice_queue_dropped_total counter
+ipfs_blockservice_queue_dropped_total{queue="provide"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "ipfs_blockservice_queue_depth", "ipfs_blockservice_queue_dropped_total"))
+	require.Equal(t, 1, testutil.CollectAndCount(reg, "ipfs_blockservice_queue_oldest_age_seconds"))
+
+	tctx, tcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer tcancel()
+	require.ErrorIs(t, bserv.WaitIdle(tctx), context.DeadlineExceeded)
+
+	close(prov.gate)
+	require.NoError(t, bserv.WaitIdle(ctx))
+	require.Len(t, prov.Provided(), 2)
+	require.Equal(t, QueueStats{Dropped: 1}, bserv.Stats(false).ProvideQueue)
+}
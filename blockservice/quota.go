@@ -0,0 +1,89 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+// ErrQuotaExceeded is returned by the writes refused because they would
+// exceed the quota of [ContextWithWriteQuota]. The blocks written before are
+// kept.
+type ErrQuotaExceeded struct {
+	// Requested is the size of the refused write.
+	Requested int64
+	// Consumed and Remaining are the bytes of the quota used and left when
+	// the write was refused.
+	Consumed  int64
+	Remaining int64
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("write quota exceeded: %d bytes requested, %d bytes left after writing %d", e.Requested, e.Remaining, e.Consumed)
+}
+
+// Is matches any ErrQuotaExceeded.
+func (e ErrQuotaExceeded) Is(err error) bool {
+	_, ok := err.(ErrQuotaExceeded)
+	return ok
+}
+
+// QuotaHandle tracks the bytes written under a quota of
+// [ContextWithWriteQuota], it can be shared by concurrent calls.
+type QuotaHandle struct {
+	max  int64
+	used atomic.Int64
+}
+
+// Consumed returns the bytes written under the quota, including the writes in
+// progress.
+func (h *QuotaHandle) Consumed() int64 {
+	return h.used.Load()
+}
+
+// Remaining returns the bytes which can still be written under the quota.
+func (h *QuotaHandle) Remaining() int64 {
+	return h.max - h.used.Load()
+}
+
+// reserve takes n bytes of the quota, or fails if they are not left.
+func (h *QuotaHandle) reserve(n int64) error {
+	for {
+		used := h.used.Load()
+		if used+n > h.max {
+			return ErrQuotaExceeded{Requested: n, Consumed: used, Remaining: h.max - used}
+		}
+		if h.used.CompareAndSwap(used, used+n) {
+			return nil
+		}
+	}
+}
+
+type writeQuotaKey struct{}
+
+// ContextWithWriteQuota limits the bytes AddBlock, AddBlocks and
+// AddBlocksAtomic can write with the returned context, and the contexts
+// derived from it, to maxBytes. Only the blocks actually written count, not
+// the ones already stored. The writes which don't fit entirely in what is
+// left fail with [ErrQuotaExceeded]: AddBlocks then keeps its previous
+// batches, see [WithMaxBatchSize].
+func ContextWithWriteQuota(ctx context.Context, maxBytes int64) (context.Context, *QuotaHandle) {
+	h := &QuotaHandle{max: max(maxBytes, 0)}
+	return context.WithValue(ctx, writeQuotaKey{}, h), h
+}
+
+// reserveQuota takes the size of bs from the quota of ctx, if any. The
+// returned function gives it back, for writes which failed.
+func reserveQuota(ctx context.Context, bs ...blocks.Block) (func(), error) {
+	h, _ := ctx.Value(writeQuotaKey{}).(*QuotaHandle)
+	if h == nil {
+		return func() {}, nil
+	}
+	n := int64(blocksSize(bs))
+	if err := h.reserve(n); err != nil {
+		return nil, err
+	}
+	return func() { h.used.Add(-n) }, nil
+}
@@ -0,0 +1,87 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteQuota(t *testing.T) {
+	t.Parallel()
+
+	bstore := &flakyBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), err: errors.New("disk full")}
+	bserv := New(bstore, nil, WithMaxBatchSize(2, 0))
+	blks := random.BlocksOfSize(8, blockSize)
+
+	ctx, quota := ContextWithWriteQuota(context.Background(), 4*blockSize)
+	require.EqualValues(t, 4*blockSize, quota.Remaining())
+
+	// failed writes don't consume the quota
+	bstore.failures = 1
+	require.Error(t, bserv.AddBlock(ctx, blks[0]))
+	require.Zero(t, quota.Consumed())
+
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	// the blocks already stored are free
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.EqualValues(t, blockSize, quota.Consumed())
+
+	err := bserv.AddBlocks(ctx, blks[:6])
+	var partial *PartialWriteError
+	require.ErrorAs(t, err, &partial)
+	require.Equal(t, 2, partial.Written)
+	require.ErrorIs(t, err, ErrQuotaExceeded{})
+	require.Equal(t, ErrQuotaExceeded{Requested: 2 * blockSize, Consumed: 3 * blockSize, Remaining: blockSize}, partial.Err)
+	// the blocks written before are kept
+	for i, b := range blks[:6] {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.Equal(t, i < 3, has)
+	}
+
+	require.NoError(t, bserv.AddBlock(ctx, blks[3]))
+	require.Zero(t, quota.Remaining())
+	require.ErrorIs(t, bserv.AddBlock(ctx, blks[6]), ErrQuotaExceeded{})
+
+	// other contexts are not limited
+	require.NoError(t, bserv.AddBlock(context.Background(), blks[7]))
+}
+
+func TestWriteQuotaConcurrent(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil)
+	ctx, quota := ContextWithWriteQuota(context.Background(), 10*blockSize)
+
+	blks := random.BlocksOfSize(40, blockSize)
+	var wg sync.WaitGroup
+	var lk sync.Mutex
+	var written, refused int
+	for i := 0; i < len(blks); i += 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := bserv.AddBlocks(ctx, blks[i:i+2])
+			lk.Lock()
+			defer lk.Unlock()
+			if err == nil {
+				written++
+			} else {
+				require.ErrorIs(t, err, ErrQuotaExceeded{})
+				refused++
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 5, written)
+	require.Equal(t, 15, refused)
+	require.EqualValues(t, 10*blockSize, quota.Consumed())
+}
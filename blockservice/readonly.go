@@ -0,0 +1,35 @@
+package blockservice
+
+import (
+	"errors"
+)
+
+// ErrReadOnly is returned by the write operations of a blockservice in
+// read-only mode.
+var ErrReadOnly = errors.New("blockservice is read-only")
+
+// WithReadOnly starts the blockservice in read-only mode, it can be switched
+// off with SetReadOnly.
+func WithReadOnly() Option {
+	return func(bs *blockService) {
+		bs.readOnly.Store(true)
+	}
+}
+
+// SetReadOnly switches the read-only mode. While read-only AddBlock, AddBlocks
+// and DeleteBlock fail with [ErrReadOnly], blocks can still be read and
+// fetched from the exchange but fetched blocks are not written to the
+// blockstore, announced to the exchange nor provided.
+func (s *blockService) SetReadOnly(readOnly bool) {
+	s.readOnly.Store(readOnly)
+}
+
+// ReadOnly reports whether the blockservice is in read-only mode.
+func (s *blockService) ReadOnly() bool {
+	return s.readOnly.Load()
+}
+
+// isReadOnly is ReadOnly handling a nil receiver.
+func (s *blockService) isReadOnly() bool {
+	return s != nil && s.readOnly.Load()
+}
@@ -0,0 +1,52 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnly(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, blks[0]))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[1:3]))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithReadOnly()).(*blockService)
+	require.True(t, bserv.ReadOnly())
+	require.True(t, bserv.Check(ctx).ReadOnly)
+
+	require.ErrorIs(t, bserv.AddBlock(ctx, blks[3]), ErrReadOnly)
+	require.ErrorIs(t, bserv.AddBlocks(ctx, blks[3:]), ErrReadOnly)
+	require.ErrorIs(t, bserv.DeleteBlock(ctx, blks[0].Cid()), ErrReadOnly)
+
+	// reads and fetches still work, without caching
+	_, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	_, err = bserv.GetBlock(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	var n int
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[2].Cid()}) {
+		n++
+	}
+	require.Equal(t, 1, n)
+	for _, b := range blks[1:] {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+
+	bserv.SetReadOnly(false)
+	require.False(t, bserv.Check(ctx).ReadOnly)
+	require.NoError(t, bserv.AddBlock(ctx, blks[3]))
+}
@@ -0,0 +1,56 @@
+package blockservice
+
+import (
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/go-cid"
+)
+
+// WithRecentCIDCache keeps the last entries CIDs written to or read from the
+// blockstore in memory, so adding them again skips the blockstore Has check.
+// Blocks deleted with DeleteBlock are evicted, but blocks removed from the
+// blockstore directly, by the garbage collector for example, are not: only use
+// it when deletions go through the blockservice.
+// The hit rate is reported by Stats.
+func WithRecentCIDCache(entries int) Option {
+	return func(bs *blockService) {
+		if entries <= 0 {
+			bs.invalidOption("WithRecentCIDCache: the size must be positive, got %d", entries)
+			return
+		}
+		cache, err := lru.New[cid.Cid, struct{}](entries)
+		if err != nil {
+			bs.invalidOption("WithRecentCIDCache: %s", err)
+			return
+		}
+		bs.recentCIDs = cache
+	}
+}
+
+// recentlyStored reports whether c is known to be in the blockstore.
+func (s *blockService) recentlyStored(c cid.Cid) bool {
+	if s == nil || s.recentCIDs == nil {
+		return false
+	}
+	if s.recentCIDs.Contains(c) {
+		s.stats.recentCacheHits.Add(1)
+		return true
+	}
+	s.stats.recentCacheMisses.Add(1)
+	return false
+}
+
+// markStored records c is in the blockstore.
+func (s *blockService) markStored(c cid.Cid) {
+	if s == nil || s.recentCIDs == nil {
+		return
+	}
+	s.recentCIDs.Add(c, struct{}{})
+}
+
+// forgetStored records c has been removed from the blockstore.
+func (s *blockService) forgetStored(c cid.Cid) {
+	if s == nil || s.recentCIDs == nil {
+		return
+	}
+	s.recentCIDs.Remove(c)
+}
@@ -0,0 +1,57 @@
+package blockservice
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+type hasCountingBlockstore struct {
+	blockstore.Blockstore
+	hasCount atomic.Int64
+}
+
+func (bs *hasCountingBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	bs.hasCount.Add(1)
+	return bs.Blockstore.Has(ctx, c)
+}
+
+func TestRecentCIDCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	bstore := &hasCountingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	require.NoError(t, bstore.Put(ctx, blks[2]))
+	bserv := New(bstore, nil, WithRecentCIDCache(16)).(*blockService)
+
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.EqualValues(t, 1, bstore.hasCount.Load())
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlocks(ctx, blks[:1]))
+	require.EqualValues(t, 1, bstore.hasCount.Load(), "recently added blocks skip Has")
+
+	// local reads populate the cache too
+	_, err := bserv.GetBlock(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.NoError(t, bserv.AddBlock(ctx, blks[2]))
+	require.EqualValues(t, 1, bstore.hasCount.Load())
+
+	require.NoError(t, bserv.DeleteBlock(ctx, blks[0].Cid()))
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.EqualValues(t, 2, bstore.hasCount.Load(), "deleted blocks are evicted")
+	has, err := bstore.Blockstore.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	stats := bserv.Stats(false)
+	require.EqualValues(t, 3, stats.RecentCacheHits)
+	require.EqualValues(t, 2, stats.RecentCacheMisses)
+}
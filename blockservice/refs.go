@@ -0,0 +1,97 @@
+package blockservice
+
+import (
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+const defaultSessionRefsLimit = 1024
+
+// WithSessionRefsLimit sets how many CIDs each [Session] remembers for
+// [Session.Refs], for the requested and the received CIDs separately.
+// 0 disables the tracking, the default is 1024.
+func WithSessionRefsLimit(n int) Option {
+	return func(bs *blockService) {
+		if n < 0 {
+			bs.invalidOption("WithSessionRefsLimit: negative limit %d", n)
+			return
+		}
+		bs.sessionRefsLimit = n
+	}
+}
+
+func (s *blockService) getSessionRefsLimit() int {
+	if s == nil {
+		return defaultSessionRefsLimit
+	}
+	return s.sessionRefsLimit
+}
+
+// sessionRefs remembers the first CIDs requested and received by a [Session].
+type sessionRefs struct {
+	lk        sync.Mutex
+	limit     int
+	requested refSet
+	received  refSet
+}
+
+type refSet struct {
+	seen     map[cid.Cid]struct{}
+	order    []cid.Cid
+	overflow bool
+}
+
+func (r *refSet) add(limit int, c cid.Cid) {
+	if _, ok := r.seen[c]; ok {
+		return
+	}
+	if len(r.order) >= limit {
+		r.overflow = true
+		return
+	}
+	if r.seen == nil {
+		r.seen = make(map[cid.Cid]struct{})
+	}
+	r.seen[c] = struct{}{}
+	r.order = append(r.order, c)
+}
+
+func (r *sessionRefs) addRequested(ks ...cid.Cid) {
+	if r.limit == 0 {
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	for _, k := range ks {
+		r.requested.add(r.limit, k)
+	}
+}
+
+func (r *sessionRefs) addReceived(c cid.Cid) {
+	if r.limit == 0 {
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.received.add(r.limit, c)
+}
+
+// Refs returns the CIDs requested through the session and the ones it received,
+// in the order they were first seen. Only the first CIDs up to the limit set
+// with [WithSessionRefsLimit] are remembered, see [Session.RefsOverflowed].
+func (s *Session) Refs() (requested, received []cid.Cid) {
+	s.refs.lk.Lock()
+	defer s.refs.lk.Unlock()
+	requested = append([]cid.Cid(nil), s.refs.requested.order...)
+	received = append([]cid.Cid(nil), s.refs.received.order...)
+	return requested, received
+}
+
+// RefsOverflowed reports whether [Session.Refs] is incomplete because more
+// CIDs than the limit were seen.
+func (s *Session) RefsOverflowed() bool {
+	s.refs.lk.Lock()
+	defer s.refs.lk.Unlock()
+	return s.refs.requested.overflow || s.refs.received.overflow
+}
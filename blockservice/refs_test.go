@@ -0,0 +1,71 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionRefs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(20, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	// the last 5 blocks are missing everywhere
+	require.NoError(t, exchbstore.PutMany(ctx, blks[:15]))
+	ses := NewSession(ctx, New(bstore, offline.Exchange(exchbstore)))
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var ks []cid.Cid
+			for _, b := range blks[i*5 : (i+1)*5] {
+				ks = append(ks, b.Cid())
+			}
+			for range ses.GetBlocks(ctx, ks) {
+			}
+		}()
+	}
+	wg.Wait()
+
+	requested, received := ses.Refs()
+	var want []cid.Cid
+	for _, b := range blks {
+		want = append(want, b.Cid())
+	}
+	require.ElementsMatch(t, want, requested)
+	require.ElementsMatch(t, want[:15], received)
+	require.False(t, ses.RefsOverflowed())
+}
+
+func TestSessionRefsLimit(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.PutMany(ctx, blks))
+	ses := NewSession(ctx, New(bstore, nil, WithSessionRefsLimit(2)))
+
+	for _, b := range blks {
+		_, err := ses.GetBlock(ctx, b.Cid())
+		require.NoError(t, err)
+	}
+
+	requested, received := ses.Refs()
+	require.Equal(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, requested)
+	require.Equal(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, received)
+	require.True(t, ses.RefsOverflowed())
+}
@@ -0,0 +1,136 @@
+package blockservice
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// Values used for the operation label of the allowlist rejections, see
+// [RejectedCid].
+const (
+	opGet      = "get"
+	opGetMany  = "get-many"
+	opAdd      = "add"
+	opAddMany  = "add-many"
+	opValidate = "validate"
+)
+
+// RejectionTopK is the number of CIDs returned by
+// [RejectionInspector.TopRejected].
+const RejectionTopK = 16
+
+// rejectionTrackSize is the number of recently rejected CIDs counted, the
+// least recently rejected one is forgotten to make room.
+const rejectionTrackSize = 4 * RejectionTopK
+
+// RejectedCid is a CID rejected by the allowlist, or the [SecurityPolicy].
+type RejectedCid struct {
+	Cid cid.Cid
+	// Count is the number of rejections since the CID was last forgotten.
+	Count uint64
+	// Operation is the one of the last rejection: "get", "get-many", "add",
+	// "add-many", or "validate" for the calls of [ValidatingBlockService].
+	Operation string
+	// Last is the time of the last rejection.
+	Last time.Time
+}
+
+// RejectionInspector is implemented by the blockservices reporting the CIDs
+// they reject, to find the clients asking for hashes no longer allowed.
+// The rejections are also counted by the AllowlistRejections stat and the
+// ipfs_blockservice_allowlist_rejections_total metric, labelled with the
+// hash function and the operation.
+type RejectionInspector interface {
+	// TopRejected returns the most rejected of the recently rejected CIDs,
+	// by decreasing count, at most [RejectionTopK] of them.
+	TopRejected() []RejectedCid
+}
+
+var _ RejectionInspector = (*blockService)(nil)
+
+func (s *blockService) TopRejected() []RejectedCid {
+	return s.rejections.top(RejectionTopK)
+}
+
+// rejectionTracker counts the rejections of the last rejectionTrackSize
+// rejected CIDs.
+type rejectionTracker struct {
+	lk     sync.Mutex
+	recent map[cid.Cid]*RejectedCid
+}
+
+func (t *rejectionTracker) add(c cid.Cid, op string, now time.Time) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	if r, ok := t.recent[c]; ok {
+		r.Count++
+		r.Operation, r.Last = op, now
+		return
+	}
+	if t.recent == nil {
+		t.recent = make(map[cid.Cid]*RejectedCid, rejectionTrackSize)
+	}
+	if len(t.recent) >= rejectionTrackSize {
+		var oldest *RejectedCid
+		for _, r := range t.recent {
+			if oldest == nil || r.Last.Before(oldest.Last) {
+				oldest = r
+			}
+		}
+		delete(t.recent, oldest.Cid)
+	}
+	t.recent[c] = &RejectedCid{Cid: c, Count: 1, Operation: op, Last: now}
+}
+
+func (t *rejectionTracker) top(k int) []RejectedCid {
+	t.lk.Lock()
+	top := make([]RejectedCid, 0, len(t.recent))
+	for _, r := range t.recent {
+		top = append(top, *r)
+	}
+	t.lk.Unlock()
+	slices.SortFunc(top, func(a, b RejectedCid) int {
+		if a.Count != b.Count {
+			if a.Count > b.Count {
+				return -1
+			}
+			return 1
+		}
+		return b.Last.Compare(a.Last)
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+// rejected records the rejection of c by the allowlist during op, it is a
+// no-op when s is not backed by this package.
+func (s *blockService) rejected(op string, c cid.Cid) {
+	if s == nil {
+		return
+	}
+	s.stats.allowlistRejections.Add(1)
+	s.rejections.add(c, op, s.clock.Now())
+	if s.metrics != nil {
+		s.metrics.allowlistRejections.WithLabelValues(hashLabel(c), op).Inc()
+	}
+}
+
+// hashLabel returns a bounded label value for the hash function of c.
+func hashLabel(c cid.Cid) string {
+	switch code := c.Prefix().MhType; code {
+	case mh.IDENTITY, mh.SHA1, mh.SHA2_256, mh.SHA2_512, mh.SHA3_224, mh.SHA3_256,
+		mh.SHA3_384, mh.SHA3_512, mh.KECCAK_256, mh.KECCAK_512, mh.BLAKE3,
+		mh.BLAKE2B_MIN + 31, mh.BLAKE2B_MAX, mh.BLAKE2S_MIN + 31, mh.MD5,
+		mh.DBL_SHA2_256, mh.MURMUR3X64_64, mh.SHA2_256_TRUNC254_PADDED,
+		mh.POSEIDON_BLS12_381_A1_FC1, mh.X11:
+		return mh.Codes[code]
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,111 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/multiformats/go-multihash"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowlistRejections(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	sha1 := blockWithHash(t, []byte("sha1"), multihash.SHA1)
+	blake3 := blockWithHash(t, []byte("blake3"), multihash.BLAKE3)
+	// a hash without a label of its own, not registered in go-multihash
+	keccakHash, err := multihash.Encode(make([]byte, 28), multihash.KECCAK_224)
+	require.NoError(t, err)
+	keccak, err := blocks.NewBlockWithCid([]byte("keccak"), cid.NewCidV1(cid.Raw, keccakHash))
+	require.NoError(t, err)
+	sha512 := blockWithHash(t, []byte("sha512"), multihash.SHA2_512)
+
+	clk := clock.NewMock()
+	reg := prometheus.NewRegistry()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(bstore),
+		WithAllowlist(verifcid.NewAllowlist(map[uint64]bool{multihash.SHA2_256: true, multihash.SHA2_512: true})),
+		WithPrometheusRegistry(reg),
+		WithClock(clk),
+	).(*blockService)
+
+	_, err = bserv.GetBlock(ctx, sha1.Cid())
+	require.Error(t, err)
+	clk.Add(time.Second)
+	for range bserv.GetBlocks(ctx, []cid.Cid{sha1.Cid(), blake3.Cid()}) {
+	}
+	clk.Add(time.Second)
+	require.Error(t, bserv.AddBlock(ctx, keccak))
+	require.Error(t, bserv.AddBlocks(ctx, []blocks.Block{blake3}))
+	_, err = bserv.GetSize(ctx, blake3.Cid())
+	require.Error(t, err)
+	clk.Add(time.Second)
+	require.Error(t, bserv.ValidateCid(sha1.Cid()))
+
+	// the session allowlist and the wrappers are counted too
+	ses := NewSession(ctx, bserv, SessionAllowlist(verifcid.NewAllowlist(map[uint64]bool{multihash.SHA2_256: true})))
+	_, err = ses.GetBlock(ctx, sha512.Cid())
+	require.Error(t, err)
+	_, err = NewScoped(bserv, func(cid.Cid) bool { return true }).GetBlock(ctx, keccak.Cid())
+	require.Error(t, err)
+
+	require.EqualValues(t, 9, bserv.Stats(false).AllowlistRejections)
+	m := bserv.metrics.allowlistRejections
+	require.Equal(t, 1.0, testutil.ToFloat64(m.WithLabelValues("sha1", "get")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.WithLabelValues("sha1", "get-many")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.WithLabelValues("sha1", "validate")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.WithLabelValues("blake3", "get-many")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.WithLabelValues("blake3", "add-many")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.WithLabelValues("blake3", "get")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.WithLabelValues("sha2-512", "get")))
+	// the hashes without a label of their own are reported as other
+	require.Equal(t, 1.0, testutil.ToFloat64(m.WithLabelValues("other", "add")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.WithLabelValues("other", "get")))
+
+	top := bserv.TopRejected()
+	require.Len(t, top, 4)
+	// ties are broken by the most recent rejection
+	require.Equal(t, sha1.Cid(), top[0].Cid)
+	require.EqualValues(t, 3, top[0].Count)
+	require.Equal(t, "validate", top[0].Operation)
+	require.Equal(t, clk.Now(), top[0].Last)
+	require.Equal(t, blake3.Cid(), top[1].Cid)
+	require.EqualValues(t, 3, top[1].Count)
+	require.Equal(t, "get", top[1].Operation)
+	require.Equal(t, keccak.Cid(), top[2].Cid)
+	require.EqualValues(t, 2, top[2].Count)
+	require.Equal(t, sha512.Cid(), top[3].Cid)
+}
+
+func TestRejectionTrackerBounded(t *testing.T) {
+	t.Parallel()
+
+	var tr rejectionTracker
+	now := time.Now()
+	ks := make([]cid.Cid, rejectionTrackSize+1)
+	for i := range ks {
+		ks[i] = blockWithHash(t, []byte{byte(i)}, multihash.SHA1).Cid()
+		tr.add(ks[i], opGet, now.Add(time.Duration(i)))
+	}
+	// the least recently rejected CID is forgotten
+	tr.add(ks[1], opGet, now.Add(time.Hour))
+	require.Len(t, tr.recent, rejectionTrackSize)
+	require.NotContains(t, tr.recent, ks[0])
+
+	top := tr.top(RejectionTopK)
+	require.Len(t, top, RejectionTopK)
+	require.Equal(t, ks[1], top[0].Cid)
+	require.Equal(t, ks[len(ks)-1], top[1].Cid)
+}
@@ -0,0 +1,53 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/go-cid"
+)
+
+// reprovideCacheSize is the number of CIDs whose last provide is remembered
+// by [WithReprovideOnRead].
+const reprovideCacheSize = 1 << 16
+
+// WithReprovideOnRead provides again the blocks read from the blockstore by
+// GetBlock and GetBlocks, at most once per minInterval for each CID, so the
+// provider records of the content served often don't expire. The last
+// provides of the 65536 most recent CIDs are remembered.
+// The provides follow the rate limit, the filter and [ContextWithNoProvide]
+// like the others, whatever [WithProvideOn], and the ones performed or
+// queued are counted by the ReprovidesOnRead stat.
+func WithReprovideOnRead(minInterval time.Duration) Option {
+	return func(bs *blockService) {
+		if minInterval <= 0 {
+			bs.invalidOption("WithReprovideOnRead: the interval must be positive, got %s", minInterval)
+			return
+		}
+		cache, err := lru.New[cid.Cid, time.Time](reprovideCacheSize)
+		if err != nil {
+			bs.invalidOption("WithReprovideOnRead: %s", err)
+			return
+		}
+		bs.reprovideInterval = minInterval
+		bs.lastProvided = cache
+	}
+}
+
+// reprovideOnRead provides c, read from the blockstore, if it hasn't been for
+// the interval of [WithReprovideOnRead].
+func (s *blockService) reprovideOnRead(ctx context.Context, c cid.Cid) {
+	if s == nil || s.lastProvided == nil || s.provider == nil || isNoProvide(ctx) {
+		return
+	}
+	now := s.clock.Now()
+	if last, ok := s.lastProvided.Get(c); ok && now.Sub(last) < s.reprovideInterval {
+		return
+	}
+	// concurrent reads may both provide c, which is harmless
+	s.lastProvided.Add(c, now)
+	if s.provideCid(ctx, c) {
+		s.stats.reprovidesOnRead.Add(1)
+	}
+}
@@ -0,0 +1,51 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReprovideOnRead(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.PutMany(ctx, blks))
+	clk := clock.NewMock()
+	prov := &recordingProvider{}
+	bserv := New(bstore, nil, WithClock(clk), WithProvider(prov), WithReprovideOnRead(time.Hour),
+		WithProvideFilter(func(c cid.Cid) bool { return c != blks[2].Cid() })).(*blockService)
+
+	_, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[0].Cid(), blks[1].Cid()}) {
+	}
+	require.Equal(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, prov.Provided())
+
+	// once per interval, and never without provides
+	clk.Add(time.Hour)
+	_, err = bserv.GetBlock(ContextWithNoProvide(ctx), blks[0].Cid())
+	require.NoError(t, err)
+	_, err = bserv.GetBlock(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[1].Cid()}, prov.Provided())
+
+	// the reprovides skipped by the filter are not counted
+	_, err = bserv.GetBlock(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.Len(t, prov.Provided(), 3)
+	require.EqualValues(t, 3, bserv.Stats(false).ReprovidesOnRead)
+
+	_, err = NewWithOptions(bstore, nil, WithReprovideOnRead(0))
+	require.Error(t, err)
+}
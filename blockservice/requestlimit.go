@@ -0,0 +1,92 @@
+package blockservice
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ErrBatchTooLarge is matched by the [*BatchTooLargeError] returned for
+// requests over the limit of [WithMaxBatchRequest].
+var ErrBatchTooLarge = errors.New("too many CIDs requested at once")
+
+// ErrTooManyMisses is reported to [WithBlockErrorHandler] for the CIDs not
+// fetched because of [WithMaxMisses].
+var ErrTooManyMisses = errors.New("too many blocks missing from the blockstore")
+
+// BatchTooLargeError identifies a request refused by [WithMaxBatchRequest].
+type BatchTooLargeError struct {
+	Requested int
+	Max       int
+}
+
+func (e *BatchTooLargeError) Error() string {
+	return fmt.Sprintf("%s: %d CIDs, the maximum is %d", ErrBatchTooLarge, e.Requested, e.Max)
+}
+
+func (e *BatchTooLargeError) Is(target error) bool {
+	return target == ErrBatchTooLarge
+}
+
+// WithMaxBatchRequest makes GetBlocks and its variants refuse the requests for
+// more than n CIDs before doing any work: the channel is closed right away and
+// every CID is reported to [WithBlockErrorHandler] with a
+// [*BatchTooLargeError], GetBlocksAndPin returns the error.
+// 0 disables the limit, the default.
+func WithMaxBatchRequest(n int) Option {
+	return func(bs *blockService) {
+		if n < 0 {
+			bs.invalidOption("WithMaxBatchRequest: negative limit %d", n)
+			return
+		}
+		bs.maxBatchRequest = n
+	}
+}
+
+// WithMaxMisses bounds how many of the CIDs of a GetBlocks call missing from
+// the blockstore are requested from the exchange, the blocks found locally are
+// still all returned. The CIDs over the limit are reported to
+// [WithBlockErrorHandler] with [ErrTooManyMisses].
+// 0 disables the limit, the default.
+func WithMaxMisses(n int) Option {
+	return func(bs *blockService) {
+		if n < 0 {
+			bs.invalidOption("WithMaxMisses: negative limit %d", n)
+			return
+		}
+		bs.maxMisses = n
+	}
+}
+
+// checkBatchRequest returns a [*BatchTooLargeError] if a request for n CIDs is
+// over the limit.
+func (s *blockService) checkBatchRequest(n int) error {
+	if s == nil || s.maxBatchRequest == 0 || n <= s.maxBatchRequest {
+		return nil
+	}
+	return &BatchTooLargeError{Requested: n, Max: s.maxBatchRequest}
+}
+
+// rejectBatch reports err for every CID of ks to the block error handler,
+// without the bookkeeping of a [blockErrorTracker].
+func (s *blockService) rejectBatch(ks []cid.Cid, err error) {
+	if s == nil || s.blockErrorHandler == nil {
+		return
+	}
+	for _, k := range ks {
+		s.blockErrorHandler(k, err)
+	}
+}
+
+// limitMisses returns the misses to fetch, the ones over the limit are
+// reported to tracker.
+func (s *blockService) limitMisses(misses []cid.Cid, tracker *blockErrorTracker) []cid.Cid {
+	if s == nil || s.maxMisses == 0 || len(misses) <= s.maxMisses {
+		return misses
+	}
+	for _, c := range misses[s.maxMisses:] {
+		tracker.fail(c, ErrTooManyMisses)
+	}
+	return misses[:s.maxMisses]
+}
@@ -0,0 +1,88 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithMaxBatchRequest(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var lk sync.Mutex
+	failed := make(map[cid.Cid]error)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithMaxBatchRequest(2), WithBlockErrorHandler(func(c cid.Cid, err error) {
+		lk.Lock()
+		defer lk.Unlock()
+		failed[c] = err
+	})).(*blockService)
+
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, bserv.AddBlocks(ctx, blks))
+	ks := []cid.Cid{blks[0].Cid(), blks[1].Cid(), blks[2].Cid()}
+
+	for range bserv.GetBlocks(ctx, ks) {
+		t.Fatal("no block should be returned")
+	}
+	lk.Lock()
+	require.Len(t, failed, 3)
+	require.ErrorIs(t, failed[ks[0]], ErrBatchTooLarge)
+	lk.Unlock()
+
+	_, err := bserv.GetBlocksAndPin(ctx, ks, func([]cid.Cid) error { return nil })
+	require.ErrorIs(t, err, ErrBatchTooLarge)
+
+	var got int
+	for range NewSession(ctx, bserv).GetBlocks(ctx, ks[:2]) {
+		got++
+	}
+	require.Equal(t, 2, got)
+}
+
+func TestWithMaxMisses(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var lk sync.Mutex
+	var tooMany int
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithMaxMisses(1), WithBlockErrorHandler(func(c cid.Cid, err error) {
+		lk.Lock()
+		defer lk.Unlock()
+		if err == ErrTooManyMisses {
+			tooMany++
+		}
+	}))
+
+	local := random.BlocksOfSize(2, blockSize)
+	remote := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, bserv.AddBlocks(ctx, local))
+	require.NoError(t, exchbstore.PutMany(ctx, remote))
+
+	var ks []cid.Cid
+	for _, b := range append(append([]blocks.Block{}, local...), remote...) {
+		ks = append(ks, b.Cid())
+	}
+	var got int
+	for range bserv.GetBlocks(ctx, ks) {
+		got++
+	}
+
+	// every local block and a single miss
+	require.Equal(t, 3, got)
+	lk.Lock()
+	require.Equal(t, 2, tooMany)
+	lk.Unlock()
+}
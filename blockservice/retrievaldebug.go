@@ -0,0 +1,265 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// ErrRetrievalDebugDisabled is returned by GetBlocksDebug without
+// [WithRetrievalDebug].
+var ErrRetrievalDebugDisabled = errors.New("retrieval debug mode is not enabled")
+
+// RetrievalSource tells where a block returned by GetBlocksDebug came from.
+type RetrievalSource string
+
+const (
+	SourceMemory     RetrievalSource = "memory"
+	SourceBlockstore RetrievalSource = "blockstore"
+	SourceFetchCache RetrievalSource = "fetch-cache"
+	SourceMultihash  RetrievalSource = "multihash"
+	SourceFallback   RetrievalSource = "fallback"
+	SourceExchange   RetrievalSource = "exchange"
+)
+
+// RetrievalResult describes how a block was retrieved by GetBlocksDebug.
+type RetrievalResult struct {
+	Block  blocks.Block
+	Source RetrievalSource
+	// DurationLocal is the time spent looking the block up locally and
+	// DurationFetch the time between the start of the exchange fetch and the
+	// arrival of the block, zero if the block was found locally.
+	DurationLocal time.Duration
+	DurationFetch time.Duration
+	// ExchangeWait is the time GetBlocks waited for the exchange to produce
+	// the block and ConsumerWait the time the block waited for the consumer
+	// of GetBlocks to read it, see [Stats.ExchangeWaitTime].
+	ExchangeWait time.Duration
+	ConsumerWait time.Duration
+	// CacheWriteErr is the error writing a fetched block to the blockstore,
+	// the block is returned anyway.
+	CacheWriteErr error
+}
+
+// WithRetrievalDebug enables GetBlocksDebug, which reports how each block was
+// retrieved and logs a summary of the latencies per source at the end of each
+// call. It has no cost on the other operations.
+func WithRetrievalDebug() Option {
+	return func(bs *blockService) {
+		bs.retrievalDebug = true
+	}
+}
+
+// RetrievalDebugger is implemented by the blockservices reporting how each
+// block they return was retrieved.
+type RetrievalDebugger interface {
+	// GetBlocksDebug is like GetBlocks but returns a [RetrievalResult] for
+	// every block, it returns [ErrRetrievalDebugDisabled] without
+	// [WithRetrievalDebug].
+	GetBlocksDebug(ctx context.Context, ks []cid.Cid) (<-chan RetrievalResult, error)
+}
+
+var _ RetrievalDebugger = (*blockService)(nil)
+
+func (s *blockService) GetBlocksDebug(ctx context.Context, ks []cid.Cid) (<-chan RetrievalResult, error) {
+	if !s.retrievalDebug {
+		return nil, ErrRetrievalDebugDisabled
+	}
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlocksDebug")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	rec := &retrievalRecorder{
+		results:   make(map[cid.Cid]*RetrievalResult, len(ks)),
+		offeredAt: make(map[cid.Cid]time.Time),
+		clock:     s.clock,
+	}
+	in := s.GetBlocks(context.WithValue(ctx, retrievalRecorderKey{}, rec), ks)
+	out := make(chan RetrievalResult)
+	go func() {
+		defer close(out)
+		var all []RetrievalResult
+		send := func(r RetrievalResult) bool {
+			all = append(all, r)
+			select {
+			case out <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for b := range in {
+			if !send(rec.take(b)) {
+				return
+			}
+		}
+		for _, r := range rec.failedWrites() {
+			if !send(r) {
+				return
+			}
+		}
+		logger.Info(retrievalSummary(all))
+	}()
+	return out, nil
+}
+
+type retrievalRecorderKey struct{}
+
+// retrievalRecorder collects the details of the blocks of a GetBlocksDebug
+// call, its methods handle a nil receiver.
+type retrievalRecorder struct {
+	lk         sync.Mutex
+	results    map[cid.Cid]*RetrievalResult
+	offeredAt  map[cid.Cid]time.Time // when the blocks were offered to the consumer
+	fetchStart time.Time
+	clock      clock.Clock
+}
+
+// getRetrievalRecorder returns the recorder of a GetBlocksDebug call, nil for
+// the other calls.
+func (s *blockService) getRetrievalRecorder(ctx context.Context) *retrievalRecorder {
+	if s == nil || !s.retrievalDebug {
+		return nil
+	}
+	rec, _ := ctx.Value(retrievalRecorderKey{}).(*retrievalRecorder)
+	return rec
+}
+
+// now returns the current time, or the zero time without reading the clock
+// when not recording.
+func (r *retrievalRecorder) now() time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+	return r.clock.Now()
+}
+
+// local records the local lookup of c started at start, source is empty on a
+// miss.
+func (r *retrievalRecorder) local(c cid.Cid, source RetrievalSource, start time.Time) {
+	if r == nil {
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.results[c] = &RetrievalResult{Source: source, DurationLocal: r.clock.Since(start)}
+}
+
+func (r *retrievalRecorder) fetchStarted() {
+	if r == nil {
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.fetchStart = r.clock.Now()
+}
+
+// fetched records the arrival of b from the exchange, writeErr is the error
+// writing it to the blockstore.
+func (r *retrievalRecorder) fetched(b blocks.Block, writeErr error) {
+	if r == nil {
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	res := r.results[b.Cid()]
+	if res == nil {
+		res = &RetrievalResult{}
+		r.results[b.Cid()] = res
+	}
+	res.Source = SourceExchange
+	res.DurationFetch = r.clock.Since(r.fetchStart)
+	res.CacheWriteErr = writeErr
+	if writeErr != nil {
+		// not delivered by GetBlocks, returned by failedWrites
+		res.Block = b
+	}
+}
+
+// exchangeWaited records GetBlocks waited d for the exchange to produce c.
+func (r *retrievalRecorder) exchangeWaited(c cid.Cid, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	res := r.results[c]
+	if res == nil {
+		res = &RetrievalResult{}
+		r.results[c] = res
+	}
+	res.ExchangeWait = d
+}
+
+// offered records the fetched block c is being handed to the consumer.
+func (r *retrievalRecorder) offered(c cid.Cid) {
+	if r == nil {
+		return
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.offeredAt[c] = r.clock.Now()
+}
+
+// take returns the result of the delivered block b.
+func (r *retrievalRecorder) take(b blocks.Block) RetrievalResult {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	res, ok := r.results[b.Cid()]
+	if !ok {
+		return RetrievalResult{Block: b}
+	}
+	delete(r.results, b.Cid())
+	if offered, ok := r.offeredAt[b.Cid()]; ok {
+		delete(r.offeredAt, b.Cid())
+		res.ConsumerWait = r.clock.Since(offered)
+	}
+	res.Block = b
+	return *res
+}
+
+// failedWrites returns the results of the fetched blocks which could not be
+// written to the blockstore.
+func (r *retrievalRecorder) failedWrites() []RetrievalResult {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	var failed []RetrievalResult
+	for _, res := range r.results {
+		if res.CacheWriteErr != nil {
+			failed = append(failed, *res)
+		}
+	}
+	return failed
+}
+
+// retrievalSummary formats the p50 and p95 latencies of results per source.
+func retrievalSummary(results []RetrievalResult) string {
+	bySource := make(map[RetrievalSource][]time.Duration)
+	for _, r := range results {
+		bySource[r.Source] = append(bySource[r.Source], r.DurationLocal+r.DurationFetch)
+	}
+	sources := make([]RetrievalSource, 0, len(bySource))
+	for source := range bySource {
+		sources = append(sources, source)
+	}
+	slices.Sort(sources)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "GetBlocksDebug: %d blocks", len(results))
+	for _, source := range sources {
+		d := bySource[source]
+		slices.Sort(d)
+		fmt.Fprintf(&sb, "; %s: n=%d p50=%s p95=%s", source, len(d), d[len(d)*50/100], d[min(len(d)*95/100, len(d)-1)])
+	}
+	return sb.String()
+}
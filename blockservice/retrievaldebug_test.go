@@ -0,0 +1,62 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBlocksDebug(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	cache := &flakyBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		failures:   1,
+		err:        errTransient,
+	}
+	bserv := New(bstore, offline.Exchange(exchbstore), WithRetrievalDebug(), WithFetchCacheBlockstore(cache)).(*blockService)
+
+	blks := random.BlocksOfSize(2, blockSize)
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, exchbstore.Put(ctx, blks[1]))
+
+	results, err := bserv.GetBlocksDebug(ctx, []cid.Cid{blks[0].Cid(), blks[1].Cid()})
+	require.NoError(t, err)
+	got := make(map[cid.Cid]RetrievalResult)
+	for r := range results {
+		got[r.Block.Cid()] = r
+	}
+	require.Len(t, got, 2)
+
+	local := got[blks[0].Cid()]
+	require.Equal(t, SourceBlockstore, local.Source)
+	require.Positive(t, local.DurationLocal)
+	require.Zero(t, local.DurationFetch)
+	require.NoError(t, local.CacheWriteErr)
+
+	// the block is returned even though the cache write failed
+	fetched := got[blks[1].Cid()]
+	require.Equal(t, SourceExchange, fetched.Source)
+	require.Positive(t, fetched.DurationFetch)
+	require.ErrorIs(t, fetched.CacheWriteErr, errTransient)
+
+	require.Contains(t, retrievalSummary([]RetrievalResult{local, fetched}), "exchange: n=1")
+}
+
+func TestGetBlocksDebugDisabled(t *testing.T) {
+	t.Parallel()
+
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil).(RetrievalDebugger)
+	_, err := bserv.GetBlocksDebug(context.Background(), nil)
+	require.ErrorIs(t, err, ErrRetrievalDebugDisabled)
+}
@@ -0,0 +1,62 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithPutRetry retries blockstore writes failing with an error classify
+// reports as transient, up to attempts tries in total, waiting backoff before
+// the first retry and doubling the wait after each one.
+// It applies to AddBlock, AddBlocks and the caching of fetched blocks.
+// Retries are disabled by default, and a nil classify retries nothing.
+func WithPutRetry(attempts int, backoff time.Duration, classify func(error) bool) Option {
+	return func(bs *blockService) {
+		if attempts < 1 || backoff < 0 {
+			bs.invalidOption("WithPutRetry: invalid %d attempts with backoff %s", attempts, backoff)
+			return
+		}
+		bs.putAttempts = attempts
+		bs.putBackoff = backoff
+		bs.putRetryable = classify
+	}
+}
+
+// retryPut calls put until it succeeds, fails with an error which is not
+// retryable, runs out of attempts or ctx is canceled.
+// It handles a nil receiver by calling put once.
+func (s *blockService) retryPut(ctx context.Context, put func() error) error {
+	err := put()
+	if err == nil || s == nil || s.putRetryable == nil {
+		return err
+	}
+
+	backoff := s.putBackoff
+	for attempt := 2; attempt <= s.putAttempts && s.putRetryable(err); attempt++ {
+		timer := s.clock.Timer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+
+		s.stats.putRetries.Add(1)
+		if s.metrics != nil {
+			s.metrics.putRetries.Inc()
+		}
+		trace.SpanFromContext(ctx).AddEvent("blockstore put retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt),
+			attribute.String("error", err.Error()),
+		))
+
+		if err = put(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+var errTransient = errors.New("transient")
+
+// flakyBlockstore fails the next failures writes with err.
+type flakyBlockstore struct {
+	blockstore.Blockstore
+	failures int
+	err      error
+	calls    int
+}
+
+func (bs *flakyBlockstore) fail() error {
+	bs.calls++
+	if bs.failures > 0 {
+		bs.failures--
+		return bs.err
+	}
+	return nil
+}
+
+func (bs *flakyBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	if err := bs.fail(); err != nil {
+		return err
+	}
+	return bs.Blockstore.Put(ctx, b)
+}
+
+func (bs *flakyBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	if err := bs.fail(); err != nil {
+		return err
+	}
+	return bs.Blockstore.PutMany(ctx, blks)
+}
+
+func TestPutRetry(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	isTransient := func(err error) bool { return errors.Is(err, errTransient) }
+
+	bstore := &flakyBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		failures:   2,
+		err:        errTransient,
+	}
+	bserv := New(bstore, nil, WithPutRetry(3, time.Millisecond, isTransient))
+	require.NoError(t, bserv.AddBlocks(ctx, random.BlocksOfSize(2, blockSize)))
+	require.Equal(t, 3, bstore.calls)
+	require.EqualValues(t, 2, bserv.(*blockService).Stats(false).PutRetries)
+
+	// attempts exhausted
+	bstore.failures, bstore.calls = 3, 0
+	require.ErrorIs(t, bserv.AddBlock(ctx, random.BlocksOfSize(1, blockSize)[0]), errTransient)
+	require.Equal(t, 3, bstore.calls)
+
+	// errors which are not transient fail immediately
+	bstore.failures, bstore.calls, bstore.err = 1, 0, errors.New("permanent")
+	require.Error(t, bserv.AddBlock(ctx, random.BlocksOfSize(1, blockSize)[0]))
+	require.Equal(t, 1, bstore.calls)
+
+	// retrying nothing is the default
+	bstore.failures, bstore.calls, bstore.err = 1, 0, errTransient
+	require.ErrorIs(t, New(bstore, nil).AddBlock(ctx, random.BlocksOfSize(1, blockSize)[0]), errTransient)
+	require.Equal(t, 1, bstore.calls)
+}
+
+// timedBlockstore records the time of the clock of its puts, the first
+// failures ones fail with errTransient.
+type timedBlockstore struct {
+	blockstore.Blockstore
+	clk      clock.Clock
+	failures int
+
+	lk   sync.Mutex
+	puts []time.Time
+}
+
+func (bs *timedBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	bs.puts = append(bs.puts, bs.clk.Now())
+	if len(bs.puts) <= bs.failures {
+		return errTransient
+	}
+	return bs.Blockstore.Put(ctx, b)
+}
+
+func (bs *timedBlockstore) putTimes() []time.Time {
+	bs.lk.Lock()
+	defer bs.lk.Unlock()
+	return slices.Clone(bs.puts)
+}
+
+func TestPutRetryBackoff(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	isTransient := func(err error) bool { return errors.Is(err, errTransient) }
+
+	clk := clock.NewMock()
+	bstore := &timedBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		clk:        clk,
+		failures:   2,
+	}
+	bserv := New(bstore, nil, WithPutRetry(3, time.Second, isTransient), WithClock(clk))
+	errs := make(chan error, 1)
+	go func() { errs <- bserv.AddBlock(ctx, random.BlocksOfSize(1, blockSize)[0]) }()
+
+	var err error
+	require.Eventually(t, func() bool {
+		select {
+		case err = <-errs:
+			return true
+		default:
+			clk.Add(100 * time.Millisecond)
+			return false
+		}
+	}, 5*time.Second, time.Millisecond)
+	require.NoError(t, err)
+
+	// the wait doubles after each retry
+	puts := bstore.putTimes()
+	require.Len(t, puts, 3)
+	require.GreaterOrEqual(t, puts[1].Sub(puts[0]), time.Second)
+	require.Less(t, puts[1].Sub(puts[0]), 2*time.Second)
+	require.GreaterOrEqual(t, puts[2].Sub(puts[1]), 2*time.Second)
+	require.Less(t, puts[2].Sub(puts[1]), 3*time.Second)
+}
@@ -0,0 +1,145 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrOutOfScope is wrapped by the errors returned for CIDs rejected by the
+// scope of [NewScoped].
+var ErrOutOfScope = errors.New("CID out of scope")
+
+// NewScoped returns a [BlockService] restricted to the CIDs for which allow
+// returns true, for example the ones of some codecs, so several datasets can
+// share bs. The other CIDs are rejected by every operation with an error
+// wrapping [ErrOutOfScope], on top of the allowlist and content blocker of
+// bs: GetBlocks drops them from the request like the CIDs rejected by the
+// allowlist. Everything else is delegated to bs, which Unwrap returns.
+// Sessions created with [NewSession] on the returned BlockService are scoped
+// too.
+func NewScoped(bs BlockService, allow func(cid.Cid) bool) BlockService {
+	return &scopedBlockService{inner: bs, allow: allow}
+}
+
+type scopedBlockService struct {
+	inner BlockService
+	allow func(cid.Cid) bool
+}
+
+var _ SecuredBlockService = (*scopedBlockService)(nil)
+
+// Unwrap returns the BlockService passed to [NewScoped].
+func (s *scopedBlockService) Unwrap() BlockService {
+	return s.inner
+}
+
+func (s *scopedBlockService) Allowlist() verifcid.Allowlist {
+	return grabAllowlistFromBlockservice(s.inner)
+}
+
+func (s *scopedBlockService) SecurityPolicy() SecurityPolicy {
+	return grabSecurityPolicyFromBlockservice(s.inner)
+}
+
+// ValidateCid checks c is in scope, then runs the checks of the inner
+// BlockService.
+func (s *scopedBlockService) ValidateCid(c cid.Cid) error {
+	return s.validateCidFor(opValidate, c)
+}
+
+func (s *scopedBlockService) validateCidFor(op string, c cid.Cid) error {
+	if !s.allow(c) {
+		return fmt.Errorf("%w: %s", ErrOutOfScope, c)
+	}
+	return validateCidOf(s.inner, op, c)
+}
+
+func (s *scopedBlockService) Blockstore() blockstore.Blockstore {
+	return s.inner.Blockstore()
+}
+
+func (s *scopedBlockService) Exchange() exchange.Interface {
+	return s.inner.Exchange()
+}
+
+func (s *scopedBlockService) Close() error {
+	return s.inner.Close()
+}
+
+func (s *scopedBlockService) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if ses := grabSessionFromContext(ctx, s); ses != nil {
+		return ses.GetBlock(ctx, c)
+	}
+	service := grabServiceFromBlockservice(s.inner)
+	if service == nil {
+		if err := s.validateCidFor(opGet, c); err != nil {
+			return nil, err
+		}
+		return s.inner.GetBlock(ctx, c)
+	}
+
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlock", trace.WithAttributes(attribute.Stringer("CID", c), codecAttribute(c)))
+	defer span.End()
+	service.tagSpan(ctx, span)
+
+	blk, err := getBlock(ctx, c, s, nil, service.getExchangeFetcher)
+	recordBlockSize(span, blk)
+	return blk, err
+}
+
+func (s *scopedBlockService) GetBlocks(ctx context.Context, ks []cid.Cid) <-chan blocks.Block {
+	if ses := grabSessionFromContext(ctx, s); ses != nil {
+		return ses.GetBlocks(ctx, ks)
+	}
+	service := grabServiceFromBlockservice(s.inner)
+	if service == nil {
+		inScope := make([]cid.Cid, 0, len(ks))
+		for _, c := range ks {
+			if err := s.validateCidFor(opGetMany, c); err != nil {
+				logger.Errorf("rejected CID (%s) passed to blockService.GetBlocks: %s", c, err)
+				continue
+			}
+			inScope = append(inScope, c)
+		}
+		return s.inner.GetBlocks(ctx, inScope)
+	}
+
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlocks")
+	defer span.End()
+	service.tagSpan(ctx, span)
+
+	return getBlocks(ctx, ks, s, nil, service.getExchangeFetcher)
+}
+
+func (s *scopedBlockService) AddBlock(ctx context.Context, o blocks.Block) error {
+	if !s.allow(o.Cid()) {
+		return fmt.Errorf("%w: %s", ErrOutOfScope, o.Cid())
+	}
+	return s.inner.AddBlock(ctx, o)
+}
+
+func (s *scopedBlockService) AddBlocks(ctx context.Context, bs []blocks.Block) error {
+	for _, b := range bs {
+		if !s.allow(b.Cid()) {
+			return fmt.Errorf("%w: %s", ErrOutOfScope, b.Cid())
+		}
+	}
+	return s.inner.AddBlocks(ctx, bs)
+}
+
+func (s *scopedBlockService) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	if !s.allow(c) {
+		return fmt.Errorf("%w: %s", ErrOutOfScope, c)
+	}
+	return s.inner.DeleteBlock(ctx, c)
+}
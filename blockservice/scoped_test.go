@@ -0,0 +1,56 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewScoped(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	outOfScope := blks[2].Cid()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	var rejected []cid.Cid
+	inner := New(bstore, offline.Exchange(exchbstore), WithBlockErrorHandler(func(c cid.Cid, err error) {
+		require.ErrorIs(t, err, ErrOutOfScope)
+		rejected = append(rejected, c)
+	}))
+	scoped := NewScoped(inner, func(c cid.Cid) bool { return c != outOfScope })
+	require.Equal(t, inner, scoped.(interface{ Unwrap() BlockService }).Unwrap())
+
+	require.ErrorIs(t, scoped.AddBlock(ctx, blks[2]), ErrOutOfScope)
+	require.ErrorIs(t, scoped.AddBlocks(ctx, blks), ErrOutOfScope)
+	require.ErrorIs(t, scoped.DeleteBlock(ctx, outOfScope), ErrOutOfScope)
+	_, err := scoped.GetBlock(ctx, outOfScope)
+	require.ErrorIs(t, err, ErrOutOfScope)
+	require.NoError(t, scoped.AddBlock(ctx, blks[0]))
+
+	var got []cid.Cid
+	for b := range scoped.GetBlocks(ctx, []cid.Cid{blks[0].Cid(), blks[1].Cid(), outOfScope}) {
+		got = append(got, b.Cid())
+	}
+	require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, got)
+	require.Equal(t, []cid.Cid{outOfScope}, rejected)
+
+	ses := NewSession(ctx, scoped)
+	_, err = ses.GetBlock(ctx, outOfScope)
+	require.ErrorIs(t, err, ErrOutOfScope)
+	_, err = scoped.GetBlock(EmbedSessionInContext(ctx, ses), outOfScope)
+	require.ErrorIs(t, err, ErrOutOfScope)
+
+	// the inner blockservice is not restricted
+	_, err = inner.GetBlock(ctx, outOfScope)
+	require.NoError(t, err)
+}
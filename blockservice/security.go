@@ -0,0 +1,89 @@
+package blockservice
+
+import (
+	"github.com/ipfs/boxo/verifcid"
+	"github.com/ipfs/go-cid"
+)
+
+// SecurityPolicy decides which blocks a blockservice accepts, it generalizes
+// [verifcid.Allowlist] with checks which depend on the whole CID and on the
+// size of the blocks, like a size limit per codec.
+type SecurityPolicy interface {
+	// ValidateCid checks c, it applies to every operation.
+	ValidateCid(c cid.Cid) error
+
+	// ValidateBlock checks a block of size bytes whose CID c was accepted by
+	// ValidateCid, it applies to the blocks added and to the blocks received
+	// from the exchange.
+	ValidateBlock(c cid.Cid, size int) error
+}
+
+// WithSecurityPolicy sets the policy checking the CIDs and the blocks in place
+// of the allowlist, which the blockservice and its sessions then ignore.
+// [AllowlistPolicy] adapts an existing allowlist. A policy with an
+// Allowlist() verifcid.Allowlist method, like the ones of [AllowlistPolicy],
+// reports it as the allowlist of the blockservice.
+func WithSecurityPolicy(p SecurityPolicy) Option {
+	return func(bs *blockService) {
+		if p == nil {
+			bs.invalidOption("WithSecurityPolicy: nil policy")
+			return
+		}
+		bs.policy = p
+	}
+}
+
+// AllowlistPolicy returns the [SecurityPolicy] applied by the blockservices
+// configured with the allowlist l: ValidateCid is [verifcid.ValidateCid],
+// with errors wrapped in an [*AllowlistError], and ValidateBlock accepts
+// every block.
+func AllowlistPolicy(l verifcid.Allowlist) SecurityPolicy {
+	return allowlistPolicy{l}
+}
+
+type allowlistPolicy struct {
+	allowlist verifcid.Allowlist
+}
+
+func (p allowlistPolicy) ValidateCid(c cid.Cid) error {
+	return validateCid(p.allowlist, c)
+}
+
+func (allowlistPolicy) ValidateBlock(cid.Cid, int) error {
+	return nil
+}
+
+func (p allowlistPolicy) Allowlist() verifcid.Allowlist {
+	return p.allowlist
+}
+
+// SecuredBlockService is a [BoundedBlockService] exposing its
+// [SecurityPolicy], so sessions and wrappers can enforce the same checks.
+type SecuredBlockService interface {
+	BoundedBlockService
+
+	// SecurityPolicy returns the policy of [WithSecurityPolicy], or the
+	// [AllowlistPolicy] of the allowlist when it is not set.
+	SecurityPolicy() SecurityPolicy
+}
+
+var _ SecuredBlockService = (*blockService)(nil)
+
+func (s *blockService) SecurityPolicy() SecurityPolicy {
+	if s.policy != nil {
+		return s.policy
+	}
+	return allowlistPolicy{s.allowlist}
+}
+
+// grabSecurityPolicyFromBlockservice never returns nil, it falls back to the
+// policy of the allowlist of bs.
+func grabSecurityPolicyFromBlockservice(bs BlockService) SecurityPolicy {
+	if sbs, ok := bs.(SecuredBlockService); ok {
+		return sbs.SecurityPolicy()
+	}
+	if l := grabAllowlistFromBlockservice(bs); l != nil {
+		return allowlistPolicy{l}
+	}
+	return allowlistPolicy{verifcid.DefaultAllowlist}
+}
@@ -0,0 +1,118 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+var errPolicy = errors.New("rejected by policy")
+
+// codecSizePolicy accepts SHA2-256 only and limits the size of the raw
+// blocks.
+type codecSizePolicy struct {
+	maxRaw int
+}
+
+func (p codecSizePolicy) ValidateCid(c cid.Cid) error {
+	if c.Prefix().MhType != multihash.SHA2_256 {
+		return fmt.Errorf("%w: hash of %s", errPolicy, c)
+	}
+	return nil
+}
+
+func (p codecSizePolicy) ValidateBlock(c cid.Cid, size int) error {
+	if c.Prefix().Codec == cid.Raw && size > p.maxRaw {
+		return fmt.Errorf("%w: size of %s", errPolicy, c)
+	}
+	return nil
+}
+
+func TestSecurityPolicy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	small := blockWithHash(t, []byte("small"), multihash.SHA2_256)
+	large := blockWithHash(t, []byte("too large for raw"), multihash.SHA2_256)
+	blake3 := blockWithHash(t, []byte("blake3"), multihash.BLAKE3)
+	// the size limit only applies to raw blocks
+	largePB := blocks.NewBlock([]byte("too large but dag-pb"))
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	// the allowlist is ignored in favor of the policy
+	bserv := New(bstore, offline.Exchange(exchbstore),
+		WithAllowlist(verifcid.NewAllowlist(map[uint64]bool{multihash.BLAKE3: true})),
+		WithSecurityPolicy(codecSizePolicy{maxRaw: 8}),
+	)
+
+	require.NoError(t, bserv.AddBlock(ctx, small))
+	require.NoError(t, bserv.AddBlock(ctx, largePB))
+	require.ErrorIs(t, bserv.AddBlock(ctx, large), errPolicy)
+	require.ErrorIs(t, bserv.AddBlocks(ctx, []blocks.Block{small, large}), errPolicy)
+	require.ErrorIs(t, bserv.AddBlock(ctx, blake3), errPolicy)
+
+	// fetched blocks are checked too, by the sessions and the wrappers
+	require.NoError(t, exchbstore.PutMany(ctx, []blocks.Block{large, blake3}))
+	_, err := bserv.GetBlock(ctx, large.Cid())
+	require.ErrorIs(t, err, errPolicy)
+	_, err = NewSession(ctx, bserv).GetBlock(ctx, large.Cid())
+	require.ErrorIs(t, err, errPolicy)
+	_, err = NewSession(ctx, bserv).GetBlock(ctx, blake3.Cid())
+	require.ErrorIs(t, err, errPolicy)
+	scoped := NewScoped(bserv, func(cid.Cid) bool { return true })
+	_, err = scoped.GetBlock(ctx, blake3.Cid())
+	require.ErrorIs(t, err, errPolicy)
+	require.Equal(t, codecSizePolicy{maxRaw: 8}, scoped.(SecuredBlockService).SecurityPolicy())
+	has, err := bstore.Has(ctx, large.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.ErrorIs(t, bserv.(ValidatingBlockService).ValidateFetchedBlock(large), errPolicy)
+}
+
+func TestAllowlistPolicy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	sha256 := blockWithHash(t, []byte("sha256"), multihash.SHA2_256)
+	blake3 := blockWithHash(t, []byte("blake3"), multihash.BLAKE3)
+	allowlist := verifcid.NewAllowlist(map[uint64]bool{multihash.SHA2_256: true})
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithSecurityPolicy(AllowlistPolicy(allowlist)))
+	require.NoError(t, bserv.AddBlock(ctx, sha256))
+	var aerr *AllowlistError
+	require.ErrorAs(t, bserv.AddBlock(ctx, blake3), &aerr)
+	require.ErrorIs(t, aerr, verifcid.ErrPossiblyInsecureHashFunction)
+
+	// the allowlist reported is the one of the policy, the one set with
+	// WithAllowlist is ignored
+	bserv = New(bstore, nil, WithAllowlist(verifcid.DefaultAllowlist), WithSecurityPolicy(AllowlistPolicy(allowlist)))
+	require.Equal(t, allowlist, bserv.(BoundedBlockService).Allowlist())
+	ses := NewSession(ctx, bserv, SessionAllowlist(verifcid.DefaultAllowlist))
+	require.False(t, ses.Allowlist().IsAllowed(multihash.BLAKE3))
+	// and nil when the policy decides alone
+	bserv = New(bstore, nil, WithAllowlist(verifcid.DefaultAllowlist), WithSecurityPolicy(codecSizePolicy{maxRaw: 1}))
+	require.Nil(t, bserv.(BoundedBlockService).Allowlist())
+	ses = NewSession(ctx, bserv, SessionAllowlist(allowlist))
+	require.Equal(t, allowlist, ses.Allowlist())
+
+	// without a policy the one of the allowlist is reported
+	bserv = New(bstore, nil)
+	require.Equal(t, AllowlistPolicy(verifcid.DefaultAllowlist), bserv.(SecuredBlockService).SecurityPolicy())
+
+	_, err := NewWithOptions(bstore, nil, WithSecurityPolicy(nil))
+	require.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package blockservice
+
+import (
+	"fmt"
+
+	"github.com/ipfs/boxo/verifcid"
+	"github.com/ipfs/go-cid"
+)
+
+// SessionOption configures a [Session] created by [NewSession].
+type SessionOption func(*Session)
+
+// SessionAllowlist restricts the hashes accepted by the session to the ones
+// allowed by both l and the allowlist of the blockservice, a session can't
+// accept a hash the blockservice rejects.
+func SessionAllowlist(l verifcid.Allowlist) SessionOption {
+	return func(s *Session) {
+		s.allowlist = l
+	}
+}
+
+// AllowlistError is returned when a CID is rejected by an allowlist, it wraps
+// the [verifcid] error.
+type AllowlistError struct {
+	Cid cid.Cid
+	// Session is true when the CID was rejected by the allowlist of the
+	// session, see [SessionAllowlist], and false when it was rejected by the
+	// allowlist of the blockservice.
+	Session bool
+	Err     error
+}
+
+func (e *AllowlistError) Error() string {
+	level := "blockservice"
+	if e.Session {
+		level = "session"
+	}
+	return fmt.Sprintf("%s rejected by the %s allowlist: %s", e.Cid, level, e.Err)
+}
+
+func (e *AllowlistError) Unwrap() error {
+	return e.Err
+}
+
+// Allowlist returns the allowlist applied by the session: the intersection of
+// the allowlist of the blockservice and the one of [SessionAllowlist]. It is
+// nil if neither has one, see [BoundedBlockService].
+func (s *Session) Allowlist() verifcid.Allowlist {
+	service := grabAllowlistFromBlockservice(s.bs)
+	if s.allowlist == nil {
+		return service
+	}
+	if service == nil {
+		return s.allowlist
+	}
+	return allowlistIntersection{service, s.allowlist}
+}
+
+type allowlistIntersection [2]verifcid.Allowlist
+
+func (l allowlistIntersection) IsAllowed(code uint64) bool {
+	return l[0].IsAllowed(code) && l[1].IsAllowed(code)
+}
+
+// validateSessionCid is validateCidOf followed by the check of the allowlist
+// of ses, ses is nil outside of sessions.
+func validateSessionCid(bs BlockService, ses *Session, op string, c cid.Cid) error {
+	if err := validateCidOf(bs, op, c); err != nil {
+		return err
+	}
+	if ses == nil || ses.allowlist == nil {
+		return nil
+	}
+	if err := verifcid.ValidateCid(ses.allowlist, c); err != nil { // hash security
+		grabServiceFromBlockservice(bs).rejected(op, c)
+		return &AllowlistError{Cid: c, Session: true, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionAllowlist(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	sha256 := random.BlocksOfSize(1, blockSize)[0]
+	blake3 := blockWithHash(t, []byte("blake3 block"), multihash.BLAKE3)
+	sha1 := blockWithHash(t, []byte("sha1 block"), multihash.SHA1)
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.PutMany(ctx, []blocks.Block{sha256, blake3, sha1}))
+	bserv := New(bstore, nil, WithAllowlist(verifcid.NewAllowlist(map[uint64]bool{
+		multihash.SHA2_256: true,
+		multihash.BLAKE3:   true,
+	})))
+
+	// the session allows SHA1 but can't widen the service allowlist
+	ses := NewSession(ctx, bserv, SessionAllowlist(verifcid.NewAllowlist(map[uint64]bool{
+		multihash.SHA2_256: true,
+		multihash.SHA1:     true,
+	})))
+
+	_, err := ses.GetBlock(ctx, sha256.Cid())
+	require.NoError(t, err)
+
+	var aerr *AllowlistError
+	_, err = ses.GetBlock(ctx, blake3.Cid())
+	require.ErrorIs(t, err, verifcid.ErrPossiblyInsecureHashFunction)
+	require.True(t, errors.As(err, &aerr))
+	require.True(t, aerr.Session)
+
+	_, err = ses.GetBlock(ctx, sha1.Cid())
+	require.ErrorIs(t, err, verifcid.ErrPossiblyInsecureHashFunction)
+	require.True(t, errors.As(err, &aerr))
+	require.False(t, aerr.Session)
+
+	var got []cid.Cid
+	for b := range ses.GetBlocks(ctx, []cid.Cid{sha256.Cid(), blake3.Cid(), sha1.Cid()}) {
+		got = append(got, b.Cid())
+	}
+	require.Equal(t, []cid.Cid{sha256.Cid()}, got)
+
+	allowlist := ses.Allowlist()
+	require.True(t, allowlist.IsAllowed(multihash.SHA2_256))
+	require.False(t, allowlist.IsAllowed(multihash.BLAKE3))
+	require.False(t, allowlist.IsAllowed(multihash.SHA1))
+
+	// the service is not affected by the session
+	_, err = bserv.GetBlock(ctx, blake3.Cid())
+	require.NoError(t, err)
+}
+
+func TestNewSessionWithOptionsDoesNotReuseContextSession(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil)
+	ctx = ContextWithSession(ctx, bserv)
+
+	require.Same(t, NewSession(ctx, bserv), NewSession(ctx, bserv))
+	strict := NewSession(ctx, bserv, SessionAllowlist(verifcid.NewAllowlist(nil)))
+	require.NotSame(t, NewSession(ctx, bserv), strict)
+}
+
+func blockWithHash(t *testing.T, data []byte, code uint64) blocks.Block {
+	t.Helper()
+	mh, err := multihash.Sum(data, code, -1)
+	require.NoError(t, err)
+	b, err := blocks.NewBlockWithCid(data, cid.NewCidV1(cid.Raw, mh))
+	require.NoError(t, err)
+	return b
+}
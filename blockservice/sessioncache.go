@@ -0,0 +1,126 @@
+package blockservice
+
+import (
+	"sync"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// SessionMemoryCache keeps the blocks fetched by the session in memory, up to
+// maxBytes, instead of writing them to the blockstore. The cache is consulted
+// before the blockstore and the exchange, the oldest blocks are evicted when
+// it is full.
+// The blocks fetched by the session are never written to the blockstore,
+// announced to the exchange nor provided. The cache is dropped when the
+// session is closed.
+func SessionMemoryCache(maxBytes int64) SessionOption {
+	return func(s *Session) {
+		if maxBytes <= 0 {
+			return
+		}
+		s.memCache = &memoryCache{max: maxBytes, blocks: make(map[cid.Cid]blocks.Block)}
+	}
+}
+
+// SessionStats are the counters of a [Session].
+type SessionStats struct {
+	// MemoryCacheHits and MemoryCacheMisses count the lookups in the cache of
+	// [SessionMemoryCache], MemoryCacheBytes is the size of the blocks it
+	// holds.
+	MemoryCacheHits   uint64
+	MemoryCacheMisses uint64
+	MemoryCacheBytes  int64
+}
+
+// Stats returns a snapshot of the session counters.
+func (s *Session) Stats() SessionStats {
+	var stats SessionStats
+	if c := s.memCache; c != nil {
+		stats.MemoryCacheHits = c.hits.Load()
+		stats.MemoryCacheMisses = c.misses.Load()
+		c.lk.Lock()
+		stats.MemoryCacheBytes = c.size
+		c.lk.Unlock()
+	}
+	return stats
+}
+
+// memoryCache is the cache of [SessionMemoryCache], its methods handle a nil
+// receiver.
+type memoryCache struct {
+	max    int64
+	hits   atomic.Uint64
+	misses atomic.Uint64
+
+	lk     sync.Mutex
+	blocks map[cid.Cid]blocks.Block // nil once closed
+	order  []cid.Cid                // insertion order, for eviction
+	size   int64
+}
+
+// sessionMemoryCache returns the cache of ses, nil outside of sessions or if
+// the session has none.
+func sessionMemoryCache(ses *Session) *memoryCache {
+	if ses == nil {
+		return nil
+	}
+	return ses.memCache
+}
+
+func (c *memoryCache) get(k cid.Cid) (blocks.Block, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lk.Lock()
+	b, ok := c.blocks[k]
+	c.lk.Unlock()
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return b, ok
+}
+
+// add caches b, evicting the oldest blocks to make room. Blocks bigger than
+// the whole cache are not cached.
+func (c *memoryCache) add(b blocks.Block) {
+	if c == nil {
+		return
+	}
+	size := int64(len(b.RawData()))
+	if size > c.max {
+		return
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.blocks == nil {
+		return
+	}
+	if _, ok := c.blocks[b.Cid()]; ok {
+		return
+	}
+	for c.size+size > c.max {
+		oldest := c.order[0]
+		c.order[0] = cid.Undef
+		c.order = c.order[1:]
+		c.size -= int64(len(c.blocks[oldest].RawData()))
+		delete(c.blocks, oldest)
+	}
+	c.blocks[b.Cid()] = b
+	c.order = append(c.order, b.Cid())
+	c.size += size
+}
+
+func (c *memoryCache) close() {
+	if c == nil {
+		return
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	c.blocks = nil
+	c.order = nil
+	c.size = 0
+}
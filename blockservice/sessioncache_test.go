@@ -0,0 +1,85 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionMemoryCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &notifyRecordingExchange{Interface: offline.Exchange(exchbstore), notified: make(map[cid.Cid]int)}
+	bserv := New(bstore, exch, WithProvider(prov))
+
+	blks := random.BlocksOfSize(3, blockSize)
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+
+	ses := NewSession(ctx, bserv, SessionMemoryCache(2*blockSize))
+	_, err := ses.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	for range ses.GetBlocks(ctx, []cid.Cid{blks[1].Cid()}) {
+	}
+
+	// the fetched blocks are only kept in memory
+	require.NoError(t, exchbstore.DeleteBlock(ctx, blks[0].Cid()))
+	got, err := ses.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), got.RawData())
+	for _, b := range blks[:2] {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+	require.Empty(t, prov.Provided())
+	exch.lk.Lock()
+	require.Empty(t, exch.notified)
+	exch.lk.Unlock()
+
+	stats := ses.Stats()
+	require.EqualValues(t, 1, stats.MemoryCacheHits)
+	require.EqualValues(t, 2, stats.MemoryCacheMisses)
+	require.EqualValues(t, 2*blockSize, stats.MemoryCacheBytes)
+
+	// the oldest block is evicted to make room
+	_, err = ses.GetBlock(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.EqualValues(t, 2*blockSize, ses.Stats().MemoryCacheBytes)
+	_, err = ses.GetBlock(ctx, blks[0].Cid())
+	require.Error(t, err)
+
+	require.NoError(t, ses.Close())
+	require.Zero(t, ses.Stats().MemoryCacheBytes)
+}
+
+func TestSessionMemoryCacheDroppedWithSession(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore))
+
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	require.NoError(t, exchbstore.Put(context.Background(), blk))
+
+	sesctx, cancel := context.WithCancel(context.Background())
+	ses := NewSession(sesctx, bserv, SessionMemoryCache(blockSize))
+	_, err := ses.GetBlock(context.Background(), blk.Cid())
+	require.NoError(t, err)
+	require.EqualValues(t, blockSize, ses.Stats().MemoryCacheBytes)
+
+	cancel()
+	require.Eventually(t, func() bool { return ses.Stats().MemoryCacheBytes == 0 }, time.Second, time.Millisecond)
+}
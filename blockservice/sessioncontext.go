@@ -0,0 +1,34 @@
+package blockservice
+
+import (
+	"fmt"
+)
+
+// ErrSessionContextCancelled is returned by the operations of a session
+// created with [SessionStrictContext] once the context it was created with is
+// canceled. It wraps [ErrSessionClosed].
+var ErrSessionContextCancelled = fmt.Errorf("%w: its context is canceled", ErrSessionClosed)
+
+// SessionStrictContext makes the operations of the session fail with
+// [ErrSessionContextCancelled] as soon as the context it was created with is
+// canceled, including a context canceled before the first operation.
+// Without it, a session whose context is canceled before its exchange session
+// is created fetches without exchange session until it is closed, as some
+// exchanges fail or panic when given a canceled context.
+// It has no effect with [SessionWithKeepAlive].
+func SessionStrictContext() SessionOption {
+	return func(s *Session) {
+		s.strictContext = true
+	}
+}
+
+// contextCanceled reports whether the context the session was created with
+// is done.
+func (ses *Session) contextCanceled() bool {
+	select {
+	case <-ses.ctxDone:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,150 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// ctxSessionExchange panics when asked for a session of a canceled context,
+// its sessions return the first block of GetBlocks then wait for their
+// context to be canceled.
+type ctxSessionExchange struct {
+	exchange.Interface
+}
+
+func (e *ctxSessionExchange) NewSession(ctx context.Context) exchange.Fetcher {
+	if ctx.Err() != nil {
+		panic("session of a canceled context")
+	}
+	return &ctxSession{Fetcher: e.Interface, ctx: ctx}
+}
+
+type ctxSession struct {
+	exchange.Fetcher
+	ctx context.Context
+}
+
+func (s *ctxSession) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		b, err := s.Fetcher.GetBlock(ctx, ks[0])
+		if err != nil {
+			return
+		}
+		select {
+		case out <- b:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-s.ctx.Done():
+		case <-ctx.Done():
+		}
+	}()
+	return out, nil
+}
+
+func newCtxSessionService(t *testing.T, blks []blocks.Block) BlockService {
+	t.Helper()
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(context.Background(), blks))
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	return New(bstore, &ctxSessionExchange{Interface: offline.Exchange(exchbstore)})
+}
+
+func TestSessionCanceledBeforeFirstUse(t *testing.T) {
+	t.Parallel()
+	blks := random.BlocksOfSize(2, blockSize)
+	blk := blks[0]
+	bserv := newCtxSessionService(t, blks)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the exchange is used without session, its panic is avoided
+	ses := newSession(ctx, bserv)
+	require.Equal(t, bserv.Exchange(), ses.grabSession())
+	require.NotPanics(t, func() {
+		got, err := NewSession(ctx, bserv).GetBlock(context.Background(), blk.Cid())
+		require.NoError(t, err)
+		require.Equal(t, blk.Cid(), got.Cid())
+	})
+	var fetched []blocks.Block
+	for b := range NewSession(ctx, bserv).GetBlocks(context.Background(), []cid.Cid{blks[1].Cid()}) {
+		fetched = append(fetched, b)
+	}
+	require.Len(t, fetched, 1)
+	require.Equal(t, blks[1].Cid(), fetched[0].Cid())
+
+	// or the session fails right away
+	strict := NewSession(ctx, bserv, SessionStrictContext())
+	_, err := strict.GetBlock(context.Background(), blk.Cid())
+	require.ErrorIs(t, err, ErrSessionContextCancelled)
+	require.ErrorIs(t, err, ErrSessionClosed)
+	var got []blocks.Block
+	for b := range strict.GetBlocks(context.Background(), []cid.Cid{blk.Cid()}) {
+		got = append(got, b)
+	}
+	require.Empty(t, got)
+}
+
+func TestSessionCanceledBetweenUses(t *testing.T) {
+	t.Parallel()
+	blks := random.BlocksOfSize(2, blockSize)
+	bserv := newCtxSessionService(t, blks)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ses := NewSession(ctx, bserv, SessionStrictContext())
+	_, err := ses.GetBlock(context.Background(), blks[0].Cid())
+	require.NoError(t, err)
+	cancel()
+	_, err = ses.GetBlock(context.Background(), blks[1].Cid())
+	require.ErrorIs(t, err, ErrSessionContextCancelled)
+
+	// without SessionStrictContext the session keeps serving the blocks
+	// stored locally
+	ctx, cancel = context.WithCancel(context.Background())
+	ses = NewSession(ctx, bserv)
+	_, err = ses.GetBlock(context.Background(), blks[0].Cid())
+	require.NoError(t, err)
+	cancel()
+	b, err := ses.GetBlock(context.Background(), blks[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blks[0].Cid(), b.Cid())
+}
+
+func TestSessionCanceledDuringGetBlocks(t *testing.T) {
+	t.Parallel()
+	blks := random.BlocksOfSize(2, blockSize)
+	bserv := newCtxSessionService(t, blks)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ses := NewSession(ctx, bserv, SessionStrictContext())
+	out := ses.GetBlocks(context.Background(), []cid.Cid{blks[0].Cid(), blks[1].Cid()})
+	b, ok := <-out
+	require.True(t, ok)
+	require.Equal(t, blks[0].Cid(), b.Cid())
+
+	// the stream ends with the exchange session
+	cancel()
+	select {
+	case _, ok := <-out:
+		require.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetBlocks did not return after the cancellation of the session")
+	}
+	_, err := ses.GetBlock(context.Background(), blks[1].Cid())
+	require.ErrorIs(t, err, ErrSessionContextCancelled)
+}
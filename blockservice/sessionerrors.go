@@ -0,0 +1,77 @@
+package blockservice
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/ipfs/go-cid"
+)
+
+// sessionErrorsSize is the number of CIDs whose last error is remembered by a
+// [Session].
+const sessionErrorsSize = 1024
+
+// LastError returns the error of the last failed retrieval of c through the
+// session by GetBlock or GetBlocks: rejected by the allowlist, timeout,
+// exchange error... The error is forgotten once c is retrieved, and only the
+// errors of the 1024 most recently failed CIDs are remembered.
+func (s *Session) LastError(c cid.Cid) (error, bool) {
+	return s.errors.get(c)
+}
+
+// sessionErrors remembers the last error of the CIDs which failed, the cache
+// is created by the first failure.
+type sessionErrors struct {
+	lk    sync.Mutex
+	cache *lru.Cache[cid.Cid, error]
+}
+
+func (e *sessionErrors) get(c cid.Cid) (error, bool) {
+	e.lk.Lock()
+	cache := e.cache
+	e.lk.Unlock()
+	if cache == nil {
+		return nil, false
+	}
+	return cache.Get(c)
+}
+
+// failed records err as the last error of c.
+func (e *sessionErrors) failed(c cid.Cid, err error) {
+	e.lk.Lock()
+	if e.cache == nil {
+		e.cache, _ = lru.New[cid.Cid, error](sessionErrorsSize)
+	}
+	cache := e.cache
+	e.lk.Unlock()
+	cache.Add(c, err)
+}
+
+// retrieved forgets the error of c.
+func (e *sessionErrors) retrieved(c cid.Cid) {
+	e.lk.Lock()
+	cache := e.cache
+	e.lk.Unlock()
+	if cache != nil {
+		cache.Remove(c)
+	}
+}
+
+// failureRecorder returns the callback recording the per-CID failures of the
+// shared helpers in the session, nil outside of sessions.
+func (s *Session) failureRecorder() func(cid.Cid, error) {
+	if s == nil {
+		return nil
+	}
+	return s.errors.failed
+}
+
+// failedAll records err as the last error of ks.
+func (s *Session) failedAll(ks []cid.Cid, err error) {
+	if s == nil {
+		return
+	}
+	for _, c := range ks {
+		s.errors.failed(c, err)
+	}
+}
@@ -0,0 +1,101 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/verifcid"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionLastError(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	sha1 := blockWithHash(t, []byte("sha1"), multihash.SHA1)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore),
+		WithAllowlist(verifcid.NewAllowlist(map[uint64]bool{multihash.SHA2_256: true})),
+	)
+	ses := NewSession(ctx, bserv)
+
+	_, err := ses.GetBlock(ctx, blks[0].Cid())
+	require.Error(t, err)
+	for range ses.GetBlocks(ctx, []cid.Cid{blks[1].Cid(), blks[2].Cid(), sha1.Cid()}) {
+	}
+
+	lastErr, ok := ses.LastError(blks[0].Cid())
+	require.True(t, ok)
+	require.True(t, ipld.IsNotFound(lastErr))
+	lastErr, ok = ses.LastError(blks[1].Cid())
+	require.True(t, ok)
+	require.True(t, ipld.IsNotFound(lastErr))
+	lastErr, ok = ses.LastError(sha1.Cid())
+	require.True(t, ok)
+	var allowlistErr *AllowlistError
+	require.ErrorAs(t, lastErr, &allowlistErr)
+
+	// the errors are forgotten once the blocks are retrieved
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	_, err = ses.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	for range ses.GetBlocks(ctx, []cid.Cid{blks[1].Cid()}) {
+	}
+	_, ok = ses.LastError(blks[0].Cid())
+	require.False(t, ok)
+	_, ok = ses.LastError(blks[1].Cid())
+	require.False(t, ok)
+	_, ok = ses.LastError(blks[2].Cid())
+	require.True(t, ok)
+
+	// the errors of the sessions are their own
+	_, err = bserv.GetBlock(ContextWithSession(ctx, bserv), sha1.Cid())
+	require.Error(t, err)
+	_, ok = NewSession(ctx, bserv).LastError(sha1.Cid())
+	require.False(t, ok)
+}
+
+func TestSessionLastErrorFromChannel(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	sha1 := blockWithHash(t, []byte("sha1"), multihash.SHA1)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(bstore),
+		WithAllowlist(verifcid.NewAllowlist(map[uint64]bool{multihash.SHA2_256: true})),
+		WithContentBlocker(func(c cid.Cid) error {
+			if c == blk.Cid() {
+				return errors.New("denied")
+			}
+			return nil
+		}),
+	)
+	ses := NewSession(ctx, bserv)
+
+	ks := make(chan cid.Cid, 2)
+	ks <- sha1.Cid()
+	ks <- blk.Cid()
+	close(ks)
+	for range ses.GetBlocksFromChannel(ctx, ks) {
+	}
+
+	lastErr, ok := ses.LastError(sha1.Cid())
+	require.True(t, ok)
+	var allowlistErr *AllowlistError
+	require.ErrorAs(t, lastErr, &allowlistErr)
+	lastErr, ok = ses.LastError(blk.Cid())
+	require.True(t, ok)
+	require.ErrorIs(t, lastErr, ErrBlocked)
+}
@@ -0,0 +1,35 @@
+package blockservice
+
+import (
+	"context"
+
+	"github.com/ipfs/boxo/exchange"
+)
+
+// SessionFactory creates the exchange session of a [Session] from the context
+// the session was created with and the exchange of the blockservice. A nil
+// fetcher means the exchange is used directly.
+type SessionFactory func(ctx context.Context, ex exchange.Interface) exchange.Fetcher
+
+// WithSessionFactory creates the exchange sessions of the sessions with f,
+// for the exchanges taking options per session which [NewSession] can't
+// express. It replaces the NewSession method of the exchanges implementing
+// [exchange.SessionExchange], and applies to every session of the
+// blockservice: the ones of [NewSession], [ContextWithSession] and the
+// wrappers of [NewScoped].
+func WithSessionFactory(f SessionFactory) Option {
+	return func(bs *blockService) {
+		if f == nil {
+			bs.invalidOption("WithSessionFactory: nil factory")
+			return
+		}
+		bs.sessionFactory = f
+	}
+}
+
+func (s *blockService) getSessionFactory() SessionFactory {
+	if s == nil {
+		return nil
+	}
+	return s.sessionFactory
+}
@@ -0,0 +1,92 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// countingFetcher counts the blocks requested through it.
+type countingFetcher struct {
+	exchange.Fetcher
+	requested *atomic.Int64
+}
+
+func (f countingFetcher) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	f.requested.Add(1)
+	return f.Fetcher.GetBlock(ctx, c)
+}
+
+func (f countingFetcher) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	f.requested.Add(int64(len(ks)))
+	return f.Fetcher.GetBlocks(ctx, ks)
+}
+
+func TestWithSessionFactory(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	ex := offline.Exchange(exchbstore)
+
+	var lk sync.Mutex
+	var created int
+	var requested atomic.Int64
+	direct := false
+	factory := func(_ context.Context, got exchange.Interface) exchange.Fetcher {
+		require.Equal(t, ex, got)
+		lk.Lock()
+		defer lk.Unlock()
+		created++
+		if direct {
+			return nil
+		}
+		return countingFetcher{Fetcher: got, requested: &requested}
+	}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, ex, WithSessionFactory(factory))
+
+	// the sessions of NewSession
+	_, err := NewSession(ctx, bserv).GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.EqualValues(t, 1, requested.Load())
+
+	// the sessions embedded in contexts
+	sesctx := ContextWithSession(ctx, bserv)
+	_, err = bserv.GetBlock(sesctx, blks[1].Cid())
+	require.NoError(t, err)
+	for range bserv.GetBlocks(sesctx, []cid.Cid{blks[2].Cid()}) {
+	}
+	require.EqualValues(t, 3, requested.Load())
+
+	// the scoped wrappers
+	scoped := NewScoped(bserv, func(cid.Cid) bool { return true })
+	_, err = NewSession(ctx, scoped).GetBlock(ctx, blks[3].Cid())
+	require.NoError(t, err)
+	require.EqualValues(t, 4, requested.Load())
+	require.Equal(t, 3, created)
+
+	// a nil fetcher means the exchange is used directly
+	lk.Lock()
+	direct = true
+	lk.Unlock()
+	ses := NewSession(ctx, bserv)
+	require.Equal(t, ex, ses.grabSession())
+	require.EqualValues(t, 4, requested.Load())
+
+	_, err = NewWithOptions(bstore, ex, WithSessionFactory(nil))
+	require.Error(t, err)
+}
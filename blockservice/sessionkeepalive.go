@@ -0,0 +1,62 @@
+package blockservice
+
+import (
+	"time"
+)
+
+// SessionWithKeepAlive decouples the lifetime of the session from the context
+// it is created with: the exchange session lives on a context of its own, and
+// the session is closed once it has not been used for idle instead of when
+// that context is canceled. It suits servers reusing a session across the
+// requests of a connection, beyond the request which created it.
+// The session can still be closed earlier with [Session.Close].
+func SessionWithKeepAlive(idle time.Duration) SessionOption {
+	return func(s *Session) {
+		if idle <= 0 {
+			return
+		}
+		s.keepAlive = idle
+	}
+}
+
+// startKeepAlive arms the idle timer of a session created with
+// [SessionWithKeepAlive].
+func (ses *Session) startKeepAlive() {
+	if ses.keepAlive == 0 {
+		return
+	}
+	ses.useLk.Lock()
+	defer ses.useLk.Unlock()
+	ses.keepAliveTimer = ses.clock.AfterFunc(ses.keepAlive, ses.closeIfIdle)
+}
+
+// closeIfIdle closes the session if it has not been used for keepAlive, or
+// rearms the timer for the end of the idle period otherwise.
+func (ses *Session) closeIfIdle() {
+	ses.useLk.Lock()
+	if ses.closed {
+		ses.useLk.Unlock()
+		return
+	}
+	if ses.active != 0 {
+		ses.keepAliveTimer.Reset(ses.keepAlive)
+		ses.useLk.Unlock()
+		return
+	}
+	if idle := ses.clock.Since(ses.lastUsed); idle < ses.keepAlive {
+		ses.keepAliveTimer.Reset(ses.keepAlive - idle)
+		ses.useLk.Unlock()
+		return
+	}
+	ses.useLk.Unlock()
+
+	logger.Debugf("closing session %d, idle for more than %s", ses.id, ses.keepAlive)
+	ses.Close()
+}
+
+// stopKeepAlive stops the idle timer, useLk must be held.
+func (ses *Session) stopKeepAlive() {
+	if ses.keepAliveTimer != nil {
+		ses.keepAliveTimer.Stop()
+	}
+}
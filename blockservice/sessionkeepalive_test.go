@@ -0,0 +1,79 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// ctxRecordingSessionExchange records the context of the exchange sessions.
+type ctxRecordingSessionExchange struct {
+	exchange.Interface
+	sesctx chan context.Context
+}
+
+func (e *ctxRecordingSessionExchange) NewSession(ctx context.Context) exchange.Fetcher {
+	e.sesctx <- ctx
+	return e.Interface
+}
+
+func TestSessionWithKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	const idle = time.Minute
+	clk := clock.NewMock()
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.Put(context.Background(), blk))
+	exch := &ctxRecordingSessionExchange{Interface: offline.Exchange(exchbstore), sesctx: make(chan context.Context, 1)}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch, WithSessionTracking(time.Hour), WithClock(clk)).(*blockService)
+	defer bserv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ses := NewSession(ctx, bserv, SessionWithKeepAlive(idle))
+	_, err := ses.GetBlock(ctx, blk.Cid())
+	require.NoError(t, err)
+	sesctx := <-exch.sesctx
+
+	// the session outlives the context it was created with while it is used
+	cancel()
+	for range 6 {
+		_, err := ses.GetBlock(context.Background(), blk.Cid())
+		require.NoError(t, err)
+		clk.Add(idle / 2)
+	}
+	require.NoError(t, sesctx.Err())
+	require.Equal(t, 1, bserv.Stats(false).LiveSessions)
+
+	// then it is closed once idle
+	clk.Add(idle)
+	require.Eventually(t, func() bool { return bserv.Stats(false).LiveSessions == 0 }, time.Second, time.Millisecond)
+	require.Error(t, sesctx.Err())
+	_, err = ses.GetBlock(context.Background(), blk.Cid())
+	require.ErrorIs(t, err, ErrSessionClosed)
+}
+
+func TestSessionWithKeepAliveClose(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithSessionTracking(time.Hour)).(*blockService)
+	defer bserv.Close()
+
+	// closing explicitly stops the idle timer
+	ses := NewSession(context.Background(), bserv, SessionWithKeepAlive(time.Hour))
+	require.Equal(t, 1, bserv.Stats(false).LiveSessions)
+	require.NoError(t, ses.Close())
+	require.Zero(t, bserv.Stats(false).LiveSessions)
+	require.False(t, ses.keepAliveTimer.Stop())
+}
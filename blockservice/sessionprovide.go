@@ -0,0 +1,18 @@
+package blockservice
+
+// SessionNoProvide makes the session cache the blocks it fetches without
+// announcing them to the providers, as if every fetch of the session used
+// [ContextWithNoProvide]. It suits short-lived sessions, like the ones serving
+// the requests of a gateway, whose blocks are not worth announcing. The blocks
+// added through the blockservice are still provided.
+func SessionNoProvide() SessionOption {
+	return func(s *Session) {
+		s.noProvide = true
+	}
+}
+
+// providesFetched reports whether the blocks fetched by s are provided, it
+// handles a nil receiver as the fetches outside of sessions.
+func (s *Session) providesFetched() bool {
+	return s == nil || !s.noProvide
+}
@@ -0,0 +1,56 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionNoProvide(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &notifyRecordingExchange{Interface: offline.Exchange(exchbstore), notified: make(map[cid.Cid]int)}
+	bserv := New(bstore, exch, WithProvider(prov))
+
+	blks := random.BlocksOfSize(5, blockSize)
+	require.NoError(t, exchbstore.PutMany(ctx, blks[:4]))
+
+	ses := NewSession(ctx, bserv, SessionNoProvide())
+	_, err := ses.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	for range ses.GetBlocks(ctx, []cid.Cid{blks[1].Cid()}) {
+	}
+
+	// the blocks are cached and the exchange notified, but never provided
+	require.Empty(t, prov.Provided())
+	for _, b := range blks[:2] {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	exch.lk.Lock()
+	require.Len(t, exch.notified, 2)
+	exch.lk.Unlock()
+
+	// the other sessions and the blockservice still provide what they fetch
+	_, err = NewSession(ctx, bserv).GetBlock(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	_, err = bserv.GetBlock(ctx, blks[3].Cid())
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{blks[2].Cid(), blks[3].Cid()}, prov.Provided())
+
+	// and so do the adds
+	require.NoError(t, bserv.AddBlock(ctx, blks[4]))
+	require.Equal(t, []cid.Cid{blks[2].Cid(), blks[3].Cid(), blks[4].Cid()}, prov.Provided())
+}
@@ -0,0 +1,39 @@
+package blockservice
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// sessionIDs hands out the session_id attribute of the session spans.
+var sessionIDs atomic.Uint64
+
+// ID returns the session_id attribute of the spans of the session, it is
+// unique within the process.
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// startSessionSpan starts the span covering the lifetime of s, it is ended
+// when the context the session was created with is canceled.
+// It must be called before sesctx is cleared by grabSession.
+func (s *Session) startSessionSpan() {
+	s.spanOnce.Do(func() {
+		_, s.span = internal.StartSpan(s.sesctx, "Session", trace.WithAttributes(attribute.Int64("session_id", int64(s.id))))
+		grabServiceFromBlockservice(s.bs).tagSpan(s.sesctx, s.span)
+		context.AfterFunc(s.sesctx, func() { s.span.End() })
+	})
+}
+
+// linkSpan ties span, started by an operation of s, to the session span so a
+// trace query can find everything a session did.
+func (s *Session) linkSpan(span trace.Span) {
+	s.startSessionSpan()
+	span.SetAttributes(attribute.Int64("session_id", int64(s.id)))
+	span.AddLink(trace.Link{SpanContext: s.span.SpanContext()})
+}
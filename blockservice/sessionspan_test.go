@@ -0,0 +1,53 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestSessionSpan(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(context.Background(), blks))
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), offline.Exchange(exchbstore))
+
+	sesctx, cancel := context.WithCancel(context.Background())
+	ses := NewSession(sesctx, bserv)
+	sessionID := attribute.Int64("session_id", int64(ses.id))
+
+	// operations run under their own request contexts
+	_, err := ses.GetBlock(context.Background(), blks[0].Cid())
+	require.NoError(t, err)
+	for range ses.GetBlocks(context.Background(), []cid.Cid{blks[1].Cid(), blks[2].Cid()}) {
+	}
+
+	// the session span only ends with the session context
+	require.Empty(t, findSpans("Blockservice.Session", sessionID))
+	cancel()
+	require.Eventually(t, func() bool {
+		return len(findSpans("Blockservice.Session", sessionID)) == 1
+	}, time.Second, time.Millisecond)
+	sessionSpan := findSpans("Blockservice.Session", sessionID)[0].SpanContext()
+
+	for _, name := range []string{"Blockservice.Session.GetBlock", "Blockservice.Session.GetBlocks"} {
+		spans := findSpans(name, sessionID)
+		require.Len(t, spans, 1, name)
+		require.NotEqual(t, sessionSpan.TraceID(), spans[0].SpanContext().TraceID(), name)
+		links := spans[0].Links()
+		require.Len(t, links, 1, name)
+		require.Equal(t, sessionSpan, links[0].SpanContext, name)
+	}
+}
@@ -0,0 +1,187 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrSessionClosed is returned by the operations of a [Session] after
+// [Session.Close], including a session closed by [WithSessionTracking].
+var ErrSessionClosed = errors.New("blockservice session is closed")
+
+// WithSessionTracking keeps track of the sessions created by [NewSession] and
+// [ContextWithSession], and closes the ones which have not been used for
+// idleTimeout, releasing their exchange session. A session closed this way
+// fails with [ErrSessionClosed] if it is used again. The tracked sessions are
+// closed as well when the context they were created with is canceled.
+// The number of live sessions is reported in [Stats.LiveSessions] and by the
+// ipfs_blockservice_live_sessions gauge.
+func WithSessionTracking(idleTimeout time.Duration) Option {
+	return func(bs *blockService) {
+		if idleTimeout <= 0 {
+			bs.invalidOption("WithSessionTracking: the idle timeout must be positive, got %s", idleTimeout)
+			return
+		}
+		bs.sessionIdleTimeout = idleTimeout
+	}
+}
+
+// sessionRegistry holds the live sessions of a blockservice, its methods
+// handle a nil receiver.
+type sessionRegistry struct {
+	idleTimeout time.Duration
+	clock       clock.Clock
+	gauge       prometheus.Gauge // nil without metrics
+
+	lk       sync.Mutex
+	sessions map[*Session]struct{}
+}
+
+// startSessionTracking starts closing the idle sessions until the
+// blockservice is closed.
+func (s *blockService) startSessionTracking() {
+	if s.sessionIdleTimeout == 0 {
+		return
+	}
+	s.sessions = &sessionRegistry{
+		idleTimeout: s.sessionIdleTimeout,
+		clock:       s.clock,
+		sessions:    make(map[*Session]struct{}),
+	}
+	if s.promRegistry != nil {
+		s.sessions.gauge = newLiveSessionsGauge(s.promRegistry)
+	}
+	// the ticker is started before returning for the tests using a mock clock
+	go s.sessions.run(s.serviceCtx, s.clock.Ticker(s.sessionIdleTimeout/2))
+}
+
+func (r *sessionRegistry) add(ses *Session) {
+	if r == nil {
+		return
+	}
+	r.lk.Lock()
+	r.sessions[ses] = struct{}{}
+	r.updateGauge()
+	r.lk.Unlock()
+}
+
+func (r *sessionRegistry) remove(ses *Session) {
+	if r == nil {
+		return
+	}
+	r.lk.Lock()
+	delete(r.sessions, ses)
+	r.updateGauge()
+	r.lk.Unlock()
+}
+
+func (r *sessionRegistry) updateGauge() {
+	if r.gauge != nil {
+		r.gauge.Set(float64(len(r.sessions)))
+	}
+}
+
+func (r *sessionRegistry) len() int {
+	if r == nil {
+		return 0
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return len(r.sessions)
+}
+
+func (r *sessionRegistry) run(ctx context.Context, ticker *clock.Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.closeIdle()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// closeIdle closes the sessions which have not been used for idleTimeout.
+func (r *sessionRegistry) closeIdle() {
+	cutoff := r.clock.Now().Add(-r.idleTimeout)
+	var idle []*Session
+	r.lk.Lock()
+	for ses := range r.sessions {
+		if ses.idleSince(cutoff) {
+			idle = append(idle, ses)
+		}
+	}
+	r.lk.Unlock()
+
+	for _, ses := range idle {
+		logger.Debugf("closing session %d, idle for more than %s", ses.id, r.idleTimeout)
+		ses.Close()
+	}
+}
+
+// use marks ses as in use until the returned function is called, it fails
+// with [ErrSessionClosed] once the session is closed, or
+// [ErrSessionContextCancelled] with [SessionStrictContext]. A nil session is
+// always usable.
+func (ses *Session) use() (func(), error) {
+	if ses == nil {
+		return func() {}, nil
+	}
+	ses.useLk.Lock()
+	defer ses.useLk.Unlock()
+	if ses.strictContext && ses.contextCanceled() {
+		return nil, ErrSessionContextCancelled
+	}
+	if ses.closed {
+		return nil, ErrSessionClosed
+	}
+	ses.active++
+	return func() {
+		ses.useLk.Lock()
+		defer ses.useLk.Unlock()
+		ses.active--
+		ses.lastUsed = ses.clock.Now()
+	}, nil
+}
+
+// idleSince reports whether ses has not been used since cutoff.
+func (ses *Session) idleSince(cutoff time.Time) bool {
+	ses.useLk.Lock()
+	defer ses.useLk.Unlock()
+	return ses.active == 0 && ses.lastUsed.Before(cutoff)
+}
+
+// Close releases the exchange session and the blocks held in memory by the
+// session. The operations started after Close fail with [ErrSessionClosed].
+// With [WithSessionTracking] it is also called when the context the session
+// was created with is canceled, otherwise that cancellation only releases the
+// exchange session and the memory cache, and the session keeps serving the
+// blocks stored locally.
+func (ses *Session) Close() error {
+	ses.useLk.Lock()
+	if ses.closed {
+		ses.useLk.Unlock()
+		return nil
+	}
+	ses.closed = true
+	ses.stopKeepAlive()
+	ses.useLk.Unlock()
+
+	ses.cancel()
+	ses.memCache.close()
+	grabServiceFromBlockservice(ses.bs).getSessions().remove(ses)
+	return nil
+}
+
+func (s *blockService) getSessions() *sessionRegistry {
+	if s == nil {
+		return nil
+	}
+	return s.sessions
+}
@@ -0,0 +1,92 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithSessionTracking(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	const idle = time.Minute
+	clk := clock.NewMock()
+	reg := prometheus.NewRegistry()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithSessionTracking(idle), WithPrometheusRegistry(reg), WithClock(clk)).(*blockService)
+	defer bserv.Close()
+
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	require.NoError(t, bserv.AddBlock(ctx, blk))
+
+	busy := NewSession(ctx, bserv)
+	idler := grabSessionFromContext(ContextWithSession(ctx, bserv), bserv)
+	require.Equal(t, 2, bserv.Stats(false).LiveSessions)
+
+	// the session in use survives, the idle one is closed
+	for range 6 {
+		_, err := busy.GetBlock(ctx, blk.Cid())
+		require.NoError(t, err)
+		clk.Add(idle / 2)
+	}
+	require.Eventually(t, func() bool { return bserv.Stats(false).LiveSessions == 1 }, time.Second, time.Millisecond)
+	require.EqualValues(t, 1, testutil.ToFloat64(bserv.sessions.gauge))
+
+	_, err := idler.GetBlock(ctx, blk.Cid())
+	require.ErrorIs(t, err, ErrSessionClosed)
+	for range idler.GetBlocks(ctx, []cid.Cid{blk.Cid()}) {
+		t.Fatal("a closed session returned a block")
+	}
+
+	require.NoError(t, busy.Close())
+	require.Zero(t, bserv.Stats(false).LiveSessions)
+	_, err = busy.GetBlock(ctx, blk.Cid())
+	require.ErrorIs(t, err, ErrSessionClosed)
+}
+
+func TestSessionClosedWithContext(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithSessionTracking(time.Hour)).(*blockService)
+	defer bserv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ses := NewSession(ctx, bserv)
+	require.Equal(t, 1, bserv.Stats(false).LiveSessions)
+
+	cancel()
+	require.Eventually(t, func() bool { return bserv.Stats(false).LiveSessions == 0 }, time.Second, time.Millisecond)
+	_, err := ses.GetBlock(context.Background(), random.BlocksOfSize(1, blockSize)[0].Cid())
+	require.ErrorIs(t, err, ErrSessionClosed)
+}
+
+func TestSessionNotClosedWithContextUntracked(t *testing.T) {
+	t.Parallel()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil)
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	require.NoError(t, bstore.Put(context.Background(), blk))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = ContextWithSession(ctx, bserv)
+	ses := NewSession(ctx, bserv)
+	cancel()
+
+	// the blocks stored locally are still served
+	got, err := ses.GetBlock(context.Background(), blk.Cid())
+	require.NoError(t, err)
+	require.Equal(t, blk.Cid(), got.Cid())
+}
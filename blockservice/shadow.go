@@ -0,0 +1,171 @@
+package blockservice
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// maxShadowReads bounds the shadow reads of [WithShadowBlockstore] running at
+// once, the reads sampled while it is reached are skipped.
+const maxShadowReads = 16
+
+// ShadowMismatch is the way the candidate blockstore of
+// [WithShadowBlockstore] disagreed with the blockstore.
+type ShadowMismatch int
+
+const (
+	// ShadowMissing means the candidate does not have the block.
+	ShadowMissing ShadowMismatch = iota
+	// ShadowDifferent means the candidate returned different bytes.
+	ShadowDifferent
+)
+
+func (m ShadowMismatch) String() string {
+	switch m {
+	case ShadowMissing:
+		return "missing"
+	case ShadowDifferent:
+		return "different"
+	default:
+		return "unknown"
+	}
+}
+
+// ShadowReader is implemented by the blockservices able to compare their
+// blockstore with a candidate one.
+type ShadowReader interface {
+	// SetShadowBlockstore replaces the candidate blockstore and sample rate of
+	// [WithShadowBlockstore], a nil candidate stops the shadow reads.
+	SetShadowBlockstore(candidate blockstore.Blockstore, sample float64) error
+}
+
+var _ ShadowReader = (*blockService)(nil)
+
+// WithShadowBlockstore reads a sample fraction, between 0 and 1, of the
+// blocks read from the blockstore by GetBlock and GetBlocks from candidate
+// too, to check that both blockstores agree before switching from one to the
+// other. The reads of candidate happen in the background and never change
+// the results nor delay them, the disagreements are counted in the
+// ShadowMismatches stat and reported to the handler of
+// [WithShadowMismatchHandler].
+func WithShadowBlockstore(candidate blockstore.Blockstore, sample float64) Option {
+	return func(bs *blockService) {
+		if candidate == nil {
+			bs.invalidOption("WithShadowBlockstore: nil candidate")
+			return
+		}
+		cfg, err := newShadowConfig(candidate, sample)
+		if err != nil {
+			bs.invalidOption("WithShadowBlockstore: %s", err)
+			return
+		}
+		bs.shadow.cfg.Store(cfg)
+	}
+}
+
+// WithShadowMismatchHandler sets a function called with the CIDs of the blocks
+// on which the candidate blockstore of [WithShadowBlockstore] disagreed. It is
+// called from background goroutines, possibly concurrently.
+func WithShadowMismatchHandler(handler func(cid.Cid, ShadowMismatch)) Option {
+	return func(bs *blockService) {
+		if handler == nil {
+			bs.invalidOption("WithShadowMismatchHandler: nil handler")
+			return
+		}
+		bs.shadow.handler = handler
+	}
+}
+
+type shadowConfig struct {
+	candidate blockstore.Blockstore
+	sample    float64
+}
+
+func newShadowConfig(candidate blockstore.Blockstore, sample float64) (*shadowConfig, error) {
+	if candidate == nil {
+		return nil, nil
+	}
+	if !(sample > 0 && sample <= 1) {
+		return nil, fmt.Errorf("the sample rate must be in (0, 1], got %v", sample)
+	}
+	return &shadowConfig{candidate: candidate, sample: sample}, nil
+}
+
+type shadowReads struct {
+	cfg     atomic.Pointer[shadowConfig]
+	handler func(cid.Cid, ShadowMismatch)
+	slots   atomic.Int32
+
+	mismatches atomic.Uint64
+	skipped    atomic.Uint64
+}
+
+func (s *blockService) SetShadowBlockstore(candidate blockstore.Blockstore, sample float64) error {
+	cfg, err := newShadowConfig(candidate, sample)
+	if err != nil {
+		return fmt.Errorf("SetShadowBlockstore: %w", err)
+	}
+	s.shadow.cfg.Store(cfg)
+	return nil
+}
+
+// shadowRead compares blk, read from the blockstore, with the candidate
+// blockstore in the background if it is sampled.
+func (s *blockService) shadowRead(blk blocks.Block) {
+	if s == nil {
+		return
+	}
+	cfg := s.shadow.cfg.Load()
+	if cfg == nil || rand.Float64() >= cfg.sample {
+		return
+	}
+	if s.shadow.slots.Add(1) > maxShadowReads {
+		s.shadow.slots.Add(-1)
+		s.shadow.skipped.Add(1)
+		return
+	}
+	ctx, done, err := s.track(s.serviceCtx)
+	if err != nil {
+		s.shadow.slots.Add(-1)
+		return
+	}
+	go func() {
+		defer s.shadow.slots.Add(-1)
+		defer done()
+		defer s.recoverPanic("shadow read")
+		c := blk.Cid()
+		other, err := cfg.candidate.Get(ctx, c)
+		switch {
+		case err == nil:
+			if !bytes.Equal(other.RawData(), blk.RawData()) {
+				s.shadowMismatch(c, ShadowDifferent)
+			}
+		case ipld.IsNotFound(err):
+			s.shadowMismatch(c, ShadowMissing)
+		case ctx.Err() == nil:
+			logger.Debugf("shadow read of %s: %s", c, err)
+		}
+	}()
+}
+
+func (s *blockService) shadowMismatch(c cid.Cid, m ShadowMismatch) {
+	logger.Warnf("the shadow blockstore disagrees on %s: %s", c, m)
+	s.shadow.mismatches.Add(1)
+	if s.shadow.handler != nil {
+		s.callShadowMismatchHandler(c, m)
+	}
+}
+
+// callShadowMismatchHandler calls the handler of [WithShadowMismatchHandler],
+// a panic is recovered.
+func (s *blockService) callShadowMismatchHandler(c cid.Cid, m ShadowMismatch) {
+	defer s.recoverPanic("shadow mismatch handler")
+	s.shadow.handler(c, m)
+}
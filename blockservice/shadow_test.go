@@ -0,0 +1,70 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithShadowBlockstore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.PutMany(ctx, blks))
+	candidate := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, candidate.Put(ctx, blks[0]))
+	corrupted, err := blocks.NewBlockWithCid([]byte("corrupted"), blks[1].Cid())
+	require.NoError(t, err)
+	require.NoError(t, candidate.Put(ctx, corrupted))
+
+	var lk sync.Mutex
+	mismatches := make(map[cid.Cid]ShadowMismatch)
+	handler := func(c cid.Cid, m ShadowMismatch) {
+		lk.Lock()
+		defer lk.Unlock()
+		mismatches[c] = m
+	}
+	bserv := New(bstore, nil, WithShadowBlockstore(candidate, 1), WithShadowMismatchHandler(handler)).(*blockService)
+	defer bserv.Close()
+
+	blk, err := bserv.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), blk.RawData())
+	var got []blocks.Block
+	for b := range bserv.GetBlocks(ctx, []cid.Cid{blks[1].Cid(), blks[2].Cid()}) {
+		got = append(got, b)
+	}
+	// the primary results are untouched
+	require.ElementsMatch(t, blks[1:], got)
+
+	require.Eventually(t, func() bool { return bserv.Stats(false).ShadowMismatches == 2 }, time.Second, time.Millisecond)
+	lk.Lock()
+	require.Equal(t, map[cid.Cid]ShadowMismatch{
+		blks[1].Cid(): ShadowDifferent,
+		blks[2].Cid(): ShadowMissing,
+	}, mismatches)
+	lk.Unlock()
+
+	// removed at runtime
+	require.Error(t, bserv.SetShadowBlockstore(candidate, 0))
+	require.NoError(t, bserv.SetShadowBlockstore(nil, 0))
+	_, err = bserv.GetBlock(ctx, blks[2].Cid())
+	require.NoError(t, err)
+	require.EqualValues(t, 2, bserv.Stats(false).ShadowMismatches)
+
+	_, err = NewWithOptions(bstore, nil, WithShadowBlockstore(candidate, 1.5))
+	require.Error(t, err)
+	_, err = NewWithOptions(bstore, nil, WithShadowBlockstore(nil, 1))
+	require.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package blockservice
+
+import (
+	"fmt"
+
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// ErrUnservableBlockSize is returned in the enforce mode of
+// [WithExchangeSizeGuard] for the blocks too large for the exchange to serve.
+type ErrUnservableBlockSize struct {
+	Cid   cid.Cid
+	Size  int
+	Limit int
+}
+
+func (e ErrUnservableBlockSize) Error() string {
+	return fmt.Sprintf("block %s is too large to be served by the exchange: %d bytes, the limit is %d", e.Cid, e.Size, e.Limit)
+}
+
+// Is matches any ErrUnservableBlockSize.
+func (e ErrUnservableBlockSize) Is(err error) bool {
+	_, ok := err.(ErrUnservableBlockSize)
+	return ok
+}
+
+// WithExchangeSizeGuard checks the blocks written by AddBlock, AddBlocks and
+// AddBlocksAtomic against limit, the size of the largest blocks the exchange
+// can send to peers, [exchange.MaxBlockSize] when limit is 0. The larger
+// blocks are counted in the UnservableBlocks stat and logged, or rejected
+// with [ErrUnservableBlockSize] when enforce is true. The blocks fetched from
+// the exchange are not checked.
+func WithExchangeSizeGuard(limit int, enforce bool) Option {
+	return func(bs *blockService) {
+		if limit < 0 {
+			bs.invalidOption("WithExchangeSizeGuard: negative limit %d", limit)
+			return
+		}
+		if limit == 0 {
+			limit = exchange.MaxBlockSize
+		}
+		bs.sizeGuardLimit = limit
+		bs.sizeGuardEnforce = enforce
+	}
+}
+
+// checkServableSize applies [WithExchangeSizeGuard] to b, it only fails in
+// enforce mode.
+func (s *blockService) checkServableSize(b blocks.Block) error {
+	err := s.unservableErr(b)
+	if err == nil {
+		return nil
+	}
+	s.stats.unservableBlocks.Add(1)
+	if s.sizeGuardEnforce {
+		return err
+	}
+	logger.Warnf("adding a block peers won't be able to fetch: %s", err)
+	return nil
+}
+
+// unservableErr returns the [ErrUnservableBlockSize] of b if it is over the
+// limit of [WithExchangeSizeGuard], in both modes.
+func (s *blockService) unservableErr(b blocks.Block) error {
+	if s.sizeGuardLimit == 0 {
+		return nil
+	}
+	if size := len(b.RawData()); size > s.sizeGuardLimit {
+		return ErrUnservableBlockSize{Cid: b.Cid(), Size: size, Limit: s.sizeGuardLimit}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeSizeGuard(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	small := random.BlocksOfSize(2, blockSize)
+	large := random.BlocksOfSize(2, 2*blockSize)
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	warn := New(bstore, nil, WithExchangeSizeGuard(blockSize, false)).(*blockService)
+	require.NoError(t, warn.AddBlock(ctx, large[0]))
+	require.NoError(t, warn.AddBlocks(ctx, []blocks.Block{small[0], large[1]}))
+	require.EqualValues(t, 2, warn.Stats(false).UnservableBlocks)
+
+	bstore = blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	enforce := New(bstore, nil, WithExchangeSizeGuard(blockSize, true)).(*blockService)
+	require.NoError(t, enforce.AddBlock(ctx, small[0]))
+	err := enforce.AddBlock(ctx, large[0])
+	require.Equal(t, ErrUnservableBlockSize{Cid: large[0].Cid(), Size: 2 * blockSize, Limit: blockSize}, err)
+	require.ErrorIs(t, enforce.AddBlocks(ctx, []blocks.Block{small[1], large[1]}), ErrUnservableBlockSize{})
+	for _, b := range append(large, small[1]) {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.False(t, has)
+	}
+	require.EqualValues(t, 2, enforce.Stats(false).UnservableBlocks)
+
+	// with WithSkipInvalid only the large blocks are skipped
+	skip := New(bstore, nil, WithExchangeSizeGuard(blockSize, true), WithSkipInvalid())
+	var skipped *SkippedBlocksError
+	require.ErrorAs(t, skip.AddBlocks(ctx, []blocks.Block{small[1], large[1]}), &skipped)
+	require.Contains(t, skipped.Skipped, large[1].Cid())
+	has, err := bstore.Has(ctx, small[1].Cid())
+	require.NoError(t, err)
+	require.True(t, has)
+
+	require.Equal(t, exchange.MaxBlockSize, New(bstore, nil, WithExchangeSizeGuard(0, true)).(*blockService).sizeGuardLimit)
+	_, err = NewWithOptions(bstore, nil, WithExchangeSizeGuard(-1, true))
+	require.Error(t, err)
+}
@@ -0,0 +1,30 @@
+package blockservice
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+// WithSkipInvalid makes AddBlocks skip the blocks rejected by the allowlist or
+// the content blocker instead of failing the whole call. The other blocks are
+// added normally and a [*SkippedBlocksError] lists the skipped ones.
+func WithSkipInvalid() Option {
+	return func(bs *blockService) {
+		bs.skipInvalid = true
+	}
+}
+
+// SkippedBlocksError is returned by AddBlocks with [WithSkipInvalid] when some
+// blocks were rejected, the other blocks have been added.
+type SkippedBlocksError struct {
+	// Skipped maps the CIDs of the rejected blocks to the reason why.
+	Skipped map[cid.Cid]error
+	// Written is the number of blocks written to the blockstore, the blocks
+	// which were already stored are not counted.
+	Written int
+}
+
+func (e *SkippedBlocksError) Error() string {
+	return fmt.Sprintf("skipped %d invalid blocks, wrote %d blocks", len(e.Skipped), e.Written)
+}
@@ -0,0 +1,47 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddBlocksSkipInvalid(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	blocker := WithContentBlocker(func(c cid.Cid) error {
+		if c == blks[1].Cid() {
+			return errors.New("nope")
+		}
+		return nil
+	})
+
+	strictStore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.ErrorIs(t, New(strictStore, nil, blocker).AddBlocks(ctx, blks), ErrBlocked)
+	has, err := strictStore.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.False(t, has, "the default is to fail before writing anything")
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	err = New(bstore, nil, blocker, WithSkipInvalid()).AddBlocks(ctx, blks)
+	var skipErr *SkippedBlocksError
+	require.ErrorAs(t, err, &skipErr)
+	require.Equal(t, 2, skipErr.Written)
+	require.Len(t, skipErr.Skipped, 1)
+	require.ErrorIs(t, skipErr.Skipped[blks[1].Cid()], ErrBlocked)
+
+	for i, b := range blks {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.Equal(t, i != 1, has)
+	}
+}
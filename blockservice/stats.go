@@ -0,0 +1,284 @@
+package blockservice
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatsReporter is implemented by the blockservices of [New].
+type StatsReporter interface {
+	// Stats returns a snapshot of the counters. When reset is true the
+	// counters of the following snapshots start again from zero, so periodic
+	// pollers get deltas. The gauges, like LiveSessions or ProvideQueue.Depth,
+	// are never reset.
+	Stats(reset bool) Stats
+
+	// PublishExpvar publishes the counters, never reset, as the expvar
+	// variable prefix. It fails when prefix is already published, so each
+	// blockservice of a process needs its own.
+	PublishExpvar(prefix string) error
+}
+
+var _ StatsReporter = (*blockService)(nil)
+
+// Stats is a snapshot of the counters of a blockservice.
+type Stats struct {
+	// ProvidesDropped counts the provides which were skipped because of the
+	// rate limit, a canceled context or a closed blockservice.
+	ProvidesDropped uint64
+	// ProvideFailures counts the failed Provide calls of each provider, in
+	// the order they were passed to [WithProviders].
+	ProvideFailures []uint64
+	// ReprovidesOnRead counts the provides of the blocks read from the
+	// blockstore triggered by [WithReprovideOnRead], which were performed or
+	// queued.
+	ReprovidesOnRead uint64
+	// ProvideSuspensions counts the suspensions of providers by
+	// [WithProvideBackoff] and ProvidersSuspended is the number of providers
+	// currently suspended.
+	ProvideSuspensions uint64
+	ProvidersSuspended int
+	// LiveSessions is the number of sessions tracked by
+	// [WithSessionTracking] which have not been closed.
+	LiveSessions int
+	// PutRetries counts the blockstore writes retried by [WithPutRetry].
+	PutRetries uint64
+	// MissRetries counts the passes of [WithMissRetry] fetching again the
+	// blocks the exchange did not deliver.
+	MissRetries uint64
+	// UnsolicitedBlocks counts the blocks the exchange returned to GetBlocks
+	// without being asked for, or more than once, and to GetBlock in place of
+	// the block asked for, which were dropped.
+	UnsolicitedBlocks uint64
+	// OversizedBlocks counts the blocks from the exchange rejected by
+	// [WithMaxFetchedBlockSize].
+	OversizedBlocks uint64
+	// InvalidBlocks counts the blocks from the exchange rejected by
+	// [WithFetchedBlockValidator].
+	InvalidBlocks uint64
+	// RecentCacheHits and RecentCacheMisses count the lookups in the cache of
+	// [WithRecentCIDCache].
+	RecentCacheHits   uint64
+	RecentCacheMisses uint64
+	// FetchesInFlight is the number of exchange fetches currently running and
+	// PeakFetchesInFlight the highest it has been since the last reset, see
+	// [WithMaxConcurrentFetches].
+	FetchesInFlight     int64
+	PeakFetchesInFlight int64
+	// AddBytes, AddBatchBytes and FetchCacheBytes count the bytes offered to
+	// and written by AddBlock, AddBlocks and AddBlocksAtomic, and the caching
+	// of the blocks fetched from the exchange.
+	AddBytes        WriteBytes
+	AddBatchBytes   WriteBytes
+	FetchCacheBytes WriteBytes
+	// AddNotifyFailures, AddBatchNotifyFailures and FetchCacheNotifyFailures
+	// count the failed calls to NotifyNewBlocks of the exchange announcing
+	// the blocks of the same write paths, see [WithNotifyErrorHandler].
+	AddNotifyFailures        uint64
+	AddBatchNotifyFailures   uint64
+	FetchCacheNotifyFailures uint64
+	// DeferredCacheFailures counts the blocks delivered by [WithEagerDelivery]
+	// which could not be written, announced or provided afterwards.
+	DeferredCacheFailures uint64
+	// FetchThrottles counts the blocks from the exchange held by
+	// [WithFetchRateLimit] and FetchThrottledTime is the sum of their waits.
+	FetchThrottles     uint64
+	FetchThrottledTime time.Duration
+	// ExchangeWaitTime is the time GetBlocks spent waiting for the exchange
+	// to produce blocks, and ConsumerWaitTime the time the blocks received
+	// waited for the consumers of GetBlocks to read them. A consumer wait
+	// much larger than the exchange wait means the consumers are the
+	// bottleneck of the retrievals.
+	ExchangeWaitTime time.Duration
+	ConsumerWaitTime time.Duration
+	// ProvideQueue is the backlog of the provide queue of [WithAsyncProvide],
+	// [WithPersistentProvideQueue] and [ProvideQueue].
+	ProvideQueue QueueStats
+	// AdaptiveBatchSize is the size of the next batch of
+	// [WithAdaptiveBatching], 0 when it is not enabled.
+	AdaptiveBatchSize int
+	// UnservableBlocks counts the blocks added over the limit of
+	// [WithExchangeSizeGuard].
+	UnservableBlocks uint64
+	// CorruptBlocks counts the stored blocks found corrupt by
+	// [WithHashOnLocalRead].
+	CorruptBlocks uint64
+	// ShadowMismatches counts the blocks on which the candidate blockstore
+	// of [WithShadowBlockstore] disagreed and ShadowReadsSkipped the sampled
+	// reads skipped because too many were running.
+	ShadowMismatches   uint64
+	ShadowReadsSkipped uint64
+	// AuditDropped counts the entries of [WithAuditSink] dropped because the
+	// sink did not keep up.
+	AuditDropped uint64
+	// RecoveredPanics counts the panics recovered by GetBlocks, see
+	// [WithStrictPanics].
+	RecoveredPanics uint64
+	// LeakWarnings and LeaksAborted count the GetBlocks calls reported by
+	// [WithLeakDetection] and aborted by [WithLeakAbort].
+	LeakWarnings uint64
+	LeaksAborted uint64
+	// NotifyQueue is the backlog of the blocks waiting to be handed to the
+	// exchange by [WithNotifyCoalescing].
+	NotifyQueue QueueStats
+	// AllowlistRejections counts the CIDs rejected by the allowlist, or the
+	// [SecurityPolicy], see [RejectionInspector].
+	AllowlistRejections uint64
+}
+
+type stats struct {
+	providesDropped    atomic.Uint64
+	provideSuspensions atomic.Uint64
+	reprovidesOnRead   atomic.Uint64
+	putRetries         atomic.Uint64
+	missRetries        atomic.Uint64
+	unsolicitedBlocks  atomic.Uint64
+	oversizedBlocks    atomic.Uint64
+	invalidBlocks      atomic.Uint64
+	localReads         atomic.Uint64
+	corruptBlocks      atomic.Uint64
+	unservableBlocks   atomic.Uint64
+	recoveredPanics    atomic.Uint64
+	leakWarnings       atomic.Uint64
+	leaksAborted       atomic.Uint64
+
+	allowlistRejections atomic.Uint64
+
+	deferredCacheFailures atomic.Uint64
+	fetchThrottles        atomic.Uint64
+	fetchThrottledNanos   atomic.Int64
+	exchangeWaitNanos     atomic.Int64
+	consumerWaitNanos     atomic.Int64
+
+	recentCacheHits   atomic.Uint64
+	recentCacheMisses atomic.Uint64
+
+	fetchesInFlight     atomic.Int64
+	peakFetchesInFlight atomic.Int64
+
+	writes         [writePathCount]writeCounters
+	notifyFailures [writePathCount]atomic.Uint64
+
+	// resetLk guards base, the totals at the last reset.
+	resetLk sync.Mutex
+	base    Stats
+}
+
+func (s *blockService) Stats(reset bool) Stats {
+	s.stats.resetLk.Lock()
+	defer s.stats.resetLk.Unlock()
+	total := s.totalStats()
+	st := total.since(s.stats.base)
+	if reset {
+		s.stats.base = total
+		s.stats.peakFetchesInFlight.Store(total.FetchesInFlight)
+	}
+	return st
+}
+
+// totalStats returns the counters since the blockservice was created.
+func (s *blockService) totalStats() Stats {
+	var provideFailures []uint64
+	var suspended int
+	if len(s.provideTargets) != 0 {
+		provideFailures = make([]uint64, len(s.provideTargets))
+		for i, t := range s.provideTargets {
+			provideFailures[i] = t.failures.Load()
+			if t.backoff.suspended() {
+				suspended++
+			}
+		}
+	}
+	return Stats{
+		ProvidesDropped:    s.stats.providesDropped.Load(),
+		ProvideFailures:    provideFailures,
+		ReprovidesOnRead:   s.stats.reprovidesOnRead.Load(),
+		ProvideSuspensions: s.stats.provideSuspensions.Load(),
+		ProvidersSuspended: suspended,
+		LiveSessions:       s.sessions.len(),
+		PutRetries:         s.stats.putRetries.Load(),
+		MissRetries:        s.stats.missRetries.Load(),
+		UnsolicitedBlocks:  s.stats.unsolicitedBlocks.Load(),
+		OversizedBlocks:    s.stats.oversizedBlocks.Load(),
+		InvalidBlocks:      s.stats.invalidBlocks.Load(),
+
+		RecentCacheHits:   s.stats.recentCacheHits.Load(),
+		RecentCacheMisses: s.stats.recentCacheMisses.Load(),
+
+		FetchesInFlight:     s.stats.fetchesInFlight.Load(),
+		PeakFetchesInFlight: s.stats.peakFetchesInFlight.Load(),
+
+		AddBytes:        s.stats.writes[writePathAdd].snapshot(),
+		AddBatchBytes:   s.stats.writes[writePathAddBatch].snapshot(),
+		FetchCacheBytes: s.stats.writes[writePathFetchCache].snapshot(),
+
+		AddNotifyFailures:        s.stats.notifyFailures[writePathAdd].Load(),
+		AddBatchNotifyFailures:   s.stats.notifyFailures[writePathAddBatch].Load(),
+		FetchCacheNotifyFailures: s.stats.notifyFailures[writePathFetchCache].Load(),
+
+		DeferredCacheFailures: s.stats.deferredCacheFailures.Load(),
+		FetchThrottles:        s.stats.fetchThrottles.Load(),
+		FetchThrottledTime:    time.Duration(s.stats.fetchThrottledNanos.Load()),
+		ExchangeWaitTime:      time.Duration(s.stats.exchangeWaitNanos.Load()),
+		ConsumerWaitTime:      time.Duration(s.stats.consumerWaitNanos.Load()),
+
+		ProvideQueue:       s.provideQueue.stats(),
+		AdaptiveBatchSize:  s.batchSizer.next(),
+		UnservableBlocks:   s.stats.unservableBlocks.Load(),
+		CorruptBlocks:      s.stats.corruptBlocks.Load(),
+		ShadowMismatches:   s.shadow.mismatches.Load(),
+		ShadowReadsSkipped: s.shadow.skipped.Load(),
+		AuditDropped:       s.auditLog.droppedCount(),
+		RecoveredPanics:    s.stats.recoveredPanics.Load(),
+		LeakWarnings:       s.stats.leakWarnings.Load(),
+		LeaksAborted:       s.stats.leaksAborted.Load(),
+
+		AllowlistRejections: s.stats.allowlistRejections.Load(),
+		NotifyQueue:         s.notifier.stats(),
+	}
+}
+
+// since returns st with the counters of base subtracted.
+func (st Stats) since(base Stats) Stats {
+	st.ProvidesDropped -= base.ProvidesDropped
+	if len(base.ProvideFailures) != 0 {
+		failures := make([]uint64, len(st.ProvideFailures))
+		for i := range failures {
+			failures[i] = st.ProvideFailures[i] - base.ProvideFailures[i]
+		}
+		st.ProvideFailures = failures
+	}
+	st.ReprovidesOnRead -= base.ReprovidesOnRead
+	st.ProvideSuspensions -= base.ProvideSuspensions
+	st.PutRetries -= base.PutRetries
+	st.MissRetries -= base.MissRetries
+	st.UnsolicitedBlocks -= base.UnsolicitedBlocks
+	st.OversizedBlocks -= base.OversizedBlocks
+	st.InvalidBlocks -= base.InvalidBlocks
+	st.RecentCacheHits -= base.RecentCacheHits
+	st.RecentCacheMisses -= base.RecentCacheMisses
+	st.AddBytes = st.AddBytes.since(base.AddBytes)
+	st.AddBatchBytes = st.AddBatchBytes.since(base.AddBatchBytes)
+	st.FetchCacheBytes = st.FetchCacheBytes.since(base.FetchCacheBytes)
+	st.AddNotifyFailures -= base.AddNotifyFailures
+	st.AddBatchNotifyFailures -= base.AddBatchNotifyFailures
+	st.FetchCacheNotifyFailures -= base.FetchCacheNotifyFailures
+	st.DeferredCacheFailures -= base.DeferredCacheFailures
+	st.FetchThrottles -= base.FetchThrottles
+	st.FetchThrottledTime -= base.FetchThrottledTime
+	st.ExchangeWaitTime -= base.ExchangeWaitTime
+	st.ConsumerWaitTime -= base.ConsumerWaitTime
+	st.ProvideQueue.Dropped -= base.ProvideQueue.Dropped
+	st.NotifyQueue.Dropped -= base.NotifyQueue.Dropped
+	st.UnservableBlocks -= base.UnservableBlocks
+	st.CorruptBlocks -= base.CorruptBlocks
+	st.ShadowMismatches -= base.ShadowMismatches
+	st.ShadowReadsSkipped -= base.ShadowReadsSkipped
+	st.AuditDropped -= base.AuditDropped
+	st.RecoveredPanics -= base.RecoveredPanics
+	st.LeakWarnings -= base.LeakWarnings
+	st.LeaksAborted -= base.LeaksAborted
+	st.AllowlistRejections -= base.AllowlistRejections
+	return st
+}
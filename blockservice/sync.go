@@ -0,0 +1,61 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+
+	ds "github.com/ipfs/go-datastore"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// ErrSyncUnsupported is returned by Sync when neither the blockstore nor the
+// blockservice has anything able to sync.
+var ErrSyncUnsupported = errors.New("blockstore does not support sync")
+
+// Syncer is implemented by blockstores able to flush the writes they received
+// to durable storage.
+type Syncer interface {
+	Sync(ctx context.Context) error
+}
+
+// datastoreSyncer is implemented by blockstores exposing the datastore Sync
+// method.
+type datastoreSyncer interface {
+	Sync(ctx context.Context, prefix ds.Key) error
+}
+
+// Sync guarantees that every block added before the call is durably stored.
+// Pending notifications of [WithNotifyCoalescing] and provides of the async
+// provide queue are performed first, then the blockstore is synced if it
+// implements [Syncer] or the datastore Sync method.
+// It returns [ErrSyncUnsupported] if nothing could be synced.
+func (s *blockService) Sync(ctx context.Context) error {
+	ctx, span := internal.StartSpan(ctx, "blockService.Sync")
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	synced := false
+	if s.notifier != nil {
+		s.notifier.flush(ctx)
+		synced = true
+	}
+	if s.provideQueue != nil {
+		if err := s.provideQueue.drain(ctx); err != nil {
+			return err
+		}
+		synced = true
+	}
+
+	switch bs := s.blockstore.(type) {
+	case Syncer:
+		return bs.Sync(ctx)
+	case datastoreSyncer:
+		return bs.Sync(ctx, ds.NewKey("/"))
+	}
+
+	if !synced {
+		return ErrSyncUnsupported
+	}
+	return nil
+}
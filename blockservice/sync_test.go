@@ -0,0 +1,41 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+type syncCountingBlockstore struct {
+	blockstore.Blockstore
+	syncs int
+}
+
+func (bs *syncCountingBlockstore) Sync(context.Context) error {
+	bs.syncs++
+	return nil
+}
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil)
+	require.ErrorIs(t, bserv.(*blockService).Sync(ctx), ErrSyncUnsupported)
+
+	bstore := &syncCountingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	prov := &recordingProvider{}
+	bserv = New(bstore, nil, WithProvider(prov), WithAsyncProvide(1, 16))
+	require.NoError(t, bserv.AddBlocks(ctx, random.BlocksOfSize(8, blockSize)))
+	require.NoError(t, bserv.(*blockService).Sync(ctx))
+	require.Len(t, prov.Provided(), 8, "pending provides must be flushed by Sync")
+	require.Equal(t, 1, bstore.syncs)
+
+	require.NoError(t, bserv.Close())
+	require.Equal(t, 2, bstore.syncs, "Close must sync")
+}
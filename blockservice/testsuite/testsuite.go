@@ -0,0 +1,278 @@
+// Package testsuite is a conformance test suite for [blockservice.BlockService]
+// implementations, including the wrappers around another blockservice.
+package testsuite
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-test/random"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+// Capability describes what the blockservices under test support, the tests
+// depending on a capability only run when it is passed to
+// [RunBlockServiceTests].
+type Capability int
+
+const (
+	// Offline declares the blockservices can't fetch blocks from each other,
+	// the exchange tests are skipped.
+	Offline Capability = iota
+	// Bounded declares the blockservices implement
+	// [blockservice.BoundedBlockService].
+	Bounded
+	// Providing declares the blockservices implement
+	// [blockservice.ProvidingBlockService].
+	Providing
+)
+
+// testTimeout bounds every operation of the suite.
+const testTimeout = 10 * time.Second
+
+// RunBlockServiceTests runs the conformance tests against the blockservices
+// returned by factory, a new one for every test. Unless [Offline] is passed,
+// the blockservices returned by successive calls must be able to fetch the
+// blocks added to each other.
+// The suite closes the blockservices it creates.
+func RunBlockServiceTests(t *testing.T, factory func() blockservice.BlockService, caps ...Capability) {
+	s := &suite{
+		factory: factory,
+		offline: slices.Contains(caps, Offline),
+		bounded: slices.Contains(caps, Bounded),
+		provide: slices.Contains(caps, Providing),
+	}
+	t.Run("AddGet", s.testAddGet)
+	t.Run("GetBlocksClose", s.testGetBlocksClose)
+	t.Run("Allowlist", s.testAllowlist)
+	t.Run("FetchCaches", s.testFetchCaches)
+	t.Run("AddNotifies", s.testAddNotifies)
+	t.Run("Close", s.testClose)
+	t.Run("Bounded", s.testBounded)
+	t.Run("Providing", s.testProviding)
+}
+
+type suite struct {
+	factory func() blockservice.BlockService
+	offline bool
+	bounded bool
+	provide bool
+}
+
+// new returns a blockservice closed at the end of the test.
+func (s *suite) new(t *testing.T) blockservice.BlockService {
+	bs := s.factory()
+	t.Cleanup(func() { bs.Close() })
+	return bs
+}
+
+func (s *suite) requireOnline(t *testing.T) {
+	if s.offline {
+		t.Skip("the blockservices are offline")
+	}
+}
+
+func newContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func collect(ch <-chan blocks.Block) []cid.Cid {
+	var got []cid.Cid
+	for b := range ch {
+		got = append(got, b.Cid())
+	}
+	return got
+}
+
+func cids(blks []blocks.Block) []cid.Cid {
+	ks := make([]cid.Cid, len(blks))
+	for i, b := range blks {
+		ks[i] = b.Cid()
+	}
+	return ks
+}
+
+func (s *suite) testAddGet(t *testing.T) {
+	ctx := newContext(t)
+	bs := s.new(t)
+	blks := random.BlocksOfSize(5, 1024)
+
+	require.NoError(t, bs.AddBlock(ctx, blks[0]))
+	require.NoError(t, bs.AddBlocks(ctx, blks[1:]))
+
+	got, err := bs.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), got.RawData())
+	require.ElementsMatch(t, cids(blks), collect(bs.GetBlocks(ctx, cids(blks))))
+
+	require.NoError(t, bs.DeleteBlock(ctx, blks[0].Cid()))
+	has, err := bs.Blockstore().Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func (s *suite) testGetBlocksClose(t *testing.T) {
+	ctx := newContext(t)
+	bs := s.new(t)
+	blks := random.BlocksOfSize(3, 1024)
+	require.NoError(t, bs.AddBlocks(ctx, blks[:2]))
+
+	require.Empty(t, collect(bs.GetBlocks(ctx, nil)))
+
+	// the channel is closed once the missing block can't be found, or the
+	// context is canceled
+	getCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	out := bs.GetBlocks(getCtx, cids(blks))
+	var got []cid.Cid
+	for range 2 {
+		select {
+		case b, ok := <-out:
+			require.True(t, ok, "closed before returning the local blocks")
+			got = append(got, b.Cid())
+		case <-ctx.Done():
+			t.Fatal("local blocks not returned")
+		}
+	}
+	require.ElementsMatch(t, cids(blks[:2]), got)
+	cancel()
+	require.Empty(t, collect(out))
+}
+
+// invalidBlock returns a block the allowlist of bs rejects, with ok false if
+// there isn't any.
+func (s *suite) invalidBlock(bs blockservice.BlockService) (blocks.Block, bool) {
+	var allowlist verifcid.Allowlist = verifcid.DefaultAllowlist
+	if bbs, ok := bs.(blockservice.BoundedBlockService); ok {
+		allowlist = bbs.Allowlist()
+	}
+	data := []byte("rejected by the allowlist")
+	for _, code := range []uint64{mh.SHA2_256, mh.MD5, mh.SHA1} {
+		// a 16 bytes digest is below the minimum length of the allowlists
+		hash, err := mh.Encode(make([]byte, 16), code)
+		if err != nil {
+			continue
+		}
+		c := cid.NewCidV1(cid.Raw, hash)
+		if verifcid.ValidateCid(allowlist, c) == nil {
+			continue
+		}
+		b, err := blocks.NewBlockWithCid(data, c)
+		if err != nil {
+			continue
+		}
+		return b, true
+	}
+	return nil, false
+}
+
+func (s *suite) testAllowlist(t *testing.T) {
+	ctx := newContext(t)
+	bs := s.new(t)
+	invalid, ok := s.invalidBlock(bs)
+	if !ok {
+		t.Skip("the allowlist accepts every hash")
+	}
+	valid := random.BlocksOfSize(1, 1024)[0]
+
+	require.Error(t, bs.AddBlock(ctx, invalid))
+	require.Error(t, bs.AddBlocks(ctx, []blocks.Block{valid, invalid}))
+	_, err := bs.GetBlock(ctx, invalid.Cid())
+	require.Error(t, err)
+
+	require.NoError(t, bs.AddBlock(ctx, valid))
+	require.Equal(t, []cid.Cid{valid.Cid()}, collect(bs.GetBlocks(ctx, []cid.Cid{invalid.Cid(), valid.Cid()})))
+}
+
+func (s *suite) testFetchCaches(t *testing.T) {
+	s.requireOnline(t)
+	ctx := newContext(t)
+	remote, local := s.new(t), s.new(t)
+	blks := random.BlocksOfSize(4, 1024)
+	require.NoError(t, remote.AddBlocks(ctx, blks))
+
+	got, err := local.GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.Equal(t, blks[0].RawData(), got.RawData())
+	require.ElementsMatch(t, cids(blks[1:]), collect(local.GetBlocks(ctx, cids(blks[1:]))))
+
+	for _, b := range blks {
+		has, err := local.Blockstore().Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has, "fetched block not cached")
+	}
+}
+
+func (s *suite) testAddNotifies(t *testing.T) {
+	s.requireOnline(t)
+	ctx := newContext(t)
+	remote, local := s.new(t), s.new(t)
+	blk := random.BlocksOfSize(1, 1024)[0]
+
+	// the pending fetch is only served if the exchange is told about the
+	// added block
+	type result struct {
+		blk blocks.Block
+		err error
+	}
+	fetched := make(chan result, 1)
+	go func() {
+		b, err := local.GetBlock(ctx, blk.Cid())
+		fetched <- result{b, err}
+	}()
+	// added once the fetch reached the exchange, when local reports its wants
+	if wants, ok := local.(blockservice.WantInspector); ok {
+		require.Eventually(t, func() bool {
+			wanted, _ := wants.IsWanted(blk.Cid())
+			return wanted
+		}, 10*time.Second, time.Millisecond)
+	}
+	require.NoError(t, remote.AddBlock(ctx, blk))
+
+	r := <-fetched
+	require.NoError(t, r.err)
+	require.Equal(t, blk.RawData(), r.blk.RawData())
+}
+
+func (s *suite) testClose(t *testing.T) {
+	ctx := newContext(t)
+	bs := s.factory()
+	blk := random.BlocksOfSize(1, 1024)[0]
+	require.NoError(t, bs.AddBlock(ctx, blk))
+
+	require.NoError(t, bs.Close())
+	require.Error(t, bs.AddBlock(ctx, random.BlocksOfSize(1, 1024)[0]))
+	_, err := bs.GetBlock(ctx, blk.Cid())
+	require.Error(t, err)
+	require.Empty(t, collect(bs.GetBlocks(ctx, []cid.Cid{blk.Cid()})))
+}
+
+func (s *suite) testBounded(t *testing.T) {
+	if !s.bounded {
+		t.Skip("the blockservices are not bounded")
+	}
+	bs := s.new(t)
+	bbs, ok := bs.(blockservice.BoundedBlockService)
+	require.True(t, ok, "%T does not implement BoundedBlockService", bs)
+	require.NotNil(t, bbs.Allowlist())
+}
+
+func (s *suite) testProviding(t *testing.T) {
+	if !s.provide {
+		t.Skip("the blockservices are not providing")
+	}
+	bs := s.new(t)
+	pbs, ok := bs.(blockservice.ProvidingBlockService)
+	require.True(t, ok, "%T does not implement ProvidingBlockService", bs)
+	// the provider is passed through as is, calling it twice is stable
+	require.Equal(t, pbs.Provider(), pbs.Provider())
+}
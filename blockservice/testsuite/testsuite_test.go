@@ -0,0 +1,57 @@
+package testsuite
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	testinstance "github.com/ipfs/boxo/bitswap/testinstance"
+	tn "github.com/ipfs/boxo/bitswap/testnet"
+	"github.com/ipfs/boxo/blockservice"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	mockrouting "github.com/ipfs/boxo/routing/mock"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	delay "github.com/ipfs/go-ipfs-delay"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// onlineFactory returns blockservices backed by bitswap instances connected
+// to each other.
+func onlineFactory(t *testing.T, opts ...blockservice.Option) func() blockservice.BlockService {
+	gen := testinstance.NewTestInstanceGenerator(tn.VirtualNetwork(delay.Fixed(0)), mockrouting.NewServer(), nil, nil)
+	t.Cleanup(func() { gen.Close() })
+
+	var lk sync.Mutex
+	var instances []testinstance.Instance
+	return func() blockservice.BlockService {
+		lk.Lock()
+		defer lk.Unlock()
+		inst := gen.Next()
+		for _, other := range instances {
+			if err := inst.Adapter.Connect(context.Background(), peer.AddrInfo{ID: other.Identity.ID()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		instances = append(instances, inst)
+		return blockservice.New(inst.Blockstore, inst.Exchange, opts...)
+	}
+}
+
+func TestBlockService(t *testing.T) {
+	RunBlockServiceTests(t, onlineFactory(t), Bounded, Providing)
+}
+
+func TestBlockServiceOffline(t *testing.T) {
+	RunBlockServiceTests(t, func() blockservice.BlockService {
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		return blockservice.New(bstore, offline.Exchange(bstore))
+	}, Offline, Bounded, Providing)
+}
+
+func TestBlockServiceNoExchange(t *testing.T) {
+	RunBlockServiceTests(t, func() blockservice.BlockService {
+		return blockservice.New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil)
+	}, Offline, Bounded, Providing)
+}
@@ -0,0 +1,75 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OperationTimeouts are the default timeouts of the blockservice operations,
+// a zero value means no timeout.
+type OperationTimeouts struct {
+	// Get applies to GetBlock and GetSize.
+	Get time.Duration
+	// GetMany applies to GetBlocks, it bounds the lifetime of the returned
+	// channel.
+	GetMany time.Duration
+	// Add applies to AddBlock and AddBlocks.
+	Add time.Duration
+	// Delete applies to DeleteBlock.
+	Delete time.Duration
+}
+
+// WithOperationTimeouts sets default timeouts for the operations of the
+// blockservice and of its sessions. They are applied when the context of the
+// operation has no earlier deadline, a shorter caller deadline is never
+// extended.
+func WithOperationTimeouts(timeouts OperationTimeouts) Option {
+	return func(bs *blockService) {
+		if timeouts.Get < 0 || timeouts.GetMany < 0 || timeouts.Add < 0 || timeouts.Delete < 0 {
+			bs.invalidOption("WithOperationTimeouts: negative timeout in %+v", timeouts)
+			return
+		}
+		bs.timeouts = timeouts
+	}
+}
+
+// withTimeout derives a context bounded by the service default timeout d,
+// recording on the span which deadline applies.
+// It handles a nil receiver by applying no timeout.
+func (s *blockService) withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if s == nil {
+		return ctx, func() {}
+	}
+
+	span := trace.SpanFromContext(ctx)
+	deadline, hasDeadline := ctx.Deadline()
+	switch {
+	case d == 0 && !hasDeadline:
+		span.SetAttributes(attribute.String("timeout_source", "none"))
+	case d == 0 || (hasDeadline && s.clock.Until(deadline) <= d):
+		span.SetAttributes(attribute.String("timeout_source", "caller"))
+	default:
+		span.SetAttributes(attribute.String("timeout_source", "service"))
+		return s.clock.WithTimeout(ctx, d)
+	}
+	return ctx, func() {}
+}
+
+// getTimeout and getManyTimeout handle a nil receiver for the shared
+// getBlock and getBlocks helpers.
+func (s *blockService) getTimeout() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return s.timeouts.Get
+}
+
+func (s *blockService) getManyTimeout() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return s.timeouts.GetMany
+}
@@ -0,0 +1,50 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestOperationTimeouts(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+
+	exch := &hangingExchange{getsStarted: make(chan struct{}, 3)}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch, WithOperationTimeouts(OperationTimeouts{
+		Get:     20 * time.Millisecond,
+		GetMany: 20 * time.Millisecond,
+	}))
+
+	blks := random.BlocksOfSize(3, blockSize)
+	_, err := bserv.GetBlock(context.Background(), blks[0].Cid())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	spans := findSpans("Blockservice.blockService.GetBlock", attribute.Stringer("CID", blks[0].Cid()))
+	require.Len(t, spans, 1)
+	source, _ := spanAttribute(spans[0], "timeout_source")
+	require.Equal(t, "service", source.AsString())
+
+	start := time.Now()
+	for range bserv.GetBlocks(context.Background(), []cid.Cid{blks[1].Cid()}) {
+	}
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// a shorter caller deadline wins
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = NewSession(ctx, bserv).GetBlock(ctx, blks[2].Cid())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	spans = findSpans("Blockservice.Session.GetBlock", attribute.Stringer("CID", blks[2].Cid()))
+	require.Len(t, spans, 1)
+	source, _ = spanAttribute(spans[0], "timeout_source")
+	require.Equal(t, "caller", source.AsString())
+}
@@ -0,0 +1,74 @@
+package blockservice
+
+import (
+	"context"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithExchangeBaggage sets the baggage members, from the context of the
+// operations, which are passed to the exchange with the fetches, so the
+// exchange implementation and its peers can log a request ID for example. The
+// other members are removed from the contexts of the fetches.
+// The default passes the whole baggage of the operations.
+func WithExchangeBaggage(keys ...string) Option {
+	return func(bs *blockService) {
+		for _, k := range keys {
+			if k == "" {
+				bs.invalidOption("WithExchangeBaggage: empty key")
+				return
+			}
+		}
+		bs.exchangeBaggage = append([]string{}, keys...)
+	}
+}
+
+// exchangeContext returns the context of a fetch from the exchange, carrying
+// the baggage members of [WithExchangeBaggage].
+func (s *blockService) exchangeContext(ctx context.Context) context.Context {
+	if s == nil || s.exchangeBaggage == nil {
+		return ctx
+	}
+	bag := baggage.FromContext(ctx)
+	members := make([]baggage.Member, 0, len(s.exchangeBaggage))
+	for _, k := range s.exchangeBaggage {
+		if m := bag.Member(k); m.Key() != "" {
+			members = append(members, m)
+		}
+	}
+	selected, err := baggage.New(members...)
+	if err != nil {
+		logger.Debugf("exchange baggage: %s", err)
+	}
+	return baggage.ContextWithBaggage(ctx, selected)
+}
+
+// taskOrigin is the trace context of the operation which queued a background
+// task, the operation has usually ended by the time the task runs.
+type taskOrigin struct {
+	span    trace.SpanContext
+	baggage baggage.Baggage
+}
+
+func originOf(ctx context.Context) taskOrigin {
+	return taskOrigin{
+		span:    trace.SpanContextFromContext(ctx),
+		baggage: baggage.FromContext(ctx),
+	}
+}
+
+// startSpan starts the span of the task on ctx, linked to the span of the
+// operation which queued it, and restores the baggage of the operation.
+func (o taskOrigin) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithAttributes(attrs...)}
+	if o.span.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: o.span}))
+	}
+	if o.baggage.Len() != 0 {
+		ctx = baggage.ContextWithBaggage(ctx, o.baggage)
+	}
+	return internal.StartSpan(ctx, name, opts...)
+}
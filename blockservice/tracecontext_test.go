@@ -0,0 +1,123 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// baggageRecordingProvider records the baggage of the provides.
+type baggageRecordingProvider struct {
+	recordingProvider
+	bag chan baggage.Baggage
+}
+
+func (p *baggageRecordingProvider) Provide(ctx context.Context, c cid.Cid, announce bool) error {
+	p.bag <- baggage.FromContext(ctx)
+	return p.recordingProvider.Provide(ctx, c, announce)
+}
+
+// baggageRecordingExchange records the baggage of the fetches.
+type baggageRecordingExchange struct {
+	exchange.Interface
+	bag chan baggage.Baggage
+}
+
+func (e *baggageRecordingExchange) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	e.bag <- baggage.FromContext(ctx)
+	return e.Interface.GetBlock(ctx, c)
+}
+
+func withBaggage(t *testing.T, ctx context.Context, kv ...string) context.Context {
+	t.Helper()
+	var members []baggage.Member
+	for i := 0; i < len(kv); i += 2 {
+		m, err := baggage.NewMember(kv[i], kv[i+1])
+		require.NoError(t, err)
+		members = append(members, m)
+	}
+	bag, err := baggage.New(members...)
+	require.NoError(t, err)
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+func TestQueuedProvideTraceContext(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+
+	prov := &baggageRecordingProvider{bag: make(chan baggage.Baggage, 1)}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithProvider(prov), WithAsyncProvide(1, 4))
+	defer bserv.Close()
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	ctx = withBaggage(t, ctx, "request-id", "42")
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	require.NoError(t, bserv.AddBlock(ctx, blk))
+	root.End()
+
+	// the provide runs once the operation has ended, with its baggage
+	bag := <-prov.bag
+	require.Equal(t, "42", bag.Member("request-id").Value())
+
+	// linked to the AddBlock span, in the trace of the operation
+	var links []string
+	require.Eventually(t, func() bool {
+		found := findSpans("Blockservice.provideQueue.provide", attribute.Stringer("CID", blk.Cid()))
+		if len(found) == 0 {
+			return false
+		}
+		span := found[0]
+		require.NotEqual(t, root.SpanContext().TraceID(), span.SpanContext().TraceID())
+		for _, l := range span.Links() {
+			links = append(links, l.SpanContext.TraceID().String())
+		}
+		return true
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{root.SpanContext().TraceID().String()}, links)
+}
+
+func TestWithExchangeBaggage(t *testing.T) {
+	t.Parallel()
+
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.Put(context.Background(), blk))
+	ctx := withBaggage(t, context.Background(), "request-id", "42", "user", "secret")
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want map[string]string
+	}{
+		{"default", nil, map[string]string{"request-id": "42", "user": "secret"}},
+		{"selected", []Option{WithExchangeBaggage("request-id", "missing")}, map[string]string{"request-id": "42"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			exch := &baggageRecordingExchange{Interface: offline.Exchange(exchbstore), bag: make(chan baggage.Baggage, 1)}
+			bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+			bserv := New(bstore, exch, tc.opts...)
+
+			_, err := bserv.GetBlock(ctx, blk.Cid())
+			require.NoError(t, err)
+			got := make(map[string]string)
+			for _, m := range (<-exch.bag).Members() {
+				got[m.Key()] = m.Value()
+			}
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+// WithTraceSampling makes GetBlocks trace one block out of oneInN of each
+// call with a child span recording where it was found, the fetch duration
+// and the cache write. The first requested block and every oneInN-th after it
+// are sampled and their CIDs are listed in the sampled_cids attribute of the
+// GetBlocks span. It is off by default, and only applies to traced calls.
+func WithTraceSampling(oneInN int) Option {
+	return func(bs *blockService) {
+		if oneInN <= 0 {
+			bs.invalidOption("WithTraceSampling: the sampling rate must be positive, got %d", oneInN)
+			return
+		}
+		bs.traceSampling = oneInN
+	}
+}
+
+// blockSampler traces the sampled blocks of one getBlocks call. A nil sampler
+// does nothing.
+type blockSampler struct {
+	ctx        context.Context
+	sampled    map[cid.Cid]*sampledBlock
+	fetchStart time.Time
+}
+
+type sampledBlock struct {
+	start    time.Time
+	received time.Time
+	done     bool
+}
+
+// newBlockSampler returns nil unless sampling is enabled and the getBlocks
+// call is traced.
+func (s *blockService) newBlockSampler(ctx context.Context, ks []cid.Cid) *blockSampler {
+	if s == nil || s.traceSampling == 0 || len(ks) == 0 {
+		return nil
+	}
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return nil
+	}
+	bs := &blockSampler{ctx: ctx, sampled: make(map[cid.Cid]*sampledBlock)}
+	var cids []string
+	for i := 0; i < len(ks); i += s.traceSampling {
+		if _, ok := bs.sampled[ks[i]]; ok {
+			continue
+		}
+		bs.sampled[ks[i]] = &sampledBlock{}
+		cids = append(cids, ks[i].String())
+	}
+	parent.SetAttributes(attribute.StringSlice("sampled_cids", cids))
+	return bs
+}
+
+// lookup returns the start time of the local lookup of c, or the zero time
+// when c is not sampled.
+func (bs *blockSampler) lookup(c cid.Cid) time.Time {
+	if bs == nil {
+		return time.Time{}
+	}
+	sb, ok := bs.sampled[c]
+	if !ok {
+		return time.Time{}
+	}
+	sb.start = time.Now()
+	return sb.start
+}
+
+// local records the result of the local lookup of c started at start.
+func (bs *blockSampler) local(c cid.Cid, source RetrievalSource, start time.Time) {
+	if bs == nil || start.IsZero() || source == "" {
+		return
+	}
+	bs.span(c, bs.sampled[c], attribute.String("source", string(source)), attribute.String("outcome", outcomeFound))
+}
+
+func (bs *blockSampler) fetchStarted() {
+	if bs != nil {
+		bs.fetchStart = time.Now()
+	}
+}
+
+// received records b was received from the exchange.
+func (bs *blockSampler) received(b blocks.Block) {
+	if bs == nil {
+		return
+	}
+	if sb, ok := bs.sampled[b.Cid()]; ok {
+		sb.received = time.Now()
+	}
+}
+
+// fetched records b has been cached, err is the error of the cache write.
+func (bs *blockSampler) fetched(b blocks.Block, err error) {
+	if bs == nil {
+		return
+	}
+	sb, ok := bs.sampled[b.Cid()]
+	if !ok || sb.done || sb.received.IsZero() {
+		return
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("source", string(SourceExchange)),
+		attribute.Int("bytes", len(b.RawData())),
+		attribute.Int64("fetch_ns", sb.received.Sub(bs.fetchStart).Nanoseconds()),
+		attribute.Int64("cache_write_ns", time.Since(sb.received).Nanoseconds()),
+	}
+	if err != nil {
+		attrs = append(attrs, attribute.String("outcome", outcomeError))
+		span := bs.start(b.Cid(), sb, attrs...)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return
+	}
+	bs.span(b.Cid(), sb, append(attrs, attribute.String("outcome", outcomeFound))...)
+}
+
+// end records the sampled blocks which were not returned.
+func (bs *blockSampler) end() {
+	if bs == nil {
+		return
+	}
+	for c, sb := range bs.sampled {
+		if !sb.done {
+			bs.span(c, sb, attribute.String("outcome", outcomeNotFound))
+		}
+	}
+}
+
+func (bs *blockSampler) start(c cid.Cid, sb *sampledBlock, attrs ...attribute.KeyValue) trace.Span {
+	sb.done = true
+	opts := []trace.SpanStartOption{trace.WithAttributes(append(attrs, attribute.Stringer("CID", c))...)}
+	if !sb.start.IsZero() {
+		opts = append(opts, trace.WithTimestamp(sb.start))
+	}
+	_, span := internal.StartSpan(bs.ctx, "getBlocks.block", opts...)
+	return span
+}
+
+func (bs *blockSampler) span(c cid.Cid, sb *sampledBlock, attrs ...attribute.KeyValue) {
+	bs.start(c, sb, attrs...).End()
+}
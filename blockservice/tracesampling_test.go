@@ -0,0 +1,65 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+)
+
+func TestWithTraceSampling(t *testing.T) {
+	t.Parallel()
+	recordSpans()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(6, blockSize)
+	missing := random.BlocksOfSize(1, blockSize)[0].Cid()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, blks[0]))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[1:]))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithTraceSampling(3))
+
+	ks := []cid.Cid{missing}
+	for _, b := range blks {
+		ks = append(ks, b.Cid())
+	}
+	ctx, root := otel.Tracer("test").Start(ctx, "root")
+	for range bserv.GetBlocks(ctx, ks) {
+	}
+	root.End()
+
+	parents := spansInTrace(root, "Blockservice.blockService.GetBlocks")
+	require.Len(t, parents, 1)
+	v, ok := spanAttribute(parents[0], "sampled_cids")
+	require.True(t, ok)
+	require.Equal(t, []string{missing.String(), blks[2].Cid().String(), blks[5].Cid().String()}, v.AsStringSlice())
+
+	sampled := spansInTrace(root, "Blockservice.getBlocks.block")
+	require.Len(t, sampled, 3)
+	outcomes := make(map[string]string)
+	for _, s := range sampled {
+		c, _ := spanAttribute(s, "CID")
+		outcome, _ := spanAttribute(s, "outcome")
+		outcomes[c.AsString()] = outcome.AsString()
+		require.Equal(t, parents[0].SpanContext().SpanID(), s.Parent().SpanID())
+		if c.AsString() == blks[2].Cid().String() {
+			source, _ := spanAttribute(s, "source")
+			require.Equal(t, string(SourceExchange), source.AsString())
+			_, ok := spanAttribute(s, "fetch_ns")
+			require.True(t, ok)
+		}
+	}
+	require.Equal(t, map[string]string{
+		missing.String():       outcomeNotFound,
+		blks[2].Cid().String(): outcomeFound,
+		blks[5].Cid().String(): outcomeFound,
+	}, outcomes)
+}
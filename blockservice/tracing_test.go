@@ -0,0 +1,52 @@
+package blockservice
+
+import (
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a global tracer provider recording every span, tests
+// find their own spans with [findSpans] since they may run in parallel.
+func recordSpans() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+// findSpans returns the ended spans named name having the attribute attr.
+func findSpans(name string, attr attribute.KeyValue) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, s := range recordSpans().Ended() {
+		if s.Name() != name {
+			continue
+		}
+		for _, a := range s.Attributes() {
+			if a == attr {
+				spans = append(spans, s)
+				break
+			}
+		}
+	}
+	return spans
+}
+
+// spanAttribute returns the value of the attribute key of s.
+func spanAttribute(s sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, a := range s.Attributes() {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
@@ -0,0 +1,58 @@
+package blockservice
+
+import (
+	"sync"
+
+	"github.com/ipfs/go-cid"
+)
+
+// requestedBlocks is the set of blocks a getBlocks call requested from the
+// exchange and has not received yet, the blocks outside of it are dropped.
+type requestedBlocks struct {
+	lk      sync.Mutex
+	pending map[cid.Cid]struct{}
+}
+
+func newRequestedBlocks(ks []cid.Cid) *requestedBlocks {
+	r := &requestedBlocks{pending: make(map[cid.Cid]struct{}, len(ks))}
+	for _, c := range ks {
+		r.pending[c] = struct{}{}
+	}
+	return r
+}
+
+// receive takes c out of the set, it returns false if c was never requested
+// or has already been received.
+func (r *requestedBlocks) receive(c cid.Cid) bool {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if _, ok := r.pending[c]; !ok {
+		return false
+	}
+	delete(r.pending, c)
+	return true
+}
+
+// remaining returns the blocks not received yet.
+func (r *requestedBlocks) remaining() []cid.Cid {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	ks := make([]cid.Cid, 0, len(r.pending))
+	for c := range r.pending {
+		ks = append(ks, c)
+	}
+	return ks
+}
+
+// dropUnsolicited counts the block c, which the exchange returned without being asked
+// for, in place of the block asked for or more than once, the warning is
+// logged at most once a minute.
+func (s *blockService) dropUnsolicited(c cid.Cid) {
+	if s == nil {
+		return
+	}
+	s.stats.unsolicitedBlocks.Add(1)
+	s.unsolicitedWarn.Do(func() {
+		logger.Warnf("dropped block %s the exchange returned without being asked for, or more than once", c)
+	})
+}
@@ -0,0 +1,99 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// hostileExchange answers every GetBlocks with its blocks, whatever was asked
+// for, each of them twice, and every GetBlock with its first block.
+type hostileExchange struct {
+	blks     []blocks.Block
+	notified []blocks.Block
+}
+
+func (e *hostileExchange) GetBlock(context.Context, cid.Cid) (blocks.Block, error) {
+	return e.blks[0], nil
+}
+
+func (e *hostileExchange) GetBlocks(ctx context.Context, _ []cid.Cid) (<-chan blocks.Block, error) {
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		for range 2 {
+			for _, b := range e.blks {
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (e *hostileExchange) NotifyNewBlocks(_ context.Context, bs ...blocks.Block) error {
+	e.notified = append(e.notified, bs...)
+	return nil
+}
+
+func (e *hostileExchange) Close() error { return nil }
+
+func TestUnsolicitedBlocksDropped(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	exch := &hostileExchange{blks: blks}
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch, WithProvider(prov))
+
+	var got []cid.Cid
+	for b := range bserv.GetBlocks(ctx, []cid.Cid{blks[0].Cid(), blks[2].Cid()}) {
+		got = append(got, b.Cid())
+	}
+	require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[2].Cid()}, got)
+
+	// the blocks not asked for and the repeats are neither cached, announced
+	// nor provided
+	for i, b := range blks {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.Equal(t, i%2 == 0, has)
+	}
+	require.Len(t, exch.notified, 2)
+	require.ElementsMatch(t, got, prov.Provided())
+	require.EqualValues(t, 6, bserv.(*blockService).Stats(false).UnsolicitedBlocks)
+}
+
+func TestUnsolicitedBlockDropped(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	exch := &hostileExchange{blks: blks}
+	prov := &recordingProvider{}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch, WithProvider(prov))
+
+	// an other block than the one asked for is neither returned nor cached
+	_, err := bserv.GetBlock(ctx, blks[1].Cid())
+	require.True(t, ipld.IsNotFound(err))
+	has, err := bstore.Has(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+	require.Empty(t, exch.notified)
+	require.Empty(t, prov.Provided())
+	require.EqualValues(t, 1, bserv.(*blockService).Stats(false).UnsolicitedBlocks)
+}
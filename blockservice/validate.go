@@ -0,0 +1,112 @@
+package blockservice
+
+import (
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// ValidatingBlockService is a [BlockService] exposing the checks it applies
+// to the blocks it stores, so importers and exchanges can run the same checks
+// before handing it blocks. The errors are the ones returned by the
+// operations.
+type ValidatingBlockService interface {
+	BlockService
+
+	// ValidateCid checks c against the allowlist, or the [SecurityPolicy],
+	// and the content blocker, it applies to every operation.
+	ValidateCid(c cid.Cid) error
+
+	// ValidateBlock runs the checks of AddBlock and AddBlocks: ValidateCid,
+	// the block checks of the [SecurityPolicy], then the hash verification of
+	// [WithVerifyOnAdd].
+	ValidateBlock(b blocks.Block) error
+
+	// ValidateFetchedBlock runs the checks applied to the blocks received from
+	// the exchange: ValidateCid, [WithFetchCodecPolicy], the block checks of
+	// the [SecurityPolicy], [WithMaxFetchedBlockSize] and
+	// [WithFetchedBlockValidator].
+	ValidateFetchedBlock(b blocks.Block) error
+}
+
+var _ ValidatingBlockService = (*blockService)(nil)
+
+func (s *blockService) ValidateCid(c cid.Cid) error {
+	return s.validateCidFor(opValidate, c)
+}
+
+// validateCidFor is ValidateCid recording the rejections of the allowlist as
+// made by op, see [RejectionInspector].
+func (s *blockService) validateCidFor(op string, c cid.Cid) error {
+	if err := s.SecurityPolicy().ValidateCid(c); err != nil { // hash security
+		s.rejected(op, c)
+		return err
+	}
+	return s.checkBlocker(c)
+}
+
+func (s *blockService) ValidateBlock(b blocks.Block) error {
+	return s.validateBlockFor(opValidate, b)
+}
+
+// validateBlockFor is ValidateBlock recording the rejections as made by op.
+func (s *blockService) validateBlockFor(op string, b blocks.Block) error {
+	if err := s.validateCidFor(op, b.Cid()); err != nil {
+		return err
+	}
+	if err := s.checkPolicyBlock(b); err != nil {
+		return err
+	}
+	if s.verifyOnAdd {
+		return verifyBlock(0, b)
+	}
+	return nil
+}
+
+func (s *blockService) ValidateFetchedBlock(b blocks.Block) error {
+	if err := s.ValidateCid(b.Cid()); err != nil {
+		return err
+	}
+	if err := s.checkFetchAllowed(b.Cid()); err != nil {
+		return err
+	}
+	return s.checkFetched(b)
+}
+
+// checkFetched runs the checks of the blocks received from the exchange which
+// need their data, the others are done before fetching.
+func (s *blockService) checkFetched(b blocks.Block) error {
+	if err := s.checkPolicyBlock(b); err != nil {
+		return err
+	}
+	if err := s.checkFetchedSize(b); err != nil {
+		return err
+	}
+	return s.validateFetched(b)
+}
+
+// checkPolicyBlock runs the block checks of the [SecurityPolicy] on b, there
+// are none without [WithSecurityPolicy].
+func (s *blockService) checkPolicyBlock(b blocks.Block) error {
+	if s == nil || s.policy == nil {
+		return nil
+	}
+	return s.policy.ValidateBlock(b.Cid(), len(b.RawData()))
+}
+
+// opValidator is implemented by the blockservices of this package, to record
+// the operation of the rejections.
+type opValidator interface {
+	validateCidFor(op string, c cid.Cid) error
+}
+
+// validateCidOf is ValidateCid for any [BlockService] made by op, only the
+// security policy is checked if bs does not implement it.
+func validateCidOf(bs BlockService, op string, c cid.Cid) error {
+	if v, ok := bs.(opValidator); ok {
+		return v.validateCidFor(op, c)
+	}
+	if v, ok := bs.(interface{ ValidateCid(cid.Cid) error }); ok {
+		return v.ValidateCid(c)
+	}
+	return grabSecurityPolicyFromBlockservice(bs).ValidateCid(c) // hash security
+}
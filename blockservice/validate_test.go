@@ -0,0 +1,83 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/verifcid"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateBlock(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	blocked, valid := blks[0], blks[1]
+	mismatch, err := blocks.NewBlockWithCid(blks[2].RawData(), valid.Cid())
+	require.NoError(t, err)
+	big := random.BlocksOfSize(1, 2*blockSize)[0]
+	short, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.SHA2_256, MhLength: 8}.Sum([]byte("short"))
+	require.NoError(t, err)
+	cbor := cid.NewCidV1(cid.DagCBOR, valid.Cid().Hash())
+	errInvalid := errors.New("invalid")
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil,
+		WithVerifyOnAdd(),
+		WithMaxFetchedBlockSize(blockSize),
+		WithFetchCodecPolicy(func(codec uint64) bool { return codec != cid.DagCBOR }),
+		WithFetchedBlockValidator(func(b blocks.Block) error {
+			if b.Cid() == blks[2].Cid() {
+				return errInvalid
+			}
+			return nil
+		}),
+		WithContentBlocker(func(c cid.Cid) error {
+			if c == blocked.Cid() {
+				return errors.New("blocked")
+			}
+			return nil
+		}),
+	).(ValidatingBlockService)
+
+	require.ErrorIs(t, bserv.ValidateCid(short), verifcid.ErrBelowMinimumHashLength)
+	require.ErrorIs(t, bserv.ValidateCid(blocked.Cid()), ErrBlocked)
+	require.NoError(t, bserv.ValidateCid(valid.Cid()))
+
+	// the errors are the ones of the operations
+	require.ErrorIs(t, bserv.ValidateBlock(blocked), ErrBlocked)
+	require.ErrorIs(t, bserv.AddBlock(ctx, blocked), ErrBlocked)
+	require.ErrorIs(t, bserv.ValidateBlock(mismatch), ErrHashMismatch)
+	require.ErrorIs(t, bserv.AddBlock(ctx, mismatch), ErrHashMismatch)
+	require.NoError(t, bserv.ValidateBlock(valid))
+	require.NoError(t, bserv.ValidateBlock(big), "the fetch limits don't apply to adds")
+
+	require.NoError(t, bserv.ValidateFetchedBlock(valid))
+	require.ErrorIs(t, bserv.ValidateFetchedBlock(blocked), ErrBlocked)
+	var tooLarge *BlockTooLargeError
+	require.True(t, errors.As(bserv.ValidateFetchedBlock(big), &tooLarge))
+	require.ErrorIs(t, bserv.ValidateFetchedBlock(blks[2]), errInvalid)
+	cborBlock, err := blocks.NewBlockWithCid(valid.RawData(), cbor)
+	require.NoError(t, err)
+	require.ErrorIs(t, bserv.ValidateFetchedBlock(cborBlock), ErrFetchNotAllowed)
+}
+
+func BenchmarkValidateBlock(b *testing.B) {
+	blk := random.BlocksOfSize(1, blockSize)[0]
+	bserv := New(blockstore.NewBlockstore(ds.NewMapDatastore()), nil).(ValidatingBlockService)
+	b.ReportAllocs()
+	for range b.N {
+		if err := bserv.ValidateBlock(blk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
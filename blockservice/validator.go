@@ -0,0 +1,108 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// WithFetchedBlockValidator sets a function checking every block received
+// from the exchange before it is written to the blockstore, announced or
+// provided, for example that it decodes under its codec. Blocks it rejects
+// are dropped: GetBlock fails with a [*InvalidBlockError] and GetBlocks skips
+// them, reporting the error to [WithBlockErrorHandler].
+// GetBlocks runs the validator on up to GOMAXPROCS blocks in parallel so a slow
+// validation doesn't stall the other blocks, it must be safe for concurrent use.
+func WithFetchedBlockValidator(validate func(blocks.Block) error) Option {
+	return func(bs *blockService) {
+		if validate == nil {
+			bs.invalidOption("WithFetchedBlockValidator: nil validator")
+			return
+		}
+		bs.fetchedBlockValidator = validate
+	}
+}
+
+// InvalidBlockError is returned for the blocks from the exchange rejected by
+// the validator set with [WithFetchedBlockValidator].
+type InvalidBlockError struct {
+	Cid cid.Cid
+	Err error
+}
+
+func (e *InvalidBlockError) Error() string {
+	return fmt.Sprintf("block %s from the exchange is invalid: %s", e.Cid, e.Err)
+}
+
+func (e *InvalidBlockError) Unwrap() error {
+	return e.Err
+}
+
+// validateFetched runs the validator on b, returning a [*InvalidBlockError]
+// if it is rejected.
+func (s *blockService) validateFetched(b blocks.Block) error {
+	if s == nil || s.fetchedBlockValidator == nil {
+		return nil
+	}
+	if err := s.callValidator(b); err != nil {
+		s.stats.invalidBlocks.Add(1)
+		return &InvalidBlockError{Cid: b.Cid(), Err: err}
+	}
+	return nil
+}
+
+// callValidator runs the validator on b, a panic rejects b with a
+// [*PanicError].
+func (s *blockService) callValidator(b blocks.Block) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered("fetched block validator", r)
+			s.repanic(r)
+		}
+	}()
+	return s.fetchedBlockValidator(b)
+}
+
+// validateFetchedBlocks returns the blocks of in accepted by the validator,
+// validating them in parallel. Rejected blocks are reported to fail, which
+// may be called concurrently. It returns in when there is no validator.
+func (s *blockService) validateFetchedBlocks(ctx context.Context, in <-chan blocks.Block, fail func(cid.Cid, error)) <-chan blocks.Block {
+	if s == nil || s.fetchedBlockValidator == nil {
+		return in
+	}
+
+	out := make(chan blocks.Block)
+	var wg sync.WaitGroup
+	workers := runtime.GOMAXPROCS(0)
+	wg.Add(workers)
+	for range workers {
+		go func() {
+			defer wg.Done()
+			for b := range in {
+				// oversized blocks are rejected by the consumer, don't
+				// spend time validating them
+				if s.maxFetchedBlockSize == 0 || len(b.RawData()) <= s.maxFetchedBlockSize {
+					if err := s.validateFetched(b); err != nil {
+						logger.Error(err)
+						fail(b.Cid(), err)
+						continue
+					}
+				}
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
@@ -0,0 +1,90 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchedBlockValidator(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(3, blockSize)
+	garbage := blks[2]
+	errGarbage := errors.New("garbage")
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+
+	errs := make(map[cid.Cid]error)
+	bserv := New(bstore, offline.Exchange(exchbstore),
+		WithFetchedBlockValidator(func(b blocks.Block) error {
+			if b.Cid() == garbage.Cid() {
+				return errGarbage
+			}
+			return nil
+		}),
+		WithBlockErrorHandler(func(c cid.Cid, err error) { errs[c] = err }),
+	).(*blockService)
+
+	_, err := bserv.GetBlock(ctx, garbage.Cid())
+	var invalid *InvalidBlockError
+	require.True(t, errors.As(err, &invalid))
+	require.Equal(t, garbage.Cid(), invalid.Cid)
+	require.ErrorIs(t, err, errGarbage)
+
+	var got []cid.Cid
+	for b := range bserv.GetBlocks(ctx, []cid.Cid{blks[0].Cid(), blks[1].Cid(), garbage.Cid()}) {
+		got = append(got, b.Cid())
+	}
+	require.ElementsMatch(t, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, got)
+	require.Len(t, errs, 1)
+	require.ErrorIs(t, errs[garbage.Cid()], errGarbage)
+	require.EqualValues(t, 2, bserv.Stats(false).InvalidBlocks)
+
+	has, err := bstore.Has(ctx, garbage.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestFetchedBlockValidatorDoesNotStall(t *testing.T) {
+	if runtime.GOMAXPROCS(0) < 2 {
+		t.Skip("needs parallel validators")
+	}
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	slow, fast := blks[0], blks[1]
+
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	fastDelivered := make(chan struct{})
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), offline.Exchange(exchbstore),
+		WithFetchedBlockValidator(func(b blocks.Block) error {
+			if b.Cid() == slow.Cid() {
+				<-fastDelivered
+			}
+			return nil
+		}),
+	)
+
+	out := bserv.GetBlocks(ctx, []cid.Cid{slow.Cid(), fast.Cid()})
+	require.Equal(t, fast.Cid(), (<-out).Cid())
+	close(fastDelivered)
+	require.Equal(t, slow.Cid(), (<-out).Cid())
+	_, ok := <-out
+	require.False(t, ok)
+}
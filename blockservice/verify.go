@@ -0,0 +1,115 @@
+package blockservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ErrHashMismatch is matched by the [*HashMismatchError] returned when
+// [WithVerifyOnAdd] finds a block whose data does not hash to its CID.
+var ErrHashMismatch = errors.New("block data does not match its CID")
+
+// HashMismatchError identifies a block rejected by [WithVerifyOnAdd].
+type HashMismatchError struct {
+	// Index is the position of the block in the AddBlocks call, 0 for AddBlock.
+	Index int
+	Cid   cid.Cid
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("block %d (%s): %s", e.Index, e.Cid, ErrHashMismatch)
+}
+
+func (e *HashMismatchError) Is(target error) bool {
+	return target == ErrHashMismatch
+}
+
+// WithVerifyOnAdd makes AddBlock and AddBlocks hash the data of every block
+// and compare it against the CID before writing it, blocks which don't match
+// are rejected with a [*HashMismatchError]. With [WithSkipInvalid] AddBlocks
+// skips them instead of failing.
+// AddBlocks hashes the blocks in parallel, using up to GOMAXPROCS goroutines.
+func WithVerifyOnAdd() Option {
+	return func(bs *blockService) {
+		bs.verifyOnAdd = true
+	}
+}
+
+// verifyBlock checks that the data of b hashes to its CID.
+func verifyBlock(i int, b blocks.Block) error {
+	c := b.Cid()
+	if c.Prefix().MhType == mh.IDENTITY {
+		dmh, err := mh.Decode(c.Hash())
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(dmh.Digest, b.RawData()) {
+			return &HashMismatchError{Index: i, Cid: c}
+		}
+		return nil
+	}
+	sum, err := c.Prefix().Sum(b.RawData())
+	if err != nil {
+		return fmt.Errorf("block %d (%s): %w", i, c, err)
+	}
+	if !sum.Equals(c) {
+		return &HashMismatchError{Index: i, Cid: c}
+	}
+	return nil
+}
+
+// verifyBlocks checks bs if [WithVerifyOnAdd] is set. It returns nil if every
+// block is valid, otherwise the error of each block by index.
+func (s *blockService) verifyBlocks(ctx context.Context, bs []blocks.Block) ([]error, error) {
+	if !s.verifyOnAdd {
+		return nil, nil
+	}
+
+	errs := make([]error, len(bs))
+	var failed atomic.Bool
+	var next atomic.Int64
+	verify := func() {
+		for ctx.Err() == nil {
+			i := int(next.Add(1) - 1)
+			if i >= len(bs) {
+				return
+			}
+			if err := verifyBlock(i, bs[i]); err != nil {
+				errs[i] = err
+				failed.Store(true)
+			}
+		}
+	}
+
+	workers := min(runtime.GOMAXPROCS(0), len(bs))
+	if workers <= 1 {
+		verify()
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for range workers {
+			go func() {
+				defer wg.Done()
+				verify()
+			}()
+		}
+		wg.Wait()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !failed.Load() {
+		return nil, nil
+	}
+	return errs, nil
+}
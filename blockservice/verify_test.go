@@ -0,0 +1,84 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyOnAdd(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(4, blockSize)
+	bad, err := blocks.NewBlockWithCid(blks[3].RawData(), blks[2].Cid())
+	require.NoError(t, err)
+	identity, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.IDENTITY, MhLength: -1}.Sum([]byte("identity"))
+	require.NoError(t, err)
+	goodIdentity, err := blocks.NewBlockWithCid([]byte("identity"), identity)
+	require.NoError(t, err)
+	badIdentity, err := blocks.NewBlockWithCid([]byte("other"), identity)
+	require.NoError(t, err)
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(bstore), WithVerifyOnAdd())
+
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlock(ctx, goodIdentity))
+	err = bserv.AddBlock(ctx, bad)
+	require.ErrorIs(t, err, ErrHashMismatch)
+	require.ErrorIs(t, bserv.AddBlock(ctx, badIdentity), ErrHashMismatch)
+
+	err = bserv.AddBlocks(ctx, []blocks.Block{blks[1], bad})
+	var mismatch *HashMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, 1, mismatch.Index)
+	require.Equal(t, bad.Cid(), mismatch.Cid)
+	has, err := bstore.Has(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.False(t, has, "nothing is written when a block mismatches")
+
+	// WithSkipInvalid adds the valid blocks
+	bserv = New(bstore, offline.Exchange(bstore), WithVerifyOnAdd(), WithSkipInvalid())
+	err = bserv.AddBlocks(ctx, []blocks.Block{blks[1], bad})
+	var skippedErr *SkippedBlocksError
+	require.True(t, errors.As(err, &skippedErr))
+	require.Equal(t, 1, skippedErr.Written)
+	require.ErrorIs(t, skippedErr.Skipped[bad.Cid()], ErrHashMismatch)
+	has, err = bstore.Has(ctx, bad.Cid())
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func BenchmarkVerifyOnAdd(b *testing.B) {
+	blks := random.BlocksOfSize(256, 256<<10)
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"off", nil},
+		{"on", []Option{WithVerifyOnAdd()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := context.Background()
+			b.SetBytes(256 * 256 << 10)
+			for range b.N {
+				bstore := blockstore.NewBlockstore(ds.NewMapDatastore())
+				bserv := New(bstore, nil, bc.opts...)
+				if err := bserv.AddBlocks(ctx, blks); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package blockservice
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// wantShards is the number of independently locked parts of a wantSet,
+	// a power of two.
+	wantShards = 16
+	// maxTrackedWants bounds the wants tracked by a blockservice, the ones
+	// requested past it are not reported by IsWanted.
+	maxTrackedWants = 1 << 16
+)
+
+// WantInfo describes the requests of a CID in progress on the exchange.
+type WantInfo struct {
+	// Since is when the oldest of them was handed to the exchange.
+	Since time.Time
+	// Session is the ID of the [Session] which made it, 0 for the requests
+	// made outside of sessions.
+	Session uint64
+	// Requests is the number of GetBlock and GetBlocks calls waiting for the
+	// CID from the exchange.
+	Requests int
+}
+
+// WantInspector is implemented by the blockservices and sessions reporting
+// the CIDs they are waiting for from the exchange, to tell a retrieval
+// stuck on the exchange from one stuck before reaching it.
+type WantInspector interface {
+	// IsWanted reports whether c is currently requested from the exchange.
+	// The wants are forgotten when the block arrives or the request ends.
+	IsWanted(c cid.Cid) (bool, WantInfo)
+}
+
+var (
+	_ WantInspector = (*blockService)(nil)
+	_ WantInspector = (*Session)(nil)
+)
+
+func (s *blockService) IsWanted(c cid.Cid) (bool, WantInfo) {
+	return s.wants.lookup(c, 0)
+}
+
+// IsWanted is [WantInspector.IsWanted] for the requests made through the
+// session.
+func (s *Session) IsWanted(c cid.Cid) (bool, WantInfo) {
+	service := grabServiceFromBlockservice(s.bs)
+	if service == nil {
+		return false, WantInfo{}
+	}
+	return service.wants.lookup(c, s.id)
+}
+
+// wantSet tracks the CIDs requested from the exchange by session.
+type wantSet struct {
+	shards [wantShards]wantShard
+	count  atomic.Int64
+}
+
+type wantShard struct {
+	lk    sync.Mutex
+	wants map[cid.Cid]map[uint64]*wantRecord
+}
+
+type wantRecord struct {
+	since time.Time
+	refs  int
+}
+
+func (w *wantSet) shard(c cid.Cid) *wantShard {
+	h := c.Hash()
+	if len(h) == 0 {
+		return &w.shards[0]
+	}
+	return &w.shards[h[len(h)-1]&(wantShards-1)]
+}
+
+// lookup returns the wants of c by session, or by all of them for session 0.
+func (w *wantSet) lookup(c cid.Cid, session uint64) (bool, WantInfo) {
+	sh := w.shard(c)
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
+	var info WantInfo
+	for id, r := range sh.wants[c] {
+		if session != 0 && id != session {
+			continue
+		}
+		if info.Requests == 0 || r.since.Before(info.Since) {
+			info.Since = r.since
+			info.Session = id
+		}
+		info.Requests += r.refs
+	}
+	return info.Requests != 0, info
+}
+
+// add records c as wanted by session, it reports false when too many wants
+// are tracked.
+func (w *wantSet) add(c cid.Cid, session uint64, now time.Time) bool {
+	sh := w.shard(c)
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
+	bySession := sh.wants[c]
+	if r, ok := bySession[session]; ok {
+		r.refs++
+		return true
+	}
+	if w.count.Add(1) > maxTrackedWants {
+		w.count.Add(-1)
+		return false
+	}
+	if sh.wants == nil {
+		sh.wants = make(map[cid.Cid]map[uint64]*wantRecord)
+	}
+	if bySession == nil {
+		bySession = make(map[uint64]*wantRecord, 1)
+		sh.wants[c] = bySession
+	}
+	bySession[session] = &wantRecord{since: now, refs: 1}
+	return true
+}
+
+func (w *wantSet) remove(c cid.Cid, session uint64) {
+	sh := w.shard(c)
+	sh.lk.Lock()
+	defer sh.lk.Unlock()
+	bySession := sh.wants[c]
+	r, ok := bySession[session]
+	if !ok {
+		return
+	}
+	if r.refs--; r.refs > 0 {
+		return
+	}
+	w.count.Add(-1)
+	delete(bySession, session)
+	if len(bySession) == 0 {
+		delete(sh.wants, c)
+	}
+}
+
+// wanted is the part of a request tracked in a wantSet. A nil wanted does
+// nothing.
+type wanted struct {
+	set     *wantSet
+	clock   clock.Clock
+	session uint64
+
+	lk      sync.Mutex
+	pending map[cid.Cid]struct{} // nil once done
+}
+
+// want records ks as requested from the exchange by ses, until they are
+// received or done is called. More CIDs are recorded by add.
+func (s *blockService) want(ses *Session, ks ...cid.Cid) *wanted {
+	if s == nil {
+		return nil
+	}
+	wt := &wanted{set: &s.wants, clock: s.getClock(), pending: make(map[cid.Cid]struct{}, len(ks))}
+	if ses != nil {
+		wt.session = ses.id
+	}
+	wt.add(ks...)
+	return wt
+}
+
+// add records ks as requested from the exchange, when they are handed to it.
+func (wt *wanted) add(ks ...cid.Cid) {
+	if wt == nil || len(ks) == 0 {
+		return
+	}
+	now := wt.clock.Now()
+	wt.lk.Lock()
+	defer wt.lk.Unlock()
+	if wt.pending == nil {
+		return
+	}
+	for _, c := range ks {
+		if _, ok := wt.pending[c]; ok {
+			continue
+		}
+		if wt.set.add(c, wt.session, now) {
+			wt.pending[c] = struct{}{}
+		}
+	}
+}
+
+// received forgets the want of c.
+func (wt *wanted) received(c cid.Cid) {
+	if wt == nil {
+		return
+	}
+	wt.lk.Lock()
+	_, ok := wt.pending[c]
+	delete(wt.pending, c)
+	wt.lk.Unlock()
+	if ok {
+		wt.set.remove(c, wt.session)
+	}
+}
+
+// done forgets the wants which were not received.
+func (wt *wanted) done() {
+	if wt == nil {
+		return
+	}
+	wt.lk.Lock()
+	pending := wt.pending
+	wt.pending = nil
+	wt.lk.Unlock()
+	for c := range pending {
+		wt.set.remove(c, wt.session)
+	}
+}
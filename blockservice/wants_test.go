@@ -0,0 +1,124 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// feedingExchange returns the blocks sent on feed to GetBlocks.
+type feedingExchange struct {
+	feed chan blocks.Block
+}
+
+func (e *feedingExchange) GetBlock(context.Context, cid.Cid) (blocks.Block, error) {
+	panic("not implemented")
+}
+
+func (e *feedingExchange) GetBlocks(ctx context.Context, _ []cid.Cid) (<-chan blocks.Block, error) {
+	return e.feed, nil
+}
+
+func (e *feedingExchange) NotifyNewBlocks(context.Context, ...blocks.Block) error { return nil }
+func (e *feedingExchange) Close() error                                           { return nil }
+
+func TestIsWanted(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	c1, c2 := blks[0].Cid(), blks[1].Cid()
+	exch := &hangingExchange{getsStarted: make(chan struct{}, 2)}
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch)
+	inspector := bserv.(WantInspector)
+	ses := NewSession(ctx, bserv)
+	other := NewSession(ctx, bserv)
+
+	wanted, _ := inspector.IsWanted(c1)
+	require.False(t, wanted)
+
+	before := time.Now()
+	sesCtx, cancelSes := context.WithCancel(ctx)
+	go ses.GetBlock(sesCtx, c1)
+	<-exch.getsStarted
+	wanted, info := inspector.IsWanted(c1)
+	require.True(t, wanted)
+	require.Equal(t, ses.ID(), info.Session)
+	require.Equal(t, 1, info.Requests)
+	require.False(t, info.Since.Before(before))
+	wanted, _ = ses.IsWanted(c1)
+	require.True(t, wanted)
+	wanted, _ = other.IsWanted(c1)
+	require.False(t, wanted)
+
+	getCtx, cancelGet := context.WithCancel(ctx)
+	bserv.GetBlocks(getCtx, []cid.Cid{c1, c2})
+	<-exch.getsStarted
+	_, info = inspector.IsWanted(c1)
+	require.Equal(t, WantInfo{Since: info.Since, Session: ses.ID(), Requests: 2}, info)
+	_, info = inspector.IsWanted(c2)
+	require.Zero(t, info.Session)
+	require.Equal(t, 1, info.Requests)
+
+	// the wants end with their requests
+	cancelSes()
+	cancelGet()
+	require.Eventually(t, func() bool {
+		w1, _ := inspector.IsWanted(c1)
+		w2, _ := inspector.IsWanted(c2)
+		return !w1 && !w2
+	}, time.Second, time.Millisecond)
+}
+
+func TestIsWantedReceived(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	exch := &feedingExchange{feed: make(chan blocks.Block)}
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), exch)
+	inspector := bserv.(WantInspector)
+
+	out := bserv.GetBlocks(ctx, []cid.Cid{blks[0].Cid(), blks[1].Cid()})
+	exch.feed <- blks[0]
+	<-out
+	wanted, _ := inspector.IsWanted(blks[0].Cid())
+	require.False(t, wanted)
+	wanted, _ = inspector.IsWanted(blks[1].Cid())
+	require.True(t, wanted)
+
+	close(exch.feed)
+	for range out {
+	}
+	wanted, _ = inspector.IsWanted(blks[1].Cid())
+	require.False(t, wanted)
+}
+
+func TestWantSetBounded(t *testing.T) {
+	t.Parallel()
+
+	var w wantSet
+	w.count.Store(maxTrackedWants)
+	c := random.BlocksOfSize(1, blockSize)[0].Cid()
+	require.False(t, w.add(c, 0, time.Now()))
+	wanted, _ := w.lookup(c, 0)
+	require.False(t, wanted)
+
+	w.count.Store(0)
+	require.True(t, w.add(c, 1, time.Now()))
+	require.True(t, w.add(c, 1, time.Now()))
+	w.remove(c, 1)
+	wanted, info := w.lookup(c, 1)
+	require.True(t, wanted)
+	require.Equal(t, 1, info.Requests)
+	w.remove(c, 1)
+	require.Zero(t, w.count.Load())
+}
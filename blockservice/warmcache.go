@@ -0,0 +1,206 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/boxo/blockservice/internal"
+)
+
+const (
+	defaultWarmBatchSize   = 256
+	defaultWarmConcurrency = 4
+)
+
+// CacheWarmer is implemented by the blockservices able to fetch blocks into
+// their blockstore without returning them.
+type CacheWarmer interface {
+	// WarmCache fetches the blocks of ks which are not stored locally into
+	// the blockstore, to prepare the cache of a gateway for instance. The
+	// blocks go through GetBlocks in a [Session], so they are written,
+	// announced and provided like any fetched block, but they are dropped as
+	// soon as they are counted instead of being returned.
+	// Blocks which can't be fetched don't abort the warming, they are
+	// reported in a [*WarmError] once everything else has been fetched. When
+	// ctx is canceled the batches in flight are stopped and the stats so far
+	// are returned with the error of ctx.
+	WarmCache(ctx context.Context, ks []cid.Cid, opts ...WarmOption) (WarmStats, error)
+}
+
+var _ CacheWarmer = (*blockService)(nil)
+
+// WarmStats reports what [CacheWarmer.WarmCache] did.
+type WarmStats struct {
+	// Present is the number of blocks already stored locally.
+	Present int
+	// Fetched is the number of blocks fetched and FetchedBytes their size.
+	Fetched      int
+	FetchedBytes int64
+	// Missing is the number of blocks the exchange could not provide.
+	Missing int
+	// Rejected is the number of CIDs rejected by the allowlist or the
+	// content blocker.
+	Rejected int
+}
+
+// WarmError is returned by [CacheWarmer.WarmCache] when some blocks could not be fetched,
+// the other blocks have been fetched normally.
+type WarmError struct {
+	// Failed maps the CIDs which were not fetched to the reason why.
+	Failed map[cid.Cid]error
+}
+
+func (e *WarmError) Error() string {
+	return fmt.Sprintf("failed to fetch %d blocks", len(e.Failed))
+}
+
+// WarmOption configures [CacheWarmer.WarmCache].
+type WarmOption func(*warmOptions)
+
+type warmOptions struct {
+	batchSize   int
+	concurrency int
+	progress    func(WarmStats)
+}
+
+// WithWarmBatchSize sets how many blocks are requested from the exchange at
+// once, the default is 256.
+func WithWarmBatchSize(n int) WarmOption {
+	return func(o *warmOptions) {
+		o.batchSize = n
+	}
+}
+
+// WithWarmConcurrency sets how many batches are fetched in parallel, the
+// default is 4.
+func WithWarmConcurrency(n int) WarmOption {
+	return func(o *warmOptions) {
+		o.concurrency = n
+	}
+}
+
+// WithWarmProgress sets a callback receiving the cumulative stats after each
+// batch. It is never called concurrently.
+func WithWarmProgress(progress func(WarmStats)) WarmOption {
+	return func(o *warmOptions) {
+		o.progress = progress
+	}
+}
+
+func (s *blockService) WarmCache(ctx context.Context, ks []cid.Cid, opts ...WarmOption) (WarmStats, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.WarmCache", trace.WithAttributes(attribute.Int("count", len(ks))))
+	defer span.End()
+	s.tagSpan(ctx, span)
+
+	if s.ReadOnly() {
+		return WarmStats{}, ErrReadOnly
+	}
+
+	o := warmOptions{
+		batchSize:   defaultWarmBatchSize,
+		concurrency: defaultWarmConcurrency,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.batchSize <= 0 {
+		o.batchSize = defaultWarmBatchSize
+	}
+	if o.concurrency <= 0 {
+		o.concurrency = 1
+	}
+
+	ks = dedupCids(ks)
+	missing, err := s.MissingBlocks(ctx, ks)
+	var rejected *RejectedCidsError
+	if err != nil && !errors.As(err, &rejected) {
+		return WarmStats{}, err
+	}
+	var stats WarmStats
+	failed := make(map[cid.Cid]error)
+	stats.Present = len(ks) - len(missing)
+	if rejected != nil {
+		stats.Rejected = len(rejected.Rejected)
+		for c, err := range rejected.Rejected {
+			failed[c] = err
+		}
+		missing = slices.DeleteFunc(missing, func(c cid.Cid) bool {
+			_, ok := rejected.Rejected[c]
+			return ok
+		})
+	}
+
+	ses := NewSession(ctx, s)
+	defer ses.Close()
+
+	r := batchRunner[WarmStats]{
+		batchSize:   o.batchSize,
+		concurrency: o.concurrency,
+		merge:       (*WarmStats).add,
+		progress:    o.progress,
+		stats:       stats,
+		failed:      failed,
+	}
+	stats, failed = r.run(ctx, missing, func(ctx context.Context, batch []cid.Cid) (WarmStats, map[cid.Cid]error) {
+		return warmBatch(ctx, ses, batch)
+	})
+
+	span.SetAttributes(attribute.Int("fetched", stats.Fetched), attribute.Int("present", stats.Present))
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+	if len(failed) != 0 {
+		return stats, &WarmError{Failed: failed}
+	}
+	return stats, nil
+}
+
+// add adds the stats of a batch to s.
+func (s *WarmStats) add(batch WarmStats) {
+	s.Fetched += batch.Fetched
+	s.FetchedBytes += batch.FetchedBytes
+	s.Missing += batch.Missing
+	s.Rejected += batch.Rejected
+}
+
+// warmBatch fetches batch through ses and drops the blocks.
+func warmBatch(ctx context.Context, ses *Session, batch []cid.Cid) (WarmStats, map[cid.Cid]error) {
+	var stats WarmStats
+	received := make(map[cid.Cid]struct{}, len(batch))
+	for b := range ses.GetBlocks(ctx, batch) {
+		received[b.Cid()] = struct{}{}
+		stats.Fetched++
+		stats.FetchedBytes += int64(len(b.RawData()))
+	}
+	failed := make(map[cid.Cid]error)
+	for _, c := range batch {
+		if _, ok := received[c]; ok {
+			continue
+		}
+		if ctx.Err() != nil {
+			failed[c] = ctx.Err()
+			continue
+		}
+		err, ok := ses.LastError(c)
+		if !ok {
+			err = ipld.ErrNotFound{Cid: c}
+		}
+		var allowlistErr *AllowlistError
+		switch {
+		case ipld.IsNotFound(err):
+			stats.Missing++
+		case errors.Is(err, ErrBlocked) || errors.As(err, &allowlistErr):
+			// blocked or disallowed after the local lookup
+			stats.Rejected++
+		}
+		failed[c] = err
+	}
+	return stats, failed
+}
@@ -0,0 +1,123 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/verifcid"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-test/random"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(6, blockSize)
+	missing := random.BlocksOfSize(1, blockSize)[0].Cid()
+	sha1 := blockWithHash(t, []byte("sha1"), multihash.SHA1)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, bstore.Put(ctx, blks[0]))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[1:]))
+	prov := &recordingProvider{}
+	bserv := New(bstore, offline.Exchange(exchbstore),
+		WithProvider(prov),
+		WithAllowlist(verifcid.NewAllowlist(map[uint64]bool{multihash.SHA2_256: true})),
+	)
+
+	ks := []cid.Cid{blks[0].Cid(), missing, sha1.Cid(), blks[1].Cid()}
+	for _, b := range blks[1:] {
+		ks = append(ks, b.Cid())
+	}
+	var progress []WarmStats
+	stats, err := bserv.(CacheWarmer).WarmCache(ctx, ks,
+		WithWarmBatchSize(2),
+		WithWarmConcurrency(2),
+		WithWarmProgress(func(st WarmStats) { progress = append(progress, st) }),
+	)
+	require.Equal(t, WarmStats{Present: 1, Fetched: 5, FetchedBytes: 5 * blockSize, Missing: 1, Rejected: 1}, stats)
+	var warmErr *WarmError
+	require.ErrorAs(t, err, &warmErr)
+	require.Len(t, warmErr.Failed, 2)
+	require.True(t, ipld.IsNotFound(warmErr.Failed[missing]))
+	var allowlistErr *AllowlistError
+	require.ErrorAs(t, warmErr.Failed[sha1.Cid()], &allowlistErr)
+
+	// the fetched blocks are stored and provided
+	for _, b := range blks[1:] {
+		has, err := bstore.Has(ctx, b.Cid())
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	require.ElementsMatch(t, cidsOf(blks[1:]...), prov.Provided())
+	// one call per batch of 2 of the 6 CIDs to fetch
+	require.Len(t, progress, 3)
+	require.Equal(t, stats, progress[2])
+
+	// nothing is fetched again
+	stats, err = bserv.(CacheWarmer).WarmCache(ctx, cidsOf(blks...))
+	require.NoError(t, err)
+	require.Equal(t, WarmStats{Present: 6}, stats)
+}
+
+func TestWarmCacheBlockedDuringFetch(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	// blks[0] is blocked once the local lookup is done
+	var checks atomic.Int32
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), offline.Exchange(exchbstore),
+		WithContentBlocker(func(c cid.Cid) error {
+			if c == blks[0].Cid() && checks.Add(1) > 1 {
+				return errors.New("nope")
+			}
+			return nil
+		}),
+	)
+
+	stats, err := bserv.(CacheWarmer).WarmCache(ctx, cidsOf(blks...))
+	require.Equal(t, WarmStats{Fetched: 1, FetchedBytes: blockSize, Rejected: 1}, stats)
+	var warmErr *WarmError
+	require.ErrorAs(t, err, &warmErr)
+	require.ErrorIs(t, warmErr.Failed[blks[0].Cid()], ErrBlocked)
+}
+
+func TestWarmCacheCancel(t *testing.T) {
+	t.Parallel()
+
+	exch := &hangingExchange{getsStarted: make(chan struct{}, 10)}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := bserv.(CacheWarmer).WarmCache(ctx, cidsOf(random.BlocksOfSize(4, blockSize)...), WithWarmBatchSize(1), WithWarmConcurrency(2))
+		errs <- err
+	}()
+	<-exch.getsStarted
+	cancel()
+	select {
+	case err := <-errs:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WarmCache did not return after the cancellation")
+	}
+
+	_, err := New(bstore, exch, WithReadOnly()).(CacheWarmer).WarmCache(context.Background(), nil)
+	require.ErrorIs(t, err, ErrReadOnly)
+}
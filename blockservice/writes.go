@@ -0,0 +1,255 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/boxo/blockstore"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	writeRegistryShards = 16
+	// maxWritesPerShard bounds the registry, writes over the limit are not
+	// deduplicated.
+	maxWritesPerShard = 256
+)
+
+// WithFetchedWriteCheck makes the blocks received from the exchange looked up
+// in the blockstore again right before they are cached, so a block added by
+// AddBlock or AddBlocks while it was fetched is notified and provided once.
+// It costs a Has call per fetched block, without it such a block may be
+// announced twice.
+func WithFetchedWriteCheck() Option {
+	return func(bs *blockService) {
+		bs.fetchedWriteCheck = true
+	}
+}
+
+// writeRegistry tracks the CIDs being written by the add and fetch paths, so
+// when both race on the same block only the first one notifies the exchange
+// and provides it.
+type writeRegistry struct {
+	shards [writeRegistryShards]writeShard
+}
+
+type writeShard struct {
+	lk       sync.Mutex
+	inflight map[cid.Cid]*writeClaim
+}
+
+func noRelease() {}
+
+// writeClaim is a write of a block registered in a [writeRegistry].
+type writeClaim struct {
+	shard *writeShard
+	c     cid.Cid
+	// first is false if another write of the block was in flight, that write
+	// announces the block unless it fails.
+	first bool
+	// leader is the first write, for the later ones.
+	leader *writeClaim
+	// checked is closed once the first write looked the block up in the
+	// blockstore, later writes wait for it so the lookup does not see them and
+	// the block ends up never announced.
+	checked   chan struct{}
+	checkOnce sync.Once
+
+	lk      sync.Mutex
+	outcome int // writePending, writeStored or writeFailed
+	// handover announces the block stored by a later write if this first
+	// write fails.
+	handover func()
+}
+
+const (
+	writePending = iota
+	writeStored
+	writeFailed
+)
+
+// lookedUp records the first write looked the block up in the blockstore.
+func (w *writeClaim) lookedUp() {
+	if w.checked != nil {
+		w.checkOnce.Do(func() { close(w.checked) })
+	}
+}
+
+// stored records the first write stored the block, or found it stored, and
+// sees to its announcement. It does nothing for the later writes.
+func (w *writeClaim) stored() {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	if w.first && w.outcome == writePending {
+		w.outcome = writeStored
+		w.handover = nil
+	}
+}
+
+// handOff is called by a later write once it stored the block, it reports
+// whether that write must announce it itself because the first write failed.
+// While the first write is in flight announce is left to it, to be called
+// without the cancellation of ctx if it fails.
+func (w *writeClaim) handOff(ctx context.Context, announce func(context.Context)) bool {
+	l := w.leader
+	if l == nil {
+		return false
+	}
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	switch l.outcome {
+	case writeStored:
+		return false
+	case writeFailed:
+		return true
+	}
+	if l.handover == nil {
+		ctx = context.WithoutCancel(ctx)
+		l.handover = func() { announce(ctx) }
+	}
+	return false
+}
+
+// release must be called once the write is done, a first write which did not
+// store the block runs the announcement handed over by a later one.
+func (w *writeClaim) release() {
+	w.lookedUp()
+	w.lk.Lock()
+	var handover func()
+	if w.first && w.outcome == writePending {
+		w.outcome = writeFailed
+		handover, w.handover = w.handover, nil
+	}
+	w.lk.Unlock()
+	if w.shard != nil {
+		w.shard.lk.Lock()
+		delete(w.shard.inflight, w.c)
+		w.shard.lk.Unlock()
+	}
+	if handover != nil {
+		handover()
+	}
+}
+
+// claim registers a write of c. If check is true the first write of c looks
+// it up in the blockstore before writing and must call lookedUp once done,
+// the other writes wait for it.
+func (r *writeRegistry) claim(ctx context.Context, c cid.Cid, check bool) (*writeClaim, error) {
+	h := c.Hash()
+	sh := &r.shards[int(h[len(h)-1])%writeRegistryShards]
+	sh.lk.Lock()
+	if first, ok := sh.inflight[c]; ok {
+		sh.lk.Unlock()
+		select {
+		case <-first.checked:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return &writeClaim{leader: first}, nil
+	}
+	defer sh.lk.Unlock()
+	if len(sh.inflight) >= maxWritesPerShard {
+		return &writeClaim{first: true}, nil
+	}
+	if sh.inflight == nil {
+		sh.inflight = make(map[cid.Cid]*writeClaim)
+	}
+	w := &writeClaim{shard: sh, c: c, first: true, checked: make(chan struct{})}
+	if !check {
+		w.lookedUp()
+	}
+	sh.inflight[c] = w
+	return w, nil
+}
+
+// claimWrite is [writeRegistry.claim] on the registry of s.
+func (s *blockService) claimWrite(ctx context.Context, c cid.Cid, check bool) (*writeClaim, error) {
+	if s == nil {
+		return &writeClaim{first: true}, nil
+	}
+	return s.writes.claim(ctx, c, check)
+}
+
+// claimWrites claims the writes of bs, claims[i] is the claim of toput[i]. If
+// check is true each block is looked up in the blockstore as soon as it is
+// claimed, before the next one is, so writes claiming the same blocks in an
+// other order never wait on each other, and toput are the blocks which are not
+// stored, otherwise toput is bs. release must be called once the writes are
+// done.
+func (s *blockService) claimWrites(ctx context.Context, bs []blocks.Block, check bool) (toput []blocks.Block, claims []*writeClaim, release func(), err error) {
+	toput = make([]blocks.Block, 0, len(bs))
+	claims = make([]*writeClaim, 0, len(bs))
+	var all []*writeClaim
+	release = func() {
+		for _, w := range all {
+			w.release()
+		}
+	}
+	for _, b := range bs {
+		w, err := s.claimWrite(ctx, b.Cid(), check)
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		all = append(all, w)
+		if check {
+			has, err := s.blockstore.Has(ctx, b.Cid())
+			w.lookedUp()
+			if err != nil {
+				release()
+				return nil, nil, nil, err
+			}
+			if has {
+				w.stored()
+				continue
+			}
+		}
+		toput = append(toput, b)
+		claims = append(claims, w)
+	}
+	return toput, claims, release, nil
+}
+
+// storedWrites records the blocks of bs, claimed by claims, were stored through
+// the write path wp and returns the ones to announce: those claimed first and
+// those whose first write failed. The others are announced by their first
+// write, or handed over to it.
+func (s *blockService) storedWrites(ctx context.Context, wp writePath, bs []blocks.Block, claims []*writeClaim) []blocks.Block {
+	announce := make([]blocks.Block, 0, len(bs))
+	for i, b := range bs {
+		w := claims[i]
+		w.stored()
+		if w.first || w.handOff(ctx, func(ctx context.Context) { s.announceAdded(ctx, wp, b) }) {
+			announce = append(announce, b)
+		}
+	}
+	return announce
+}
+
+// claimFetchedWrite claims the write of a block received from the exchange,
+// announce is false if an other write of c is in flight, in which case that
+// write announces it unless it fails, see [writeClaim.handOff]. With [WithFetchedWriteCheck] it is also false if c was
+// stored since it was looked up.
+func (s *blockService) claimFetchedWrite(ctx context.Context, bs blockstore.Blockstore, c cid.Cid) (w *writeClaim, announce bool, err error) {
+	check := s != nil && s.fetchedWriteCheck
+	w, err = s.claimWrite(ctx, c, check)
+	if err != nil || !w.first || !check {
+		return w, err == nil && w.first, err
+	}
+	defer w.lookedUp()
+	if has, err := bs.Has(ctx, c); err == nil && has {
+		w.stored()
+		return w, false, nil
+	}
+	return w, true, nil
+}
+
+// blockCids returns the CIDs of bs.
+func blockCids(bs []blocks.Block) []cid.Cid {
+	ks := make([]cid.Cid, len(bs))
+	for i, b := range bs {
+		ks[i] = b.Cid()
+	}
+	return ks
+}
@@ -0,0 +1,159 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/exchange"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+// notifyRecordingExchange counts the notifications per CID, and the calls.
+type notifyRecordingExchange struct {
+	exchange.Interface
+
+	lk       sync.Mutex
+	notified map[cid.Cid]int
+	calls    int
+}
+
+func (e *notifyRecordingExchange) NotifyNewBlocks(ctx context.Context, blks ...blocks.Block) error {
+	e.lk.Lock()
+	e.calls++
+	for _, b := range blks {
+		e.notified[b.Cid()]++
+	}
+	e.lk.Unlock()
+	return e.Interface.NotifyNewBlocks(ctx, blks...)
+}
+
+// slowPutBlockstore makes the writes last long enough to overlap.
+type slowPutBlockstore struct {
+	blockstore.Blockstore
+}
+
+func (bs slowPutBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	time.Sleep(time.Millisecond)
+	return bs.Blockstore.Put(ctx, b)
+}
+
+func TestFetchedWriteCheckOptIn(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(2, blockSize)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+
+	bstore := &hasCountingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	_, err := New(bstore, offline.Exchange(exchbstore)).GetBlock(ctx, blks[0].Cid())
+	require.NoError(t, err)
+	require.Zero(t, bstore.hasCount.Load(), "the fetched blocks are not looked up by default")
+
+	_, err = New(bstore, offline.Exchange(exchbstore), WithFetchedWriteCheck()).GetBlock(ctx, blks[1].Cid())
+	require.NoError(t, err)
+	require.EqualValues(t, 1, bstore.hasCount.Load())
+}
+
+func TestConcurrentAddAndFetchNotifyOnce(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	blks := random.BlocksOfSize(200, blockSize)
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, exchbstore.PutMany(ctx, blks))
+	exch := &notifyRecordingExchange{Interface: offline.Exchange(exchbstore), notified: make(map[cid.Cid]int)}
+	prov := &recordingProvider{}
+	bstore := slowPutBlockstore{blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	bserv := New(bstore, exch, WithProvider(prov), WithFetchedWriteCheck())
+
+	var wg sync.WaitGroup
+	for _, b := range blks {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, bserv.AddBlock(ctx, b))
+		}()
+		go func() {
+			defer wg.Done()
+			require.NoError(t, bserv.AddBlocks(ctx, []blocks.Block{b}))
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := bserv.GetBlock(ctx, b.Cid())
+			require.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			for range bserv.GetBlocks(ctx, []cid.Cid{b.Cid()}) {
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, b := range blks {
+		require.Equal(t, 1, exch.notified[b.Cid()], "block %s notified more than once", b.Cid())
+	}
+	require.Len(t, prov.Provided(), len(blks))
+}
+
+// controlledPutBlockstore hands each Put to the test, which decides whether it
+// fails.
+type controlledPutBlockstore struct {
+	blockstore.Blockstore
+	puts chan chan error
+}
+
+func (bs *controlledPutBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	res := make(chan error)
+	bs.puts <- res
+	if err := <-res; err != nil {
+		return err
+	}
+	return bs.Blockstore.Put(ctx, b)
+}
+
+func TestFailedFirstWriteHandsOverAnnouncement(t *testing.T) {
+	t.Parallel()
+
+	for _, firstFailsFirst := range []bool{false, true} {
+		ctx := context.Background()
+		blk := random.BlocksOfSize(1, blockSize)[0]
+		exch := &notifyRecordingExchange{Interface: offline.Exchange(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))), notified: make(map[cid.Cid]int)}
+		prov := &recordingProvider{}
+		bstore := &controlledPutBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), puts: make(chan chan error)}
+		bserv := New(bstore, exch, WithProvider(prov))
+
+		firstErr, secondErr := make(chan error), make(chan error)
+		go func() { firstErr <- bserv.AddBlock(ctx, blk) }()
+		first := <-bstore.puts
+		go func() { secondErr <- bserv.AddBlock(ctx, blk) }()
+		second := <-bstore.puts
+
+		if firstFailsFirst {
+			first <- errors.New("disk full")
+			require.Error(t, <-firstErr)
+			second <- nil
+			require.NoError(t, <-secondErr)
+		} else {
+			second <- nil
+			require.NoError(t, <-secondErr)
+			require.Zero(t, exch.notified[blk.Cid()], "the first write is still in flight")
+			first <- errors.New("disk full")
+			require.Error(t, <-firstErr)
+		}
+
+		require.Equal(t, 1, exch.notified[blk.Cid()], "first fails first: %t", firstFailsFirst)
+		require.Equal(t, []cid.Cid{blk.Cid()}, prov.Provided(), "first fails first: %t", firstFailsFirst)
+	}
+}
@@ -0,0 +1,94 @@
+package blockservice
+
+import (
+	"sync/atomic"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+// WriteBytes counts the bytes going through a write path of the blockservice:
+// Offered is the size of the blocks handed to it and Written the size of the
+// blocks actually written to the blockstore, the difference being the blocks
+// already stored.
+type WriteBytes struct {
+	Offered uint64
+	Written uint64
+}
+
+// since returns w with the bytes of base subtracted.
+func (w WriteBytes) since(base WriteBytes) WriteBytes {
+	return WriteBytes{Offered: w.Offered - base.Offered, Written: w.Written - base.Written}
+}
+
+// DedupRatio is the share of the offered bytes which did not need to be
+// written, 0 when nothing was offered.
+func (w WriteBytes) DedupRatio() float64 {
+	if w.Offered == 0 || w.Written >= w.Offered {
+		return 0
+	}
+	return float64(w.Offered-w.Written) / float64(w.Offered)
+}
+
+// writePath identifies a write path in [Stats] and in the metrics.
+type writePath int
+
+const (
+	writePathAdd writePath = iota
+	writePathAddBatch
+	writePathFetchCache
+	writePathCount
+)
+
+// label is the value of the path label of the write metrics.
+func (p writePath) label() string {
+	switch p {
+	case writePathAdd:
+		return "add"
+	case writePathAddBatch:
+		return "add-batch"
+	default:
+		return "fetch-cache"
+	}
+}
+
+type writeCounters struct {
+	offered atomic.Uint64
+	written atomic.Uint64
+}
+
+func (c *writeCounters) snapshot() WriteBytes {
+	return WriteBytes{Offered: c.offered.Load(), Written: c.written.Load()}
+}
+
+// countOffered records the blocks of bs handed to the write path p.
+func (s *blockService) countOffered(p writePath, bs ...blocks.Block) {
+	if s == nil {
+		return
+	}
+	n := blocksSize(bs)
+	s.stats.writes[p].offered.Add(n)
+	if s.metrics != nil {
+		s.metrics.writeBytes.WithLabelValues(p.label(), "offered").Add(float64(n))
+	}
+}
+
+// countWritten records the blocks of bs written to the blockstore by the
+// write path p.
+func (s *blockService) countWritten(p writePath, bs ...blocks.Block) {
+	if s == nil {
+		return
+	}
+	n := blocksSize(bs)
+	s.stats.writes[p].written.Add(n)
+	if s.metrics != nil {
+		s.metrics.writeBytes.WithLabelValues(p.label(), "written").Add(float64(n))
+	}
+}
+
+func blocksSize(bs []blocks.Block) uint64 {
+	var n uint64
+	for _, b := range bs {
+		n += uint64(len(b.RawData()))
+	}
+	return n
+}
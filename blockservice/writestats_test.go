@@ -0,0 +1,39 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-test/random"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStats(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore))
+
+	blks := random.BlocksOfSize(4, blockSize)
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlock(ctx, blks[0]))
+	require.NoError(t, bserv.AddBlocks(ctx, blks[:2]))
+	require.NoError(t, exchbstore.PutMany(ctx, blks[2:]))
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[2].Cid(), blks[3].Cid()}) {
+	}
+
+	st := bserv.(*blockService).Stats(false)
+	require.Equal(t, WriteBytes{Offered: 2 * blockSize, Written: blockSize}, st.AddBytes)
+	require.Equal(t, 0.5, st.AddBytes.DedupRatio())
+	require.Equal(t, WriteBytes{Offered: 2 * blockSize, Written: blockSize}, st.AddBatchBytes)
+	require.Equal(t, WriteBytes{Offered: 2 * blockSize, Written: 2 * blockSize}, st.FetchCacheBytes)
+	require.Zero(t, st.FetchCacheBytes.DedupRatio())
+	require.Zero(t, WriteBytes{}.DedupRatio())
+}
@@ -9,6 +9,10 @@ import (
 	cid "github.com/ipfs/go-cid"
 )
 
+// MaxBlockSize is the size of the largest blocks exchanges are expected to
+// transfer, the 2MiB maximum block size of the bitswap protocol.
+const MaxBlockSize = 2 << 20
+
 // Interface defines the functionality of the IPFS block exchange protocol.
 type Interface interface { // type Exchanger interface
 	Fetcher